@@ -0,0 +1,79 @@
+// Package backend implements the storage systems statsdaemon can send its flushed metrics to.
+package backend
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Metric is a single flushed datapoint
+type Metric struct {
+	Name  string
+	Value float64
+	Time  int64 // unix timestamp in seconds
+	Nsec  int64 // nanoseconds within the second, for sub-second timestamps. see out.SetTimestamps
+}
+
+// Output is a backend that metrics can be written to.
+// Write returns an error if the metrics could not be written, in which case the caller may retry.
+type Output interface {
+	Write(metrics []Metric) error
+}
+
+// Parse reads the metrics from a graphite plaintext buffer, as generated by the out package.
+// lines that can't be parsed are skipped.
+func Parse(buf []byte) []Metric {
+	metrics := make([]Metric, 0, bytes.Count(buf, []byte("\n")))
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		val, err := strconv.ParseFloat(string(fields[1]), 64)
+		if err != nil {
+			continue
+		}
+		ts, nsec, err := parseTimestamp(fields[2])
+		if err != nil {
+			continue
+		}
+		metrics = append(metrics, Metric{string(fields[0]), val, ts, nsec})
+	}
+	return metrics
+}
+
+// parseTimestamp parses a unix timestamp in seconds, with up to 9 decimals, like 1500000000 or 1500000000.25
+func parseTimestamp(field []byte) (sec, nsec int64, err error) {
+	frac := bytes.IndexByte(field, '.')
+	if frac < 0 {
+		sec, err = strconv.ParseInt(string(field), 10, 64)
+		return sec, 0, err
+	}
+	sec, err = strconv.ParseInt(string(field[:frac]), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	digits := field[frac+1:]
+	if len(digits) == 0 || len(digits) > 9 {
+		return 0, 0, strconv.ErrSyntax
+	}
+	nsec, err = strconv.ParseInt(string(digits), 10, 64)
+	if err != nil || nsec < 0 {
+		return 0, 0, strconv.ErrSyntax
+	}
+	for i := len(digits); i < 9; i++ {
+		nsec *= 10
+	}
+	return sec, nsec, nil
+}
+
+// appendTimestamp appends the timestamp of m in seconds, with as many decimals as needed for its Nsec
+func appendTimestamp(buf []byte, m Metric) []byte {
+	buf = strconv.AppendInt(buf, m.Time, 10)
+	if m.Nsec == 0 {
+		return buf
+	}
+	frac := strconv.AppendInt(nil, 1000000000+m.Nsec, 10)[1:]
+	buf = append(buf, '.')
+	return append(buf, bytes.TrimRight(frac, "0")...)
+}
@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// GraphiteOutput writes metrics to graphite using the carbon plaintext (or pickle) protocol, over a persistent tcp connection.
+// it (re)connects in the background, every 2 seconds while not connected.
+// conn.Write() returns no error for a while when the remote endpoint is gone (e.g. graphite restarted), so that data
+// would be silently lost. therefore we also read from the connection: graphite never sends us anything, so as soon
+// as that read fails (typically with io.EOF) the connection is closed and reestablished.
+// carbon doesn't acknowledge what it receives either, so see Stats to compare what we sent with what carbon ingested.
+type GraphiteOutput struct {
+	Stats GraphiteStats
+
+	addr    string
+	clock   clock.Clock
+	timeout time.Duration
+	opts    GraphiteOptions
+	// used by the connect goroutine only
+	lookup   func(host string) ([]string, error)
+	lastGood string // ip we last connected to
+
+	sync.Mutex
+	conn net.Conn
+	buf  []byte // the chunk being written, kept for the next write
+}
+
+// GraphiteOptions are the optional settings of a GraphiteOutput
+type GraphiteOptions struct {
+	// Pickle makes it use the carbon pickle protocol instead of plaintext
+	Pickle bool
+	// TLS, if not nil, makes it connect over TLS with this config.
+	// if its ServerName is empty, it's taken from the address.
+	TLS *tls.Config
+	// ChunkSize is about how many bytes are written at once, see Write. 0 means DefaultChunkSize
+	ChunkSize int
+	// ConnectTimeout is how long connecting to an address (including the TLS handshake) may take,
+	// e.g. to give up on black-holed ones quickly. 0 means the write timeout.
+	ConnectTimeout time.Duration
+}
+
+// DefaultChunkSize is the default GraphiteOptions.ChunkSize
+const DefaultChunkSize = 64 * 1024
+
+// GraphiteStats count what was written to graphite, to correlate with carbon's own metrics (e.g. metricsReceived):
+// when its queues are full, carbon accepts data but drops it, which only shows up as a difference between the two.
+// they're accessed atomically
+type GraphiteStats struct {
+	Metrics       uint64 // metrics we wrote to a connection, including those of writes that failed
+	BytesExpected uint64 // bytes we wrote to a connection, including those of writes that failed
+	BytesWritten  uint64 // bytes the connection accepted
+}
+
+// NewGraphiteOutput creates an output to the graphite carbon plaintext listener at addr.
+// every write (and, unless GraphiteOptions.ConnectTimeout is set, connecting) must complete within timeout,
+// otherwise we reconnect.
+func NewGraphiteOutput(addr string, clk clock.Clock, timeout time.Duration) *GraphiteOutput {
+	return NewGraphiteOutputOpts(addr, clk, timeout, GraphiteOptions{})
+}
+
+// NewGraphiteOutputOpts is like NewGraphiteOutput, with the given options.
+func NewGraphiteOutputOpts(addr string, clk clock.Clock, timeout time.Duration, opts GraphiteOptions) *GraphiteOutput {
+	g := &GraphiteOutput{
+		addr:    addr,
+		clock:   clk,
+		timeout: timeout,
+		opts:    opts,
+		lookup:  net.LookupHost,
+	}
+	go g.connect()
+	return g
+}
+
+func (g *GraphiteOutput) connect() {
+	for range g.clock.Tick(2 * time.Second) {
+		g.Lock()
+		connected := g.conn != nil
+		g.Unlock()
+		if connected {
+			continue
+		}
+		// without holding the lock, so writes keep failing fast while we try the addresses.
+		// we're the only ones setting conn, so it'll still be nil after.
+		conn, err := g.dial()
+		if err != nil {
+			log.Warnf("dialing %s failed: %s. will retry", g.addr, err.Error())
+			continue
+		}
+		log.Infof("now connected to %s (%s)", g.addr, conn.RemoteAddr())
+		g.Lock()
+		g.conn = conn
+		g.Unlock()
+		go g.watch(conn)
+	}
+}
+
+// dial resolves the address, and tries to connect to every ip it resolves to until one works,
+// starting with the last one that worked, so that we stick to it but fail over to the others.
+func (g *GraphiteOutput) dial() (net.Conn, error) {
+	host, port, err := net.SplitHostPort(g.addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := g.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s resolves to no addresses", host)
+	}
+	for i, ip := range ips {
+		if ip == g.lastGood {
+			ips[0], ips[i] = ips[i], ips[0]
+			break
+		}
+	}
+	dialer := &net.Dialer{Timeout: g.timeout}
+	if g.opts.ConnectTimeout > 0 {
+		dialer.Timeout = g.opts.ConnectTimeout
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip, port)
+		if g.opts.TLS == nil {
+			conn, err = dialer.Dial("tcp", addr)
+		} else {
+			// the certificate is for the host, not for the ip we dial
+			config := g.opts.TLS
+			if config.ServerName == "" {
+				config = config.Clone()
+				config.ServerName = host
+			}
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+		}
+		if err == nil {
+			g.lastGood = ip
+			return conn, nil
+		}
+		log.Warnf("dialing %s (%s) failed: %s", g.addr, addr, err.Error())
+	}
+	return nil, err
+}
+
+// watch reads from conn until that fails, at which point the connection is dropped (if it's still in use)
+func (g *GraphiteOutput) watch(conn net.Conn) {
+	buf := make([]byte, 512)
+	var err error
+	for err == nil {
+		_, err = conn.Read(buf)
+	}
+	g.Lock()
+	if g.conn == conn {
+		log.Warnf("connection to %s lost: %s. will reconnect", g.addr, err)
+		g.conn.Close()
+		g.conn = nil
+	}
+	g.Unlock()
+}
+
+// Write writes the metrics, if we're connected, in chunks of about ChunkSize bytes (or as many pickle messages),
+// so that a large flush doesn't need a buffer for all of it. all chunks must be written within the timeout.
+// with debug logging, every metric is logged as it's written.
+// if a write fails, the connection is closed so that it will be reestablished.
+func (g *GraphiteOutput) Write(metrics []Metric) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.conn == nil {
+		return fmt.Errorf("not connected to %s", g.addr)
+	}
+	chunkSize := g.opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	debug := log.IsLevelEnabled(log.DebugLevel)
+	g.conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	atomic.AddUint64(&g.Stats.Metrics, uint64(len(metrics)))
+	for len(metrics) > 0 {
+		buf, n := g.buf[:0], 0
+		for n < len(metrics) && len(buf) < chunkSize {
+			if g.opts.Pickle {
+				end := n + pickleBatch
+				if end > len(metrics) {
+					end = len(metrics)
+				}
+				buf = appendPickle(buf, metrics[n:end])
+				n = end
+			} else {
+				buf = appendPlain(buf, metrics[n])
+				n++
+			}
+		}
+		g.buf = buf
+		if debug {
+			var line []byte
+			for _, m := range metrics[:n] {
+				line = appendPlain(line[:0], m)
+				log.Debugf("writing %s", line[:len(line)-1])
+			}
+		}
+		written, err := g.conn.Write(buf)
+		atomic.AddUint64(&g.Stats.BytesExpected, uint64(len(buf)))
+		atomic.AddUint64(&g.Stats.BytesWritten, uint64(written))
+		if err != nil {
+			if written > 0 {
+				// carbon ingests what it got, so those metrics are duplicated (and the last one may be cut off) when retried
+				log.Warnf("only %d of %d bytes written to %s before failing", written, len(buf), g.addr)
+			}
+			g.conn.Close()
+			g.conn = nil
+			return err
+		}
+		metrics = metrics[n:]
+	}
+	return nil
+}
+
+// appendPlain appends the metric to buf in the carbon plaintext protocol.
+// sub-second timestamps are written as fractional seconds, which carbon accepts.
+func appendPlain(buf []byte, m Metric) []byte {
+	buf = append(buf, m.Name...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, m.Value, 'f', -1, 64)
+	buf = append(buf, ' ')
+	buf = appendTimestamp(buf, m)
+	return append(buf, '\n')
+}
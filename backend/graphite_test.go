@@ -0,0 +1,252 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/bmizerany/assert"
+)
+
+// waitFor polls cond, to give the connect and watch goroutines a chance to run
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestGraphiteReconnectsWhenRemoteCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	mock := clock.NewMock()
+	g := NewGraphiteOutput(l.Addr().String(), mock, time.Second)
+	connected := func() bool {
+		g.Lock()
+		defer g.Unlock()
+		return g.conn != nil
+	}
+	assert.NotEqual(t, nil, g.Write([]Metric{{"a", 1, 10, 0}}))
+
+	waitFor(t, "connect ticker", func() bool { mock.Add(2 * time.Second); return connected() })
+	remote, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nil, g.Write([]Metric{{"a", 1, 10, 0}}))
+	line, err := bufio.NewReader(remote).ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a 1 10\n", line)
+	// the failed write while not connected doesn't count
+	assert.Equal(t, GraphiteStats{Metrics: 1, BytesExpected: 7, BytesWritten: 7}, g.Stats)
+
+	// e.g. graphite restarting. we should notice before writing to the dead connection
+	remote.Close()
+	waitFor(t, "disconnect", func() bool { return !connected() })
+	assert.NotEqual(t, nil, g.Write([]Metric{{"a", 1, 10, 0}}))
+
+	waitFor(t, "reconnect", func() bool { mock.Add(2 * time.Second); return connected() })
+}
+
+func TestGraphiteChunks(t *testing.T) {
+	var metrics []Metric
+	for i := 0; i < 1200; i++ {
+		metrics = append(metrics, Metric{fmt.Sprintf("some.metric.%d", i), float64(i), 10, 0})
+	}
+	for _, pickle := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock := clock.NewMock()
+		g := NewGraphiteOutputOpts(l.Addr().String(), mock, time.Second, GraphiteOptions{Pickle: pickle, ChunkSize: 1000})
+		waitFor(t, "connect", func() bool {
+			mock.Add(2 * time.Second)
+			g.Lock()
+			defer g.Unlock()
+			return g.conn != nil
+		})
+		remote, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan []byte)
+		go func() {
+			buf, _ := ioutil.ReadAll(remote)
+			received <- buf
+		}()
+		assert.Equal(t, nil, g.Write(metrics))
+		// the chunks add up to what a single write would be
+		var exp []byte
+		if pickle {
+			exp = appendPickle(nil, metrics)
+		} else {
+			for _, m := range metrics {
+				exp = appendPlain(exp, m)
+			}
+		}
+		g.Lock()
+		g.conn.Close()
+		// with pickle, a chunk is at least a whole message
+		assert.T(t, pickle || cap(g.buf) < 2000, cap(g.buf))
+		g.Unlock()
+		assert.Equal(t, exp, <-received)
+		assert.Equal(t, uint64(len(exp)), g.Stats.BytesWritten)
+		l.Close()
+	}
+}
+
+func TestGraphiteTLS(t *testing.T) {
+	// borrow the certificate of httptest, which is valid for 127.0.0.1
+	server := httptest.NewTLSServer(nil)
+	cert := server.TLS.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	server.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	mock := clock.NewMock()
+	g := NewGraphiteOutputOpts(l.Addr().String(), mock, time.Second, GraphiteOptions{TLS: &tls.Config{RootCAs: pool}})
+	connected := func() bool {
+		g.Lock()
+		defer g.Unlock()
+		return g.conn != nil
+	}
+	accepted := make(chan net.Conn)
+	go func() {
+		remote, err := l.Accept()
+		if err == nil && remote.(*tls.Conn).Handshake() == nil {
+			accepted <- remote
+		}
+	}()
+	waitFor(t, "connect ticker", func() bool { mock.Add(2 * time.Second); return connected() })
+	remote := <-accepted
+	assert.Equal(t, nil, g.Write([]Metric{{"a", 1, 10, 0}}))
+	line, err := bufio.NewReader(remote).ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a 1 10\n", line)
+}
+
+func TestGraphiteTLSVerifies(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	mock := clock.NewMock()
+	// the certificate isn't signed by a CA we trust
+	g := NewGraphiteOutputOpts(server.Listener.Addr().String(), mock, time.Second, GraphiteOptions{TLS: &tls.Config{}})
+	for i := 0; i < 3; i++ {
+		mock.Add(2 * time.Second)
+		time.Sleep(20 * time.Millisecond)
+	}
+	g.Lock()
+	defer g.Unlock()
+	assert.Equal(t, nil, g.conn)
+}
+
+func TestGraphiteFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	mock := clock.NewMock()
+	g := NewGraphiteOutput(net.JoinHostPort("graphite.example", port), mock, time.Second)
+	// nothing listens on 127.0.0.2
+	g.lookup = func(host string) ([]string, error) {
+		return []string{"127.0.0.2", "127.0.0.1"}, nil
+	}
+	connected := func() bool {
+		g.Lock()
+		defer g.Unlock()
+		return g.conn != nil
+	}
+	waitFor(t, "connect", func() bool { mock.Add(2 * time.Second); return connected() })
+	assert.Equal(t, "127.0.0.1", g.lastGood)
+
+	// lookup failures are retried
+	g.Lock()
+	g.conn.Close()
+	g.conn = nil
+	g.Unlock()
+	lookups := make(chan bool, 10)
+	g.lookup = func(host string) ([]string, error) {
+		lookups <- true
+		return nil, fmt.Errorf("no such host")
+	}
+	mock.Add(2 * time.Second)
+	mock.Add(2 * time.Second)
+	<-lookups
+	<-lookups
+	assert.Equal(t, false, connected())
+}
+
+func TestGraphiteConnectTimeout(t *testing.T) {
+	dial := func(addr string, opts GraphiteOptions) (net.Conn, time.Duration, error) {
+		g := &GraphiteOutput{addr: addr, timeout: time.Minute, opts: opts, lookup: net.LookupHost}
+		start := time.Now()
+		conn, err := g.dial()
+		return conn, time.Since(start), err
+	}
+
+	// a server that accepts connections, but never completes the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, took, err := dial(l.Addr().String(), GraphiteOptions{TLS: &tls.Config{}, ConnectTimeout: 200 * time.Millisecond})
+	assert.NotEqual(t, nil, err)
+	if took > 2*time.Second {
+		t.Fatalf("dial took %s, expected it to give up after 200ms", took)
+	}
+
+	// not routable, so connecting hangs rather than fails
+	conn, took, err := dial("10.255.255.1:2003", GraphiteOptions{ConnectTimeout: 200 * time.Millisecond})
+	if err == nil {
+		conn.Close()
+		t.Log("this network accepts connections to 10.255.255.1, not checking that")
+		return
+	}
+	if took > 2*time.Second {
+		t.Fatalf("dial took %s, expected it to give up after 200ms", took)
+	}
+}
+
+func TestGraphiteIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6: %s", err)
+	}
+	defer l.Close()
+
+	mock := clock.NewMock()
+	g := NewGraphiteOutput(l.Addr().String(), mock, time.Second)
+	waitFor(t, "connect", func() bool {
+		mock.Add(2 * time.Second)
+		g.Lock()
+		defer g.Unlock()
+		return g.conn != nil
+	})
+	assert.Equal(t, "::1", g.lastGood)
+}
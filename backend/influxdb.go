@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InfluxDBOutput writes metrics to InfluxDB using the line protocol, over http.
+type InfluxDBOutput struct {
+	url       string
+	precision time.Duration
+	client    *http.Client
+}
+
+// influxPrecisions are the names of the timestamp precisions InfluxDB supports
+var influxPrecisions = map[time.Duration]string{
+	time.Second:      "s",
+	time.Millisecond: "ms",
+	time.Microsecond: "u",
+	time.Nanosecond:  "ns",
+}
+
+// NewInfluxDBOutput creates an output that writes to the given database
+// of the InfluxDB server at addr (e.g. http://localhost:8086), with timestamps of the given precision:
+// a second, millisecond, microsecond or nanosecond. anything else means a second.
+func NewInfluxDBOutput(addr, db string, precision time.Duration) *InfluxDBOutput {
+	if _, ok := influxPrecisions[precision]; !ok {
+		precision = time.Second
+	}
+	return &InfluxDBOutput{
+		url:       strings.TrimRight(addr, "/") + "/write?precision=" + influxPrecisions[precision] + "&db=" + url.QueryEscape(db),
+		precision: precision,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *InfluxDBOutput) Write(metrics []Metric) error {
+	var buf []byte
+	debug := log.IsLevelEnabled(log.DebugLevel)
+	for _, m := range metrics {
+		start := len(buf)
+		buf = AppendInfluxLine(buf, m, o.precision)
+		if debug {
+			log.Debugf("writing %s", buf[start:len(buf)-1])
+		}
+	}
+	resp, err := o.client.Post(o.url, "text/plain", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influxdb returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// AppendInfluxLine appends the metric to buf in the InfluxDB line protocol.
+// nodes of metrics 2.0 names (key_is_value) become tags, and
+// the remaining nodes, joined by dots, the measurement. The value is stored in the "value" field.
+// e.g. "stats.unit_is_ms.what_is_latency.upper" becomes "stats.upper,unit=ms,what=latency value=..."
+// the timestamp is written in units of precision, see NewInfluxDBOutput.
+func AppendInfluxLine(buf []byte, m Metric, precision time.Duration) []byte {
+	var nodes []string
+	var tags []string
+	for _, node := range strings.Split(m.Name, ".") {
+		if kv := strings.SplitN(node, "_is_", 2); len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+			tags = append(tags, influxEscape(kv[0])+"="+influxEscape(kv[1]))
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+	measurement := strings.Join(nodes, ".")
+	if measurement == "" {
+		measurement = "value"
+	}
+	sort.Strings(tags)
+
+	buf = append(buf, influxMeasurementEscaper.Replace(measurement)...)
+	for _, tag := range tags {
+		buf = append(buf, ',')
+		buf = append(buf, tag...)
+	}
+	buf = append(buf, " value="...)
+	buf = strconv.AppendFloat(buf, m.Value, 'f', -1, 64)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, m.Time*int64(time.Second/precision)+m.Nsec/int64(precision), 10)
+	return append(buf, '\n')
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func influxEscape(s string) string {
+	return influxTagEscaper.Replace(s)
+}
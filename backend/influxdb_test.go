@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestAppendInfluxLine(t *testing.T) {
+	cases := []struct {
+		in  Metric
+		out string
+	}{
+		{Metric{"stats.gauges.foo", 1.5, 1000, 0}, "stats.gauges.foo value=1.5 1000\n"},
+		{Metric{"stats.timers.foo.upper_90", 20, 1000, 0}, "stats.timers.foo.upper_90 value=20 1000\n"},
+		{Metric{"stats.unit_is_ms.what_is_latency.upper", 3, 1000, 0}, "stats.upper,unit=ms,what=latency value=3 1000\n"},
+		{Metric{"service_is_a b.mtype_is_gauge", 3, 1000, 0}, "value,mtype=gauge,service=a\\ b value=3 1000\n"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.out, string(AppendInfluxLine(nil, c.in, time.Second)))
+	}
+	m := Metric{"foo", 1, 1000, 250000000}
+	assert.Equal(t, "foo value=1 1000250\n", string(AppendInfluxLine(nil, m, time.Millisecond)))
+	assert.Equal(t, "foo value=1 1000250000000\n", string(AppendInfluxLine(nil, m, time.Nanosecond)))
+}
+
+func TestParse(t *testing.T) {
+	buf := []byte("stats.a 1.5 10\nbroken line\nstats.b 2 11\nstats.c 3 12.25\nstats.d 4 12.1234567890\n")
+	assert.Equal(t, []Metric{{"stats.a", 1.5, 10, 0}, {"stats.b", 2, 11, 0}, {"stats.c", 3, 12, 250000000}}, Parse(buf))
+	assert.Equal(t, "stats.c 3 12.25\n", string(appendPlain(nil, Metric{"stats.c", 3, 12, 250000000})))
+	assert.Equal(t, "stats.c 3 12.000001\n", string(appendPlain(nil, Metric{"stats.c", 3, 12, 1000})))
+}
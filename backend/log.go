@@ -0,0 +1,26 @@
+package backend
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// LogOutput logs the metrics, in the carbon plaintext format, instead of writing them anywhere. see dry_run.
+// it never fails.
+type LogOutput struct {
+	name string
+}
+
+// NewLogOutput creates a LogOutput for the metrics that would go to the output called name, like a graphite address
+func NewLogOutput(name string) *LogOutput {
+	return &LogOutput{name}
+}
+
+// Write logs every metric at info level
+func (o *LogOutput) Write(metrics []Metric) error {
+	var buf []byte
+	for _, m := range metrics {
+		buf = appendPlain(buf[:0], m)
+		log.Infof("dry run, not writing to %s: %s", o.name, buf[:len(buf)-1])
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package backend
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogOutput(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	o := NewLogOutput("127.0.0.1:2003")
+	assert.Equal(t, nil, o.Write([]Metric{{"stats.a", 1.5, 10, 0}, {"stats.b", 2, 11, 250000000}}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.T(t, strings.Contains(lines[0], `msg="dry run, not writing to 127.0.0.1:2003: stats.a 1.5 10"`), lines[0])
+	assert.T(t, strings.Contains(lines[1], `msg="dry run, not writing to 127.0.0.1:2003: stats.b 2 11.25"`), lines[1])
+}
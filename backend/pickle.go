@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// pickleBatch is the maximum amount of metrics per pickle message
+const pickleBatch = 500
+
+// pickle opcodes, see python's pickletools. we use protocol 2, which both python 2 and 3 can read.
+const (
+	pickleProto     = 0x80
+	pickleEmptyList = ']'
+	pickleMark      = '('
+	pickleAppends   = 'e'
+	pickleUnicode   = 'X' // BINUNICODE: 4 byte little endian length, utf-8 data
+	pickleInt       = 'J' // BININT: 4 byte little endian signed int
+	pickleLong      = 0x8a
+	pickleFloat     = 'G' // BINFLOAT: 8 byte big endian double
+	pickleTuple2    = 0x86
+	pickleStop      = '.'
+)
+
+// appendPickle appends the metrics to buf in the carbon pickle protocol:
+// messages of a 4 byte big endian length header, followed by a pickled list of (name, (timestamp, value)) tuples.
+// every message holds up to pickleBatch metrics.
+func appendPickle(buf []byte, metrics []Metric) []byte {
+	for len(metrics) > 0 {
+		n := len(metrics)
+		if n > pickleBatch {
+			n = pickleBatch
+		}
+		start := len(buf)
+		buf = append(buf, 0, 0, 0, 0, pickleProto, 2, pickleEmptyList, pickleMark)
+		for _, m := range metrics[:n] {
+			buf = append(buf, pickleUnicode)
+			buf = appendUint32LE(buf, uint32(len(m.Name)))
+			buf = append(buf, m.Name...)
+			if m.Time >= math.MinInt32 && m.Time <= math.MaxInt32 {
+				buf = append(buf, pickleInt)
+				buf = appendUint32LE(buf, uint32(int32(m.Time)))
+			} else {
+				buf = append(buf, pickleLong, 8)
+				for i := uint(0); i < 8; i++ {
+					buf = append(buf, byte(uint64(m.Time)>>(8*i)))
+				}
+			}
+			buf = append(buf, pickleFloat, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(m.Value))
+			buf = append(buf, pickleTuple2, pickleTuple2)
+		}
+		buf = append(buf, pickleAppends, pickleStop)
+		binary.BigEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+		metrics = metrics[n:]
+	}
+	return buf
+}
+
+func appendUint32LE(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
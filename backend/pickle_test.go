@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// unpickle decodes the messages generated by appendPickle.
+// it only supports the opcodes appendPickle uses.
+func unpickle(t *testing.T, buf []byte) [][]Metric {
+	var messages [][]Metric
+	for len(buf) > 0 {
+		size := binary.BigEndian.Uint32(buf)
+		msg := buf[4 : 4+size]
+		buf = buf[4+size:]
+
+		var metrics []Metric
+		var stack []interface{}
+		for i := 0; i < len(msg); {
+			op := msg[i]
+			i++
+			switch op {
+			case pickleProto:
+				i++
+			case pickleEmptyList, pickleMark, pickleAppends:
+			case pickleUnicode:
+				n := int(binary.LittleEndian.Uint32(msg[i:]))
+				stack = append(stack, string(msg[i+4:i+4+n]))
+				i += 4 + n
+			case pickleInt:
+				stack = append(stack, int64(int32(binary.LittleEndian.Uint32(msg[i:]))))
+				i += 4
+			case pickleLong:
+				n := int(msg[i])
+				stack = append(stack, int64(binary.LittleEndian.Uint64(msg[i+1:i+1+n])))
+				i += 1 + n
+			case pickleFloat:
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(msg[i:])))
+				i += 8
+			case pickleTuple2:
+				tuple := [2]interface{}{stack[len(stack)-2], stack[len(stack)-1]}
+				stack = append(stack[:len(stack)-2], tuple)
+				if name, ok := tuple[0].(string); ok {
+					point := tuple[1].([2]interface{})
+					metrics = append(metrics, Metric{name, point[1].(float64), point[0].(int64), 0})
+					stack = stack[:len(stack)-1]
+				}
+			case pickleStop:
+				assert.Equal(t, len(msg), i)
+			default:
+				t.Fatalf("unexpected opcode %x", op)
+			}
+		}
+		messages = append(messages, metrics)
+	}
+	return messages
+}
+
+func TestPickle(t *testing.T) {
+	metrics := []Metric{{"stats.foo", 1.5, 1500000000, 0}, {"stats.bär", -3, 3000000000, 0}}
+	assert.Equal(t, [][]Metric{metrics}, unpickle(t, appendPickle(nil, metrics)))
+}
+
+func TestPickleBatches(t *testing.T) {
+	var metrics []Metric
+	for i := 0; i < pickleBatch+1; i++ {
+		metrics = append(metrics, Metric{"foo", float64(i), 10, 0})
+	}
+	messages := unpickle(t, appendPickle(nil, metrics))
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, metrics[:pickleBatch], messages[0])
+	assert.Equal(t, metrics[pickleBatch:], messages[1])
+}
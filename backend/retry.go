@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryOutput wraps an Output, and retries failed writes with exponential backoff:
+// it waits backoff before the first retry, and twice as long before every next one.
+// it gives up after the given amount of retries, or when a retry would start more than maxTime after the first attempt,
+// and then returns the last error. (e.g. so that a SpoolOutput around it can spool the metrics)
+type RetryOutput struct {
+	out     Output
+	clock   clock.Clock
+	retries int
+	backoff time.Duration
+	maxTime time.Duration
+}
+
+// NewRetryOutput creates a RetryOutput. a maxTime of 0 means no limit other than the amount of retries.
+func NewRetryOutput(out Output, clk clock.Clock, retries int, backoff, maxTime time.Duration) *RetryOutput {
+	return &RetryOutput{
+		out:     out,
+		clock:   clk,
+		retries: retries,
+		backoff: backoff,
+		maxTime: maxTime,
+	}
+}
+
+// Write writes the metrics, retrying as needed.
+func (r *RetryOutput) Write(metrics []Metric) error {
+	start := r.clock.Now()
+	wait := r.backoff
+	err := r.out.Write(metrics)
+	for i := 0; err != nil && i < r.retries; i++ {
+		if r.maxTime > 0 && r.clock.Now().Add(wait).Sub(start) > r.maxTime {
+			break
+		}
+		log.Warnf("writing failed: %s. retrying in %s", err, wait)
+		r.clock.Sleep(wait)
+		wait *= 2
+		err = r.out.Write(metrics)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/bmizerany/assert"
+)
+
+// flakyOutput fails the first fails writes
+type flakyOutput struct {
+	fails  int
+	writes int
+}
+
+func (f *flakyOutput) Write(metrics []Metric) error {
+	f.writes++
+	if f.writes <= f.fails {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	metrics := []Metric{{"foo", 1, 10, 0}}
+
+	flaky := &flakyOutput{fails: 2}
+	r := NewRetryOutput(flaky, clock.New(), 3, time.Millisecond, 0)
+	assert.Equal(t, nil, r.Write(metrics))
+	assert.Equal(t, 3, flaky.writes)
+
+	// gives up after the retries
+	flaky = &flakyOutput{fails: 10}
+	r = NewRetryOutput(flaky, clock.New(), 3, time.Millisecond, 0)
+	assert.Equal(t, errors.New("down"), r.Write(metrics))
+	assert.Equal(t, 4, flaky.writes)
+
+	// the backoff doubles, and it gives up rather than retry beyond maxTime:
+	// retries after 10ms and 30ms would both be fine, but the next one would be at 70ms
+	flaky = &flakyOutput{fails: 10}
+	r = NewRetryOutput(flaky, clock.New(), 5, 10*time.Millisecond, 50*time.Millisecond)
+	start := time.Now()
+	assert.Equal(t, errors.New("down"), r.Write(metrics))
+	assert.Equal(t, 3, flaky.writes)
+	if took := time.Since(start); took < 30*time.Millisecond || took >= 70*time.Millisecond {
+		t.Errorf("expected the retries to take ~30ms, took %s", took)
+	}
+}
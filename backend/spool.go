@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type spoolFile struct {
+	name string
+	size int64
+}
+
+// SpoolOutput wraps an Output, and when writing to it fails, stores the metrics in files in a spool directory instead.
+// as soon as writing works again, the spooled metrics are replayed, oldest first, before any new metrics.
+// the spool is bounded to maxBytes, when it's full the oldest files are dropped.
+// if a replay fails halfway through a file, the whole file is replayed again later. this may send some points twice,
+// which is harmless for backends like graphite and influxdb where a point with the same name and timestamp overwrites the previous one.
+type SpoolOutput struct {
+	out      Output
+	dir      string
+	maxBytes int64
+	files    []spoolFile // oldest first
+	size     int64
+}
+
+// NewSpoolOutput creates the spool directory if needed, and picks up any files spooled by a previous run.
+func NewSpoolOutput(out Output, dir string, maxBytes int64) (*SpoolOutput, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &SpoolOutput{
+		out:      out,
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".spool") {
+			continue
+		}
+		s.files = append(s.files, spoolFile{e.Name(), e.Size()})
+		s.size += e.Size()
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	if len(s.files) > 0 {
+		log.Infof("found %d spooled files (%d bytes) in %s, will replay", len(s.files), s.size, dir)
+	}
+	return s, nil
+}
+
+// Write replays the spooled files and then writes the metrics.
+// if that fails, the metrics are spooled. only if spooling fails as well, an error is returned.
+func (s *SpoolOutput) Write(metrics []Metric) error {
+	err := s.replay()
+	if err == nil {
+		err = s.out.Write(metrics)
+		if err == nil {
+			return nil
+		}
+	}
+	log.Warnf("writing failed: %s. spooling %d metrics to %s", err, len(metrics), s.dir)
+	return s.spool(metrics)
+}
+
+func (s *SpoolOutput) replay() error {
+	for len(s.files) > 0 {
+		f := s.files[0]
+		path := filepath.Join(s.dir, f.name)
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			// nothing we can do about this, don't have it block all writes
+			log.Errorf("could not read spooled file %s, dropping it: %s", path, err)
+		} else {
+			err = s.out.Write(Parse(buf))
+			if err != nil {
+				return err
+			}
+			log.Infof("replayed spooled file %s", path)
+		}
+		os.Remove(path)
+		s.files = s.files[1:]
+		s.size -= f.size
+	}
+	return nil
+}
+
+func (s *SpoolOutput) spool(metrics []Metric) error {
+	buf := make([]byte, 0, len(metrics)*64)
+	for _, m := range metrics {
+		buf = appendPlain(buf, m)
+	}
+	// it would be dropped right away, along with everything spooled before it
+	if int64(len(buf)) > s.maxBytes {
+		return fmt.Errorf("could not spool metrics: %d bytes don't fit in the spool of %d bytes", len(buf), s.maxBytes)
+	}
+	// zero padded, so that the names sort by age
+	name := fmt.Sprintf("%020d.spool", time.Now().UnixNano())
+	path := filepath.Join(s.dir, name)
+	// write to a temporary file first, so that we never replay half written files
+	err := ioutil.WriteFile(path+".tmp", buf, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("could not spool metrics: %s", err)
+	}
+	// make room for it by dropping older files
+	for s.size+int64(len(buf)) > s.maxBytes && len(s.files) > 0 {
+		f := s.files[0]
+		log.Warnf("spool %s is full, dropping oldest file %s", s.dir, f.name)
+		os.Remove(filepath.Join(s.dir, f.name))
+		s.files = s.files[1:]
+		s.size -= f.size
+	}
+	s.files = append(s.files, spoolFile{name, int64(len(buf))})
+	s.size += int64(len(buf))
+	return nil
+}
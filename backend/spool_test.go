@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+type fakeOutput struct {
+	fail    bool
+	written [][]Metric
+}
+
+func (f *fakeOutput) Write(metrics []Metric) error {
+	if f.fail {
+		return errors.New("down")
+	}
+	f.written = append(f.written, metrics)
+	return nil
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &fakeOutput{fail: true}
+	s, err := NewSpoolOutput(f, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nil, s.Write([]Metric{{"a", 1, 10, 0}}))
+	assert.Equal(t, nil, s.Write([]Metric{{"b", 2, 20, 0}}))
+	assert.Equal(t, 2, len(s.files))
+
+	// a new spool picks up the files of the previous one
+	s, err = NewSpoolOutput(f, dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.fail = false
+	assert.Equal(t, nil, s.Write([]Metric{{"c", 3, 30, 0}}))
+	assert.Equal(t, [][]Metric{{{"a", 1, 10, 0}}, {{"b", 2, 20, 0}}, {{"c", 3, 30, 0}}}, f.written)
+	assert.Equal(t, 0, len(s.files))
+	assert.Equal(t, int64(0), s.size)
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &fakeOutput{fail: true}
+	// each file is "x 1 10\n", 7 bytes
+	s, err := NewSpoolOutput(f, dir, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		s.Write([]Metric{{"x", float64(i), 10, 0}})
+	}
+	f.fail = false
+	s.Write(nil)
+	assert.Equal(t, [][]Metric{{{"x", 2, 10, 0}}, {{"x", 3, 10, 0}}, nil}, f.written)
+}
+
+func TestSpoolTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &fakeOutput{fail: true}
+	s, err := NewSpoolOutput(f, dir, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nil, s.Write([]Metric{{"x", 1, 10, 0}}))
+	// a flush that doesn't fit in the spool by itself fails, and leaves what was spooled before alone
+	assert.NotEqual(t, nil, s.Write([]Metric{{"x", 2, 10, 0}, {"x", 3, 10, 0}, {"x", 4, 10, 0}}))
+	entries, err := ioutil.ReadDir(dir)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, int64(7), s.size)
+
+	f.fail = false
+	assert.Equal(t, nil, s.Write(nil))
+	assert.Equal(t, [][]Metric{{{"x", 1, 10, 0}}, nil}, f.written)
+}
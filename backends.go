@@ -0,0 +1,109 @@
+package statsdaemon
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/raintank/statsdaemon/backend"
+	"github.com/raintank/statsdaemon/common"
+)
+
+// DefaultBackend is the name BackendRoutes use for Output, the backend of the metrics that match no route
+const DefaultBackend = "default"
+
+// Backend is a named output that BackendRoutes can send metrics to
+type Backend struct {
+	Type string // graphite or influxdb
+	Addr string // host:port for graphite, an http url for influxdb
+	DB   string // the database, for influxdb
+}
+
+// BackendRoute sends the metrics whose flushed name (without global_prefix and global_suffix) matches Pattern,
+// see common.NewFilter, to the backend named Backend: one of Backends, or DefaultBackend.
+type BackendRoute struct {
+	Pattern string
+	Backend string
+}
+
+// backendRoute is a BackendRoute of the destination it sends to
+type backendRoute struct {
+	match *common.Filter
+	dest  int // index in destinations
+}
+
+// CheckBackendRoutes returns an error if a route has an invalid pattern, or refers to a backend that isn't defined.
+func CheckBackendRoutes(routes []BackendRoute, backends map[string]Backend) error {
+	if _, ok := backends[DefaultBackend]; ok {
+		return fmt.Errorf("backend name %q is reserved for the output backend", DefaultBackend)
+	}
+	for name, b := range backends {
+		if b.Type != "graphite" && b.Type != "influxdb" {
+			return fmt.Errorf("backend %q has invalid type %q. must be graphite or influxdb", name, b.Type)
+		}
+		if b.Addr == "" {
+			return fmt.Errorf("backend %q has no address", name)
+		}
+	}
+	for _, r := range routes {
+		if match, err := common.NewFilter(r.Pattern, ""); err != nil || match == nil {
+			return fmt.Errorf("route %q has invalid pattern %q", r.Pattern+"="+r.Backend, r.Pattern)
+		}
+		if _, ok := backends[r.Backend]; !ok && r.Backend != DefaultBackend {
+			return fmt.Errorf("route %q refers to undefined backend %q", r.Pattern+"="+r.Backend, r.Backend)
+		}
+	}
+	return nil
+}
+
+// backendOutput creates the output of a Backend. graphite ones use the same options as graphiteOutput.
+func (s *StatsDaemon) backendOutput(b Backend) backend.Output {
+	if b.Type != "influxdb" {
+		return s.graphiteOutput(b.Addr)
+	}
+	if s.DryRun {
+		return backend.NewLogOutput(b.Addr)
+	}
+	return backend.NewInfluxDBOutput(b.Addr, b.DB, s.TimestampPrecision)
+}
+
+// setBackendRoutes adds the destinations of the Backends that BackendRoutes refer to, after the one for Output
+// (which must be the last one so far), and sets backendRoutes.
+func (s *StatsDaemon) setBackendRoutes() error {
+	if err := CheckBackendRoutes(s.BackendRoutes, s.Backends); err != nil {
+		return err
+	}
+	dests := map[string]int{DefaultBackend: len(s.destinations) - 1}
+	s.backendRoutes = nil
+	for _, r := range s.BackendRoutes {
+		i, ok := dests[r.Backend]
+		if !ok {
+			b := s.Backends[r.Backend]
+			i = len(s.destinations)
+			dests[r.Backend] = i
+			s.destinations = append(s.destinations, &destination{"", r.Backend, s.spool(s.backendOutput(b), "backend_"+r.Backend), make(chan []byte, 1000)})
+		}
+		// already validated
+		match, _ := common.NewFilter(r.Pattern, "")
+		s.backendRoutes = append(s.backendRoutes, backendRoute{match, i})
+	}
+	return nil
+}
+
+// backendRoute returns the index of the destination of the first of backendRoutes that matches the name of
+// the line, -1 if none does.
+func (s *StatsDaemon) backendRoute(line []byte) int {
+	if len(s.backendRoutes) == 0 {
+		return -1
+	}
+	name := line
+	if end := bytes.IndexByte(line, ' '); end >= 0 {
+		name = line[:end]
+	}
+	bucket := string(name)
+	for _, r := range s.backendRoutes {
+		if r.match.Accept(bucket) {
+			return r.dest
+		}
+	}
+	return -1
+}
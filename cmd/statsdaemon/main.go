@@ -1,21 +1,36 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Dieterbe/profiletrigger/cpu"
 	"github.com/Dieterbe/profiletrigger/heap"
+	ini "github.com/glacjay/goini"
 	"github.com/raintank/dur"
 	"github.com/raintank/statsdaemon"
+	"github.com/raintank/statsdaemon/backend"
+	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/logger"
 	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
 	log "github.com/sirupsen/logrus"
 
 	"net/http"
@@ -25,7 +40,6 @@ import (
 )
 
 const (
-	VERSION = "0.6"
 	// number of packets we can read out of udp buffer without processing them
 	// statsdaemon doesn't really interrupt the udp reader like some other statsd's do (like on flush)
 	// but this can still be useful to deal with traffic bursts.
@@ -34,32 +48,125 @@ const (
 )
 
 var (
-	listen_addr   = flag.String("listen_addr", ":8125", "listener address for statsd, listens on UDP only")
-	admin_addr    = flag.String("admin_addr", ":8126", "listener address for admin port")
-	profile_addr  = flag.String("profile_addr", "", "listener address for profiler")
-	graphite_addr = flag.String("graphite_addr", "127.0.0.1:2003", "graphite carbon-in url")
-	prometheus_addr = flag.String("prometheus_addr", ":9091", "prometheus listen address")
-	flushInterval = flag.Int("flush_interval", 10, "flush interval in seconds")
-	processes     = flag.Int("processes", 2, "number of processes to use")
-
-	instance = flag.String("instance", "$HOST", "instance name, defaults to short hostname if not set")
+	listen_addr                  = flag.String("listen_addr", ":8125", "listener address for statsd, listens on UDP only")
+	max_udp_packet_size          = flag.Int("max_udp_packet_size", udp.MaxUdpPacketSize, "size of the udp read buffer. the last line of larger packets is dropped")
+	udp_recv_buffer              = flag.Int("udp_recv_buffer", 0, "size of the kernel receive buffer (SO_RCVBUF) of the udp socket(s) in bytes, capped by net.core.rmem_max on linux. 0 for the OS default")
+	num_readers                  = flag.Int("num_readers", 1, "amount of udp sockets (with SO_REUSEPORT, linux only) and goroutines reading from listen_addr")
+	listen_addr_tcp              = flag.String("listen_addr_tcp", "", "listener address for statsd over TCP (newline delimited). empty to disable")
+	payload_encoding             = flag.String("payload_encoding", "plain", "how the packets on listen_addr and socket_path are encoded: plain|gzip (every packet compressed by itself)")
+	payload_encoding_tcp         = flag.String("payload_encoding_tcp", "plain", "how the connections to listen_addr_tcp are encoded: plain|gzip (every connection a single gzip stream)")
+	socket_path                  = flag.String("socket_path", "", "path of unix datagram socket to listen on for statsd. empty to disable")
+	admin_addr                   = flag.String("admin_addr", ":8126", "listener address for admin port")
+	admin_token                  = flag.String("admin_token", "", "if set, admin connections must first send auth <token> to run commands other than help")
+	profile_addr                 = flag.String("profile_addr", "", "listener address for profiler")
+	graphite_addr                = flag.String("graphite_addr", "127.0.0.1:2003", "graphite carbon-in url")
+	graphite_protocol            = flag.String("graphite_protocol", "text", "protocol to send to graphite with. text|pickle")
+	graphite_tls                 = flag.Bool("graphite_tls", false, "connect to graphite over TLS")
+	graphite_tls_ca              = flag.String("graphite_tls_ca", "", "PEM file with the CA certificate(s) to verify graphite's certificate with. empty for the system's")
+	graphite_tls_skip_verify     = flag.Bool("graphite_tls_skip_verify", false, "don't verify graphite's certificate. insecure, for self-signed dev setups only")
+	graphite_write_timeout       = flag.String("graphite_write_timeout", "", "how long connecting to and every write to graphite may take, like 2s. empty means the flush interval")
+	graphite_connect_timeout     = flag.String("graphite_connect_timeout", "", "how long connecting to graphite may take, like 500ms. empty means graphite_write_timeout")
+	graphite_write_retries       = flag.Int("graphite_write_retries", 0, "how often to retry a failed write to graphite within the flush interval, before spooling or retrying from memory")
+	graphite_write_retry_backoff = flag.String("graphite_write_retry_backoff", "1s", "how long to wait before the first retry of a write to graphite. doubles for every next one")
+	graphite_routes              = flag.String("graphite_routes", "", "comma separated prefix=graphite_addr pairs, to send metrics starting with prefix to another graphite")
+	backends                     = flag.String("backends", "", "comma separated name=type:addr backends for backend_routes, with type graphite or influxdb")
+	backend_routes               = flag.String("backend_routes", "", "comma separated pattern=backend rules. metrics go to the backend of the first rule whose pattern they match")
+	output_backend               = flag.String("output_backend", "graphite", "where to send metrics to. graphite|influxdb")
+	dry_run                      = flag.Bool("dry_run", false, "log the flushed metrics instead of sending them, without ever connecting to the output backend")
+	influxdb_addr                = flag.String("influxdb_addr", "http://localhost:8086", "influxdb http url (for output_backend influxdb)")
+	influxdb_db                  = flag.String("influxdb_db", "statsd", "influxdb database (for output_backend influxdb)")
+	timestamp_precision          = flag.String("timestamp_precision", "s", "precision of the timestamps of flushed metrics: s, ms, us or ns. graphite pickle always uses s")
+	value_precision              = flag.Int("value_precision", -1, "decimals to round flushed values to. tiny values keep as many significant digits instead. -1 to send them exactly")
+	spool_dir                    = flag.String("spool_dir", "", "directory to store metrics in while the output backend is unreachable, to replay them later. empty to disable")
+	spool_max_bytes              = flag.Int64("spool_max_bytes", 100*1024*1024, "maximum size of spool_dir. when full, the oldest metrics are dropped")
+	prometheus_addr              = flag.String("prometheus_addr", ":9091", "prometheus listen address")
+	expose_timers_prometheus     = flag.Bool("expose_timers_prometheus", false, "expose the timers on prometheus_addr /metrics as summaries, instead of their flushed stats")
+	expose_prometheus_metrics    = flag.Bool("expose_prometheus_metrics", false, "expose the counters (as totals since startup) and gauges on prometheus_addr /metrics, instead of their flushed values")
+	health_max_intervals         = flag.Int("health_max_intervals", 3, "/health and /ready (on prometheus_addr) fail if the last successful flush is more than this many flush intervals ago")
+	flushInterval                = flag.Int("flush_interval", 10, "flush interval in seconds")
+	flush_offset                 = flag.String("flush_offset", "", "how long after every whole flush interval to flush: a duration like 2.5s, host (derived from the hostname) or random. empty means 0")
+	rollup_interval              = flag.String("rollup_interval", "", "combine the flush intervals of this period, like 60s, and send the data once at its end. a multiple of the flush interval. empty means sending every flush interval")
+	processes                    = flag.Int("processes", 2, "number of processes to use")
+	num_shards                   = flag.Int("num_shards", 1, "amount of goroutines aggregating metrics, each owning the buckets that hash to it")
+
+	replay_file = flag.String("replay_file", "", "instead of listening, aggregate the statsd lines in this file (- for stdin), flush and exit")
+	replay_rate = flag.Int("replay_rate", 0, "lines per second to read from replay_file. 0 means as fast as possible")
+
+	instance        = flag.String("instance", "$HOST", "instance name, defaults to short hostname if not set")
+	prefix_internal = flag.String("prefix_internal", "service_is_statsdaemon.instance_is_$INSTANCE.", "prefix of statsdaemon's own metrics. $INSTANCE is replaced by the instance name")
 
 	legacy_namespace = flag.Bool("legacy_namespace", true, "legacy namespacing (not recommended)")
 	prefix_rates     = flag.String("prefix_rates", "stats.", "rates prefix, it is recommended that you use stats.rates if possible")
 	prefix_counters  = flag.String("prefix_counters", "stats_counts.", "counters prefix")
 	prefix_timers    = flag.String("prefix_timers", "stats.timers.", "timers prefix")
 	prefix_gauges    = flag.String("prefix_gauges", "stats.gauges.", "gauges prefix")
+	prefix_sets      = flag.String("prefix_sets", "stats.sets.", "sets prefix")
+
+	global_prefix = flag.String("global_prefix", "", "prefix of the names of all flushed metrics, before the per type prefixes")
+	global_suffix = flag.String("global_suffix", "", "suffix of the names of all flushed metrics")
 
 	prefix_m20_counters = flag.String("prefix_m20_counters", "", "counters 2.0 prefix")
 	prefix_m20_gauges   = flag.String("prefix_m20_gauges", "", "gauges 2.0 prefix")
 	prefix_m20_rates    = flag.String("prefix_m20_rates", "", "rates 2.0 prefix")
 	prefix_m20_timers   = flag.String("prefix_m20_timers", "", "timers 2.0 prefix")
+	prefix_m20_sets     = flag.String("prefix_m20_sets", "", "sets 2.0 prefix")
 
-	flush_rates  = flag.Bool("flush_rates", true, "send count for counters (using prefix_counters)")
+	flush_rates  = flag.Bool("flush_rates", true, "send rates for counters (using prefix_rates)")
 	flush_counts = flag.Bool("flush_counts", false, "send count for counters (using prefix_counters)")
 
-	percentile_thresholds = flag.String("percentile_thresholds", "90,75", "percential thresholds (used by timers)")
-	max_timers_per_s      = flag.Uint64("max_timers_per_s", 1000, "max timers per second")
+	max_bucket_len = flag.Int("max_bucket_len", 512, "longest bucket name accepted (after sanitizing), longer ones are invalid lines. 0 means no limit")
+
+	counter_allow_negative = flag.Bool("counter_allow_negative", false, "accept negative counter values to decrement counters. otherwise they're invalid")
+	default_modifier       = flag.String("default_modifier", "", "type of lines without one, like c to treat foo:1 as a counter: c|g|ms|s. empty means they're invalid")
+	strict_types           = flag.Bool("strict_types", false, "only accept the first type seen for a bucket in an interval. metrics of the bucket with another type are invalid")
+	treat_as_gauge         = flag.String("treat_as_gauge", "", "comma separated patterns of buckets whose counters are treated as gauges, taking their last value instead of being summed")
+
+	counter_mode = flag.String("counter_mode", "delta", "delta (reset counters every flush) or cumulative (send their running total)")
+
+	delete_idle_counters = flag.Bool("delete_idle_counters", true, "delete counters that didn't get data for delete_idle_after intervals. if false, they're sent as 0 forever")
+	delete_idle_gauges   = flag.Bool("delete_idle_gauges", true, "delete gauges that didn't get data for delete_idle_after intervals. if false, they're sent with their last value forever")
+	delete_idle_timers   = flag.Bool("delete_idle_timers", true, "delete timers that didn't get data for delete_idle_after intervals. if false, they're sent with a count of 0 forever")
+	delete_idle_after    = flag.Int("delete_idle_after", 1, "after how many intervals without data to delete idle metrics (see delete_idle_*)")
+
+	gauges_persist_file   = flag.String("gauges_persist_file", "", "file to save gauges to on shutdown, and restore them from on startup. empty to disable")
+	gauge_deltas          = flag.Bool("gauge_deltas", false, "treat gauge values with an explicit sign (+5, -3) as a change relative to the previous value")
+	gauge_flush_unchanged = flag.Bool("gauge_flush_unchanged", true, "send gauges every interval. if false, only send them when their value changed since they were last sent")
+
+	sanitize_bucket = flag.Bool("sanitize_bucket", false, "replace the characters of sanitize_chars by underscores, collapse repeated dots and strip leading and trailing dots in metric names")
+	sanitize_chars  = flag.String("sanitize_chars", " ", "characters to replace by underscores in metric names, if sanitize_bucket is set")
+
+	allow_patterns = flag.String("allow_patterns", "", "comma separated globs or /regexes/. if set, only metrics matching one of them are accepted")
+	block_patterns = flag.String("block_patterns", "", "comma separated globs or /regexes/. metrics matching any of them are dropped")
+	rewrite_rules  = flag.String("rewrite_rules", "", "comma separated pattern=>template rules to rename metrics with. the first matching rule applies")
+
+	forward_addr     = flag.String("forward_addr", "", "udp address of a statsd to forward the lines matching forward_patterns to, verbatim")
+	forward_patterns = flag.String("forward_patterns", "", "comma separated globs or /regexes/. metrics matching one of them are forwarded to forward_addr rather than aggregated")
+
+	tag_format  = flag.String("tag_format", "none", "what to do with dogstatsd style tags (|#key:val,...). none|dotted|graphite")
+	static_tags = flag.String("static_tags", "", "comma separated key=value tags to add to every metric sent, e.g. env=prod,cluster=eu1")
+
+	percentile_thresholds      = flag.String("percentile_thresholds", "90,75", "percential thresholds (used by timers)")
+	timer_percentiles          = flag.String("timer_percentiles", "", "percentiles for timers matching a glob, instead of percentile_thresholds, like \"db.*=99,99.9;http.*=50,90\"")
+	stat_separator             = flag.String("stat_separator", ".", "what joins buckets and their stats, like upper_90 in stats.timers.<bucket>.upper_90. may be empty")
+	percentile_suffix_format   = flag.String("percentile_suffix_format", "underscore", "how to name percentiles in the timer stats, e.g. 99.9 in upper_99_9: underscore (99_9), p_prefix (p99_9) or raw (99.9)")
+	percentile_method          = flag.String("percentile_method", "nearest_rank", "how to compute percentiles: nearest_rank|linear")
+	stddev_sample              = flag.Bool("stddev_sample", false, "send the sample standard deviation (dividing by n-1) as timer std and std_pct, instead of the population one (dividing by n)")
+	timer_histograms           = flag.String("timer_histogram_buckets", "", "histogram bucket boundaries for timers, like \"api.*=10,50,100;db.*=1,5;100,1000\"")
+	timer_stats                = flag.String("timer_stats", "", "comma separated list of timer stats to send. empty means all")
+	timer_scale                = flag.Float64("timer_scale", 1, "multiplier for the timer stats in the unit of the timer values, e.g. 0.001 to send seconds for timers in ms")
+	timer_reservoir_size       = flag.Int("timer_reservoir_size", 0, "max points kept per timer per interval. beyond it, a random sample is kept. 0 means unbounded")
+	timer_algorithm            = flag.String("timer_algorithm", "exact", "how to compute timer percentiles: exact (from all points) or tdigest (estimated, in bounded memory)")
+	timer_weighted_percentiles = flag.Bool("timer_weighted_percentiles", false, "weigh every timer point by 1/its sample rate in the percentiles, for buckets that clients sample differently")
+	max_timers_per_s           = flag.Uint64("max_timers_per_s", 1000, "max timers per second")
+	max_timers_per_s_prefixes  = flag.String("max_timers_per_s_prefixes", "", "comma separated prefix=max pairs, overriding max_timers_per_s for buckets starting with prefix")
+	shutdown_grace             = flag.String("shutdown_grace", "5s", "on SIGTERM, how long to wait for the listeners to stop and what they read to be aggregated, before the final flush")
+	sample_rate_window         = flag.String("sample_rate_window", "10s", "period that the sample_rate and metric_stats admin commands measure over")
+	overflow_policy            = flag.String("overflow_policy", "block", "what listeners do when aggregation can't keep up: block (stop reading until there's room) or drop (drop the metrics)")
+	sample_rate_tracking       = flag.Bool("sample_rate_tracking", true, "track how often every bucket is submitted, for the sample_rate and metric_stats admin commands")
+	enforce_sample_rate        = flag.Bool("enforce_sample_rate", false, "drop timer points of buckets submitted more often than max_timers_per_s at random, rather than only advising a sample rate")
+	max_set_members            = flag.Int("max_set_members", 0, "max unique members tracked per set per interval. 0 means unbounded")
+	max_buckets                = flag.String("max_buckets", "", "comma separated type=max pairs bounding the distinct buckets per type (counter, gauge, timer or set), like counter=100000")
+	max_buckets_policy         = flag.String("max_buckets_policy", "reject", "what to do with new buckets once max_buckets is reached: reject (drop their metrics) or evict (delete the least recently used bucket)")
 
 	proftrigPath = flag.String("proftrigger_path", "/tmp/profiletrigger/", "profiler file path") // "path to store triggered profiles"
 
@@ -73,11 +180,13 @@ var (
 	proftrigCpuThresh     = flag.Int("proftrigger_cpu_thresh", 80, "profiler cpu threshold")             // "if this much percent cpu used, trigger a profile"
 
 	logLevel    = flag.String("log_level", "info", "log level. panic|fatal|error|warning|info|debug")
+	logFormat   = flag.String("log_format", "text", "log format. text|json")
 	showVersion = flag.Bool("version", false, "print version string")
+	checkOnly   = flag.Bool("check_config", false, "validate the config, print a summary and exit, without opening any socket")
 	config_file = flag.String("config_file", "/etc/statsdaemon.ini", "config file location")
+	config_dir  = flag.String("config_dir", "", "directory of *.ini files to load after config_file, in lexical order. later files override earlier ones")
 	cpuprofile  = flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile  = flag.String("memprofile", "", "write memory profile to this file")
-	GitHash     = "(none)"
 )
 
 func expand_cfg_vars(in string) (out string) {
@@ -91,13 +200,392 @@ func expand_cfg_vars(in string) (out string) {
 		return ""
 	}
 }
+
+// timestampPrecisions are the values of timestamp_precision
+var timestampPrecisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// flushOffset returns the offset to flush at within the flush interval, see flush_offset.
+func flushOffset(spec string, interval time.Duration) (time.Duration, error) {
+	switch spec {
+	case "":
+		return 0, nil
+	case "host":
+		hostname, _ := os.Hostname()
+		h := fnv.New64a()
+		h.Write([]byte(hostname))
+		return time.Duration(h.Sum64()%uint64(interval/time.Millisecond)) * time.Millisecond, nil
+	case "random":
+		return time.Duration(rand.Int63n(int64(interval/time.Millisecond))) * time.Millisecond, nil
+	}
+	offset, err := time.ParseDuration(spec)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset >= interval {
+		return 0, fmt.Errorf("%s is not within the flush interval", spec)
+	}
+	return offset, nil
+}
+
+// graphiteWriteTimeout returns the timeout for writes to graphite, see graphite_write_timeout (or for connecting to it,
+// see graphite_connect_timeout). 0 means the default.
+func graphiteWriteTimeout(spec string, interval time.Duration) (time.Duration, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(spec)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 || timeout > interval {
+		return 0, fmt.Errorf("%s is not within the flush interval", spec)
+	}
+	return timeout, nil
+}
+
+// graphiteTLS returns the TLS config to connect to graphite with, or nil if TLS is disabled
+func graphiteTLS(enabled bool, caFile string, skipVerify bool) (*tls.Config, error) {
+	if !enabled {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caFile)
+		}
+	}
+	return config, nil
+}
+
+// keepIdle returns for how many intervals idle metrics should still be sent
+func keepIdle(deleteIdle bool) int {
+	if !deleteIdle {
+		return -1
+	}
+	return *delete_idle_after - 1
+}
+
+// parseRoutes parses comma separated prefix=addr pairs
+func parseRoutes(spec string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range strings.Split(spec, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form prefix=addr", route)
+		}
+		if _, ok := routes[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate prefix %q", parts[0])
+		}
+		routes[parts[0]] = parts[1]
+	}
+	return routes, nil
+}
+
+// parseBackends parses comma separated name=type:addr backends. influxdb ones use influxdb_db.
+func parseBackends(spec string) (map[string]statsdaemon.Backend, error) {
+	named := make(map[string]statsdaemon.Backend)
+	for _, b := range strings.Split(spec, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		parts := strings.SplitN(b, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form name=type:addr", b)
+		}
+		typeAddr := strings.SplitN(parts[1], ":", 2)
+		if len(typeAddr) != 2 {
+			return nil, fmt.Errorf("%q is not of the form name=type:addr", b)
+		}
+		if _, ok := named[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate backend %q", parts[0])
+		}
+		named[parts[0]] = statsdaemon.Backend{Type: typeAddr[0], Addr: typeAddr[1], DB: *influxdb_db}
+	}
+	return named, nil
+}
+
+// parseBackendRoutes parses comma separated pattern=backend rules, in order.
+// the pattern ends at the last =, as backend names can't contain one.
+func parseBackendRoutes(spec string) ([]statsdaemon.BackendRoute, error) {
+	var routes []statsdaemon.BackendRoute
+	for _, route := range strings.Split(spec, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(route, '=')
+		if eq <= 0 || eq == len(route)-1 {
+			return nil, fmt.Errorf("%q is not of the form pattern=backend", route)
+		}
+		routes = append(routes, statsdaemon.BackendRoute{Pattern: route[:eq], Backend: route[eq+1:]})
+	}
+	return routes, nil
+}
+
+// checkConfig resolves the graphite addresses the daemon would write to, and writes a summary of the config to w.
+// the rest of the config has been validated by then. it doesn't open any socket.
+func checkConfig(w io.Writer, daemon *statsdaemon.StatsDaemon, inst string) error {
+	addrs := map[string]string{}
+	if *output_backend == "graphite" {
+		addrs["graphite_addr"] = *graphite_addr
+	}
+	for prefix, addr := range daemon.GraphiteRoutes {
+		addrs["graphite_routes "+prefix] = addr
+	}
+	for name, b := range daemon.Backends {
+		if b.Type == "graphite" {
+			addrs["backend "+name] = b.Addr
+		}
+	}
+	for what, addr := range addrs {
+		if err := resolves(addr); err != nil {
+			return fmt.Errorf("%s %q: %s", what, addr, err)
+		}
+	}
+
+	line := func(key string, val interface{}) {
+		fmt.Fprintf(w, "%-20s %v\n", key, val)
+	}
+	line("instance", inst)
+	line("listen_addr", *listen_addr)
+	line("listen_addr_tcp", *listen_addr_tcp)
+	line("socket_path", *socket_path)
+	line("admin_addr", *admin_addr)
+	line("prometheus_addr", *prometheus_addr)
+	line("flush_interval", time.Duration(*flushInterval)*time.Second)
+	if *output_backend == "influxdb" {
+		line("output", fmt.Sprintf("influxdb %s database %s", *influxdb_addr, *influxdb_db))
+	} else {
+		line("output", fmt.Sprintf("graphite %s (%s)", *graphite_addr, *graphite_protocol))
+	}
+	line("dry_run", *dry_run)
+	line("graphite_routes", len(daemon.GraphiteRoutes))
+	line("backend_routes", len(daemon.BackendRoutes))
+	line("percentiles", *percentile_thresholds)
+	line("num_shards", *num_shards)
+	fmt.Fprintln(w, "config ok")
+	return nil
+}
+
+// resolves returns an error if addr is not a host:port, or its host can't be resolved
+func resolves(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return err
+	}
+	_, err = net.LookupHost(host)
+	return err
+}
+
+// replay aggregates the statsd lines in path (or stdin, for "-"), see StatsDaemon.Replay
+func replay(daemon *statsdaemon.StatsDaemon, path string, rate int, graphite_addr string) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("could not open replay_file: %s", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := daemon.Replay(in, rate, graphite_addr); err != nil {
+		log.Fatalf("could not read replay_file: %s", err)
+	}
+}
+
+// parseMaxBuckets parses max_buckets into a map of types to their max amount of buckets
+func parseMaxBuckets(spec string) (map[string]int, error) {
+	maxes := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not of the form type=max", pair)
+		}
+		switch parts[0] {
+		case "counter", "gauge", "timer", "set":
+		default:
+			return nil, fmt.Errorf("invalid type %q. must be counter, gauge, timer or set", parts[0])
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max < 0 {
+			return nil, fmt.Errorf("invalid max in %q. must be 0 or more", pair)
+		}
+		if _, ok := maxes[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate type %q", parts[0])
+		}
+		maxes[parts[0]] = max
+	}
+	return maxes, nil
+}
+
+// parseMaxTimersPerS parses max_timers_per_s_prefixes into a map of prefixes to max timers per second
+func parseMaxTimersPerS(spec string) (map[string]uint64, error) {
+	maxes := make(map[string]uint64)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form prefix=max", pair)
+		}
+		max, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max in %q: %s", pair, err)
+		}
+		if _, ok := maxes[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate prefix %q", parts[0])
+		}
+		maxes[parts[0]] = max
+	}
+	return maxes, nil
+}
+
+// loadConfig sets the flags that weren't given on the command line from SD_<FLAG NAME> environment variables
+// (e.g. SD_PERCENTILE_THRESHOLDS), or else from the config files. so command line flags take precedence over the
+// environment, which takes precedence over the config files. the config file itself can be set with SD_CONFIG_FILE
+// too, and config_dir with SD_CONFIG_DIR. a config file that doesn't exist is ignored.
+func loadConfig() error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	configFile, configDir := *config_file, *config_dir
+	fileGiven, dirGiven := false, false
+	flag.Visit(func(f *flag.Flag) {
+		fileGiven = fileGiven || f.Name == "config_file"
+		dirGiven = dirGiven || f.Name == "config_dir"
+	})
+	if env, ok := os.LookupEnv("SD_CONFIG_FILE"); ok && !fileGiven {
+		configFile = env
+	}
+	if env, ok := os.LookupEnv("SD_CONFIG_DIR"); ok && !dirGiven {
+		configDir = env
+	}
+	var paths []string
+	if _, err := os.Stat(configFile); err == nil {
+		paths = append(paths, configFile)
+	}
+	if configDir != "" {
+		if _, err := os.Stat(configDir); err != nil {
+			return fmt.Errorf("can't read config_dir: %s", err)
+		}
+		files, err := filepath.Glob(filepath.Join(configDir, "*.ini"))
+		if err != nil {
+			return fmt.Errorf("can't read config_dir %s: %s", configDir, err)
+		}
+		sort.Strings(files)
+		paths = append(paths, files...)
+	}
+	path := ""
+	if len(paths) == 1 {
+		path = paths[0]
+	} else if len(paths) > 1 {
+		// globalconf reads a single file, so we give it one with all of them merged
+		merged, err := mergeConfigFiles(paths)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(merged)
+		path = merged
+	}
+	conf, err := globalconf.NewWithOptions(&globalconf.Options{
+		Filename:  path,
+		EnvPrefix: "SD_",
+	})
+	if err != nil {
+		return fmt.Errorf("can't read config file %s: %s", path, err)
+	}
+	conf.ParseAll()
+	return nil
+}
+
+// mergeConfigFiles merges the config files into a temporary one, whose name it returns. every option gets the
+// value of the last file that has it: values aren't merged, so for lists (like percentile_thresholds or
+// graphite_routes) the last file's list replaces those of earlier ones.
+func mergeConfigFiles(paths []string) (string, error) {
+	merged := make(ini.Dict)
+	for _, path := range paths {
+		dict, err := ini.Load(path)
+		if err != nil {
+			return "", fmt.Errorf("can't read config file %s: %s", path, err)
+		}
+		for section, vals := range dict {
+			if merged[section] == nil {
+				merged[section] = make(map[string]string)
+			}
+			for key, val := range vals {
+				merged[section][key] = val
+			}
+		}
+	}
+	f, err := ioutil.TempFile("", "statsdaemon-config")
+	if err != nil {
+		return "", fmt.Errorf("can't merge config files: %s", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	sections := make([]string, 0, len(merged))
+	for section := range merged {
+		sections = append(sections, section)
+	}
+	// the options without a section come first, as "" sorts first
+	sort.Strings(sections)
+	for _, section := range sections {
+		if section != "" {
+			fmt.Fprintf(w, "[%s]\n", section)
+		}
+		keys := make([]string, 0, len(merged[section]))
+		for key := range merged[section] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// quoted, so that values with a # or ; are read back as they are
+			val := merged[section][key]
+			if strings.Contains(val, `"`) {
+				fmt.Fprintf(w, "%s = '%s'\n", key, val)
+			} else {
+				fmt.Fprintf(w, "%s = \"%s\"\n", key, val)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("can't merge config files: %s", err)
+	}
+	return f.Name(), nil
+}
+
 func main() {
 	flag.Parse()
-
 	if *showVersion {
-		fmt.Printf("statsdaemon v%s (built w/%s, git hash %s)\n", VERSION, runtime.Version(), GitHash)
+		fmt.Println(statsdaemon.BuildInfo())
 		return
 	}
+
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -115,24 +603,20 @@ func main() {
 		defer pprof.WriteHeapProfile(f)
 	}
 
-	path := ""
-	if _, err := os.Stat(*config_file); err == nil {
-		path = *config_file
-	}
-	conf, err := globalconf.NewWithOptions(&globalconf.Options{
-		Filename:  path,
-		EnvPrefix: "SD_",
-	})
-
-	conf.ParseAll()
-
 	/***********************************
-	          Set up Logger
-    ***********************************/
-
-	logformatter := &logger.TextFormatter{}
-	logformatter.TimestampFormat = "2006-01-02 15:04:05.000"
-	log.SetFormatter(logformatter)
+		          Set up Logger
+	    ***********************************/
+
+	switch *logFormat {
+	case "text":
+		logformatter := &logger.TextFormatter{}
+		logformatter.TimestampFormat = "2006-01-02 15:04:05.000"
+		log.SetFormatter(logformatter)
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		log.Fatalf("invalid log_format %q. text|json", *logFormat)
+	}
 	lvl, err := log.ParseLevel(*logLevel)
 	if err != nil {
 		log.Fatalf("failed to parse log-level, %s", err.Error())
@@ -175,9 +659,200 @@ func main() {
 
 	runtime.GOMAXPROCS(*processes)
 	pct, err := out.NewPercentiles(*percentile_thresholds)
+	if err != nil {
+		log.Fatalf("invalid percentile_thresholds: %s", err)
+	}
+	timerStats, err := out.NewTimerStats(*timer_stats)
+	if err != nil {
+		log.Fatalf("invalid timer_stats: %s", err)
+	}
+	if *percentile_method != out.PercentileNearestRank && *percentile_method != out.PercentileLinear {
+		log.Fatalf("invalid percentile_method '%s'", *percentile_method)
+	}
+	switch *percentile_suffix_format {
+	case out.PercentileSuffixUnderscore, out.PercentileSuffixPPrefix, out.PercentileSuffixRaw:
+	default:
+		log.Fatalf("invalid percentile_suffix_format %q. must be underscore, p_prefix or raw", *percentile_suffix_format)
+	}
+	if !(*timer_scale > 0) {
+		log.Fatal("timer_scale must be a positive number")
+	}
+	statSeparator := *stat_separator
+	if statSeparator == "" {
+		statSeparator = out.StatSeparatorNone
+	}
+	if strings.Contains(statSeparator, ";") && *tag_format == out.TagsGraphite {
+		log.Fatal("stat_separator can't contain a ; with tag_format graphite, which separates the tags with it")
+	}
+	timerPercentiles, err := out.NewPercentileSets(*timer_percentiles)
+	if err != nil {
+		log.Fatalf("invalid timer_percentiles: %s", err)
+	}
+	histograms, err := out.NewHistograms(*timer_histograms)
+	if err != nil {
+		log.Fatalf("invalid timer_histogram_buckets: %s", err)
+	}
+	if *tag_format != out.TagsNone && *tag_format != out.TagsDotted && *tag_format != out.TagsGraphite {
+		log.Fatalf("invalid tag_format '%s'", *tag_format)
+	}
+	staticTags, err := out.ParseTags(*static_tags)
+	if err != nil {
+		log.Fatalf("invalid static_tags: %s", err)
+	}
+	for name, encoding := range map[string]string{"payload_encoding": *payload_encoding, "payload_encoding_tcp": *payload_encoding_tcp} {
+		if encoding != out.EncodingPlain && encoding != out.EncodingGzip {
+			log.Fatalf("invalid %s %q. must be plain or gzip", name, encoding)
+		}
+	}
+	switch *default_modifier {
+	case "", "c", "g", "ms", "s":
+	default:
+		log.Fatalf("invalid default_modifier %q. must be c, g, ms, s or empty", *default_modifier)
+	}
+	if *output_backend != "graphite" && *output_backend != "influxdb" {
+		log.Fatalf("invalid output_backend %q. must be graphite or influxdb", *output_backend)
+	}
+	if *graphite_protocol != "text" && *graphite_protocol != "pickle" {
+		log.Fatalf("invalid graphite_protocol %q. must be text or pickle", *graphite_protocol)
+	}
+	tlsConfig, err := graphiteTLS(*graphite_tls, *graphite_tls_ca, *graphite_tls_skip_verify)
+	if err != nil {
+		log.Fatalf("invalid graphite_tls_ca: %s", err)
+	}
+	writeTimeout, err := graphiteWriteTimeout(*graphite_write_timeout, time.Duration(*flushInterval)*time.Second)
+	if err != nil {
+		log.Fatalf("invalid graphite_write_timeout: %s", err)
+	}
+	connectTimeout, err := graphiteWriteTimeout(*graphite_connect_timeout, time.Duration(*flushInterval)*time.Second)
+	if err != nil {
+		log.Fatalf("invalid graphite_connect_timeout: %s", err)
+	}
+	if *graphite_write_retries < 0 {
+		log.Fatal("graphite_write_retries must not be negative")
+	}
+	retryBackoff, err := time.ParseDuration(*graphite_write_retry_backoff)
+	if err != nil || retryBackoff <= 0 {
+		log.Fatalf("invalid graphite_write_retry_backoff %q. must be a positive duration", *graphite_write_retry_backoff)
+	}
+	filter, err := common.NewFilter(*allow_patterns, *block_patterns)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if (*forward_addr == "") != (*forward_patterns == "") {
+		log.Fatal("forward_addr and forward_patterns must be set together")
+	}
+	var forwarder *out.Forwarder
+	if *forward_addr != "" {
+		forwarder, err = out.NewForwarder(*forward_addr, *forward_patterns)
+		if err != nil {
+			log.Fatalf("invalid forward_patterns: %s", err)
+		}
+	}
+	treatAsGauge, err := common.NewFilter(*treat_as_gauge, "")
+	if err != nil {
+		log.Fatalf("invalid treat_as_gauge: %s", err)
+	}
+	rewriter, err := common.NewRewriter(*rewrite_rules)
+	if err != nil {
+		log.Fatalf("invalid rewrite_rules: %s", err)
+	}
+	routes, err := parseRoutes(*graphite_routes)
+	if err != nil {
+		log.Fatalf("invalid graphite_routes: %s", err)
+	}
+	namedBackends, err := parseBackends(*backends)
+	if err != nil {
+		log.Fatalf("invalid backends: %s", err)
+	}
+	backendRoutes, err := parseBackendRoutes(*backend_routes)
+	if err != nil {
+		log.Fatalf("invalid backend_routes: %s", err)
+	}
+	if err := statsdaemon.CheckBackendRoutes(backendRoutes, namedBackends); err != nil {
+		log.Fatalf("invalid backend_routes: %s", err)
+	}
+	maxTimersPrefixes, err := parseMaxTimersPerS(*max_timers_per_s_prefixes)
+	if err != nil {
+		log.Fatalf("invalid max_timers_per_s_prefixes: %s", err)
+	}
+	maxBuckets, err := parseMaxBuckets(*max_buckets)
+	if err != nil {
+		log.Fatalf("invalid max_buckets: %s", err)
+	}
+	if *max_buckets_policy != "reject" && *max_buckets_policy != "evict" {
+		log.Fatalf("invalid max_buckets_policy %q. must be reject or evict", *max_buckets_policy)
+	}
+	if *enforce_sample_rate && !*sample_rate_tracking {
+		log.Fatal("enforce_sample_rate needs sample_rate_tracking")
+	}
+	sampleRateWindow, err := time.ParseDuration(*sample_rate_window)
+	if err != nil || sampleRateWindow < time.Second {
+		log.Fatalf("invalid sample_rate_window %q. must be a duration of at least 1s", *sample_rate_window)
+	}
+	shutdownGrace, err := time.ParseDuration(*shutdown_grace)
+	if err != nil || shutdownGrace < 0 {
+		log.Fatalf("invalid shutdown_grace %q. must be a duration of at least 0s", *shutdown_grace)
+	}
+	if *max_udp_packet_size < 1 || *max_udp_packet_size > 65535 {
+		log.Fatal("max_udp_packet_size must be between 1 and 65535")
+	}
+	udp.MaxUdpPacketSize = *max_udp_packet_size
+	if *udp_recv_buffer < 0 {
+		log.Fatal("udp_recv_buffer must be 0 or more")
+	}
+	udp.RecvBuffer = *udp_recv_buffer
+	offset, err := flushOffset(*flush_offset, time.Duration(*flushInterval)*time.Second)
+	if err != nil {
+		log.Fatalf("invalid flush_offset: %s", err)
+	}
+	var rollup time.Duration
+	if *rollup_interval != "" {
+		rollup, err = time.ParseDuration(*rollup_interval)
+		if err != nil || rollup <= 0 || rollup%(time.Duration(*flushInterval)*time.Second) != 0 {
+			log.Fatalf("invalid rollup_interval %q. must be a multiple of the flush interval", *rollup_interval)
+		}
+	}
+	if strings.ContainsAny(*global_prefix+*global_suffix, " \t\n") {
+		log.Fatal("global_prefix and global_suffix must not contain whitespace")
+	}
+	if *timer_reservoir_size < 0 {
+		log.Fatal("timer_reservoir_size must not be negative")
+	}
+	if *timer_algorithm != "exact" && *timer_algorithm != "tdigest" {
+		log.Fatalf("invalid timer_algorithm %q. must be exact or tdigest", *timer_algorithm)
+	}
+	if *timer_algorithm == "tdigest" && *timer_reservoir_size > 0 {
+		log.Fatal("timer_reservoir_size can't be combined with timer_algorithm tdigest, which keeps no points")
+	}
+	if *timer_weighted_percentiles && (*timer_algorithm != "exact" || *percentile_method != out.PercentileNearestRank) {
+		log.Fatal("timer_weighted_percentiles needs timer_algorithm exact and percentile_method nearest_rank")
+	}
+	if *num_shards < 1 {
+		log.Fatal("num_shards must be at least 1")
+	}
+	if *overflow_policy != "block" && *overflow_policy != "drop" {
+		log.Fatalf("invalid overflow_policy %q. must be block or drop", *overflow_policy)
+	}
+	if *replay_rate < 0 {
+		log.Fatal("replay_rate must not be negative")
+	}
+	if *counter_mode != "delta" && *counter_mode != "cumulative" {
+		log.Fatalf("invalid counter_mode %q. must be delta or cumulative", *counter_mode)
+	}
+	if *max_bucket_len < 0 {
+		log.Fatal("max_bucket_len must be at least 0")
+	}
+	if *value_precision < -1 || *value_precision > 17 {
+		log.Fatal("value_precision must be between -1 and 17")
+	}
+	out.ValuePrecision = *value_precision
+	precision, ok := timestampPrecisions[*timestamp_precision]
+	if !ok {
+		log.Fatalf("invalid timestamp_precision %q. must be s, ms, us or ns", *timestamp_precision)
+	}
+	if *delete_idle_after < 1 {
+		log.Fatal("delete_idle_after must be at least 1")
+	}
 	inst := os.Expand(*instance, expand_cfg_vars)
 	if inst == "" {
 		inst = "null"
@@ -185,7 +860,7 @@ func main() {
 
 	signalchan := make(chan os.Signal, 1)
 	signal.Notify(signalchan)
-	if *profile_addr != "" {
+	if *profile_addr != "" && !*checkOnly {
 		go func() {
 			log.Info("Profiling endpoint listening on " + *profile_addr)
 			log.Info(http.ListenAndServe(*profile_addr, nil))
@@ -193,34 +868,123 @@ func main() {
 	}
 
 	formatter := out.Formatter{
-		PrefixInternal: "service_is_statsdaemon.instance_is_" + inst + ".",
+		PrefixInternal: os.Expand(*prefix_internal, func(in string) string {
+			if in == "INSTANCE" {
+				return inst
+			}
+			return expand_cfg_vars(in)
+		}),
 
 		Legacy_namespace: *legacy_namespace,
 		Prefix_counters:  *prefix_counters,
 		Prefix_gauges:    *prefix_gauges,
 		Prefix_rates:     *prefix_rates,
 		Prefix_timers:    *prefix_timers,
+		Prefix_sets:      *prefix_sets,
 
 		Prefix_m20_counters: *prefix_m20_counters,
 		Prefix_m20_gauges:   *prefix_m20_gauges,
 		Prefix_m20_rates:    *prefix_m20_rates,
 		Prefix_m20_timers:   *prefix_m20_timers,
+		Prefix_m20_sets:     *prefix_m20_sets,
 
 		Prefix_m20ne_counters: strings.Replace(*prefix_m20_counters, "=", "_is_", -1),
 		Prefix_m20ne_gauges:   strings.Replace(*prefix_m20_gauges, "=", "_is_", -1),
 		Prefix_m20ne_rates:    strings.Replace(*prefix_m20_rates, "=", "_is_", -1),
 		Prefix_m20ne_timers:   strings.Replace(*prefix_m20_timers, "=", "_is_", -1),
+		Prefix_m20ne_sets:     strings.Replace(*prefix_m20_sets, "=", "_is_", -1),
+
+		Global_prefix: *global_prefix,
+		Global_suffix: *global_suffix,
+
+		Tag_format:        *tag_format,
+		Static_tags:       staticTags,
+		Timer_stats:       timerStats,
+		Timer_histograms:  histograms,
+		Timer_percentiles: timerPercentiles,
+		Timer_scale:       *timer_scale,
+
+		Percentile_method: *percentile_method,
+		Stddev_sample:     *stddev_sample,
+		Percentile_suffix: *percentile_suffix_format,
+		Stat_separator:    statSeparator,
 	}
 
 	daemon := statsdaemon.New(inst, formatter, *flush_rates, *flush_counts, *pct, *flushInterval, MAX_UNPROCESSED_PACKETS, *max_timers_per_s, signalchan)
-	if *logLevel == "debug" {
-		consumer := make(chan interface{}, 100)
-		daemon.Invalid_lines.Register(consumer)
-		go func() {
-			for line := range consumer {
-				log.Debugf("invalid line '%s'", line)
-			}
-		}()
+	daemon.MaxSetMembers = *max_set_members
+	daemon.MaxBuckets = maxBuckets
+	daemon.MaxBucketsEvict = *max_buckets_policy == "evict"
+	daemon.TimerReservoirSize = *timer_reservoir_size
+	daemon.TimerWeightedPercentiles = *timer_weighted_percentiles
+	if *timer_algorithm == "tdigest" {
+		daemon.TimerDigestCompression = out.DigestCompression
+	}
+	daemon.GaugeDeltas = *gauge_deltas
+	daemon.SkipUnchangedGauges = !*gauge_flush_unchanged
+	daemon.GaugesPersistFile = *gauges_persist_file
+	daemon.KeepIdleCounters = keepIdle(*delete_idle_counters)
+	daemon.CumulativeCounters = *counter_mode == "cumulative"
+	daemon.KeepIdleGauges = keepIdle(*delete_idle_gauges)
+	daemon.KeepIdleTimers = keepIdle(*delete_idle_timers)
+	if *sanitize_bucket {
+		daemon.Sanitizer = common.NewSanitizer(*sanitize_chars)
+	}
+	daemon.Filter = filter
+	daemon.Rewriter = rewriter
+	daemon.Forwarder = forwarder
+	daemon.CounterAllowNegative = *counter_allow_negative
+	daemon.DefaultModifier = *default_modifier
+	daemon.StrictTypes = *strict_types
+	daemon.TreatAsGauge = treatAsGauge
+	daemon.MaxBucketLen = *max_bucket_len
+	daemon.PayloadEncoding = *payload_encoding
+	daemon.PayloadEncodingTCP = *payload_encoding_tcp
+	daemon.DisableSampleRateTracking = !*sample_rate_tracking
+	daemon.DropWhenFull = *overflow_policy == "drop"
+	daemon.ShutdownGrace = shutdownGrace
+	daemon.TimestampPrecision = precision
+	daemon.AdminToken = *admin_token
+	daemon.SampleRateWindow = sampleRateWindow
+	daemon.MaxTimersPerSPrefixes = maxTimersPrefixes
+	daemon.EnforceSampleRate = *enforce_sample_rate
+	daemon.NumReaders = *num_readers
+	daemon.NumShards = *num_shards
+	daemon.FlushOffset = offset
+	daemon.RollupInterval = rollup
+	daemon.HealthMaxIntervals = *health_max_intervals
+	daemon.ExposeTimersPrometheus = *expose_timers_prometheus
+	daemon.ExposePrometheusMetrics = *expose_prometheus_metrics
+	daemon.GraphiteRoutes = routes
+	daemon.Backends = namedBackends
+	daemon.BackendRoutes = backendRoutes
+	daemon.GraphiteOptions = backend.GraphiteOptions{
+		Pickle:         *graphite_protocol == "pickle",
+		TLS:            tlsConfig,
+		ConnectTimeout: connectTimeout,
+	}
+	daemon.GraphiteWriteTimeout = writeTimeout
+	daemon.GraphiteRetries = *graphite_write_retries
+	daemon.GraphiteRetryBackoff = retryBackoff
+	daemon.SpoolDir = *spool_dir
+	daemon.SpoolMaxBytes = *spool_max_bytes
+	daemon.DryRun = *dry_run
+	switch {
+	case *dry_run && *output_backend == "influxdb":
+		daemon.Output = backend.NewLogOutput(*influxdb_addr)
+	case *output_backend == "influxdb":
+		daemon.Output = backend.NewInfluxDBOutput(*influxdb_addr, *influxdb_db, precision)
+	}
+	// logs the invalid lines too, at debug level. see the loglevel admin command
+	daemon.SetLogLevel(log.GetLevel())
+	if *checkOnly {
+		if err := checkConfig(os.Stdout, daemon, inst); err != nil {
+			log.Fatalf("invalid config: %s", err)
+		}
+		return
+	}
+	if *replay_file != "" {
+		replay(daemon, *replay_file, *replay_rate, *graphite_addr)
+		return
 	}
-	daemon.Run(*listen_addr, *admin_addr, *graphite_addr, *prometheus_addr)
+	daemon.Run(*listen_addr, *admin_addr, *graphite_addr, *prometheus_addr, *listen_addr_tcp, *socket_path)
 }
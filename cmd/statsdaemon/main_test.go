@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon"
+	"github.com/raintank/statsdaemon/out"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	ini := filepath.Join(dir, "statsdaemon.ini")
+	err = ioutil.WriteFile(ini, []byte(`tag_format = "dotted"
+percentile_thresholds = "90"
+prefix_rates = "ini."
+prefix_counters = "ini."
+flush_counts = true
+`), 0644)
+	assert.Equal(t, nil, err)
+
+	env := map[string]string{
+		"SD_CONFIG_FILE":           ini,
+		"SD_TAG_FORMAT":            "graphite",
+		"SD_PERCENTILE_THRESHOLDS": "50,99.9",
+		"SD_PREFIX_RATES":          "env.rates.",
+		"SD_PREFIX_COUNTERS":       "env.",
+	}
+	for key, val := range env {
+		os.Setenv(key, val)
+		defer os.Unsetenv(key)
+	}
+	// the command line takes precedence over the environment
+	flag.Set("prefix_counters", "cli.")
+
+	assert.Equal(t, nil, loadConfig())
+	assert.Equal(t, "graphite", *tag_format)
+	assert.Equal(t, "50,99.9", *percentile_thresholds)
+	assert.Equal(t, "env.rates.", *prefix_rates)
+	assert.Equal(t, "cli.", *prefix_counters)
+	// only in the config file
+	assert.Equal(t, true, *flush_counts)
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	confDir := filepath.Join(dir, "statsdaemon.d")
+	assert.Equal(t, nil, os.Mkdir(confDir, 0755))
+	files := map[string]string{
+		filepath.Join(dir, "statsdaemon.ini"): `prefix_timers = "file.timers."
+prefix_gauges = "file.gauges."
+prefix_sets = "file.sets."
+prefix_m20_gauges = "file."
+`,
+		// loaded in lexical order, so 20 overrides 10, which overrides the config file
+		filepath.Join(confDir, "20-env.ini"): `prefix_gauges = 'env.gauges.'
+timer_percentiles = "api.*=99;db.*=50"
+`,
+		filepath.Join(confDir, "10-base.ini"): `prefix_gauges = "base.gauges."
+prefix_sets = "base.sets."
+prefix_m20_gauges = "base."
+`,
+		// not an ini file, so ignored
+		filepath.Join(confDir, "30-ignored.ini.bak"): `prefix_sets = "ignored."
+`,
+	}
+	for path, contents := range files {
+		assert.Equal(t, nil, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	// as if given on the command line, as loading the config of another test set them already
+	flag.Set("config_file", filepath.Join(dir, "statsdaemon.ini"))
+	flag.Set("config_dir", confDir)
+	defer flag.Set("config_dir", "")
+	os.Setenv("SD_PREFIX_M20_GAUGES", "env.")
+	defer os.Unsetenv("SD_PREFIX_M20_GAUGES")
+
+	assert.Equal(t, nil, loadConfig())
+	assert.Equal(t, "file.timers.", *prefix_timers)
+	assert.Equal(t, "env.gauges.", *prefix_gauges)
+	assert.Equal(t, "base.sets.", *prefix_sets)
+	assert.Equal(t, "api.*=99;db.*=50", *timer_percentiles)
+	// the environment takes precedence over all files
+	assert.Equal(t, "env.", *prefix_m20_gauges)
+
+	flag.Set("config_dir", filepath.Join(dir, "missing"))
+	assert.NotEqual(t, nil, loadConfig())
+}
+
+func TestCheckConfig(t *testing.T) {
+	daemon := statsdaemon.New("test", out.Formatter{}, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.GraphiteRoutes = map[string]string{"stats.timers.": "127.0.0.1:2004"}
+	var buf bytes.Buffer
+	assert.Equal(t, nil, checkConfig(&buf, daemon, "test"))
+	assert.T(t, bytes.Contains(buf.Bytes(), []byte("graphite_routes      1\n")), buf.String())
+	assert.T(t, bytes.HasSuffix(buf.Bytes(), []byte("config ok\n")), buf.String())
+
+	daemon.GraphiteRoutes = map[string]string{"stats.timers.": "127.0.0.1"}
+	assert.NotEqual(t, nil, checkConfig(&buf, daemon, "test"))
+	daemon.GraphiteRoutes = nil
+	daemon.Backends = map[string]statsdaemon.Backend{"longterm": {Type: "graphite", Addr: "no port"}}
+	assert.NotEqual(t, nil, checkConfig(&buf, daemon, "test"))
+}
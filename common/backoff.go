@@ -0,0 +1,36 @@
+package common
+
+import "time"
+
+// Backoff computes how long to wait before retrying something that keeps failing, like accepting connections:
+// Min after the first failure, twice as long after every next one, up to Max.
+// the zero value waits 5ms up to 1s, like net/http does when accepting fails.
+type Backoff struct {
+	Min, Max time.Duration
+	cur      time.Duration
+}
+
+// Next returns how long to wait after another failure
+func (b *Backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min == 0 {
+		min = 5 * time.Millisecond
+	}
+	if max == 0 {
+		max = time.Second
+	}
+	if b.cur == 0 {
+		b.cur = min
+	} else {
+		b.cur *= 2
+	}
+	if b.cur > max {
+		b.cur = max
+	}
+	return b.cur
+}
+
+// Reset starts over after a success
+func (b *Backoff) Reset() {
+	b.cur = 0
+}
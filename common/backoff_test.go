@@ -0,0 +1,25 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 3 * time.Second}
+	assert.Equal(t, time.Second, b.Next())
+	assert.Equal(t, 2*time.Second, b.Next())
+	assert.Equal(t, 3*time.Second, b.Next())
+	assert.Equal(t, 3*time.Second, b.Next())
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next())
+
+	var def Backoff
+	assert.Equal(t, 5*time.Millisecond, def.Next())
+	for i := 0; i < 20; i++ {
+		def.Next()
+	}
+	assert.Equal(t, time.Second, def.Next())
+}
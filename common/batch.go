@@ -0,0 +1,96 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBatch is the most metrics a Batch may hold to be reused. a packet usually has at most a few hundred,
+// but a 64KB one full of tiny lines has over 10000: reusing those would hand every later packet a slice
+// (and the pool a pile of metrics) sized for the worst case.
+const maxPooledBatch = 4096
+
+// metricPool holds the metrics of released batches, see NewMetric
+var metricPool sync.Pool
+
+// batchPool holds released batches, with their (emptied) Metrics slice, see NewBatch
+var batchPool sync.Pool
+
+// NewMetric returns an empty metric, one of a released Batch if there is one.
+func NewMetric() *Metric {
+	if m, ok := metricPool.Get().(*Metric); ok {
+		return m
+	}
+	return &Metric{}
+}
+
+// Batch is the metrics of a packet, whose memory is reused for later packets once every consumer is done with them:
+// the metrics themselves (see NewMetric) and the slice that holds them.
+// whoever passes the metrics (or part of them) on calls Retain first, and whoever receives them calls Release once
+// it's done with them, after which it must not touch them anymore: they may be overwritten by then.
+// that makes the metrics (or any slice holding some of them) one reference each, of the batch they're Own'ed by.
+// metrics of no batch, like those parsed from tcp, aren't reused, and Retain and Release ignore them.
+// not releasing a batch is fine, its memory is then left to the GC like any other.
+type Batch struct {
+	Metrics []*Metric
+	refs    int32 // accessed atomically
+}
+
+// NewBatch returns an empty batch, with a single reference: that of the caller, see Release.
+func NewBatch() *Batch {
+	b, ok := batchPool.Get().(*Batch)
+	if !ok {
+		b = &Batch{}
+	}
+	b.refs = 1
+	return b
+}
+
+// Own makes metrics the metrics of the batch, which must be the only ones to have them.
+// metrics is typically b.Metrics (from a previous use) with new metrics appended to it.
+func (b *Batch) Own(metrics []*Metric) {
+	for _, m := range metrics {
+		m.batch = b
+	}
+	b.Metrics = metrics
+}
+
+// Release drops a reference to the batch. once there are none left, its metrics are reused.
+func (b *Batch) Release() {
+	if atomic.AddInt32(&b.refs, -1) > 0 {
+		return
+	}
+	if cap(b.Metrics) > maxPooledBatch {
+		return
+	}
+	for i, m := range b.Metrics {
+		*m = Metric{}
+		metricPool.Put(m)
+		b.Metrics[i] = nil
+	}
+	b.Metrics = b.Metrics[:0]
+	batchPool.Put(b)
+}
+
+// batchOf returns the batch of the metrics, nil if they don't have one (or no metrics).
+// all metrics of a slice come from the same packet, so it's that of the first one.
+func batchOf(metrics []*Metric) *Batch {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return metrics[0].batch
+}
+
+// Retain adds a reference to the batch of the metrics, for passing them on. see Batch
+func Retain(metrics []*Metric) {
+	if b := batchOf(metrics); b != nil {
+		atomic.AddInt32(&b.refs, 1)
+	}
+}
+
+// Release drops the reference to the batch of the metrics that Retain added, see Batch
+func Release(metrics []*Metric) {
+	if b := batchOf(metrics); b != nil {
+		b.Release()
+	}
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBatch(t *testing.T) {
+	b := NewBatch()
+	m := NewMetric()
+	m.Bucket = "foo"
+	metrics := append(b.Metrics, m)
+	b.Own(metrics)
+
+	// passed on to two consumers
+	Retain(metrics)
+	Retain(metrics[:1])
+	b.Release()
+	Release(metrics)
+	assert.Equal(t, "foo", m.Bucket)
+	// the last one is done with them
+	Release(metrics[:1])
+	assert.Equal(t, "", m.Bucket)
+	assert.Equal(t, (*Batch)(nil), m.batch)
+
+	// metrics of no batch are left alone
+	other := []*Metric{{Bucket: "bar"}}
+	Retain(other)
+	Release(other)
+	Release(nil)
+	assert.Equal(t, "bar", other[0].Bucket)
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter decides which buckets to accept, based on allow and block patterns.
+// a nil Filter accepts everything.
+type Filter struct {
+	allow *patterns // nil means allow all
+	block *patterns // nil means block none
+}
+
+// patterns are globs, which we match ourselves because that's much faster than using regular expressions,
+// and regular expressions, which are combined into one.
+type patterns struct {
+	globs []string
+	re    *regexp.Regexp
+}
+
+// NewFilter compiles comma separated lists of patterns.
+// a pattern is either a glob, where * matches any (possibly empty) string and ? any single character,
+// and which must match the whole bucket.  or a regular expression enclosed in slashes like /^foo\.[0-9]+/,
+// which may match any part of the bucket.
+// if allow is not empty, only buckets that match one of its patterns are accepted.
+// buckets that match any of the block patterns are never accepted.
+// if both are empty, NewFilter returns nil.
+func NewFilter(allow, block string) (*Filter, error) {
+	if allow == "" && block == "" {
+		return nil, nil
+	}
+	var f Filter
+	var err error
+	f.allow, err = compilePatterns(allow)
+	if err != nil {
+		return nil, err
+	}
+	f.block, err = compilePatterns(block)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func compilePatterns(list string) (*patterns, error) {
+	var p patterns
+	var res []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+			re := pattern[1 : len(pattern)-1]
+			_, err := regexp.Compile(re)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+			}
+			res = append(res, "(?:"+re+")")
+		} else if pattern != "" {
+			p.globs = append(p.globs, pattern)
+		}
+	}
+	if len(res) > 0 {
+		p.re = regexp.MustCompile(strings.Join(res, "|"))
+	}
+	if p.globs == nil && p.re == nil {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (p *patterns) match(bucket string) bool {
+	for _, glob := range p.globs {
+		if MatchGlob(glob, bucket) {
+			return true
+		}
+	}
+	return p.re != nil && p.re.MatchString(bucket)
+}
+
+// MatchGlob returns whether the glob matches all of s. * matches any (possibly empty) string and ? any single character
+func MatchGlob(glob, s string) bool {
+	// position in glob and s to resume at when what follows the last * doesn't match
+	star, next := -1, 0
+	g, i := 0, 0
+	for i < len(s) {
+		if g < len(glob) && (glob[g] == '?' || glob[g] == s[i]) {
+			g++
+			i++
+		} else if g < len(glob) && glob[g] == '*' {
+			star, next = g, i
+			g++
+		} else if star >= 0 {
+			// let the last * match one more character
+			next++
+			g, i = star+1, next
+		} else {
+			return false
+		}
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
+
+// Accept returns whether metrics for the bucket should be accepted
+func (f *Filter) Accept(bucket string) bool {
+	if f == nil {
+		return true
+	}
+	if f.allow != nil && !f.allow.match(bucket) {
+		return false
+	}
+	return f.block == nil || !f.block.match(bucket)
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter("", "")
+	assert.Equal(t, nil, err)
+	assert.T(t, f.Accept("anything"))
+
+	f, err = NewFilter("app.*, /^web[0-9]+\\./", "app.*.debug,app.?.tmp")
+	assert.Equal(t, nil, err)
+	cases := map[string]bool{
+		"app.requests":       true,
+		"app.requests.debug": false,
+		"app.x.tmp":          false,
+		"app.xy.tmp":         true,
+		"web12.hits":         true,
+		"web.hits":           false,
+		"other.app.requests": false,
+	}
+	for bucket, exp := range cases {
+		if f.Accept(bucket) != exp {
+			t.Errorf("Accept(%q): expected %t", bucket, exp)
+		}
+	}
+
+	f, err = NewFilter("", "/req_[0-9a-f]{8}/")
+	assert.Equal(t, nil, err)
+	assert.T(t, f.Accept("app.requests"))
+	assert.T(t, !f.Accept("app.req_deadbeef.time"))
+
+	globs := []struct {
+		glob, s string
+		match   bool
+	}{
+		{"*", "", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"*.count", "foo.bar.count", true},
+		{"foo?", "foo", false},
+		{"f?o*", "fxo", true},
+	}
+	for _, c := range globs {
+		if MatchGlob(c.glob, c.s) != c.match {
+			t.Errorf("MatchGlob(%q, %q): expected %t", c.glob, c.s, c.match)
+		}
+	}
+
+	_, err = NewFilter("/[/", "")
+	assert.NotEqual(t, nil, err)
+}
@@ -1,8 +1,14 @@
 package common
 
 type Metric struct {
-	Bucket   string
-	Value    float64
-	Modifier string
-	Sampling float32
+	Bucket     string
+	Value      float64
+	Modifier   string
+	Sampling   float64
+	Member     string // only used by sets ("s" modifier), Value is not set for them
+	GaugeDelta bool   // only used by gauges: value had an explicit sign, meaning it is relative to the previous value
+	Timestamp  int64  // unix timestamp provided by the client with |T<timestamp>, if any. only used by gauges
+	Tags       map[string]string
+
+	batch *Batch // the batch whose memory this is, if any. see Batch
 }
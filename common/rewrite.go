@@ -0,0 +1,99 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rewriter renames buckets according to an ordered list of rules, e.g. to collapse ids embedded in them.
+// a nil Rewriter leaves all buckets as they are.
+type Rewriter struct {
+	rules []rewriteRule
+}
+
+type rewriteRule struct {
+	pattern  string
+	re       *regexp.Regexp
+	template string
+}
+
+// NewRewriter compiles a comma separated list of pattern=>template rules.
+// patterns are like those of NewFilter: a glob must match the whole bucket, and each of its * and ? is a
+// capture group. a regular expression between slashes may match any part of the bucket, and only the parts
+// it matches are replaced. in the template, $1 or ${1} is replaced by the first capture group, and so on.
+// if the list is empty, NewRewriter returns nil.
+func NewRewriter(list string) (*Rewriter, error) {
+	var r Rewriter
+	for _, rule := range strings.Split(list, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=>", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not of the form pattern=>template", rule)
+		}
+		pattern, template := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var expr string
+		if len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+			expr = pattern[1 : len(pattern)-1]
+		} else if pattern != "" {
+			expr = globToRegexp(pattern)
+		} else {
+			return nil, fmt.Errorf("%q has an empty pattern", rule)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+		r.rules = append(r.rules, rewriteRule{pattern, re, template})
+	}
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// globToRegexp turns a glob into an anchored regular expression, with a capture group for each * and ?
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			expr.WriteString("(.*)")
+		case '?':
+			expr.WriteString("(.)")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// Rewrite returns the new name of the bucket, according to the first rule that matches it.
+// if none match, or the new name would be empty, the bucket is returned as is.
+func (r *Rewriter) Rewrite(bucket string) string {
+	bucket, _ = r.Match(bucket)
+	return bucket
+}
+
+// Match is like Rewrite, but also returns the pattern of the rule that renamed the bucket, or "" if none did.
+func (r *Rewriter) Match(bucket string) (string, string) {
+	if r == nil {
+		return bucket, ""
+	}
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(bucket) {
+			continue
+		}
+		renamed := rule.re.ReplaceAllString(bucket, rule.template)
+		if renamed == "" {
+			return bucket, ""
+		}
+		return renamed, rule.pattern
+	}
+	return bucket, ""
+}
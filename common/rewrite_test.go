@@ -0,0 +1,43 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRewriter(t *testing.T) {
+	r, err := NewRewriter("")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "anything", r.Rewrite("anything"))
+
+	r, err = NewRewriter("api.req.*.latency=>api.req.latency, app.*.?.hits=>app.$2.${1}_hits, /\\.user_[0-9]+\\./=>.user., api.*=>api.other, drop.*=>")
+	assert.Equal(t, nil, err)
+	cases := map[string]string{
+		"api.req.0f8fad5b-d9cb-469f-a165-70867728950e.latency": "api.req.latency",
+		"api.req.latency":            "api.other", // first matching rule wins
+		"app.web.x.hits":             "app.x.web_hits",
+		"app.web.xy.hits":            "app.web.xy.hits",
+		"site.user_12.login.user_3.": "site.user.login.user.",
+		"drop.this":                  "drop.this", // would be empty
+		"other":                      "other",
+	}
+	for bucket, exp := range cases {
+		if got := r.Rewrite(bucket); got != exp {
+			t.Errorf("Rewrite(%q): expected %q, got %q", bucket, exp, got)
+		}
+	}
+	renamed, rule := r.Match("api.req.1.latency")
+	assert.Equal(t, "api.req.latency", renamed)
+	assert.Equal(t, "api.req.*.latency", rule)
+	renamed, rule = r.Match("other")
+	assert.Equal(t, "other", renamed)
+	assert.Equal(t, "", rule)
+
+	for _, bad := range []string{"foo", "=>foo", "/[/=>foo"} {
+		_, err = NewRewriter(bad)
+		if err == nil {
+			t.Errorf("NewRewriter(%q): expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import "strings"
+
+// Sanitizer cleans up buckets that graphite can't handle: it replaces the configured characters by underscores,
+// collapses repeated dots (empty path segments) and strips leading and trailing dots.
+// a nil Sanitizer leaves all buckets as they are.
+type Sanitizer struct {
+	replace [256]bool
+}
+
+// NewSanitizer returns a Sanitizer that replaces the (single byte) characters in chars by underscores
+func NewSanitizer(chars string) *Sanitizer {
+	var s Sanitizer
+	for i := 0; i < len(chars); i++ {
+		s.replace[chars[i]] = true
+	}
+	return &s
+}
+
+// Sanitize returns the cleaned up bucket. a bucket that needs no changes is returned as is.
+func (s *Sanitizer) Sanitize(bucket string) string {
+	if s == nil || s.clean(bucket) {
+		return bucket
+	}
+	var b strings.Builder
+	b.Grow(len(bucket))
+	for i := 0; i < len(bucket); i++ {
+		c := bucket[i]
+		switch {
+		case s.replace[c]:
+			b.WriteByte('_')
+		case c == '.' && (b.Len() == 0 || i == len(bucket)-1 || bucket[i+1] == '.'):
+			// of a run of dots, only the last one stays, unless it's leading or trailing
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// clean returns whether the bucket needs no changes
+func (s *Sanitizer) clean(bucket string) bool {
+	if len(bucket) > 0 && (bucket[0] == '.' || bucket[len(bucket)-1] == '.') {
+		return false
+	}
+	// the last byte is not a dot, so there's always one after a dot
+	for i := 0; i < len(bucket); i++ {
+		if s.replace[bucket[i]] || (bucket[i] == '.' && bucket[i+1] == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSanitizer(t *testing.T) {
+	var none *Sanitizer
+	assert.Equal(t, "my metric..foo.", none.Sanitize("my metric..foo."))
+
+	s := NewSanitizer(" /")
+	cases := map[string]string{
+		"my metric":          "my_metric",
+		"my  app.req time":   "my__app.req_time",
+		"app/web01/hits":     "app_web01_hits",
+		"app..hits":          "app.hits",
+		"app....hits":        "app.hits",
+		".app.hits":          "app.hits",
+		"..app.hits..":       "app.hits",
+		"my app//req..time.": "my_app__req.time",
+		"app. .hits":         "app._.hits",
+		"...":                "",
+		"":                   "",
+		"clean.name_is-fine": "clean.name_is-fine",
+	}
+	for bucket, exp := range cases {
+		if got := s.Sanitize(bucket); got != exp {
+			t.Errorf("Sanitize(%q): expected %q, got %q", bucket, exp, got)
+		}
+	}
+
+	// only the configured characters are replaced
+	assert.Equal(t, "app/web01/hits_total", NewSanitizer(" ").Sanitize("app/web01/hits total"))
+}
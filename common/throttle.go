@@ -0,0 +1,30 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle limits how often something happens, like logging the same error: at most once per Interval.
+// it is safe for concurrent use.
+type Throttle struct {
+	Interval time.Duration
+
+	sync.Mutex
+	last       time.Time
+	suppressed uint64
+}
+
+// Allow returns whether it may happen at now, and if so, how many times it was not allowed since the last time it was.
+func (t *Throttle) Allow(now time.Time) (bool, uint64) {
+	t.Lock()
+	defer t.Unlock()
+	if !t.last.IsZero() && now.Sub(t.last) < t.Interval {
+		t.suppressed++
+		return false, 0
+	}
+	t.last = now
+	suppressed := t.suppressed
+	t.suppressed = 0
+	return true, suppressed
+}
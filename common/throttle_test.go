@@ -0,0 +1,25 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	th := Throttle{Interval: 10 * time.Second}
+	start := time.Unix(1000, 0)
+	ok, suppressed := th.Allow(start)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint64(0), suppressed)
+	for i := 1; i <= 3; i++ {
+		ok, _ = th.Allow(start.Add(time.Duration(i) * time.Second))
+		assert.Equal(t, false, ok)
+	}
+	ok, suppressed = th.Allow(start.Add(10 * time.Second))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint64(3), suppressed)
+	ok, _ = th.Allow(start.Add(15 * time.Second))
+	assert.Equal(t, false, ok)
+}
@@ -12,7 +12,7 @@ func getDifferentCounters(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "count" + strconv.Itoa(i)
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "c", Sampling: sampling}
 	}
 	return metrics
@@ -24,7 +24,7 @@ func getSameCounters(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "count"
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "c", Sampling: sampling}
 	}
 	return metrics
@@ -36,7 +36,7 @@ func getDifferentGauges(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "gauge" + strconv.Itoa(i)
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "g", Sampling: sampling}
 	}
 	return metrics
@@ -48,7 +48,7 @@ func getSameGauges(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "gauge"
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "g", Sampling: sampling}
 	}
 	return metrics
@@ -60,7 +60,7 @@ func getDifferentTimers(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "timer" + strconv.Itoa(i)
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "ms", Sampling: sampling}
 	}
 	return metrics
@@ -72,7 +72,7 @@ func getSameTimers(amount int) []common.Metric {
 	for i := 0; i < amount; i++ {
 		bucket := "timer"
 		val := r.Float64()
-		sampling := r.Float32()
+		sampling := float64(r.Float32())
 		metrics[i] = common.Metric{Bucket: bucket, Value: val, Modifier: "ms", Sampling: sampling}
 	}
 	return metrics
@@ -0,0 +1,79 @@
+package statsdaemon
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// limitStats count what the bucketLimits of a type did, across shards. accessed atomically
+type limitStats struct {
+	rejected uint64 // metrics of new buckets that were not accepted
+	evicted  uint64 // buckets deleted to make room for new ones
+}
+
+// bucketLimit bounds the amount of distinct buckets of a type, see StatsDaemon.MaxBuckets.
+// it knows a bucket from its first metric until the datastructures of its type forget it for being idle,
+// and orders the buckets by when they last got data, to evict the least recently used one.
+// it's shared by the aggregators of consecutive intervals, and only used from the goroutine that adds data to them.
+type bucketLimit struct {
+	max      int
+	evict    bool
+	keepIdle int // for how many intervals without data buckets are kept, -1 means forever. see out.NewCounters etc
+	interval int // number of the current interval
+	lru      *list.List
+	buckets  map[string]*list.Element // of *limitedBucket, in lru (most recently used first)
+	stats    *limitStats
+}
+
+type limitedBucket struct {
+	name string
+	seen int // the last interval the bucket got data
+}
+
+func newBucketLimit(max int, evict bool, keepIdle int, stats *limitStats) *bucketLimit {
+	return &bucketLimit{
+		max:      max,
+		evict:    evict,
+		keepIdle: keepIdle,
+		lru:      list.New(),
+		buckets:  make(map[string]*list.Element),
+		stats:    stats,
+	}
+}
+
+// admit returns whether the bucket may get data. if it's new and the limit is reached, the least recently used
+// bucket is evicted to make room for it, if so configured, and returned. it must then be deleted by the caller.
+func (l *bucketLimit) admit(bucket string) (ok bool, evicted string) {
+	if el, ok := l.buckets[bucket]; ok {
+		el.Value.(*limitedBucket).seen = l.interval
+		l.lru.MoveToFront(el)
+		return true, ""
+	}
+	if len(l.buckets) >= l.max {
+		if !l.evict {
+			atomic.AddUint64(&l.stats.rejected, 1)
+			return false, ""
+		}
+		evicted = l.lru.Remove(l.lru.Back()).(*limitedBucket).name
+		delete(l.buckets, evicted)
+		atomic.AddUint64(&l.stats.evicted, 1)
+	}
+	l.buckets[bucket] = l.lru.PushFront(&limitedBucket{bucket, l.interval})
+	return true, evicted
+}
+
+// next marks the end of an interval, and forgets the buckets that have been idle for longer than keepIdle.
+func (l *bucketLimit) next() {
+	l.interval++
+	if l.keepIdle < 0 {
+		return
+	}
+	for el := l.lru.Back(); el != nil; el = l.lru.Back() {
+		b := el.Value.(*limitedBucket)
+		if l.interval-b.seen <= l.keepIdle {
+			return
+		}
+		l.lru.Remove(el)
+		delete(l.buckets, b.name)
+	}
+}
@@ -1,6 +1,8 @@
 package out
 
 import (
+	"math"
+
 	m20 "github.com/metrics20/go-metrics20/carbon20"
 	"github.com/raintank/statsdaemon/common"
 )
@@ -9,33 +11,153 @@ type Counters struct {
 	flushRates  bool
 	flushCounts bool
 	Values      map[string]float64
+	idle        *idleBuckets // nil if idle counters are not sent
+	stale       []string     // idle counters to send as 0
+	// running total of every counter up to the previous interval, if cumulative. like the last values of Gauges,
+	// it's carried over across intervals, and only accessed by Add, Delete and Next.
+	totals map[string]float64
+	// buckets that got an increment that's not an integer in this interval. the counts of the others are rounded to
+	// an integer when not cumulative, since extrapolating by the sample rate (e.g. 1/0.333) makes them fractional.
+	fractional map[string]struct{}
+}
+
+// NewCounters creates a new counters datastructure.
+// keepIdle is for how many intervals without data counters are still sent (as 0). -1 means forever
+// if cumulative is true, counters are not reset every interval: they're sent with their running total
+// (also as rate, which is then not divided by the interval), also while idle, until they're deleted for being idle.
+// without idle tracking (keepIdle 0), they're kept forever.
+func NewCounters(flushRates, flushCounts bool, keepIdle int, cumulative bool) *Counters {
+	c := &Counters{
+		flushRates:  flushRates,
+		flushCounts: flushCounts,
+		Values:      make(map[string]float64),
+	}
+	if keepIdle != 0 {
+		c.idle = newIdleBuckets(keepIdle)
+	}
+	if cumulative {
+		c.totals = make(map[string]float64)
+	}
+	return c
 }
 
-func NewCounters(flushRates, flushCounts bool) *Counters {
-	return &Counters{
-		flushRates,
-		flushCounts,
-		make(map[string]float64),
+// Next returns a new, empty counters datastructure for the next interval,
+// which will send the counters that are idle but should still be sent.
+func (c *Counters) Next() *Counters {
+	next := &Counters{
+		flushRates:  c.flushRates,
+		flushCounts: c.flushCounts,
+		Values:      make(map[string]float64),
+		idle:        c.idle,
+		totals:      c.totals,
+	}
+	if c.idle != nil {
+		seen := make([]string, 0, len(c.Values))
+		for key := range c.Values {
+			seen = append(seen, key)
+		}
+		next.stale = c.idle.advance(seen, func(key string) {
+			delete(c.totals, key)
+		})
 	}
+	if c.totals != nil {
+		// from now on, c has the running totals of all counters, to be sent
+		for key, val := range c.Values {
+			c.totals[key] += val
+		}
+		for key, total := range c.totals {
+			c.Values[key] = total
+		}
+	}
+	return next
 }
 
 // Add updates the counters map, adding the metric key if needed
 func (c *Counters) Add(metric *common.Metric) {
-	c.Values[metric.Bucket] += metric.Value * float64(1/metric.Sampling)
+	c.Values[metric.Bucket] += metric.Value / metric.Sampling
+	if metric.Value != math.Trunc(metric.Value) {
+		c.markFractional(metric.Bucket)
+	}
+}
+
+func (c *Counters) markFractional(bucket string) {
+	if c.fractional == nil {
+		c.fractional = make(map[string]struct{})
+	}
+	c.fractional[bucket] = struct{}{}
+}
+
+// Delete removes all data and idle state of the given counter, and returns whether there was any.
+func (c *Counters) Delete(bucket string) bool {
+	_, found := c.Values[bucket]
+	_, total := c.totals[bucket]
+	delete(c.Values, bucket)
+	delete(c.totals, bucket)
+	delete(c.fractional, bucket)
+	var stale bool
+	c.stale, stale = removeBucket(c.stale, bucket)
+	idle := c.idle.remove(bucket)
+	return found || total || stale || idle
+}
+
+// Merge adds the values and idle counters of other, e.g. from another shard, to c.
+func (c *Counters) Merge(other *Counters) {
+	for key, val := range other.Values {
+		c.Values[key] += val
+	}
+	for key := range other.fractional {
+		c.markFractional(key)
+	}
+	c.stale = append(c.stale, other.stale...)
+}
+
+// Rollup adds the counters of later, a later interval, to c, so that they're sent as one
+// (see RollupInterval of the daemon). cumulative counters have the latest total. later is not modified.
+func (c *Counters) Rollup(later *Counters) {
+	for key, val := range later.Values {
+		if c.totals != nil {
+			c.Values[key] = val
+		} else {
+			c.Values[key] += val
+		}
+	}
+	for key := range later.fractional {
+		c.markFractional(key)
+	}
+	c.stale = appendNew(c.stale, later.stale)
 }
 
 // processCounters computes the outbound metrics for counters and puts them in the buffer
 func (c *Counters) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
 	for key, val := range c.Values {
-		if c.flushCounts {
-			key := m20.Count(key, f.Prefix_counters, f.Prefix_m20_counters, f.Prefix_m20ne_counters, f.Legacy_namespace)
-			buf = WriteFloat64(buf, []byte(key), val, now)
+		buf = c.process(buf, key, val, now, interval, f)
+	}
+	num := int64(len(c.Values))
+	for _, key := range c.stale {
+		if _, ok := c.Values[key]; !ok {
+			buf = c.process(buf, key, 0, now, interval, f)
+			num++
+		}
+	}
+	return buf, num
+}
+
+func (c *Counters) process(buf []byte, key string, val float64, now int64, interval int, f Formatter) []byte {
+	if c.flushCounts {
+		name := m20.Count(key, f.Prefix_counters, f.Prefix_m20_counters, f.Prefix_m20ne_counters, f.Legacy_namespace)
+		count := val
+		if _, ok := c.fractional[key]; !ok && c.totals == nil {
+			count = math.Round(count)
 		}
+		buf = WriteFloat64(buf, f.statKey(name, f.Prefix_counters, key), count, now)
+	}
 
-		if c.flushRates {
-			key := m20.DeriveCount(key, f.Prefix_rates, f.Prefix_m20_rates, f.Prefix_m20ne_rates, f.Legacy_namespace)
-			buf = WriteFloat64(buf, []byte(key), val/float64(interval), now)
+	if c.flushRates {
+		name := m20.DeriveCount(key, f.Prefix_rates, f.Prefix_m20_rates, f.Prefix_m20ne_rates, f.Legacy_namespace)
+		if c.totals == nil {
+			val /= float64(interval)
 		}
+		buf = WriteFloat64(buf, f.statKey(name, f.Prefix_rates, key), val, now)
 	}
-	return buf, int64(len(c.Values))
+	return buf
 }
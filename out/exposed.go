@@ -0,0 +1,80 @@
+package out
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Exposed keeps the counters and gauges for the prometheus endpoint, named after PrometheusName. counters are
+// prometheus counters: the total since startup (extrapolated using the sample rate), with a _total suffix. for
+// cumulative counters that's the value they're flushed with. gauges have the last value they were flushed with.
+// like the _sum and _count of Summaries, both are kept until restart.
+// it is safe for concurrent use.
+type Exposed struct {
+	sync.Mutex
+	counters map[string]float64 // by prometheus name
+	gauges   map[string]float64 // by prometheus name
+}
+
+// NewExposed creates an empty Exposed
+func NewExposed() *Exposed {
+	return &Exposed{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// Update adds the counters and gauges of an interval that ended.
+// buckets whose names are the same after PrometheusName are combined: counters are summed,
+// and gauges get the value of one of them.
+func (e *Exposed) Update(counters *Counters, gauges *Gauges) {
+	e.Lock()
+	defer e.Unlock()
+	cumulative := make(map[string]bool)
+	for bucket, val := range counters.Values {
+		name := counterName(bucket)
+		if counters.totals == nil {
+			e.counters[name] += val
+			continue
+		}
+		// already running totals, which replace the previous ones
+		if !cumulative[name] {
+			e.counters[name] = 0
+			cumulative[name] = true
+		}
+		e.counters[name] += val
+	}
+	for bucket, val := range gauges.Values {
+		e.gauges[PrometheusName(bucket)] = val
+	}
+}
+
+// Write writes the counters and then the gauges in the prometheus text format, sorted by name
+func (e *Exposed) Write(w io.Writer) {
+	e.Lock()
+	defer e.Unlock()
+	write := func(typ string, values map[string]float64) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, values[name])
+		}
+	}
+	write("counter", e.counters)
+	write("gauge", e.gauges)
+}
+
+// counterName is the PrometheusName of a counter, which ends in _total
+func counterName(bucket string) string {
+	name := PrometheusName(bucket)
+	if !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
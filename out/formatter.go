@@ -1,5 +1,25 @@
 package out
 
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+	"github.com/raintank/statsdaemon/common"
+)
+
+const (
+	TagsNone   = "none"   // tags sent along with metrics are ignored
+	TagsDotted = "dotted" // tags are folded into the bucket using the metrics 2.0 _is_ convention
+	// tags are sent as graphite tags: name;key1=val1;key2=val2. see FoldTags and Namespace
+	TagsGraphite = "graphite"
+)
+
+// StatSeparatorNone is the Stat_separator to join buckets and their stats without anything in between
+const StatSeparatorNone = "none"
+
 type Formatter struct {
 	// prefix of statsdaemon's own metrics2.0 stats
 	PrefixInternal string
@@ -10,16 +30,226 @@ type Formatter struct {
 	Prefix_gauges    string
 	Prefix_rates     string
 	Prefix_timers    string
+	Prefix_sets      string
 
 	// formatting of metrics2.0
 	Prefix_m20_counters string
 	Prefix_m20_gauges   string
 	Prefix_m20_rates    string
 	Prefix_m20_timers   string
+	Prefix_m20_sets     string
 
 	// metrics2.0 using _is_ convention instead of =
 	Prefix_m20ne_counters string
 	Prefix_m20ne_gauges   string
 	Prefix_m20ne_rates    string
 	Prefix_m20ne_timers   string
+	Prefix_m20ne_sets     string
+
+	// how to handle tags, see the Tags* constants. empty means TagsNone
+	Tag_format string
+
+	// which timer stats to send. empty means all of them
+	Timer_stats TimerStats
+
+	// which percentiles to compute for which timers, instead of those of the Timers
+	Timer_percentiles PercentileSets
+
+	// how to compute timer percentiles, see the Percentile* constants. empty means PercentileNearestRank
+	Percentile_method string
+
+	// compute the std (and std_pct) timer stats as the sample standard deviation (dividing by n-1), rather than
+	// the population one (dividing by n)
+	Stddev_sample bool
+
+	// what joins the bucket and the stat of the legacy metrics that have one, like upper_90 in
+	// stats.timers.<bucket>.upper_90 or count in stats.sets.<bucket>.count. see statKey.
+	// empty means ".", StatSeparatorNone means nothing.
+	Stat_separator string
+
+	// how to name the percentiles in the timer stats, see the PercentileSuffix* constants. empty means PercentileSuffixUnderscore
+	Percentile_suffix string
+
+	// for which timers to send histogram buckets. empty means none
+	Timer_histograms Histograms
+
+	// multiplier for the timer stats that have the unit of the timer values (e.g. 0.001 to send seconds for
+	// timers in ms), see TimerScale
+	Timer_scale float64
+
+	// applied to all metrics sent to graphite, around all other prefixes, see Namespace
+	Global_prefix string
+	Global_suffix string
+
+	// tags added to all metrics sent to graphite (or the output backend), after the global suffix. see Namespace.
+	// they replace tags of the same key sent along with metrics, see FoldTags
+	Static_tags map[string]string
+}
+
+// ParseTags parses a comma separated list of key=value tags, e.g. for Static_tags
+func ParseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form key=value", tag)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// staticTags returns the Static_tags, sorted by key, as they should be appended to the names:
+// like graphite tags ";key1=val1;key2=val2" in graphite mode, and in the metrics 2.0 style ".key1_is_val1" otherwise.
+func (f Formatter) staticTags() []byte {
+	keys := make([]string, 0, len(f.Static_tags))
+	for key := range f.Static_tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var tags []byte
+	for _, key := range keys {
+		if f.Tag_format == TagsGraphite {
+			tags = append(tags, ";"+graphiteTagReplacer.Replace(key)+"="+graphiteTagReplacer.Replace(f.Static_tags[key])...)
+			continue
+		}
+		tags = append(tags, "."+strings.Replace(key, ".", "_", -1)+"_is_"+strings.Replace(f.Static_tags[key], ".", "_", -1)...)
+	}
+	return tags
+}
+
+// statKey returns key, which the metrics 2.0 library made for a stat of bucket with prefix, with Stat_separator:
+// for legacy metrics that's <prefix><bucket>.<stat>, which gets the separator instead of the dot. metrics 2.0 ones,
+// whose stats are tags, and legacy ones without a stat (e.g. counters with Legacy_namespace) are left as they are.
+func (f Formatter) statKey(key, prefix, bucket string) []byte {
+	if f.Stat_separator == "" || f.Stat_separator == "." || m20.GetVersion(bucket) != m20.Legacy {
+		return []byte(key)
+	}
+	base := prefix + bucket + "."
+	if !strings.HasPrefix(key, base) {
+		return []byte(key)
+	}
+	sep := f.Stat_separator
+	if sep == StatSeparatorNone {
+		sep = ""
+	}
+	stat := key[len(base):]
+	if tags := strings.IndexByte(bucket, ';'); tags >= 0 && f.Tag_format == TagsGraphite {
+		// before the tags, as Namespace can only tell where they end by a dot
+		return []byte(prefix + bucket[:tags] + sep + stat + bucket[tags:])
+	}
+	return []byte(prefix + bucket + sep + stat)
+}
+
+// TimerScale returns the multiplier for timer stats. 0 means 1, i.e. unscaled.
+func (f Formatter) TimerScale() float64 {
+	if f.Timer_scale == 0 {
+		return 1
+	}
+	return f.Timer_scale
+}
+
+// Namespace applies the global prefix and suffix to the names of the graphite lines in buf,
+// so that they become <global prefix><type prefix><bucket><global suffix>.
+// with graphite tags, it also moves the tags that FoldTags put in the bucket to the end, as graphite wants them:
+// <global prefix><type prefix><bucket><stat suffix><global suffix>;key1=val1;key2=val2
+// the static tags come last, also for statsdaemon's own metrics.
+// without a global prefix and suffix (and graphite or static tags), buf is returned as is.
+func (f Formatter) Namespace(buf []byte) []byte {
+	if f.Global_prefix == "" && f.Global_suffix == "" && f.Tag_format != TagsGraphite && len(f.Static_tags) == 0 {
+		return buf
+	}
+	static := f.staticTags()
+	lines := bytes.Count(buf, []byte("\n")) + 1
+	namespaced := make([]byte, 0, len(buf)+lines*(len(f.Global_prefix)+len(f.Global_suffix)+len(static)))
+	for len(buf) > 0 {
+		end := bytes.IndexByte(buf, '\n') + 1
+		if end == 0 {
+			end = len(buf)
+		}
+		line := buf[:end]
+		buf = buf[end:]
+		name := bytes.IndexByte(line, ' ')
+		if name < 0 {
+			namespaced = append(namespaced, line...)
+			continue
+		}
+		namespaced = append(namespaced, f.Global_prefix...)
+		if tags := bytes.IndexByte(line[:name], ';'); tags >= 0 && f.Tag_format == TagsGraphite {
+			// the tags end where the stat suffix starts, if any
+			end := tags + 1 + bytes.IndexByte(line[tags+1:name], '.')
+			if end == tags {
+				end = name
+			}
+			namespaced = append(namespaced, line[:tags]...)
+			namespaced = append(namespaced, line[end:name]...)
+			namespaced = append(namespaced, f.Global_suffix...)
+			namespaced = appendGraphiteTags(namespaced, line[tags:end])
+		} else {
+			namespaced = append(namespaced, line[:name]...)
+			namespaced = append(namespaced, f.Global_suffix...)
+		}
+		namespaced = append(namespaced, static...)
+		namespaced = append(namespaced, line[name:]...)
+	}
+	return namespaced
+}
+
+// appendGraphiteTags appends tags like ";key1:val1;key2:val2" (see FoldTags) as ";key1=val1;key2=val2"
+func appendGraphiteTags(buf, tags []byte) []byte {
+	for len(tags) > 0 {
+		end := bytes.IndexByte(tags[1:], ';') + 1
+		if end == 0 {
+			end = len(tags)
+		}
+		tag := tags[:end]
+		tags = tags[end:]
+		if sep := bytes.IndexByte(tag, ':'); sep >= 0 {
+			buf = append(buf, tag[:sep]...)
+			buf = append(buf, '=')
+			buf = append(buf, tag[sep+1:]...)
+		} else {
+			buf = append(buf, tag...)
+		}
+	}
+	return buf
+}
+
+// graphiteTagReplacer cleans up tag keys and values for graphite mode, see FoldTags
+var graphiteTagReplacer = strings.NewReplacer(".", "_", ";", "_")
+
+// FoldTags returns the metric to aggregate, taking its tags into account.
+// in dotted mode, tags are sorted by key and appended to the bucket like `bucket.key1_is_val1.key2_is_val2`,
+// so the result is a metrics 2.0 metric. dots in tag keys and values are replaced by underscores.
+// in graphite mode, they're sorted and appended like `bucket;key1:val1;key2:val2`, which Namespace turns into
+// graphite tags. (not with =, which would make it a metrics 2.0 metric) dots and semicolons in keys and values are
+// replaced by underscores, so that Namespace can tell where the tags end.
+// tags with the key of one of the Static_tags are left out, Namespace adds the static one instead.
+// the input metric is never modified, as it is shared with other consumers.
+func (f Formatter) FoldTags(metric *common.Metric) *common.Metric {
+	if len(metric.Tags) == 0 || (f.Tag_format != TagsDotted && f.Tag_format != TagsGraphite) {
+		return metric
+	}
+	keys := make([]string, 0, len(metric.Tags))
+	for key := range metric.Tags {
+		if _, ok := f.Static_tags[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	bucket := metric.Bucket
+	for _, key := range keys {
+		if f.Tag_format == TagsGraphite {
+			bucket += ";" + graphiteTagReplacer.Replace(key) + ":" + graphiteTagReplacer.Replace(metric.Tags[key])
+			continue
+		}
+		bucket += "." + strings.Replace(key, ".", "_", -1) + "_is_" + strings.Replace(metric.Tags[key], ".", "_", -1)
+	}
+	folded := *metric
+	folded.Bucket = bucket
+	return &folded
 }
@@ -0,0 +1,122 @@
+package out
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// ForwardPacketSize is the most a packet of a Forwarder holds, so that it fits in a single ethernet frame.
+// longer lines are sent in a packet by themselves.
+const ForwardPacketSize = 1432
+
+// ForwardInterval is how long, at most, a Forwarder holds on to lines before sending them
+const ForwardInterval = 100 * time.Millisecond
+
+// Forwarder relays the lines of the buckets that match its patterns, as they were received, to another statsd over
+// udp, rather than having them aggregated. lines are batched into packets of up to ForwardPacketSize. it never blocks
+// the listeners: lines it has no room for are dropped. a nil Forwarder forwards nothing.
+type Forwarder struct {
+	// must be first, for alignment on 32-bit platforms
+	Forwarded   uint64 // lines passed on to be sent. accessed atomically
+	Dropped     uint64 // lines dropped because the forwarder couldn't keep up. accessed atomically
+	WriteErrors uint64 // packets that could not be sent. accessed atomically
+
+	addr  string
+	match *common.Filter
+	lines chan []byte
+}
+
+// NewForwarder creates a Forwarder to addr of the buckets that match patterns, see common.NewFilter.
+// it doesn't send anything until Run is called.
+func NewForwarder(addr, patterns string) (*Forwarder, error) {
+	match, err := common.NewFilter(patterns, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Forwarder{
+		addr:  addr,
+		match: match,
+		lines: make(chan []byte, 1000),
+	}, nil
+}
+
+// Match returns whether the lines of bucket must be forwarded
+func (f *Forwarder) Match(bucket string) bool {
+	return f != nil && f.match != nil && f.match.Accept(bucket)
+}
+
+// Forward queues newline terminated lines (n of them) to be sent. f owns lines afterwards.
+func (f *Forwarder) Forward(lines []byte, n int) {
+	if f == nil || n == 0 {
+		return
+	}
+	select {
+	case f.lines <- lines:
+		atomic.AddUint64(&f.Forwarded, uint64(n))
+	default:
+		atomic.AddUint64(&f.Dropped, uint64(n))
+	}
+}
+
+// Run sends the forwarded lines from its own udp socket until done is closed, after which it sends what's queued
+// and returns.
+func (f *Forwarder) Run(done <-chan struct{}) error {
+	conn, err := net.Dial("udp", f.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Infof("forwarding lines to %s", f.addr)
+
+	throttle := common.Throttle{Interval: 10 * time.Second}
+	var packet []byte
+	send := func() {
+		if len(packet) == 0 {
+			return
+		}
+		// without the last newline
+		if _, err := conn.Write(packet[:len(packet)-1]); err != nil {
+			atomic.AddUint64(&f.WriteErrors, 1)
+			if ok, suppressed := throttle.Allow(time.Now()); ok {
+				log.Errorf("ERROR: forwarding to %s - %s (%d more errors not logged since the previous one)", f.addr, err, suppressed)
+			}
+		}
+		packet = packet[:0]
+	}
+	add := func(lines []byte) {
+		for len(lines) > 0 {
+			end := bytes.IndexByte(lines, '\n') + 1
+			if len(packet) > 0 && len(packet)+end-1 > ForwardPacketSize {
+				send()
+			}
+			packet = append(packet, lines[:end]...)
+			lines = lines[end:]
+		}
+	}
+
+	ticker := time.NewTicker(ForwardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case lines := <-f.lines:
+			add(lines)
+		case <-ticker.C:
+			send()
+		case <-done:
+			for {
+				select {
+				case lines := <-f.lines:
+					add(lines)
+				default:
+					send()
+					return nil
+				}
+			}
+		}
+	}
+}
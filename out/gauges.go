@@ -6,24 +6,214 @@ import (
 )
 
 type Gauges struct {
+	deltas bool
 	Values map[string]float64
+	// client provided timestamps (see common.Metric.Timestamp) of the Values that had one, to send them with
+	timestamps map[string]int64
+	// idle gauges to send with their last value
+	stale map[string]float64
+	// last known value of every gauge, carried over across intervals so deltas can be applied and idle gauges can be sent.
+	// it is only accessed by Add and Next, so it's safe to share it with the next Gauges while this one is being processed.
+	last map[string]float64
+	idle *idleBuckets
+	// if skipUnchanged, flushed has the last sent value of every gauge, and unchanged the gauges that still have it.
+	// like last, flushed is only accessed by Add and Next.
+	skipUnchanged bool
+	flushed       map[string]float64
+	unchanged     map[string]struct{}
 }
 
-func NewGauges() *Gauges {
-	return &Gauges{
-		make(map[string]float64),
+// NewGauges creates a new gauges datastructure.
+// if deltas is true, values with an explicit sign (e.g. +5 or -3) adjust the last known value
+// of the gauge rather than overwriting it.
+// keepIdle is for how many intervals without data gauges are still sent (with their last value). -1 means forever.
+// a gauge that is deleted for being idle isn't sent anymore, but its last value is kept for deltas and Last.
+// if skipUnchanged is true, gauges are only sent when their value differs from the one sent last time
+// (which also means idle gauges aren't sent). the first value of a gauge is always sent.
+func NewGauges(deltas bool, keepIdle int, skipUnchanged bool) *Gauges {
+	g := &Gauges{
+		deltas:        deltas,
+		Values:        make(map[string]float64),
+		last:          make(map[string]float64),
+		idle:          newIdleBuckets(keepIdle),
+		skipUnchanged: skipUnchanged,
 	}
+	if skipUnchanged {
+		g.flushed = make(map[string]float64)
+	}
+	return g
+}
+
+// Next returns a new, empty gauges datastructure for the next interval
+// which remembers the last known values of this one.
+func (g *Gauges) Next() *Gauges {
+	seen := make([]string, 0, len(g.Values))
+	for key, val := range g.Values {
+		seen = append(seen, key)
+		if g.skipUnchanged {
+			if prev, ok := g.flushed[key]; ok && prev == val {
+				if g.unchanged == nil {
+					g.unchanged = make(map[string]struct{})
+				}
+				g.unchanged[key] = struct{}{}
+			}
+			g.flushed[key] = val
+		}
+	}
+	// last is kept: deltas still apply to it when the gauge comes back, and Last still persists it
+	send := g.idle.advance(seen, func(key string) {
+		delete(g.flushed, key)
+	})
+	next := &Gauges{
+		deltas:        g.deltas,
+		Values:        make(map[string]float64),
+		last:          g.last,
+		idle:          g.idle,
+		skipUnchanged: g.skipUnchanged,
+		flushed:       g.flushed,
+	}
+	// idle gauges have the value that was sent already
+	if len(send) > 0 && !g.skipUnchanged {
+		next.stale = make(map[string]float64, len(send))
+		for _, key := range send {
+			next.stale[key] = g.last[key]
+		}
+	}
+	return next
 }
 
 // Add updates the gauges with the latest value for given key
+// (or, in delta mode, adjusts the last known value. which is 0 if there is none)
 func (g *Gauges) Add(metric *common.Metric) {
-	g.Values[metric.Bucket] = metric.Value
+	val := metric.Value
+	if g.deltas && metric.GaugeDelta {
+		val += g.last[metric.Bucket]
+	}
+	g.Values[metric.Bucket] = val
+	g.last[metric.Bucket] = val
+	if metric.Timestamp != 0 {
+		if g.timestamps == nil {
+			g.timestamps = make(map[string]int64)
+		}
+		g.timestamps[metric.Bucket] = metric.Timestamp
+	} else {
+		delete(g.timestamps, metric.Bucket)
+	}
+}
+
+// Delete removes the value, last known value and idle state of the given gauge, and returns whether there was any.
+func (g *Gauges) Delete(bucket string) bool {
+	_, found := g.Values[bucket]
+	_, last := g.last[bucket]
+	_, stale := g.stale[bucket]
+	delete(g.Values, bucket)
+	delete(g.timestamps, bucket)
+	delete(g.last, bucket)
+	delete(g.stale, bucket)
+	delete(g.flushed, bucket)
+	idle := g.idle.remove(bucket)
+	return found || last || stale || idle
+}
+
+// Merge adds the values and idle gauges of other, e.g. from another shard, to g.
+// last known values are not merged, so the result should only be processed.
+func (g *Gauges) Merge(other *Gauges) {
+	for key, val := range other.Values {
+		g.Values[key] = val
+	}
+	if len(other.timestamps) > 0 && g.timestamps == nil {
+		g.timestamps = make(map[string]int64, len(other.timestamps))
+	}
+	for key, ts := range other.timestamps {
+		g.timestamps[key] = ts
+	}
+	if len(other.stale) > 0 && g.stale == nil {
+		g.stale = make(map[string]float64, len(other.stale))
+	}
+	for key, val := range other.stale {
+		g.stale[key] = val
+	}
+	if len(other.unchanged) > 0 && g.unchanged == nil {
+		g.unchanged = make(map[string]struct{}, len(other.unchanged))
+	}
+	for key := range other.unchanged {
+		g.unchanged[key] = struct{}{}
+	}
 }
 
-// Process puts gauges in the outbound buffer
+// Rollup sets the values of later, a later interval, on g, so that they're sent as one with their last value
+// (see RollupInterval of the daemon). with skipUnchanged, a gauge is only skipped if it was unchanged in all of the
+// intervals it had a value in. later is not modified.
+func (g *Gauges) Rollup(later *Gauges) {
+	for key, val := range later.Values {
+		_, unchanged := later.unchanged[key]
+		_, before := g.Values[key]
+		_, unchangedBefore := g.unchanged[key]
+		if unchanged && (!before || unchangedBefore) {
+			if g.unchanged == nil {
+				g.unchanged = make(map[string]struct{})
+			}
+			g.unchanged[key] = struct{}{}
+		} else {
+			delete(g.unchanged, key)
+		}
+		if ts, ok := later.timestamps[key]; ok {
+			if g.timestamps == nil {
+				g.timestamps = make(map[string]int64)
+			}
+			g.timestamps[key] = ts
+		} else {
+			delete(g.timestamps, key)
+		}
+		g.Values[key] = val
+	}
+	if len(later.stale) > 0 && g.stale == nil {
+		g.stale = make(map[string]float64, len(later.stale))
+	}
+	for key, val := range later.stale {
+		g.stale[key] = val
+	}
+}
+
+// Last returns a copy of the last known value of every gauge
+func (g *Gauges) Last() map[string]float64 {
+	last := make(map[string]float64, len(g.last))
+	for key, val := range g.last {
+		last[key] = val
+	}
+	return last
+}
+
+// Restore sets gauges to previously known values (e.g. from before a restart),
+// so that they're sent in the upcoming flush and deltas apply to them.
+func (g *Gauges) Restore(values map[string]float64) {
+	for key, val := range values {
+		g.Values[key] = val
+		g.last[key] = val
+	}
+}
+
+// Process puts gauges in the outbound buffer.
+// with skipUnchanged, which gauges are unchanged is determined by Next, so it must be called first.
+// values that came with a timestamp are sent with it, unless it's after now. idle gauges are sent with now.
 func (g *Gauges) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
 	var num int64
 	for key, val := range g.Values {
+		if _, ok := g.unchanged[key]; ok {
+			continue
+		}
+		ts := now
+		if t, ok := g.timestamps[key]; ok && t < now {
+			ts = t
+		}
+		key = m20.Gauge(key, f.Prefix_gauges, f.Prefix_m20_gauges, f.Prefix_m20ne_gauges)
+		buf = WriteFloat64(buf, []byte(key), val, ts)
+		num++
+	}
+	for key, val := range g.stale {
+		if _, ok := g.Values[key]; ok {
+			continue
+		}
 		key = m20.Gauge(key, f.Prefix_gauges, f.Prefix_m20_gauges, f.Prefix_m20ne_gauges)
 		buf = WriteFloat64(buf, []byte(key), val, now)
 		num++
@@ -0,0 +1,72 @@
+package out
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+// histogram are the bucket boundaries for the timers matching a pattern
+type histogram struct {
+	pattern string // glob. empty matches all timers
+	bounds  []float64
+}
+
+// Histograms configures for which timers to compute cumulative histogram buckets, and with which boundaries
+type Histograms []histogram
+
+// NewHistograms parses a semicolon separated list of histogram specs.
+// each spec is a comma separated list of bucket boundaries, optionally preceded by a glob and an equals sign to
+// only apply it to the timers matching the glob, e.g. "api.*=10,50,100,500;db.*=1,5,10;100,1000"
+// timers use the first spec that matches them.
+func NewHistograms(spec string) (Histograms, error) {
+	var hs Histograms
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		var h histogram
+		if pos := strings.Index(s, "="); pos >= 0 {
+			h.pattern = strings.TrimSpace(s[:pos])
+			if h.pattern == "" {
+				return nil, fmt.Errorf("empty pattern in histogram spec %q", s)
+			}
+			s = s[pos+1:]
+		}
+		for _, b := range strings.Split(s, ",") {
+			bound, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid histogram bucket boundary %q", b)
+			}
+			h.bounds = append(h.bounds, bound)
+		}
+		sort.Float64s(h.bounds)
+		for i := 1; i < len(h.bounds); i++ {
+			if h.bounds[i] == h.bounds[i-1] {
+				return nil, fmt.Errorf("duplicate histogram bucket boundary %v", h.bounds[i])
+			}
+		}
+		hs = append(hs, h)
+	}
+	return hs, nil
+}
+
+// Bounds returns the bucket boundaries for the given timer, if any
+func (hs Histograms) Bounds(bucket string) []float64 {
+	for _, h := range hs {
+		if h.pattern == "" || common.MatchGlob(h.pattern, bucket) {
+			return h.bounds
+		}
+	}
+	return nil
+}
+
+// boundStr formats a bucket boundary for use in a metric key,
+// avoiding dots so it stays a single node. e.g. 0.5 becomes 0_5
+func boundStr(bound float64) string {
+	return strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", -1)
+}
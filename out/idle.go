@@ -0,0 +1,80 @@
+package out
+
+// idleBuckets keeps track of how many intervals buckets have gone without data.
+// it is shared by the datastructures of consecutive intervals, and only used from the goroutine that adds data to them.
+type idleBuckets struct {
+	keep int // for how many idle intervals to keep sending a bucket. -1 means forever
+	idle map[string]int
+}
+
+func newIdleBuckets(keep int) *idleBuckets {
+	return &idleBuckets{
+		keep,
+		make(map[string]int),
+	}
+}
+
+// advance marks the end of an interval during which the given buckets received data.
+// it returns the idle buckets that should still be sent during the next interval,
+// and calls forget (if not nil) for every bucket that has been idle for too long.
+func (ib *idleBuckets) advance(seen []string, forget func(bucket string)) []string {
+	for _, bucket := range seen {
+		ib.idle[bucket] = -1
+	}
+	var send []string
+	for bucket, n := range ib.idle {
+		n++
+		if ib.keep >= 0 && n > ib.keep {
+			delete(ib.idle, bucket)
+			if forget != nil {
+				forget(bucket)
+			}
+			continue
+		}
+		ib.idle[bucket] = n
+		if ib.keep < 0 || n < ib.keep {
+			send = append(send, bucket)
+		}
+	}
+	return send
+}
+
+// remove stops tracking the bucket, and returns whether it was tracked.
+// it's safe to call on a nil idleBuckets.
+func (ib *idleBuckets) remove(bucket string) bool {
+	if ib == nil {
+		return false
+	}
+	_, ok := ib.idle[bucket]
+	delete(ib.idle, bucket)
+	return ok
+}
+
+// appendNew appends the buckets of more that aren't in buckets yet, e.g. to combine the idle buckets of several
+// intervals, and returns the resulting list.
+func appendNew(buckets, more []string) []string {
+	if len(more) == 0 {
+		return buckets
+	}
+	have := make(map[string]struct{}, len(buckets)+len(more))
+	for _, b := range buckets {
+		have[b] = struct{}{}
+	}
+	for _, b := range more {
+		if _, ok := have[b]; !ok {
+			have[b] = struct{}{}
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// removeBucket removes bucket from buckets (if present), and returns the resulting list, and whether it was present.
+func removeBucket(buckets []string, bucket string) ([]string, bool) {
+	for i, b := range buckets {
+		if b == bucket {
+			return append(buckets[:i], buckets[i+1:]...), true
+		}
+	}
+	return buckets, false
+}
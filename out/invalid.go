@@ -0,0 +1,83 @@
+package out
+
+import "sync"
+
+// InvalidReasons lists why lines can be invalid, see udp.Reason
+var InvalidReasons = [...]string{
+	"no_colon",
+	"double_colon",
+	"empty_key",
+	"no_pipe",
+	"bad_modifier",
+	"bad_value",
+	"bad_sample_rate",
+	"empty_set_member",
+	"bad_tags",
+	"bad_timestamp",
+	"negative_counter",
+	"truncated",
+	"bucket_too_long",
+	"value_too_long",
+	"bad_compression",
+	"type_conflict",
+	"other",
+}
+
+// InvalidLine is an invalid line, along with why it was rejected
+type InvalidLine struct {
+	Line   []byte
+	Reason string
+}
+
+// InvalidLines keeps the most recent invalid lines in a ring buffer.
+// it is safe for concurrent use. a nil *InvalidLines discards everything.
+type InvalidLines struct {
+	sync.Mutex
+	lines []InvalidLine
+	next  int // where the next line goes
+	full  bool
+}
+
+// NewInvalidLines keeps the last size invalid lines
+func NewInvalidLines(size int) *InvalidLines {
+	return &InvalidLines{
+		lines: make([]InvalidLine, size),
+	}
+}
+
+// Add records an invalid line. the line must not be modified afterwards.
+func (il *InvalidLines) Add(line []byte, reason string) {
+	if il == nil {
+		return
+	}
+	il.Lock()
+	if len(il.lines) > 0 {
+		il.lines[il.next] = InvalidLine{line, reason}
+		il.next = (il.next + 1) % len(il.lines)
+		if il.next == 0 {
+			il.full = true
+		}
+	}
+	il.Unlock()
+}
+
+// Last returns up to n of the most recent invalid lines, oldest first
+func (il *InvalidLines) Last(n int) []InvalidLine {
+	if il == nil {
+		return nil
+	}
+	il.Lock()
+	defer il.Unlock()
+	avail := il.next
+	if il.full {
+		avail = len(il.lines)
+	}
+	if n > avail {
+		n = avail
+	}
+	last := make([]InvalidLine, n)
+	for i := range last {
+		last[i] = il.lines[(il.next-n+i+len(il.lines))%len(il.lines)]
+	}
+	return last
+}
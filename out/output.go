@@ -1,15 +1,189 @@
 package out
 
 import (
+	"io"
+	"sync"
+	"sync/atomic"
+
 	"github.com/raintank/statsdaemon/common"
 	"github.com/tv42/topic"
 )
 
+// how listeners may receive data encoded, see Output.DatagramEncoding and Output.StreamEncoding
+const (
+	EncodingPlain = "plain"
+	EncodingGzip  = "gzip"
+)
+
+// Stats are counters that listeners maintain about the data they receive. they're accessed atomically
+type Stats struct {
+	Packets      uint64 // packets (datagrams) received
+	ReadErrors   uint64 // failed reads from the socket
+	InvalidLines uint64 // lines that could not be parsed
+	Dropped      uint64 // metrics dropped because aggregation couldn't keep up, see DropWhenFull
+	KernelDrops  uint64 // packets the kernel dropped because the udp receive buffer was full. a total that listeners update periodically
+	// Rejected are the invalid lines per reason, indexed like InvalidReasons
+	Rejected [len(InvalidReasons)]uint64
+}
+
 type Output struct {
-	Metrics       chan []*common.Metric
+	// must be first, for alignment of its 64-bit fields on 32-bit platforms
+	Stats Stats
+
+	Metrics chan []*common.Metric
+	// Shards, if not empty, receive the metrics instead of Metrics. each of them gets those of the buckets it owns.
+	Shards []chan []*common.Metric
+	// MetricAmounts, if not nil, also receives all metrics, to track how often buckets are submitted
 	MetricAmounts chan []*common.Metric
 	Valid_lines   *topic.Topic
 	Invalid_lines *topic.Topic
+	// Sampler, if not nil, samples down the timers of buckets that are submitted too often, before they're
+	// aggregated. MetricAmounts still receives all of them.
+	Sampler *Sampler
+	// Forwarder, if not nil, gets the lines of the buckets it matches, which are then not aggregated (nor sanitized,
+	// filtered or rewritten)
+	Forwarder *Forwarder
+	// ValidPackets, if not nil, receives the metrics that were parsed successfully and accepted by Filter
+	ValidPackets *Tap
+	// Invalid, if not nil, keeps the most recent invalid lines and counts them by reason
+	Invalid *InvalidLines
+	// Sanitizer cleans up the buckets, before they're filtered. nil leaves them as they are.
+	Sanitizer *common.Sanitizer
+	// Filter decides which buckets are accepted. nil accepts all of them.
+	Filter *common.Filter
+	// Rewriter renames the accepted buckets. nil leaves them as they are.
+	Rewriter *common.Rewriter
+	// DropWhenFull drops metrics (and amounts) when aggregation can't keep up, rather than waiting for room in
+	// the channels, so that listeners keep reading.
+	DropWhenFull bool
+	// CounterAllowNegative accepts counters with a negative value. otherwise they're invalid lines.
+	CounterAllowNegative bool
+	// DefaultModifier is the type of lines without one (no pipe after the value, or a blank modifier), like "c".
+	// empty means such lines are invalid.
+	DefaultModifier string
+	// MaxBucketLen is the longest bucket accepted, after sanitizing. longer ones are invalid lines. 0 means no limit.
+	MaxBucketLen int
+	// DatagramEncoding is how the packets of the udp and unix socket listeners are encoded: EncodingPlain (or empty),
+	// or EncodingGzip, every packet being a gzip stream of its own.
+	DatagramEncoding string
+	// StreamEncoding is how tcp connections are encoded: EncodingPlain (or empty), or EncodingGzip, the whole
+	// connection being a single gzip stream.
+	StreamEncoding string
+	// Listening, if not nil, is called by listeners once they're ready to receive data
+	Listening func(network, addr string)
+	// Done, if not nil, stops the listeners once it's closed: they close their sockets, and return after passing on
+	// what they've read already. see Reading and Wait.
+	Done <-chan struct{}
+
+	readers sync.WaitGroup
+}
+
+// Reading registers a reader of c, which is closed once Done is. the reader must call the returned function
+// when it returns.
+func (o *Output) Reading(c io.Closer) func() {
+	o.readers.Add(1)
+	stop := make(chan struct{})
+	if o.Done != nil {
+		go func() {
+			select {
+			case <-o.Done:
+				c.Close()
+			case <-stop:
+			}
+		}()
+	}
+	return func() {
+		close(stop)
+		o.readers.Done()
+	}
+}
+
+// Stopping returns whether Done is closed, i.e. whether failing reads are due to the sockets being closed
+func (o *Output) Stopping() bool {
+	select {
+	case <-o.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits until all readers returned, see Reading
+func (o *Output) Wait() {
+	o.readers.Wait()
+}
+
+// Listen notifies that a listener is ready to receive data
+func (o *Output) Listen(network, addr string) {
+	if o.Listening != nil {
+		o.Listening(network, addr)
+	}
+}
+
+// Send passes metrics on to be aggregated: to Metrics, or split across Shards. see Sampler.
+func (o *Output) Send(metrics []*common.Metric) {
+	metrics = o.Sampler.Sample(metrics)
+	if len(metrics) == 0 {
+		return
+	}
+	if len(o.Shards) == 0 {
+		o.send(o.Metrics, metrics)
+		return
+	}
+	split := make([][]*common.Metric, len(o.Shards))
+	for _, m := range metrics {
+		i := Shard(m.Bucket, len(o.Shards))
+		split[i] = append(split[i], m)
+	}
+	for i, metrics := range split {
+		if len(metrics) > 0 {
+			o.send(o.Shards[i], metrics)
+		}
+	}
+}
+
+// send sends the metrics to ch. with DropWhenFull, they're dropped (and counted) if ch is full.
+// the receiver must common.Release them once it's done with them.
+func (o *Output) send(ch chan []*common.Metric, metrics []*common.Metric) {
+	common.Retain(metrics)
+	if !o.DropWhenFull {
+		ch <- metrics
+		return
+	}
+	select {
+	case ch <- metrics:
+	default:
+		atomic.AddUint64(&o.Stats.Dropped, uint64(len(metrics)))
+		common.Release(metrics)
+	}
+}
+
+// Track passes metrics on to MetricAmounts, unless that's nil. with DropWhenFull, they're left out if it's full.
+// the receiver must common.Release them once it's done with them.
+func (o *Output) Track(metrics []*common.Metric) {
+	if o.MetricAmounts == nil {
+		return
+	}
+	common.Retain(metrics)
+	if !o.DropWhenFull {
+		o.MetricAmounts <- metrics
+		return
+	}
+	select {
+	case o.MetricAmounts <- metrics:
+	default:
+		common.Release(metrics)
+	}
+}
+
+// Shard returns which of n shards owns the bucket, based on its FNV-1a hash
+func Shard(bucket string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(bucket); i++ {
+		h ^= uint32(bucket[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
 }
 
 func NullOutput() *Output {
@@ -21,12 +195,12 @@ func NullOutput() *Output {
 	}
 	go func() {
 		for {
-			<-output.Metrics
+			common.Release(<-output.Metrics)
 		}
 	}()
 	go func() {
 		for {
-			<-output.MetricAmounts
+			common.Release(<-output.MetricAmounts)
 		}
 	}()
 	return &output
@@ -2,8 +2,22 @@ package out
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+const (
+	PercentileNearestRank = "nearest_rank" // the point at the rounded rank (pct/100)*n
+	PercentileLinear      = "linear"       // interpolate linearly between the points around rank (pct/100)*(n-1)
+)
+
+const (
+	PercentileSuffixUnderscore = "underscore" // like etsy statsd: 90 stays 90, 99.9 becomes 99_9
+	PercentileSuffixPPrefix    = "p_prefix"   // p90, p99_9
+	PercentileSuffixRaw        = "raw"        // 90, 99.9. note that graphite treats the dot as a separator
 )
 
 type Percentiles []*Percentile
@@ -12,7 +26,13 @@ type Percentile struct {
 	str   string
 }
 
+// Set adds the percentile(s) in s (comma separated), so that Percentiles is a flag.Value
 func (a *Percentiles) Set(s string) error {
+	pctls, err := NewPercentiles(s)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, *pctls...)
 	return nil
 }
 func (p *Percentile) String() string {
@@ -22,10 +42,31 @@ func (a *Percentiles) String() string {
 	return fmt.Sprintf("%v", *a)
 }
 
+// suffix returns how the percentile is named in the stats (e.g. upper_<suffix>) in the given format,
+// see the PercentileSuffix* constants. empty means PercentileSuffixUnderscore.
+// lower percentiles lose their minus sign: their stats are named lower_<suffix> instead.
+func (p *Percentile) suffix(format string) string {
+	str := strings.TrimPrefix(p.str, "-")
+	switch format {
+	case PercentileSuffixPPrefix:
+		return "p" + str
+	case PercentileSuffixRaw:
+		return strings.Replace(str, "_", ".", -1)
+	}
+	return str
+}
+
+// NewPercentile parses a percentile like "90", "99.9", or "-10" for a lower percentile.
+// it must be between 0 and 100, exclusive.
 func NewPercentile(pctl string) (*Percentile, error) {
+	pctl = strings.TrimSpace(pctl)
 	f, err := strconv.ParseFloat(pctl, 64)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid percentile %q: not a number", pctl)
+	}
+	// this also rejects NaN
+	if !(math.Abs(f) > 0 && math.Abs(f) < 100) {
+		return nil, fmt.Errorf("invalid percentile %q: must be between 0 and 100 (or -100 and 0 for lower percentiles), exclusive", pctl)
 	}
 	return &Percentile{f, strings.Replace(pctl, ".", "_", -1)}, nil
 }
@@ -34,7 +75,7 @@ func NewPercentiles(pctls string) (*Percentiles, error) {
 	percentiles := Percentiles{}
 	pcts := strings.Split(pctls, ",")
 	for _, pct := range pcts {
-		if pct == "" {
+		if strings.TrimSpace(pct) == "" {
 			continue
 		}
 		percentile, err := NewPercentile(pct)
@@ -45,3 +86,50 @@ func NewPercentiles(pctls string) (*Percentiles, error) {
 	}
 	return &percentiles, nil
 }
+
+// percentileSet are the percentiles for the timers matching a pattern
+type percentileSet struct {
+	pattern string // glob
+	pctls   Percentiles
+}
+
+// PercentileSets configures which percentiles to compute for which timers, instead of the global ones
+type PercentileSets []percentileSet
+
+// NewPercentileSets parses a semicolon separated list of <glob>=<percentiles> specs, where the percentiles are like
+// those of NewPercentiles, e.g. "db.*=99,99.9;http.*=50,90". timers use the first spec that matches them.
+// an empty list of percentiles means none.
+func NewPercentileSets(spec string) (PercentileSets, error) {
+	var sets PercentileSets
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pos := strings.Index(s, "=")
+		if pos < 0 {
+			return nil, fmt.Errorf("percentile spec %q is not of the form <glob>=<percentiles>", s)
+		}
+		set := percentileSet{pattern: strings.TrimSpace(s[:pos])}
+		if set.pattern == "" {
+			return nil, fmt.Errorf("empty pattern in percentile spec %q", s)
+		}
+		pctls, err := NewPercentiles(s[pos+1:])
+		if err != nil {
+			return nil, err
+		}
+		set.pctls = *pctls
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// For returns the percentiles for the given timer: those of the first spec that matches it, or else fallback
+func (sets PercentileSets) For(bucket string, fallback Percentiles) Percentiles {
+	for _, set := range sets {
+		if common.MatchGlob(set.pattern, bucket) {
+			return set.pctls
+		}
+	}
+	return fallback
+}
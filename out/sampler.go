@@ -0,0 +1,69 @@
+package out
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+// Sampler enforces sample rates on timers as they come in: points of buckets that are submitted more often than
+// their budget are dropped at random, and the Sampling of the points that are kept is lowered accordingly, so
+// that the counts extrapolated from them stay right. a nil Sampler keeps all points.
+type Sampler struct {
+	// must be first, for alignment on 32-bit platforms
+	Dropped uint64 // timer points dropped. accessed atomically
+
+	rates atomic.Value // map[string]float64, the chance for a point of a bucket to be kept
+}
+
+// NewSampler creates a Sampler that keeps all points, until SetRates is called
+func NewSampler() *Sampler {
+	s := &Sampler{}
+	s.rates.Store(map[string]float64{})
+	return s
+}
+
+// SetRates replaces the rates to enforce by those of rates, the chance to keep a point per bucket.
+// buckets that aren't in it are kept entirely. rates must not be modified afterwards.
+func (s *Sampler) SetRates(rates map[string]float64) {
+	s.rates.Store(rates)
+}
+
+// Sample returns the metrics to keep. the kept points of sampled buckets are copies, so that metrics itself
+// isn't modified.
+func (s *Sampler) Sample(metrics []*common.Metric) []*common.Metric {
+	if s == nil {
+		return metrics
+	}
+	rates := s.rates.Load().(map[string]float64)
+	if len(rates) == 0 {
+		return metrics
+	}
+	// only allocated once a point is sampled, most batches contain none
+	var kept []*common.Metric
+	for i, m := range metrics {
+		rate, ok := rates[m.Bucket]
+		if !ok || m.Modifier != "ms" {
+			if kept != nil {
+				kept = append(kept, m)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = make([]*common.Metric, i, len(metrics))
+			copy(kept, metrics[:i])
+		}
+		if rand.Float64() >= rate {
+			atomic.AddUint64(&s.Dropped, 1)
+			continue
+		}
+		sampled := *m
+		sampled.Sampling *= rate
+		kept = append(kept, &sampled)
+	}
+	if kept == nil {
+		return metrics
+	}
+	return kept
+}
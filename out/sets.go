@@ -0,0 +1,60 @@
+package out
+
+import (
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+	"github.com/raintank/statsdaemon/common"
+)
+
+type Sets struct {
+	maxMembers int
+	Values     map[string]map[string]struct{}
+}
+
+// NewSets creates a new sets datastructure.
+// maxMembers bounds the amount of unique members tracked per set within one interval,
+// which bounds the memory used by very high cardinality sets. 0 means unbounded.
+func NewSets(maxMembers int) *Sets {
+	return &Sets{
+		maxMembers,
+		make(map[string]map[string]struct{}),
+	}
+}
+
+// Add records the member in the set for the given key, adding the key if needed.
+// once a set is at its max size, new members are ignored.
+func (s *Sets) Add(metric *common.Metric) {
+	members, ok := s.Values[metric.Bucket]
+	if !ok {
+		members = make(map[string]struct{})
+		s.Values[metric.Bucket] = members
+	}
+	if s.maxMembers > 0 && len(members) >= s.maxMembers {
+		return
+	}
+	members[metric.Member] = struct{}{}
+}
+
+// Delete removes the given set, and returns whether it was present.
+func (s *Sets) Delete(bucket string) bool {
+	_, found := s.Values[bucket]
+	delete(s.Values, bucket)
+	return found
+}
+
+// Merge adds the members of other, e.g. from another shard, to s.
+func (s *Sets) Merge(other *Sets) {
+	for key, members := range other.Values {
+		for member := range members {
+			s.Add(&common.Metric{Bucket: key, Member: member})
+		}
+	}
+}
+
+// Process puts the amount of unique members of each set in the outbound buffer
+func (s *Sets) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
+	for key, members := range s.Values {
+		name := m20.CountMetric(key, f.Prefix_sets, f.Prefix_m20_sets, f.Prefix_m20ne_sets)
+		buf = WriteInt64(buf, f.statKey(name, f.Prefix_sets, key), int64(len(members)), now)
+	}
+	return buf, int64(len(s.Values))
+}
@@ -0,0 +1,115 @@
+package out
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Summaries keeps the timers as prometheus summaries: the percentiles of the last flush as quantiles,
+// and the amount and sum of all points (as received, i.e. not extrapolated using the sample rate) since startup
+// as _count and _sum, so that they behave like the counters prometheus expects them to be.
+// timers that had no points in the last flush only have _count and _sum.
+// it is safe for concurrent use.
+type Summaries struct {
+	sync.Mutex
+	values map[string]*summary // by prometheus name
+}
+
+type summary struct {
+	quantiles []quantile
+	count     int64
+	sum       float64
+}
+
+type quantile struct {
+	q string
+	v float64
+}
+
+// NewSummaries creates an empty Summaries
+func NewSummaries() *Summaries {
+	return &Summaries{
+		values: make(map[string]*summary),
+	}
+}
+
+// Update adds the timers of an interval that ended, computing the quantiles of f.Timer_percentiles (or those of
+// the timers) with f.Percentile_method, scaled by f.Timer_scale. it sorts the points of the timers.
+// timers whose names are the same after PrometheusName are combined, with the quantiles of only one of them.
+func (s *Summaries) Update(timers *Timers, f Formatter) {
+	scale := f.TimerScale()
+	s.Lock()
+	defer s.Unlock()
+	for _, sum := range s.values {
+		sum.quantiles = sum.quantiles[:0]
+	}
+	for u, t := range timers.Values {
+		if t.NumPoints() == 0 {
+			continue
+		}
+		name := PrometheusName(u)
+		sum, ok := s.values[name]
+		if !ok {
+			sum = &summary{}
+			s.values[name] = sum
+		}
+		sum.count += t.added
+		sum.sum += scale * t.sum
+		if t.digest == nil {
+			t.sort()
+		}
+		sum.quantiles = sum.quantiles[:0]
+		pctls := f.Timer_percentiles.For(u, timers.pctls)
+		done := make(map[string]bool, len(pctls))
+		for _, pct := range pctls {
+			abs := pct.float
+			if abs < 0 {
+				abs = 100 + abs
+			}
+			q := strconv.FormatFloat(abs/100, 'f', -1, 64)
+			if done[q] {
+				continue
+			}
+			done[q] = true
+			sum.quantiles = append(sum.quantiles, quantile{q, scale * t.threshold(pct.float, f.Percentile_method)})
+		}
+	}
+}
+
+// Write writes the summaries in the prometheus text format, sorted by name
+func (s *Summaries) Write(w io.Writer) {
+	s.Lock()
+	defer s.Unlock()
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum := s.values[name]
+		fmt.Fprintf(w, "# TYPE %s summary\n", name)
+		for _, q := range sum.quantiles {
+			fmt.Fprintf(w, "%s{quantile=%q} %v\n", name, q.q, q.v)
+		}
+		fmt.Fprintf(w, "%s_sum %v\n%s_count %v\n", name, sum.sum, name, sum.count)
+	}
+}
+
+// PrometheusName turns a bucket into a valid prometheus metric name:
+// characters other than letters, digits, underscores and colons (e.g. dots) become underscores,
+// and it gets an underscore in front if it starts with a digit.
+func PrometheusName(bucket string) string {
+	b := []byte(bucket)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package out
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+// Tap passes copies of the metrics that the listeners parsed successfully (and that passed the filter) on to
+// registered consumers, e.g. to mirror a sample of them to another system. it never blocks the listeners: batches
+// that a consumer has no room for are dropped. a nil Tap has no consumers.
+type Tap struct {
+	// must be first, for alignment on 32-bit platforms
+	Dropped uint64 // metrics not passed on because a consumer wasn't ready. accessed atomically
+
+	active    int32 // whether there are consumers, so listeners don't lock when there are none. accessed atomically
+	lock      sync.RWMutex
+	consumers map[chan<- []common.Metric]float64 // sample rate per consumer
+}
+
+// NewTap creates a Tap without consumers
+func NewTap() *Tap {
+	return &Tap{consumers: make(map[chan<- []common.Metric]float64)}
+}
+
+// Register starts sending metrics to ch, every one with a chance of sampleRate (between 0 and 1) to be included.
+// the metrics are copies, but their Tags are not and must not be modified.
+func (t *Tap) Register(ch chan<- []common.Metric, sampleRate float64) {
+	t.lock.Lock()
+	t.consumers[ch] = sampleRate
+	atomic.StoreInt32(&t.active, 1)
+	t.lock.Unlock()
+}
+
+// Unregister stops sending metrics to ch. it doesn't close it.
+func (t *Tap) Unregister(ch chan<- []common.Metric) {
+	t.lock.Lock()
+	delete(t.consumers, ch)
+	if len(t.consumers) == 0 {
+		atomic.StoreInt32(&t.active, 0)
+	}
+	t.lock.Unlock()
+}
+
+// Active returns whether there are consumers, i.e. whether the metrics should be collected for Send
+func (t *Tap) Active() bool {
+	return t != nil && atomic.LoadInt32(&t.active) == 1
+}
+
+// Send passes a sample of the metrics on to every consumer that has room for them
+func (t *Tap) Send(metrics []*common.Metric) {
+	if !t.Active() || len(metrics) == 0 {
+		return
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for ch, rate := range t.consumers {
+		var sample []common.Metric
+		for _, m := range metrics {
+			if rate >= 1 || rand.Float64() < rate {
+				sample = append(sample, *m)
+			}
+		}
+		if len(sample) == 0 {
+			continue
+		}
+		select {
+		case ch <- sample:
+		default:
+			atomic.AddUint64(&t.Dropped, uint64(len(sample)))
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package out
+
+import (
+	"math"
+	"sort"
+)
+
+// DigestCompression is the compression of the t-digests of timers in approximate mode, see NewTimers.
+// a digest keeps at most a few times this many centroids, however many points it gets.
+const DigestCompression = 100
+
+// digest is a merging t-digest (Dunning & Ertl), which summarizes points as weighted centroids, so that
+// quantiles can be estimated in bounded memory. centroids near the tails are kept small, so the estimates
+// are most accurate there: for the percentiles people care about, like 90 or 99.
+// as long as a centroid holds a single point, it's exact.
+type digest struct {
+	compression float64
+	centroids   []centroid // sorted by mean
+	buffer      []centroid // not merged into centroids yet
+	min, max    float64
+}
+
+type centroid struct {
+	mean, weight float64
+}
+
+func newDigest(compression int) *digest {
+	return &digest{
+		compression: float64(compression),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// add adds a point
+func (d *digest) add(x float64) {
+	d.buffer = append(d.buffer, centroid{x, 1})
+	d.min = math.Min(d.min, x)
+	d.max = math.Max(d.max, x)
+	if len(d.buffer) >= 5*int(d.compression) {
+		d.compress()
+	}
+}
+
+// merge adds the points of other, which is not modified
+func (d *digest) merge(other *digest) {
+	d.buffer = append(d.buffer, other.centroids...)
+	d.buffer = append(d.buffer, other.buffer...)
+	d.min = math.Min(d.min, other.min)
+	d.max = math.Max(d.max, other.max)
+	d.compress()
+}
+
+// clone returns a copy of d that shares no memory with it
+func (d *digest) clone() *digest {
+	c := *d
+	c.centroids = append([]centroid(nil), d.centroids...)
+	c.buffer = append([]centroid(nil), d.buffer...)
+	return &c
+}
+
+// compress merges the buffer into the centroids, combining neighbouring centroids as long as
+// the k1 scale function allows it.
+func (d *digest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+	merged := make([]centroid, 0, len(all))
+	cur := all[0]
+	var done float64 // weight of the centroids before cur
+	for _, next := range all[1:] {
+		if d.k(done+cur.weight+next.weight, total)-d.k(done, total) <= 1 {
+			cur.mean += (next.mean - cur.mean) * next.weight / (cur.weight + next.weight)
+			cur.weight += next.weight
+			continue
+		}
+		merged = append(merged, cur)
+		done += cur.weight
+		cur = next
+	}
+	d.centroids = append(merged, cur)
+	d.buffer = d.buffer[:0]
+}
+
+// k is the k1 scale function, at the quantile of the given weight
+func (d *digest) k(weight, total float64) float64 {
+	q := math.Min(weight/total, 1)
+	return d.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// count returns the amount of points
+func (d *digest) count() float64 {
+	d.compress()
+	var total float64
+	for _, c := range d.centroids {
+		total += c.weight
+	}
+	return total
+}
+
+// span returns the interval the points of centroid i are assumed to be spread over, uniformly:
+// from halfway its left neighbour (or the minimum) to halfway its right neighbour (or the maximum).
+func (d *digest) span(i int) (left, right float64) {
+	left, right = d.min, d.max
+	if i > 0 {
+		left = (d.centroids[i-1].mean + d.centroids[i].mean) / 2
+	}
+	if i < len(d.centroids)-1 {
+		right = (d.centroids[i].mean + d.centroids[i+1].mean) / 2
+	}
+	return left, right
+}
+
+// quantile returns the estimated point that the quantile q (0 to 1) of the points is at or below.
+// like PercentileNearestRank, it's the point at rank q * count, rounded.
+func (d *digest) quantile(q float64) float64 {
+	d.compress()
+	target := math.Floor(q*d.count() + 0.5)
+	var cum float64
+	for i, c := range d.centroids {
+		if cum+c.weight < target && i < len(d.centroids)-1 {
+			cum += c.weight
+			continue
+		}
+		if c.weight == 1 {
+			return c.mean
+		}
+		left, right := d.span(i)
+		frac := math.Max(0, math.Min(1, (target-cum)/c.weight))
+		return left + frac*(right-left)
+	}
+	return math.NaN()
+}
+
+// below returns the estimated amount of points up to the quantile q (like quantile), and their sum and sum of squares.
+func (d *digest) below(q float64) (count, sum, sumSquares float64) {
+	d.compress()
+	target := math.Floor(q*d.count() + 0.5)
+	for i, c := range d.centroids {
+		if count+c.weight <= target {
+			count += c.weight
+			sum += c.weight * c.mean
+			sumSquares += c.weight * c.mean * c.mean
+			continue
+		}
+		// part of this centroid is included. its points are spread out uniformly over its span
+		part := target - count
+		left, right := d.span(i)
+		mid := left + part/c.weight*(right-left)/2
+		count += part
+		sum += part * mid
+		sumSquares += part * mid * mid
+		break
+	}
+	return count, sum, sumSquares
+}
+
+// atMost returns the estimated amount of points <= x
+func (d *digest) atMost(x float64) float64 {
+	d.compress()
+	var count float64
+	for i, c := range d.centroids {
+		if c.weight == 1 {
+			if c.mean <= x {
+				count++
+			}
+			continue
+		}
+		left, right := d.span(i)
+		switch {
+		case x >= right:
+			count += c.weight
+		case x > left:
+			count += c.weight * (x - left) / (right - left)
+		}
+	}
+	return count
+}
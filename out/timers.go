@@ -3,7 +3,9 @@ package out
 import (
 	"fmt"
 	"math"
+	"math/rand"
 	"sort"
+	"sync"
 
 	m20 "github.com/metrics20/go-metrics20/carbon20"
 	"github.com/raintank/statsdaemon/common"
@@ -11,21 +13,151 @@ import (
 
 type Float64Slice []float64
 
+// maxPooledPoints is the largest capacity of Points slices that Release keeps for reuse.
+// larger ones are left to the GC, so that a one-off burst doesn't pin its memory forever.
+const maxPooledPoints = 8192
+
+// pointsPool holds emptied Points slices (as *Float64Slice), see Release
+var pointsPool sync.Pool
+
 type Timers struct {
-	pctls  Percentiles
-	Values map[string]Data
+	pctls       Percentiles
+	reservoir   int
+	compression int   // of the digests, 0 if the timers keep their points
+	weighted    bool  // whether points keep their weight, see NewTimers
+	dropped     int64 // points that were not kept in the sample
+	Values      map[string]Data
+	idle        *idleBuckets // nil if idle timers are not sent
+	stale       []string     // idle timers to send with a count of 0
+}
+
+// NewTimers creates a new timers datastructure.
+// keepIdle is for how many intervals without data timers are still sent (only their count and count_ps, as 0).
+// -1 means forever
+// reservoirSize bounds the amount of points kept per timer, per interval. beyond it, a uniform random sample of the points
+// is kept (reservoir sampling), from which the percentiles etc are computed. count, sum, mean, upper and lower stay exact.
+// 0 means unbounded.
+// with a compression (like DigestCompression), points are not kept at all, but summarized in a t-digest per timer
+// (the reservoir size is ignored then), from which the percentiles, median and histograms are estimated rather than
+// computed exactly. count, sum, mean, upper, lower and std stay exact. 0 means exact computation from the points.
+// if weighted is true (and the points are kept), every point weighs 1/its sample rate in the percentiles: their
+// ranks are the cumulative weights of the points, so that e.g. a point sent with @0.1 counts as much as 10 points
+// sent with @1. the other stats are computed from the points as received.
+func NewTimers(pctls Percentiles, keepIdle, reservoirSize, compression int, weighted bool) *Timers {
+	t := &Timers{
+		pctls:       pctls,
+		reservoir:   reservoirSize,
+		compression: compression,
+		weighted:    weighted && compression == 0,
+		Values:      make(map[string]Data),
+	}
+	if keepIdle != 0 {
+		t.idle = newIdleBuckets(keepIdle)
+	}
+	return t
+}
+
+// Next returns a new, empty timers datastructure for the next interval,
+// which will send the timers that are idle but should still be sent.
+func (timers *Timers) Next() *Timers {
+	next := &Timers{
+		pctls:       timers.pctls,
+		reservoir:   timers.reservoir,
+		compression: timers.compression,
+		weighted:    timers.weighted,
+		Values:      make(map[string]Data),
+		idle:        timers.idle,
+	}
+	if timers.idle != nil {
+		seen := make([]string, 0, len(timers.Values))
+		for key := range timers.Values {
+			seen = append(seen, key)
+		}
+		next.stale = timers.idle.advance(seen, nil)
+	}
+	return next
+}
+
+// Delete removes all data and idle state of the given timer, and returns whether there was any.
+func (timers *Timers) Delete(bucket string) bool {
+	_, found := timers.Values[bucket]
+	delete(timers.Values, bucket)
+	var stale bool
+	timers.stale, stale = removeBucket(timers.stale, bucket)
+	idle := timers.idle.remove(bucket)
+	return found || stale || idle
+}
+
+// Merge adds the points (or digests) and idle timers of other, e.g. from another shard, to timers.
+// other is not modified.
+func (timers *Timers) Merge(other *Timers) {
+	for key, o := range other.Values {
+		t, ok := timers.Values[key]
+		if !ok {
+			t = Data{min: o.min, max: o.max}
+		}
+		t.Points = append(t.Points, o.Points...)
+		t.weights = append(t.weights, o.weights...)
+		if o.digest != nil {
+			if t.digest == nil {
+				t.digest = o.digest.clone()
+			} else {
+				t.digest.merge(o.digest)
+			}
+		}
+		t.Amount_submitted += o.Amount_submitted
+		t.added += o.added
+		t.sum += o.sum
+		t.sumSquares += o.sumSquares
+		t.min = math.Min(t.min, o.min)
+		t.max = math.Max(t.max, o.max)
+		timers.Values[key] = t
+	}
+	timers.dropped += other.dropped
+	timers.stale = append(timers.stale, other.stale...)
+}
+
+// Rollup adds the points (or digests) and idle timers of later, a later interval, to timers, so that they're
+// sent as one (see RollupInterval of the daemon). later is not modified.
+// the stats are computed from the points of all intervals, so they're exact, unless the points were sampled
+// (the reservoir of every interval then weighs the same, however many points it had) or summarized in digests
+// (which merge into an estimate).
+func (timers *Timers) Rollup(later *Timers) {
+	stale := timers.stale
+	timers.Merge(later)
+	timers.stale = appendNew(stale, later.stale)
 }
 
-func NewTimers(pctls Percentiles) *Timers {
-	return &Timers{
-		pctls,
-		make(map[string]Data),
+// Release hands the Points slices back for reuse by the timers of later intervals, to save allocations.
+// the timers must not be used anymore afterwards.
+func (timers *Timers) Release() {
+	for key, t := range timers.Values {
+		if cap(t.Points) <= maxPooledPoints {
+			points := t.Points[:0]
+			pointsPool.Put(&points)
+		}
+		delete(timers.Values, key)
 	}
 }
 
+// Dropped returns how many points were left out of the samples, see NewTimers
+func (timers *Timers) Dropped() int64 {
+	return timers.dropped
+}
+
 type Data struct {
-	Points           Float64Slice
-	Amount_submitted int64
+	Points Float64Slice
+	// the weight (1/sample rate) of each of the Points, if the timers are weighted. see NewTimers
+	weights Float64Slice
+	// estimate of how many points were measured, taking the sample rates into account
+	Amount_submitted float64
+
+	// of all points added, also those not in the sample
+	added                     int64
+	min, max, sum, sumSquares float64
+
+	// the points, if the timers summarize them rather than keeping them. see NewTimers
+	digest *digest
 }
 
 func (s Float64Slice) Len() int           { return len(s) }
@@ -40,11 +172,36 @@ func (t *Timers) String() string {
 func (timers *Timers) Add(metric *common.Metric) {
 	t, ok := timers.Values[metric.Bucket]
 	if !ok {
-		var p Float64Slice
-		t = Data{p, 0}
+		t = Data{min: metric.Value, max: metric.Value}
+		if timers.compression > 0 {
+			t.digest = newDigest(timers.compression)
+		} else if points, ok := pointsPool.Get().(*Float64Slice); ok {
+			t.Points = *points
+		}
 	}
-	t.Points = append(t.Points, metric.Value)
-	t.Amount_submitted += int64(1 / metric.Sampling)
+	if t.digest != nil {
+		t.digest.add(metric.Value)
+	} else if timers.reservoir > 0 && len(t.Points) >= timers.reservoir {
+		// algorithm R: every point added so far has the same chance to be in the sample
+		if i := rand.Int63n(t.added + 1); i < int64(len(t.Points)) {
+			t.Points[i] = metric.Value
+			if timers.weighted {
+				t.weights[i] = 1 / metric.Sampling
+			}
+		}
+		timers.dropped++
+	} else {
+		t.Points = append(t.Points, metric.Value)
+		if timers.weighted {
+			t.weights = append(t.weights, 1/metric.Sampling)
+		}
+	}
+	t.added++
+	t.sum += metric.Value
+	t.sumSquares += metric.Value * metric.Value
+	t.min = math.Min(t.min, metric.Value)
+	t.max = math.Max(t.max, metric.Value)
+	t.Amount_submitted += 1 / metric.Sampling
 	timers.Values[metric.Bucket] = t
 }
 
@@ -62,92 +219,457 @@ func (timers *Timers) Process(buf []byte, now int64, interval int, f Formatter)
 	// sum_90
 	// upper
 	// upper_90 / lower_90
+	// count_90  number of points (as received, i.e. not extrapolated using the samplerate) within the percentile
+	// count_ps_90 same but per second
+	// median_90 / std_90 median and standard deviation of the points within the (upper) percentile
+	// le_<bound> number of points (as received) <= bound, for histograms configured via f.Timer_histograms
+	// the stats that have the unit of the points (all but the counts) are multiplied by f.Timer_scale, and
+	// the histogram bounds are in that scaled unit too.
+	// le_inf      number of points (as received), for timers with histograms
 
 	var num int64
+	ts := f.Timer_stats
+	scale := f.TimerScale()
+	for u, t := range timers.Values {
+		if t.NumPoints() == 0 {
+			continue
+		}
+		count := int64(math.Round(t.Amount_submitted))
+		count_ps := t.Amount_submitted / float64(interval)
+		num++
+
+		bounds := f.Timer_histograms.Bounds(u)
+		pctls := f.Timer_percentiles.For(u, timers.pctls)
+		var st timerStats
+		if t.digest != nil {
+			st = t.digestStats(pctls, bounds, scale)
+		} else {
+			st = t.exactStats(pctls, f.Percentile_method, bounds, scale, ts.Has("median_pct") || ts.Has("std_pct"))
+		}
+		if f.Stddev_sample {
+			st.std = sampleStd(st.std, st.seen)
+			for i := range st.pcts {
+				st.pcts[i].std = sampleStd(st.pcts[i].std, st.pcts[i].count)
+			}
+		}
+
+		for i, pct := range pctls {
+			p := st.pcts[i]
+			pctstr := pct.suffix(f.Percentile_suffix)
+			fn := m20.Max
+			if pct.float < 0 {
+				fn = m20.Min
+			}
+			if ts.Has("upper_pct") {
+				buf = WriteFloat64(buf, f.statKey(fn(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), f.Prefix_timers, u), scale*p.threshold, now)
+			}
+			if ts.Has("mean_pct") {
+				buf = WriteFloat64(buf, f.statKey(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), f.Prefix_timers, u), scale*p.mean, now)
+			}
+			if ts.Has("sum_pct") {
+				buf = WriteFloat64(buf, f.statKey(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), f.Prefix_timers, u), scale*p.sum, now)
+			}
+			if ts.Has("count_pct") {
+				buf = WriteInt64(buf, f.statKey(pctStat(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "count", pctstr), f.Prefix_timers, u), p.count, now)
+			}
+			if ts.Has("count_ps_pct") {
+				buf = WriteFloat64(buf, f.statKey(pctStat(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "count_ps", pctstr), f.Prefix_timers, u), float64(p.count)/float64(interval), now)
+			}
+			if pct.float >= 0 && ts.Has("median_pct") {
+				buf = WriteFloat64(buf, f.statKey(m20.Median(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), f.Prefix_timers, u), scale*p.median, now)
+			}
+			if pct.float >= 0 && ts.Has("std_pct") {
+				buf = WriteFloat64(buf, f.statKey(m20.Std(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), f.Prefix_timers, u), scale*p.std, now)
+			}
+		}
+
+		if bounds != nil {
+			for i, bound := range bounds {
+				buf = WriteInt64(buf, f.statKey(pctStat(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "le", boundStr(bound)), f.Prefix_timers, u), st.le[i], now)
+			}
+			buf = WriteInt64(buf, f.statKey(pctStat(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "le", "inf"), f.Prefix_timers, u), st.seen, now)
+		}
+
+		if ts.Has("mean") {
+			buf = WriteFloat64(buf, f.statKey(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.mean, now)
+		}
+		if ts.Has("median") {
+			buf = WriteFloat64(buf, f.statKey(m20.Median(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.median, now)
+		}
+		if ts.Has("std") {
+			buf = WriteFloat64(buf, f.statKey(m20.Std(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.std, now)
+		}
+		if ts.Has("sum") {
+			buf = WriteFloat64(buf, f.statKey(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.sum, now)
+		}
+		if ts.Has("upper") {
+			buf = WriteFloat64(buf, f.statKey(m20.Max(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.max, now)
+		}
+		if ts.Has("lower") {
+			buf = WriteFloat64(buf, f.statKey(m20.Min(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), f.Prefix_timers, u), scale*st.min, now)
+		}
+		if ts.Has("count") {
+			buf = WriteInt64(buf, f.statKey(m20.CountPckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), f.Prefix_timers, u), count, now)
+		}
+		if ts.Has("count_ps") {
+			buf = WriteFloat64(buf, f.statKey(m20.RatePckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), f.Prefix_timers, u), count_ps, now)
+		}
+	}
+	for _, u := range timers.stale {
+		if _, ok := timers.Values[u]; ok {
+			continue
+		}
+		num++
+		if ts.Has("count") {
+			buf = WriteInt64(buf, f.statKey(m20.CountPckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), f.Prefix_timers, u), 0, now)
+		}
+		if ts.Has("count_ps") {
+			buf = WriteFloat64(buf, f.statKey(m20.RatePckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), f.Prefix_timers, u), 0, now)
+		}
+	}
+	return buf, num
+}
+
+// timerStats are the stats of a timer in an interval, in the unit of its points (i.e. not scaled), see Process
+type timerStats struct {
+	min, max, sum, mean, median, std float64
+
+	pcts []pctStats // for each of the percentiles of the timers
+	le   []int64    // for each of the histogram bounds, the amount of points at or below it
+	seen int64      // amount of points the stats are computed from
+}
+
+// pctStats are the stats of the points within a percentile
+type pctStats struct {
+	threshold, sum, mean, median, std float64
+	count                             int64
+}
+
+// exactStats computes the stats from the points, which it sorts. the median and standard deviation within
+// each percentile are only computed if pctMedianStd is set, because they take another pass over the points.
+// the histogram bounds are in the scaled unit.
+func (t Data) exactStats(pctls Percentiles, method string, bounds []float64, scale float64, pctMedianStd bool) timerStats {
+	seen := len(t.Points)
+	t.sort()
+	st := timerStats{
+		min:  t.Points[0],
+		max:  t.Points[seen-1],
+		seen: int64(seen),
+	}
+
+	for _, value := range t.Points {
+		st.sum += value
+	}
+	st.mean = st.sum / float64(seen)
+	if t.added > int64(seen) {
+		// only a sample was kept, but we know these of all points
+		st.min, st.max, st.sum = t.min, t.max, t.sum
+		st.mean = st.sum / float64(t.added)
+	}
+	sumOfDiffs := float64(0)
+	for _, value := range t.Points {
+		sumOfDiffs += math.Pow((float64(value) - st.mean), 2)
+	}
+	st.std = math.Sqrt(sumOfDiffs / float64(seen))
+	mid := seen / 2
+	if seen%2 == 1 {
+		st.median = t.Points[mid]
+	} else {
+		st.median = (t.Points[mid-1] + t.Points[mid]) / 2
+	}
+	cumulativeValues := make(Float64Slice, seen, seen)
+	cumulativeValues[0] = t.Points[0]
+	for i := 1; i < seen; i++ {
+		cumulativeValues[i] = t.Points[i] + cumulativeValues[i-1]
+	}
+
+	st.pcts = make([]pctStats, len(pctls))
+	for i, pct := range pctls {
+		p := pctStats{st.max, st.sum, st.mean, st.median, st.std, int64(seen)}
+		if seen > 1 {
+			var from, to int
+			from, to, p.threshold = pctRange(t.Points, t.weights, pct.float, method)
+			p.sum = cumulativeValues[to-1]
+			if from > 0 {
+				p.sum -= cumulativeValues[from-1]
+			}
+			p.count = int64(to - from)
+			p.mean = p.sum / float64(p.count)
+			if pct.float >= 0 && pctMedianStd {
+				p.median, p.std = medianStd(t.Points[from:to], p.mean)
+			}
+		}
+		st.pcts[i] = p
+	}
+
+	// cumulative, so we can just walk the sorted points once
+	j := 0
+	for _, bound := range bounds {
+		for j < seen && scale*t.Points[j] <= bound {
+			j++
+		}
+		st.le = append(st.le, int64(j))
+	}
+	return st
+}
+
+// digestStats estimates the stats from the t-digest of the points. count, sum, mean, upper, lower and std are exact.
+// the histogram bounds are in the scaled unit.
+func (t Data) digestStats(pctls Percentiles, bounds []float64, scale float64) timerStats {
+	n := float64(t.added)
+	st := timerStats{
+		min:    t.min,
+		max:    t.max,
+		sum:    t.sum,
+		mean:   t.sum / n,
+		median: t.digest.quantile(0.5),
+		seen:   t.added,
+	}
+	st.std = math.Sqrt(math.Max(0, t.sumSquares/n-st.mean*st.mean))
+
+	st.pcts = make([]pctStats, len(pctls))
+	for i, pct := range pctls {
+		var p pctStats
+		var sumSquares float64
+		if pct.float >= 0 {
+			var count float64
+			count, p.sum, sumSquares = t.digest.below(pct.float / 100)
+			p.count = int64(math.Round(count))
+			p.median = t.digest.quantile(pct.float / 200)
+		} else {
+			// the points above the complementary upper percentile
+			abs := (100 + pct.float) / 100
+			count, sum, sq := t.digest.below(abs)
+			p.count = int64(math.Round(n - count))
+			p.sum, sumSquares = t.sum-sum, t.sumSquares-sq
+		}
+		p.threshold = t.threshold(pct.float, "")
+		if p.count == 0 {
+			p = pctStats{st.min, 0, st.min, st.min, 0, 0}
+			if pct.float < 0 {
+				p = pctStats{st.max, 0, st.max, st.max, 0, 0}
+			}
+		} else {
+			c := float64(p.count)
+			p.mean = p.sum / c
+			p.std = math.Sqrt(math.Max(0, sumSquares/c-p.mean*p.mean))
+		}
+		st.pcts[i] = p
+	}
+
+	for _, bound := range bounds {
+		st.le = append(st.le, int64(math.Round(t.digest.atMost(bound/scale))))
+	}
+	return st
+}
+
+// NumPoints returns the amount of points the timer has in this interval (in its sample or digest)
+func (t Data) NumPoints() int {
+	if t.digest != nil {
+		return int(t.added)
+	}
+	return len(t.Points)
+}
+
+// threshold returns the threshold of the percentile pct (negative for a lower percentile), see pctRange.
+// the timer must have points, and they must be sorted.
+func (t Data) threshold(pct float64, method string) float64 {
+	if t.digest != nil {
+		if pct < 0 {
+			// like pctRange, the lowest point within the percentile, i.e. the one after the complementary upper one
+			return t.digest.quantile(math.Min(1, (100+pct)/100+1/float64(t.added)))
+		}
+		return t.digest.quantile(pct / 100)
+	}
+	if len(t.Points) == 1 {
+		return t.Points[0]
+	}
+	_, _, threshold := pctRange(t.Points, t.weights, pct, method)
+	return threshold
+}
+
+// sort sorts the points, along with their weights if they have them
+func (t Data) sort() {
+	if t.weights != nil {
+		sort.Sort(weightedPoints{t.Points, t.weights})
+	} else {
+		sort.Sort(t.Points)
+	}
+}
+
+// weightedPoints sorts points along with their weights
+type weightedPoints struct {
+	points, weights Float64Slice
+}
+
+func (w weightedPoints) Len() int           { return len(w.points) }
+func (w weightedPoints) Less(i, j int) bool { return w.points[i] < w.points[j] }
+func (w weightedPoints) Swap(i, j int) {
+	w.points[i], w.points[j] = w.points[j], w.points[i]
+	w.weights[i], w.weights[j] = w.weights[j], w.weights[i]
+}
+
+// sampleStd turns the (population) standard deviation std of n points into the sample standard deviation,
+// which divides by n-1 rather than n. for a single point, it's 0.
+func sampleStd(std float64, n int64) float64 {
+	if n <= 1 {
+		return 0
+	}
+	return std * math.Sqrt(float64(n)/float64(n-1))
+}
+
+// medianStd returns the median and standard deviation of the sorted points, of which mean is the mean
+func medianStd(points Float64Slice, mean float64) (median, std float64) {
+	n := len(points)
+	if n == 1 {
+		return points[0], 0
+	}
+	if n%2 == 1 {
+		median = points[n/2]
+	} else {
+		median = (points[n/2-1] + points[n/2]) / 2
+	}
+	sumOfDiffs := float64(0)
+	for _, value := range points {
+		sumOfDiffs += (value - mean) * (value - mean)
+	}
+	return median, math.Sqrt(sumOfDiffs / float64(n))
+}
+
+// pctRange returns the threshold of the percentile pct (negative for a lower percentile) of the sorted points,
+// and which of them are within it: points[from:to]. see the Percentile* constants for the methods.
+// if the points have weights, see weightedRange.
+func pctRange(points, weights Float64Slice, pct float64, method string) (from, to int, threshold float64) {
+	if weights != nil {
+		return weightedRange(points, weights, pct)
+	}
+	seen := len(points)
+	abs := pct
+	if pct < 0 {
+		abs = 100 + pct
+	}
+	if method == PercentileLinear {
+		rank := (abs / 100.0) * float64(seen-1)
+		lo := int(math.Floor(rank))
+		hi := int(math.Ceil(rank))
+		threshold = points[lo] + (rank-float64(lo))*(points[hi]-points[lo])
+		if pct >= 0 {
+			// the points up to lo are at or below the threshold
+			return 0, lo + 1, threshold
+		}
+		// the points from hi onwards are at or above the threshold
+		return hi, seen, threshold
+	}
+	// poor man's math.Round(x):
+	// math.Floor(x + 0.5)
+	indexOfPerc := int(math.Floor(((abs / 100.0) * float64(seen)) + 0.5))
+	// with few points, the rank rounds to 0 or seen: every percentile has at least one point, like weightedRange
+	if pct >= 0 {
+		if indexOfPerc < 1 {
+			indexOfPerc = 1
+		} else if indexOfPerc > seen {
+			indexOfPerc = seen
+		}
+		return 0, indexOfPerc, points[indexOfPerc-1]
+	}
+	if indexOfPerc > seen-1 {
+		indexOfPerc = seen - 1
+	} else if indexOfPerc < 0 {
+		indexOfPerc = 0
+	}
+	// the points from indexOfPerc onwards are within the (lower) percentile
+	return indexOfPerc, seen, points[indexOfPerc]
+}
+
+// weightedRange is pctRange for points that have weights, see NewTimers. like PercentileNearestRank, the points within
+// the percentile are those whose cumulative weight is nearest to pct/100 of the total weight. for equal weights,
+// that's the same as without weights.
+func weightedRange(points, weights Float64Slice, pct float64) (from, to int, threshold float64) {
+	abs := pct
+	if pct < 0 {
+		abs = 100 + pct
+	}
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	target := abs / 100 * total
+	// the amount of points up to target, rounded like pctRange does
+	n, cum := 0, float64(0)
+	for n < len(points) && cum+weights[n] <= target {
+		cum += weights[n]
+		n++
+	}
+	if n < len(points) && cum+weights[n]-target <= target-cum {
+		n++
+	}
+	if pct >= 0 {
+		if n == 0 {
+			n = 1
+		}
+		return 0, n, points[n-1]
+	}
+	if n == len(points) {
+		n--
+	}
+	return n, len(points), points[n]
+}
+
+// Snapshot returns the current stats of every timer: the estimated count (like the count stat), the amount of points,
+// lower, upper, mean, median, and per percentile (see f.Timer_percentiles) upper_<pct> (or lower_<pct>),
+// computed with f.Percentile_method. the timers are not modified.
+func (timers *Timers) Snapshot(f Formatter) map[string]map[string]float64 {
+	snapshot := make(map[string]map[string]float64, len(timers.Values))
 	for u, t := range timers.Values {
-		if len(t.Points) > 0 {
-			seen := len(t.Points)
-			count := t.Amount_submitted
-			count_ps := float64(count) / float64(interval)
-			num++
-
-			sort.Sort(t.Points)
-			min := t.Points[0]
-			max := t.Points[seen-1]
-
-			sum := float64(0)
-			for _, value := range t.Points {
-				sum += value
-			}
-			mean := float64(sum) / float64(seen)
-			sumOfDiffs := float64(0)
-			for _, value := range t.Points {
-				sumOfDiffs += math.Pow((float64(value) - mean), 2)
-			}
-			stddev := math.Sqrt(sumOfDiffs / float64(seen))
-			mid := seen / 2
-			var median float64
+		seen := t.NumPoints()
+		stats := map[string]float64{
+			"count":  math.Round(t.Amount_submitted),
+			"points": float64(seen),
+		}
+		snapshot[u] = stats
+		if seen == 0 {
+			continue
+		}
+		stats["lower"], stats["upper"] = t.min, t.max
+		stats["mean"] = t.sum / float64(t.added)
+		if t.digest != nil {
+			stats["median"] = t.digest.quantile(0.5)
+		} else {
+			points := make(Float64Slice, seen)
+			copy(points, t.Points)
+			t.Points = points
+			if t.weights != nil {
+				t.weights = append(Float64Slice(nil), t.weights...)
+			}
+			t.sort()
+			if t.added == int64(seen) {
+				stats["lower"], stats["upper"] = points[0], points[seen-1]
+			}
 			if seen%2 == 1 {
-				median = t.Points[mid]
+				stats["median"] = points[seen/2]
 			} else {
-				median = (t.Points[mid-1] + t.Points[mid]) / 2
-			}
-			var cumulativeValues Float64Slice
-			cumulativeValues = make(Float64Slice, seen, seen)
-			cumulativeValues[0] = t.Points[0]
-			for i := 1; i < seen; i++ {
-				cumulativeValues[i] = t.Points[i] + cumulativeValues[i-1]
-			}
-
-			maxAtThreshold := max
-			sum_pct := sum
-			mean_pct := mean
-
-			for _, pct := range timers.pctls {
-
-				if seen > 1 {
-					var abs float64
-					if pct.float >= 0 {
-						abs = pct.float
-					} else {
-						abs = 100 + pct.float
-					}
-					// poor man's math.Round(x):
-					// math.Floor(x + 0.5)
-					indexOfPerc := int(math.Floor(((abs / 100.0) * float64(seen)) + 0.5))
-					if pct.float >= 0 {
-						sum_pct = cumulativeValues[indexOfPerc-1]
-						maxAtThreshold = t.Points[indexOfPerc-1]
-					} else {
-						maxAtThreshold = t.Points[indexOfPerc]
-						sum_pct = cumulativeValues[seen-1] - cumulativeValues[seen-indexOfPerc-1]
-					}
-					mean_pct = float64(sum_pct) / float64(indexOfPerc)
-				}
-
-				var pctstr string
-				var fn func(metric_in, p1, p2, p2ne, percentile, timespec string) string
-				if pct.float >= 0 {
-					pctstr = pct.str
-					fn = m20.Max
-				} else {
-					pctstr = pct.str[1:]
-					fn = m20.Min
-				}
-				buf = WriteFloat64(buf, []byte(fn(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), maxAtThreshold, now)
-				buf = WriteFloat64(buf, []byte(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), mean_pct, now)
-				buf = WriteFloat64(buf, []byte(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), sum_pct, now)
-			}
-
-			buf = WriteFloat64(buf, []byte(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), mean, now)
-			buf = WriteFloat64(buf, []byte(m20.Median(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), median, now)
-			buf = WriteFloat64(buf, []byte(m20.Std(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), stddev, now)
-			buf = WriteFloat64(buf, []byte(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), sum, now)
-			buf = WriteFloat64(buf, []byte(m20.Max(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), max, now)
-			buf = WriteFloat64(buf, []byte(m20.Min(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), min, now)
-			buf = WriteInt64(buf, []byte(m20.CountPckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers)), count, now)
-			buf = WriteFloat64(buf, []byte(m20.RatePckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers)), count_ps, now)
+				stats["median"] = (points[seen/2-1] + points[seen/2]) / 2
+			}
+		}
+		for _, pct := range f.Timer_percentiles.For(u, timers.pctls) {
+			name := "upper_" + pct.str
+			if pct.float < 0 {
+				name = "lower_" + pct.str[1:]
+			}
+			stats[name] = t.threshold(pct.float, f.Percentile_method)
 		}
 	}
-	return buf, num
+	return snapshot
+}
+
+// pctStat formats the key for a per-percentile stat which the metrics20 library doesn't know about,
+// the same way the library does for e.g. upper_<pct> or mean_<pct>
+func pctStat(in, p1, p2, p2ne, stat, percentile string) string {
+	switch m20.GetVersion(in) {
+	case m20.M20:
+		return p2 + in + ".stat=" + stat + "_" + percentile
+	case m20.M20NoEquals:
+		return p2ne + in + ".stat_is_" + stat + "_" + percentile
+	}
+	return p1 + in + "." + stat + "_" + percentile
 }
@@ -0,0 +1,50 @@
+package out
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AllTimerStats lists all stats that can be computed for timers.
+// the _pct stats are computed for every percentile.
+// upper_pct covers both upper_<pct> and lower_<pct> (for negative percentiles).
+// median_pct and std_pct are only computed for upper percentiles.
+var AllTimerStats = []string{
+	"mean", "median", "std", "sum", "upper", "lower", "count", "count_ps",
+	"upper_pct", "mean_pct", "sum_pct", "count_pct", "count_ps_pct", "median_pct", "std_pct",
+}
+
+// TimerStats is a set of timer stats to send. an empty set means all stats
+type TimerStats map[string]struct{}
+
+// NewTimerStats parses a comma separated list of timer stats, and validates them
+func NewTimerStats(stats string) (TimerStats, error) {
+	ts := TimerStats{}
+	for _, stat := range strings.Split(stats, ",") {
+		stat = strings.TrimSpace(stat)
+		if stat == "" {
+			continue
+		}
+		known := false
+		for _, s := range AllTimerStats {
+			if s == stat {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown timer stat '%s'. valid stats are %s", stat, strings.Join(AllTimerStats, ","))
+		}
+		ts[stat] = struct{}{}
+	}
+	return ts, nil
+}
+
+// Has returns whether the given stat should be sent
+func (ts TimerStats) Has(stat string) bool {
+	if len(ts) == 0 {
+		return true
+	}
+	_, ok := ts[stat]
+	return ok
+}
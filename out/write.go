@@ -1,11 +1,22 @@
 package out
 
-import "strconv"
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ValuePrecision is the amount of decimals WriteFloat64 rounds values to, -1 for as many as needed to represent
+// them exactly. values that would round to 0 keep that many significant digits instead (at least 1), so they don't
+// lose all significance. trailing zeros are left out either way, so integer values never have a decimal point.
+// it must be set before anything is written.
+var ValuePrecision = -1
 
 func WriteFloat64(buf []byte, key []byte, val float64, now int64) []byte {
 	buf = append(buf, key...)
 	buf = append(buf, ' ')
-	buf = strconv.AppendFloat(buf, val, 'f', -1, 64)
+	buf = appendValue(buf, val)
 	buf = append(buf, ' ')
 	buf = strconv.AppendInt(buf, now, 10)
 	return append(buf, '\n')
@@ -19,3 +30,71 @@ func WriteInt64(buf []byte, key []byte, val, now int64) []byte {
 	buf = strconv.AppendInt(buf, now, 10)
 	return append(buf, '\n')
 }
+
+// appendValue appends val to buf, rounded to ValuePrecision
+func appendValue(buf []byte, val float64) []byte {
+	if ValuePrecision < 0 || val == 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+		return strconv.AppendFloat(buf, val, 'f', -1, 64)
+	}
+	decimals := ValuePrecision
+	if math.Abs(val) < 0.5*math.Pow(10, -float64(decimals)) {
+		// e.g. 0.0000123 with a precision of 2 is 0.000012
+		digits := decimals
+		if digits < 1 {
+			digits = 1
+		}
+		decimals = digits - 1 - int(math.Floor(math.Log10(math.Abs(val))))
+	}
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, val, 'f', decimals, 64)
+	if bytes.IndexByte(buf[start:], '.') >= 0 {
+		buf = bytes.TrimRight(buf, "0")
+		buf = bytes.TrimSuffix(buf, []byte("."))
+	}
+	return buf
+}
+
+// SubSecond returns the nanoseconds within the second of t, truncated to precision.
+// for a precision of a second or more, it returns 0.
+func SubSecond(t time.Time, precision time.Duration) int64 {
+	if precision <= 0 || precision >= time.Second {
+		return 0
+	}
+	nsec := int64(t.Nanosecond())
+	return nsec - nsec%int64(precision)
+}
+
+// SetTimestamps replaces the timestamp of every line in buf by t, as fractional seconds with as many decimals
+// as a precision of a millisecond, microsecond or nanosecond needs (e.g. 1500000000.250 for milliseconds).
+// for a precision of a second or more, buf is returned as is.
+func SetTimestamps(buf []byte, t time.Time, precision time.Duration) []byte {
+	if precision <= 0 || precision >= time.Second {
+		return buf
+	}
+	digits := 0
+	for p := precision; p < time.Second; p *= 10 {
+		digits++
+	}
+	ts := strconv.AppendInt(nil, t.Unix(), 10)
+	ts = append(ts, '.')
+	frac := strconv.AppendInt(nil, int64(time.Second/precision)+SubSecond(t, precision)/int64(precision), 10)
+	ts = append(ts, frac[len(frac)-digits:]...)
+
+	res := make([]byte, 0, len(buf)+bytes.Count(buf, []byte("\n"))*(digits+1))
+	for len(buf) > 0 {
+		end := bytes.IndexByte(buf, '\n') + 1
+		if end == 0 {
+			end = len(buf)
+		}
+		line := bytes.TrimSuffix(buf[:end], []byte("\n"))
+		buf = buf[end:]
+		if space := bytes.LastIndexByte(line, ' '); space >= 0 {
+			res = append(res, line[:space+1]...)
+			res = append(res, ts...)
+		} else {
+			res = append(res, line...)
+		}
+		res = append(res, '\n')
+	}
+	return res
+}
@@ -19,4 +19,4 @@ export CGO_ENABLED=0
 
 # Build binary
 cd $GOPATH/src/github.com/raintank/statsdaemon/cmd/statsdaemon
-go build -ldflags "-X main.GitHash=$GITVERSION" -o $BUILDDIR/statsdaemon
+go build -ldflags "-X github.com/raintank/statsdaemon.GitHash=$GITVERSION" -o $BUILDDIR/statsdaemon
@@ -0,0 +1,378 @@
+package statsdaemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
+	log "github.com/sirupsen/logrus"
+)
+
+// aggregator holds the metrics datastructures of the current interval.
+// it's only used from a single goroutine: that of metricsMonitor, or that of a shard.
+type aggregator struct {
+	s  *StatsDaemon
+	c  *out.Counters
+	g  *out.Gauges
+	t  *out.Timers
+	se *out.Sets
+
+	oneCounter, oneGauge, oneTimer, oneSet *common.Metric
+
+	types map[string]string // with StrictTypes, the type of every bucket in the interval, by its first metric
+
+	limits map[string]*bucketLimit // by type, see MaxBuckets. shared with the aggregators of later intervals
+}
+
+func (s *StatsDaemon) newAggregator(restoredGauges map[string]float64) *aggregator {
+	one := func(name string) *common.Metric {
+		return &common.Metric{
+			Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal, name),
+			Value:    1,
+			Sampling: 1,
+		}
+	}
+	a := &aggregator{
+		s:          s,
+		c:          out.NewCounters(s.flush_rates, s.flush_counts, s.KeepIdleCounters, s.CumulativeCounters),
+		g:          out.NewGauges(s.GaugeDeltas, s.KeepIdleGauges, s.SkipUnchangedGauges),
+		t:          out.NewTimers(s.pct, s.KeepIdleTimers, s.TimerReservoirSize, s.TimerDigestCompression, s.TimerWeightedPercentiles),
+		oneCounter: one("counter"),
+		oneGauge:   one("gauge"),
+		oneTimer:   one("timer"),
+		oneSet:     one("set"),
+	}
+	for typ, max := range s.MaxBuckets {
+		if max <= 0 {
+			continue
+		}
+		if s.NumShards > 1 {
+			// the buckets hash evenly over the shards
+			max = (max + s.NumShards - 1) / s.NumShards
+		}
+		if a.limits == nil {
+			a.limits = make(map[string]*bucketLimit)
+		}
+		a.limits[typ] = newBucketLimit(max, s.MaxBucketsEvict, s.keepIdle(typ), s.limitStats[typ])
+	}
+	a.g.Restore(restoredGauges)
+	a.reset()
+	return a
+}
+
+// keepIdle returns for how many intervals without data buckets of the given type are kept, -1 meaning forever
+func (s *StatsDaemon) keepIdle(typ string) int {
+	switch typ {
+	case "counter":
+		if s.CumulativeCounters && s.KeepIdleCounters == 0 {
+			return -1
+		}
+		return s.KeepIdleCounters
+	case "gauge":
+		return s.KeepIdleGauges
+	case "timer":
+		return s.KeepIdleTimers
+	}
+	// sets start over every interval
+	return 0
+}
+
+// reset starts new sets, and makes sure the internal counters are sent, even if they stay 0
+func (a *aggregator) reset() {
+	a.se = out.NewSets(a.s.MaxSetMembers)
+	if a.s.StrictTypes {
+		a.types = make(map[string]string)
+	}
+	for _, name := range []string{"timer", "gauge", "counter", "set"} {
+		a.c.Add(&common.Metric{
+			Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", a.s.fmt.PrefixInternal, name),
+			Sampling: 1,
+		})
+	}
+}
+
+// next moves on to the next interval, and returns the data of the interval that ended.
+// the returned datastructures are no longer touched by the aggregator.
+func (a *aggregator) next() *aggregator {
+	prev := *a
+	a.c = a.c.Next()
+	a.g = a.g.Next()
+	a.t = a.t.Next()
+	for _, l := range a.limits {
+		l.next()
+	}
+	a.reset()
+	return &prev
+}
+
+func (a *aggregator) add(metrics []*common.Metric) {
+	for _, m := range metrics {
+		if m.Modifier == "c" && a.s.TreatAsGauge != nil && a.s.TreatAsGauge.Accept(m.Bucket) {
+			m = asGauge(m)
+		}
+		m = a.s.fmt.FoldTags(m)
+		if a.types != nil && a.conflicts(m) {
+			continue
+		}
+		if a.limits != nil && !a.admit(m) {
+			continue
+		}
+		if m.Modifier == "ms" {
+			a.t.Add(m)
+			a.c.Add(a.oneTimer)
+		} else if m.Modifier == "g" {
+			a.g.Add(m)
+			a.c.Add(a.oneGauge)
+		} else if m.Modifier == "s" {
+			a.se.Add(m)
+			a.c.Add(a.oneSet)
+		} else {
+			a.c.Add(m)
+			a.c.Add(a.oneCounter)
+		}
+	}
+}
+
+// typeNames names the metric types by modifier. counters may have none (our own metrics)
+var typeNames = map[string]string{"": "counter", "c": "counter", "g": "gauge", "ms": "timer", "s": "set"}
+
+// conflicts returns whether m has another type than the bucket got earlier in the interval, see StrictTypes.
+// if so, it's counted as an invalid line.
+func (a *aggregator) conflicts(m *common.Metric) bool {
+	typ := typeNames[m.Modifier]
+	first, ok := a.types[m.Bucket]
+	if !ok {
+		a.types[m.Bucket] = typ
+		return false
+	}
+	if first == typ {
+		return false
+	}
+	log.Debugf("bucket %s is a %s in this interval, rejecting it as a %s", m.Bucket, first, typ)
+	value := m.Member
+	if m.Modifier != "s" {
+		value = strconv.FormatFloat(m.Value, 'f', -1, 64)
+	}
+	output := a.s.output
+	if output == nil {
+		// RunBare, without listeners
+		output = &out.Output{Invalid_lines: a.s.Invalid_lines, Invalid: a.s.invalid}
+	}
+	line := fmt.Sprintf("%s:%s|%s", m.Bucket, value, m.Modifier)
+	a.c.Add(udp.RejectLine([]byte(line), "type_conflict", a.s.fmt.PrefixInternal, output))
+	return true
+}
+
+// asGauge returns a copy of the counter m as a gauge with its value, for TreatAsGauge.
+// (m itself is shared with other consumers)
+func asGauge(m *common.Metric) *common.Metric {
+	g := *m
+	g.Modifier = "g"
+	g.Sampling = 1
+	g.GaugeDelta = false
+	return &g
+}
+
+// admit returns whether m may be aggregated, given the limit on buckets of its type (see MaxBuckets).
+// if that evicts another bucket, it's deleted. our own metrics are always accepted.
+func (a *aggregator) admit(m *common.Metric) bool {
+	typ := typeNames[m.Modifier]
+	l := a.limits[typ]
+	if l == nil || a.s.fmt.PrefixInternal != "" && strings.HasPrefix(m.Bucket, a.s.fmt.PrefixInternal) {
+		return true
+	}
+	ok, evicted := l.admit(m.Bucket)
+	if evicted != "" {
+		log.Debugf("evicted %s %s to make room for %s", typ, evicted, m.Bucket)
+		deleteFrom(typ, evicted, a.c, a.g, a.t, a.se)
+	}
+	return ok
+}
+
+// rollup adds the data of later, that of a later interval, to a. see RollupInterval
+func (a *aggregator) rollup(later *aggregator) {
+	a.c.Rollup(later.c)
+	a.g.Rollup(later.g)
+	a.t.Rollup(later.t)
+	a.se.Merge(later.se)
+}
+
+// merge adds the data of other to a
+func (a *aggregator) merge(other *aggregator) {
+	a.c.Merge(other.c)
+	a.g.Merge(other.g)
+	a.t.Merge(other.t)
+	a.se.Merge(other.se)
+}
+
+// mapSizes are the amount of metrics of each type
+type mapSizes struct {
+	counters, gauges, timers, sets int
+}
+
+func (m *mapSizes) add(other mapSizes) {
+	m.counters += other.counters
+	m.gauges += other.gauges
+	m.timers += other.timers
+	m.sets += other.sets
+}
+
+func (a *aggregator) sizes() mapSizes {
+	return mapSizes{len(a.c.Values), len(a.g.Values), len(a.t.Values), len(a.se.Values)}
+}
+
+// shard aggregates the metrics of the buckets it owns (see out.Shard), in its own goroutine.
+// statsdaemon's own counters are tracked by every shard, and summed when merging.
+type shard struct {
+	metrics  chan []*common.Metric
+	requests chan func(a *aggregator)
+}
+
+func (sh *shard) run(a *aggregator) {
+	for {
+		select {
+		case metrics := <-sh.metrics:
+			a.add(metrics)
+			common.Release(metrics)
+		case req := <-sh.requests:
+			// first aggregate what has been queued already, so a flush includes it
+			for len(sh.metrics) > 0 {
+				metrics := <-sh.metrics
+				a.add(metrics)
+				common.Release(metrics)
+			}
+			req(a)
+		}
+	}
+}
+
+// startShards starts NumShards shards, if there should be more than one.
+// the restored gauges are passed on to the shards that own them.
+func (s *StatsDaemon) startShards() {
+	if s.NumShards <= 1 {
+		return
+	}
+	restored := make([]map[string]float64, s.NumShards)
+	for key, val := range s.restoredGauges {
+		i := out.Shard(key, s.NumShards)
+		if restored[i] == nil {
+			restored[i] = make(map[string]float64)
+		}
+		restored[i][key] = val
+	}
+	s.restoredGauges = nil
+	s.shards = make([]*shard, s.NumShards)
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			metrics:  make(chan []*common.Metric, s.max_unprocessed),
+			requests: make(chan func(a *aggregator)),
+		}
+		go s.shards[i].run(s.newAggregator(restored[i]))
+	}
+}
+
+// shardChannels returns the channels to send the metrics of each shard to
+func (s *StatsDaemon) shardChannels() []chan []*common.Metric {
+	var chans []chan []*common.Metric
+	for _, sh := range s.shards {
+		chans = append(chans, sh.metrics)
+	}
+	return chans
+}
+
+// queueLength returns how many batches of metrics are waiting to be aggregated, including those queued for the shards
+func (s *StatsDaemon) queueLength() int {
+	n := len(s.Metrics)
+	for _, sh := range s.shards {
+		n += len(sh.metrics)
+	}
+	return n
+}
+
+// queueCapacity returns how many batches of metrics can be queued, see queueLength
+func (s *StatsDaemon) queueCapacity() int {
+	n := cap(s.Metrics)
+	for _, sh := range s.shards {
+		n += cap(sh.metrics)
+	}
+	return n
+}
+
+// onShards runs fn for every shard, in the goroutine of the shard, and waits until they're all done.
+func (s *StatsDaemon) onShards(fn func(i int, a *aggregator)) {
+	var wg sync.WaitGroup
+	wg.Add(len(s.shards))
+	for i, sh := range s.shards {
+		i := i
+		sh.requests <- func(a *aggregator) {
+			fn(i, a)
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
+
+// nextShards moves all shards on to the next interval, and returns the data of the interval that ended, per shard.
+// if gauges is true, it also returns the last known values of all gauges.
+func (s *StatsDaemon) nextShards(gauges bool) ([]*aggregator, map[string]float64) {
+	prev := make([]*aggregator, len(s.shards))
+	last := make([]map[string]float64, len(s.shards))
+	s.onShards(func(i int, a *aggregator) {
+		if gauges {
+			last[i] = a.g.Last()
+		}
+		prev[i] = a.next()
+	})
+	var merged map[string]float64
+	if gauges {
+		merged = make(map[string]float64)
+		for _, l := range last {
+			for key, val := range l {
+				merged[key] = val
+			}
+		}
+	}
+	return prev, merged
+}
+
+// mergeShards combines the data of the interval that ended of all shards into the first one.
+func mergeShards(prev []*aggregator) *aggregator {
+	for _, a := range prev[1:] {
+		prev[0].merge(a)
+		a.t.Release()
+	}
+	return prev[0]
+}
+
+// rollupShards merges the data of consecutive intervals, oldest first, each of them per shard like for mergeShards,
+// into that of the first one. see RollupInterval
+func rollupShards(intervals [][]*aggregator) *aggregator {
+	cur := mergeShards(intervals[0])
+	for _, prev := range intervals[1:] {
+		later := mergeShards(prev)
+		cur.rollup(later)
+		later.t.Release()
+	}
+	return cur
+}
+
+// snapshotShards returns a copy of the current data of all shards
+func (s *StatsDaemon) snapshotShards() *aggregator {
+	snapshot := &aggregator{
+		c:  out.NewCounters(s.flush_rates, s.flush_counts, 0, false),
+		g:  out.NewGauges(s.GaugeDeltas, 0, false),
+		t:  out.NewTimers(s.pct, 0, 0, 0, false),
+		se: out.NewSets(0),
+	}
+	var lock sync.Mutex
+	s.onShards(func(i int, a *aggregator) {
+		lock.Lock()
+		snapshot.merge(a)
+		lock.Unlock()
+	})
+	return snapshot
+}
@@ -1,32 +1,61 @@
 package statsdaemon
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"net/http"
+
 	"github.com/benbjohnson/clock"
+	"github.com/raintank/statsdaemon/backend"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/tcp"
 	"github.com/raintank/statsdaemon/ticker"
 	"github.com/raintank/statsdaemon/udp"
 	log "github.com/sirupsen/logrus"
 	"github.com/tv42/topic"
 )
 
+// Version is the version of statsdaemon, and GitHash the commit it was built from, which the build sets
+// with -ldflags "-X github.com/raintank/statsdaemon.GitHash=...". see BuildInfo
+var (
+	Version = "0.6"
+	GitHash = "(none)"
+)
+
+// BuildInfo describes the build: its Version, the go version it was built with, and its GitHash.
+// it's what -version prints and the version admin command returns.
+func BuildInfo() string {
+	return fmt.Sprintf("statsdaemon v%s (built w/%s, git hash %s)", Version, runtime.Version(), GitHash)
+}
+
+// invalidLinesKept is how many of the most recent invalid lines are kept, for tail_invalid
+const invalidLinesKept = 100
+
 type metricsStatsReq struct {
 	Command []string
 	Conn    *net.Conn
 }
 
-type SubmitFunc func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time)
+// SubmitFunc flushes the data of an interval. deadline is when the next flush is due: a flush interval after the
+// time this one was meant to happen.
+type SubmitFunc func(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, deadline time.Time)
 type StatsDaemon struct {
 	instance string
 
@@ -40,22 +69,187 @@ type StatsDaemon struct {
 	debug            bool
 	signalchan       chan os.Signal
 
+	// TimerReservoirSize bounds the amount of points kept per timer per interval, by sampling them. 0 means unbounded.
+	TimerReservoirSize int
+	// TimerDigestCompression summarizes the points of timers in t-digests of this compression, which bounds memory,
+	// and estimates their percentiles, median and histograms from them. 0 keeps the points. see out.NewTimers
+	TimerDigestCompression int
+	// TimerWeightedPercentiles weighs every timer point by 1/its sample rate for the percentiles. see out.NewTimers
+	TimerWeightedPercentiles bool
+	// MaxSetMembers bounds the amount of unique members tracked per set, per interval. 0 means unbounded.
+	MaxSetMembers int
+	// MaxBuckets bounds the amount of distinct buckets per type (counter, gauge, timer or set), from their first
+	// metric until they're deleted for being idle. metrics of new buckets beyond it are dropped, unless
+	// MaxBucketsEvict. with NumShards, every shard gets an equal part. 0 or a missing type means unbounded.
+	MaxBuckets map[string]int
+	// MaxBucketsEvict makes room for new buckets beyond MaxBuckets by deleting the least recently used one.
+	MaxBucketsEvict bool
+	// GaugeDeltas makes gauge values with an explicit sign adjust the previous value instead of replacing it.
+	GaugeDeltas bool
+	// SkipUnchangedGauges only sends gauges whose value changed since they were last sent. the first value is always sent.
+	SkipUnchangedGauges bool
+	// for how many intervals without data buckets are still sent (counters as 0, gauges with their last value,
+	// timers with a count of 0). 0 means they're deleted right away, -1 means they're kept forever.
+	KeepIdleCounters int
+	KeepIdleGauges   int
+	KeepIdleTimers   int
+	// GaugesPersistFile is where gauges are saved on shutdown and restored from on startup. empty disables it.
+	GaugesPersistFile string
+	// Output is where flushed metrics are written to. if nil, Run uses graphite at graphite_addr.
+	Output backend.Output
+	// SpoolDir is where metrics are stored when writing to Output fails, to be replayed later. empty disables it.
+	// the spool is bounded to SpoolMaxBytes.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	// GraphiteOptions are used for the graphite outputs: to graphite_addr (unless Output is set) and GraphiteRoutes.
+	GraphiteOptions backend.GraphiteOptions
+	// GraphiteWriteTimeout is how long connecting to and every write to graphite may take. 0 means the flush interval.
+	GraphiteWriteTimeout time.Duration
+	// GraphiteRetries is how often a failed write to graphite is retried, GraphiteRetryBackoff after the first attempt
+	// and twice as long after every next one, as long as the retry still fits within the flush interval.
+	// after that, the metrics are spooled (see SpoolDir) or retried from memory.
+	GraphiteRetries      int
+	GraphiteRetryBackoff time.Duration
+	// GraphiteRoutes maps metric prefixes to graphite addresses. metrics are sent to the address of the longest
+	// matching prefix, or to Output if none matches. every destination is written to independently.
+	GraphiteRoutes map[string]string
+	// BackendRoutes send the metrics that match their pattern to the backend of the first matching one instead:
+	// one of Backends, or Output (see DefaultBackend). the others go by GraphiteRoutes as usual.
+	// every backend is written to independently, like the destinations of GraphiteRoutes.
+	BackendRoutes []BackendRoute
+	Backends      map[string]Backend
+	// DryRun logs the flushed metrics (see backend.LogOutput) instead of writing them to graphite_addr,
+	// GraphiteRoutes and Backends, which are never connected to, and disables SpoolDir. Output is still used when
+	// it's set.
+	DryRun bool
+	// FlushOffset is how long after every whole flush interval to flush, so that instances can spread their flushes.
+	FlushOffset time.Duration
+	// RollupInterval, if more than the flush interval (of which it must be a multiple), sends the metrics once per
+	// RollupInterval: the data of its flush intervals is combined, and sent at the end of it (plus FlushOffset).
+	RollupInterval time.Duration
+	// NumShards is the amount of goroutines that aggregate metrics, each owning the buckets that hash to it.
+	// 0 or 1 means metricsMonitor aggregates them all by itself.
+	NumShards int
+	// NumReaders is the amount of udp sockets (using SO_REUSEPORT) and reader goroutines. 0 or 1 means a single one.
+	NumReaders int
+	// Sanitizer cleans up the buckets the listeners receive. nil leaves them as they are
+	Sanitizer *common.Sanitizer
+	// Filter decides which buckets are accepted by the listeners. nil accepts all of them
+	Filter *common.Filter
+	// Rewriter renames the accepted buckets, before they're aggregated. nil leaves them as they are
+	Rewriter *common.Rewriter
+	// Forwarder relays the lines of the buckets it matches to another statsd, rather than aggregating them.
+	// nil aggregates all of them
+	Forwarder *out.Forwarder
+	// CumulativeCounters sends counters with their running total, rather than resetting them every flush.
+	// see out.NewCounters
+	CumulativeCounters bool
+	// MaxBucketLen is the longest bucket accepted, longer ones are invalid lines. 0 means no limit.
+	MaxBucketLen int
+	// CounterAllowNegative accepts negative counter values (decrements). otherwise they're counted as invalid lines.
+	CounterAllowNegative bool
+	// DefaultModifier is the type of lines that don't have one, see out.Output.DefaultModifier. empty rejects them.
+	DefaultModifier string
+	// StrictTypes only accepts the first type (counter, gauge, timer or set) seen for a bucket in an interval.
+	// metrics of that bucket with another type are counted as invalid lines (reason type_conflict).
+	StrictTypes bool
+	// TreatAsGauge makes the counters of the buckets it accepts gauges: they take the last value of the interval,
+	// instead of being summed. nil means none.
+	TreatAsGauge *common.Filter
+	// PayloadEncoding is how udp and unix socket packets are encoded, and PayloadEncodingTCP how tcp connections are,
+	// see out.Output.DatagramEncoding and out.Output.StreamEncoding. empty means plain.
+	PayloadEncoding    string
+	PayloadEncodingTCP string
+	// DropWhenFull makes the listeners drop metrics when aggregation can't keep up, rather than wait for it
+	// (and stop reading from their sockets, so that the kernel drops packets instead).
+	DropWhenFull bool
+	// DisableSampleRateTracking stops tracking how often every bucket is submitted, which is only needed for
+	// the sample_rate and metric_stats admin commands, to save that overhead for every incoming metric.
+	DisableSampleRateTracking bool
+	// SampleRateWindow is the period that the sample_rate and metric_stats admin commands measure over. 0 means 10s.
+	SampleRateWindow time.Duration
+	// MaxTimersPerSPrefixes overrides max_timers_per_s for the sample_rate advice of buckets starting with a prefix.
+	// the longest matching prefix wins.
+	MaxTimersPerSPrefixes map[string]uint64
+	// EnforceSampleRate samples down the timers of buckets that are submitted more often than their max timers per
+	// second, rather than only advising clients to: every SampleRateWindow, the sample_rate advice of the window
+	// that ended becomes the chance for every point of the bucket to be kept. see out.Sampler. it needs the sample
+	// rate tracking.
+	EnforceSampleRate bool
+	// ExposeTimersPrometheus serves the timers as summaries on the prometheus /metrics endpoint, see out.Summaries,
+	// instead of the flushed timer stats.
+	ExposeTimersPrometheus bool
+	// ExposePrometheusMetrics serves the counters and gauges on the prometheus /metrics endpoint, see out.Exposed,
+	// instead of their flushed values.
+	ExposePrometheusMetrics bool
+	// ShutdownGrace is how long to wait, on SIGTERM, for the listeners to stop and for what they've read already
+	// to be aggregated, before the final flush. 0 means not to wait.
+	ShutdownGrace time.Duration
+	// TimestampPrecision makes the flushed metrics carry the actual flush time, truncated to a millisecond,
+	// microsecond or nanosecond, rather than whole seconds. see out.SetTimestamps. 0 means whole seconds.
+	TimestampPrecision time.Duration
+	// AdminToken, if not empty, must be sent with "auth <token>" on an admin connection before it can run
+	// any command other than help.
+	AdminToken string
+	// HealthMaxIntervals is how many flush intervals may pass without a successful write to Output
+	// before /health and /ready report the daemon as unhealthy.
+	HealthMaxIntervals int
+
+	udpListening int32 // set to 1 once the udp listener is bound. accessed atomically
+	lastFlush    int64 // unix timestamp of the last successful write to Output (or of startup). accessed atomically
+	prevFlush    int64 // unix timestamp of the previous flush, 0 until the first one. accessed atomically
+
+	// the sample rate tracker of metricStatsMonitor, for the internal stats. accessed atomically
+	trackerCurBuckets  int64 // buckets in the map of the current period
+	trackerPrevBuckets int64 // buckets in the map of the previous period
+	trackerSwap        int64 // unix timestamp of when the current period started, 0 until the first one ended
+
+	// internal stats, exposed on the prometheus endpoint
+	output             *out.Output
+	writeFailures      uint64                 // accessed atomically
+	timerPointsDropped uint64                 // accessed atomically
+	limitStats         map[string]*limitStats // by type, see MaxBuckets
+	flushLag           int64                  // nanoseconds the last flush was enqueued after it was due. accessed atomically
+	flushDurations     map[string]float64     // duration in seconds of the last processing, per type
+	flushDurationsLock sync.Mutex
+	flushStats         flushStats
+	flushStatsLock     sync.Mutex
+	graphiteOutputs    map[string]*backend.GraphiteOutput // per address, for their Stats. see graphiteOutput
+	startTime          time.Time
+	summaries          *out.Summaries // nil unless ExposeTimersPrometheus
+	exposed            *out.Exposed   // nil unless ExposePrometheusMetrics
+	restoredGauges     map[string]float64
+	shards             []*shard      // nil unless NumShards > 1
+	stopListeners      chan struct{} // closed to stop the listeners of Run, see drain
+
 	Metrics             chan []*common.Metric
 	metricAmounts       chan []*common.Metric
 	metricStatsRequests chan metricsStatsReq
+	dumpRequests        chan metricsStatsReq
+	statsRequests       chan metricsStatsReq
+	deleteRequests      chan metricsStatsReq
+	snapshotRequests    chan chan *snapshot
 	valid_lines         *topic.Topic
 	Invalid_lines       *topic.Topic
+	ValidPackets        *out.Tap     // a sample of the metrics the listeners accepted, for consumers to Register with
+	sampler             *out.Sampler // used by the listeners with EnforceSampleRate
+	invalid             *out.InvalidLines
 	events              *topic.Topic
+	debugLock           sync.Mutex
+	debugInvalid        chan interface{} // consumer of Invalid_lines that logs them, while the log level is debug
 
-	Clock         clock.Clock
-	submitFunc    SubmitFunc
-	graphiteQueue chan []byte
+	Clock           clock.Clock
+	submitFunc      SubmitFunc
+	destinations    []*destination // sorted by prefix length, longest first, then the one for Output and those of Backends
+	backendRoutes   []backendRoute
 	prometheusQueue chan []byte
-	pmb bool
+	pmb             bool
 
-	listen_addr   string
-	admin_addr    string
-	graphite_addr string
+	listen_addr     string
+	listen_addr_tcp string
+	socket_path     string
+	admin_addr      string
+	graphite_addr   string
 	prometheus_addr string
 }
 
@@ -73,39 +267,215 @@ func New(instance string, formatter out.Formatter, flush_rates, flush_counts boo
 		Metrics:             make(chan []*common.Metric, max_unprocessed),
 		metricAmounts:       make(chan []*common.Metric, max_unprocessed),
 		metricStatsRequests: make(chan metricsStatsReq),
+		dumpRequests:        make(chan metricsStatsReq),
+		snapshotRequests:    make(chan chan *snapshot),
+		statsRequests:       make(chan metricsStatsReq),
+		deleteRequests:      make(chan metricsStatsReq),
 		valid_lines:         topic.New(),
 		Invalid_lines:       topic.New(),
+		ValidPackets:        out.NewTap(),
+		sampler:             out.NewSampler(),
+		limitStats:          map[string]*limitStats{"counter": {}, "gauge": {}, "timer": {}, "set": {}},
+		invalid:             out.NewInvalidLines(invalidLinesKept),
 		events:              topic.New(),
 	}
 }
 
 // start statsdaemon instance with standard network daemon behaviors
-func (s *StatsDaemon) Run(listen_addr, admin_addr, graphite_addr, prometheus_addr string) {
+// listen_addr_tcp and socket_path are optional: leave empty to only listen on udp.
+func (s *StatsDaemon) Run(listen_addr, admin_addr, graphite_addr, prometheus_addr, listen_addr_tcp, socket_path string) {
 	s.Clock = clock.New()
 	s.submitFunc = s.GraphiteQueue
-	s.graphiteQueue = make(chan []byte, 1000)
 	s.prometheusQueue = make(chan []byte, 1000)
 	s.pmb = false
 
 	s.listen_addr = listen_addr
+	s.listen_addr_tcp = listen_addr_tcp
+	s.socket_path = socket_path
 	s.admin_addr = admin_addr
-	s.graphite_addr = graphite_addr
+	s.setDestinations(graphite_addr)
 	s.prometheus_addr = prometheus_addr
+	if s.ExposeTimersPrometheus {
+		s.summaries = out.NewSummaries()
+	}
+	if s.ExposePrometheusMetrics {
+		s.exposed = out.NewExposed()
+	}
 
 	log.Infof("statsdaemon instance '%s' starting", s.instance)
-	output := &out.Output{
-		Metrics:       s.Metrics,
-		MetricAmounts: s.metricAmounts,
-		Valid_lines:   s.valid_lines,
-		Invalid_lines: s.Invalid_lines,
-	}
-	go udp.StatsListener(s.listen_addr, s.fmt.PrefixInternal, output) // set up udp listener that writes messages to output's channels (i.e. s's channels)
-	go s.adminListener()                                              // tcp admin_addr to handle requests
-	go s.metricStatsMonitor()                                         // handles requests fired by telnet api
+	s.start()
+	s.stopListeners = make(chan struct{})
+	metricAmounts := s.metricAmounts
+	if s.DisableSampleRateTracking {
+		metricAmounts = nil
+	}
+	output := s.newOutput(metricAmounts)
+	if s.Forwarder != nil {
+		go func() {
+			if err := s.Forwarder.Run(s.stopListeners); err != nil {
+				log.Fatalf("ERROR: can't forward - %s", err)
+			}
+		}()
+	}
+	go udp.StatsListeners(s.listen_addr, s.NumReaders, s.fmt.PrefixInternal, output) // set up udp listener(s) that write messages to output's channels (i.e. s's channels)
+	if s.listen_addr_tcp != "" {
+		go tcp.StatsListener(s.listen_addr_tcp, s.fmt.PrefixInternal, output) // same, but for newline-delimited metrics over tcp
+	}
+	if s.socket_path != "" {
+		go udp.UnixStatsListener(s.socket_path, s.fmt.PrefixInternal, output) // same, but for datagrams over a unix socket
+	}
+	go s.adminListener() // tcp admin_addr to handle requests
+	if !s.DisableSampleRateTracking {
+		go s.metricStatsMonitor() // handles requests fired by telnet api
+	}
 	go s.prometheusWriter()
-	go s.graphiteWriter()                                             // writes to graphite in the background
+	for _, d := range s.destinations {
+		go s.outputWriter(d) // writes to graphite (or the configured Output) in the background
+	}
 	go s.prometheusListener()
-	s.metricsMonitor()                                                // takes data from s.Metrics and puts them in the guage/timers/etc objects. pointers guarded by select. also listens for signals.
+	s.metricsMonitor() // takes data from s.Metrics and puts them in the guage/timers/etc objects. pointers guarded by select. also listens for signals.
+}
+
+// Replay feeds the newline delimited statsd lines read from r into aggregation, instead of listening for them.
+// linesPerSecond limits how fast they are read, 0 means as fast as possible. metrics are flushed every flush
+// interval as usual, and once all lines are read, a final flush is written to the outputs, after which Replay returns.
+func (s *StatsDaemon) Replay(r io.Reader, linesPerSecond int, graphite_addr string) error {
+	s.Clock = clock.New()
+	s.submitFunc = s.GraphiteQueue
+	s.prometheusQueue = make(chan []byte, 1000)
+	s.setDestinations(graphite_addr)
+	if s.signalchan == nil {
+		s.signalchan = make(chan os.Signal, 1)
+	}
+
+	log.Infof("statsdaemon instance '%s' replaying", s.instance)
+	s.start()
+	output := s.newOutput(nil)
+	// rather than lose lines, we read them slower
+	output.DropWhenFull = false
+	go s.prometheusWriter()
+	var writers sync.WaitGroup
+	for _, d := range s.destinations {
+		writers.Add(1)
+		go func(d *destination) {
+			s.outputWriter(d)
+			writers.Done()
+		}(d)
+	}
+	monitorDone := make(chan struct{})
+	go func() {
+		s.metricsMonitor()
+		close(monitorDone)
+	}()
+
+	// lines are parsed in batches, of up to a tenth of a second worth of lines when rate limited
+	batchSize := 1000
+	if linesPerSecond > 0 && linesPerSecond < 10*batchSize {
+		batchSize = (linesPerSecond + 9) / 10
+	}
+	scanner := bufio.NewScanner(r)
+	var batch []byte
+	lines, start := 0, s.Clock.Now()
+	for more := true; more; {
+		more = scanner.Scan()
+		if more {
+			batch = append(append(batch, scanner.Bytes()...), '\n')
+			lines++
+		}
+		if len(batch) > 0 && (!more || lines%batchSize == 0) {
+			output.Send(udp.ParseMessage(batch, s.fmt.PrefixInternal, output, udp.ParseLine2))
+			batch = batch[:0]
+			if linesPerSecond > 0 {
+				due := start.Add(time.Duration(lines) * time.Second / time.Duration(linesPerSecond))
+				s.Clock.Sleep(due.Sub(s.Clock.Now()))
+			}
+		}
+	}
+	err := scanner.Err()
+
+	// once metricsMonitor took all metrics, it handles the signal after them, and flushes them before returning
+	for s.queueLength() > 0 {
+		s.Clock.Sleep(10 * time.Millisecond)
+	}
+	s.signalchan <- syscall.SIGTERM
+	<-monitorDone
+	for _, d := range s.destinations {
+		close(d.queue)
+	}
+	writers.Wait()
+	log.Infof("replayed %d lines", lines)
+	return err
+}
+
+// setDestinations sets up the destinations to write the flushed metrics to: those of GraphiteRoutes, Output,
+// which defaults to the graphite at graphite_addr, and the Backends of BackendRoutes.
+func (s *StatsDaemon) setDestinations(graphite_addr string) {
+	s.graphite_addr = graphite_addr
+	if s.Output == nil {
+		s.Output = s.graphiteOutput(s.graphite_addr)
+	}
+	s.destinations = nil
+	for prefix, addr := range s.GraphiteRoutes {
+		s.destinations = append(s.destinations, &destination{prefix, addr, s.spool(s.graphiteOutput(addr), "route_"+addr), make(chan []byte, 1000)})
+	}
+	sort.Slice(s.destinations, func(i, j int) bool {
+		return len(s.destinations[i].prefix) > len(s.destinations[j].prefix)
+	})
+	s.destinations = append(s.destinations, &destination{"", DefaultBackend, s.spool(s.Output, ""), make(chan []byte, 1000)})
+	if err := s.setBackendRoutes(); err != nil {
+		log.Fatalf("invalid backend routes: %s", err)
+	}
+}
+
+// start restores the persisted gauges and starts the shards, before metrics come in
+func (s *StatsDaemon) start() {
+	if s.GaugesPersistFile != "" {
+		s.restoredGauges = loadGauges(s.GaugesPersistFile)
+	}
+	s.startTime = s.Clock.Now()
+	atomic.StoreInt64(&s.lastFlush, s.startTime.Unix())
+	s.startShards()
+}
+
+// newOutput creates the output for the listeners, which sends metrics to be aggregated, and to metricAmounts unless
+// that's nil
+func (s *StatsDaemon) newOutput(metricAmounts chan []*common.Metric) *out.Output {
+	output := &out.Output{
+		Metrics:              s.Metrics,
+		Shards:               s.shardChannels(),
+		MetricAmounts:        metricAmounts,
+		Valid_lines:          s.valid_lines,
+		Invalid_lines:        s.Invalid_lines,
+		ValidPackets:         s.ValidPackets,
+		Invalid:              s.invalid,
+		Sampler:              s.enforcedSampler(),
+		Sanitizer:            s.Sanitizer,
+		Filter:               s.Filter,
+		Rewriter:             s.Rewriter,
+		Forwarder:            s.Forwarder,
+		CounterAllowNegative: s.CounterAllowNegative,
+		DefaultModifier:      s.DefaultModifier,
+		DropWhenFull:         s.DropWhenFull,
+		MaxBucketLen:         s.MaxBucketLen,
+		DatagramEncoding:     s.PayloadEncoding,
+		StreamEncoding:       s.PayloadEncodingTCP,
+		Done:                 s.stopListeners,
+		Listening: func(network, addr string) {
+			if network == "udp" {
+				atomic.StoreInt32(&s.udpListening, 1)
+			}
+		},
+	}
+	s.output = output
+	return output
+}
+
+// enforcedSampler returns the sampler for the listeners, nil unless EnforceSampleRate
+func (s *StatsDaemon) enforcedSampler() *out.Sampler {
+	if !s.EnforceSampleRate {
+		return nil
+	}
+	return s.sampler
 }
 
 // start statsdaemon instance, only processing incoming metrics from the channel, and flushing
@@ -114,7 +484,10 @@ func (s *StatsDaemon) Run(listen_addr, admin_addr, graphite_addr, prometheus_add
 
 func (s *StatsDaemon) RunBare() {
 	log.Infof("statsdaemon instance '%s' starting", s.instance)
-	go s.metricStatsMonitor()
+	if !s.DisableSampleRateTracking {
+		go s.metricStatsMonitor()
+	}
+	s.startShards()
 	s.metricsMonitor()
 }
 
@@ -123,250 +496,621 @@ func (s *StatsDaemon) RunBare() {
 // external signals and every flushInterval, computes and flushes the data
 func (s *StatsDaemon) metricsMonitor() {
 	period := time.Duration(s.flushInterval) * time.Second
-	tick := ticker.GetAlignedTicker(s.Clock, period)
-
-	var c *out.Counters
-	var g *out.Gauges
-	var t *out.Timers
-	oneCounter := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_counter.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
-	}
-	oneGauge := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_gauge.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
-	}
-	oneTimer := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_timer.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
-	}
-
-	initializeCounters := func() {
-		c = out.NewCounters(s.flush_rates, s.flush_counts)
-		g = out.NewGauges()
-		t = out.NewTimers(s.pct)
-		for _, name := range []string{"timer", "gauge", "counter"} {
-			c.Add(&common.Metric{
-				Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal, name),
-				Sampling: 1,
-			})
-		}
-	}
-	initializeCounters()
+	tick := ticker.GetAlignedTickerOffset(s.Clock, period, s.FlushOffset)
+
+	// with shards, they own the data. we only route metrics to them, and handle flushes and requests.
+	var a *aggregator
+	router := &out.Output{Shards: s.shardChannels()}
+	if len(s.shards) == 0 {
+		a = s.newAggregator(s.restoredGauges)
+		s.restoredGauges = nil
+	}
+	// the data of the intervals so far of the current RollupInterval, if any
+	var rollup [][]*aggregator
 	for {
 		select {
 		case sig := <-s.signalchan:
 			switch sig {
 			case syscall.SIGTERM, syscall.SIGINT:
-				fmt.Printf("!! Caught signal %s... shutting down\n", sig)
-				s.submitFunc(c, g, t, s.Clock.Now().Add(period))
+				log.WithField("signal", sig.String()).Info("caught signal, shutting down")
+				if s.socket_path != "" {
+					os.Remove(s.socket_path)
+				}
+				s.drain(a, router)
+				var last map[string]float64
+				var prev []*aggregator
+				if a == nil {
+					prev, last = s.nextShards(s.GaugesPersistFile != "")
+				} else {
+					if s.GaugesPersistFile != "" {
+						last = a.g.Last()
+					}
+					// like for every flush, so that e.g. cumulative counters have their totals
+					prev = []*aggregator{a.next()}
+				}
+				cur := rollupShards(append(rollup, prev))
+				s.submitFunc(cur.c, cur.g, cur.t, cur.se, s.Clock.Now().Add(period))
+				if s.GaugesPersistFile != "" {
+					saveGauges(s.GaugesPersistFile, last)
+				}
 				return
 			default:
-				fmt.Printf("unknown signal %s, ignoring\n", sig)
+				log.WithField("signal", sig.String()).Warn("unknown signal, ignoring")
 			}
-		case <-tick.C:
-			go func(c *out.Counters, g *out.Gauges, t *out.Timers) {
-				s.submitFunc(c, g, t, s.Clock.Now().Add(period))
-				s.events.Broadcast <- "flush"
-			}(c, g, t)
-			initializeCounters()
-			tick = ticker.GetAlignedTicker(s.Clock, period)
-		case metrics := <-s.Metrics:
-			for _, m := range metrics {
-				if m.Modifier == "ms" {
-					t.Add(m)
-					c.Add(oneTimer)
-				} else if m.Modifier == "g" {
-					g.Add(m)
-					c.Add(oneGauge)
-				} else {
-					c.Add(m)
-					c.Add(oneCounter)
+		case tickTime := <-tick.C:
+			var prev []*aggregator
+			if a == nil {
+				prev, _ = s.nextShards(false)
+			} else {
+				prev = []*aggregator{a.next()}
+			}
+			rollup = append(rollup, prev)
+			if s.rollupDue(s.Clock.Now()) {
+				go func(intervals [][]*aggregator) {
+					cur := rollupShards(intervals)
+					s.submitFunc(cur.c, cur.g, cur.t, cur.se, tickTime.Add(period))
+					s.events.Broadcast <- "flush"
+				}(rollup)
+				rollup = nil
+			}
+			tick = ticker.GetAlignedTickerOffset(s.Clock, period, s.FlushOffset)
+		case req := <-s.dumpRequests:
+			cur := a
+			if a == nil {
+				cur = s.snapshotShards()
+			}
+			go s.handleApiRequest(*req.Conn, dump(req.Command[1], cur.c, cur.g, cur.t, cur.se))
+		case reply := <-s.snapshotRequests:
+			cur := a
+			if a == nil {
+				cur = s.snapshotShards()
+			}
+			reply <- newSnapshot(cur.c, cur.g, cur.t, cur.se, s.fmt)
+		case req := <-s.statsRequests:
+			var sizes mapSizes
+			if a == nil {
+				var lock sync.Mutex
+				s.onShards(func(i int, a *aggregator) {
+					lock.Lock()
+					sizes.add(a.sizes())
+					lock.Unlock()
+				})
+			} else {
+				sizes = a.sizes()
+			}
+			go s.handleApiRequest(*req.Conn, s.stats(sizes))
+		case req := <-s.deleteRequests:
+			typ, bucket := "", req.Command[1]
+			if len(req.Command) == 3 {
+				typ, bucket = req.Command[1], req.Command[2]
+			}
+			var deleted []byte
+			if a == nil {
+				// the bucket may have been folded from tags, so we don't know which shard owns it.
+				var lock sync.Mutex
+				s.onShards(func(i int, a *aggregator) {
+					buf := deleteFrom(typ, bucket, a.c, a.g, a.t, a.se)
+					lock.Lock()
+					deleted = append(deleted, buf...)
+					lock.Unlock()
+				})
+				if deleted == nil {
+					deleted = []byte(fmt.Sprintf("not found: %s\n", bucket))
 				}
+			} else {
+				deleted = deleteBucket(typ, bucket, a.c, a.g, a.t, a.se)
+			}
+			go s.handleApiRequest(*req.Conn, deleted)
+		case metrics := <-s.Metrics:
+			if a == nil {
+				router.Send(metrics)
+			} else {
+				a.add(metrics)
 			}
+			common.Release(metrics)
 		}
 	}
 }
 
+// rollupDue returns whether the flush at now is the last one of a RollupInterval, after which its data is sent.
+// without RollupInterval, that's every flush.
+func (s *StatsDaemon) rollupDue(now time.Time) bool {
+	period := time.Duration(s.flushInterval) * time.Second
+	if s.RollupInterval <= period {
+		return true
+	}
+	// the flush interval it's at, as the ticker may fire a bit late
+	unix := now.UnixNano() - int64(s.FlushOffset)
+	flush := (unix + int64(period)/2) / int64(period) * int64(period)
+	return flush%int64(s.RollupInterval) == 0
+}
+
+// drain stops the listeners, and aggregates (or with shards, routes) the metrics they read already,
+// until they've all returned, or for at most ShutdownGrace.
+func (s *StatsDaemon) drain(a *aggregator, router *out.Output) {
+	if s.ShutdownGrace <= 0 || s.stopListeners == nil {
+		return
+	}
+	close(s.stopListeners)
+	stopped := make(chan struct{})
+	go func() {
+		s.output.Wait()
+		close(stopped)
+	}()
+	add := func(metrics []*common.Metric) {
+		if a == nil {
+			router.Send(metrics)
+		} else {
+			a.add(metrics)
+		}
+		common.Release(metrics)
+	}
+	timeout := s.Clock.After(s.ShutdownGrace)
+	for {
+		select {
+		case metrics := <-s.Metrics:
+			add(metrics)
+		case <-stopped:
+			// nothing more will be queued
+			for len(s.Metrics) > 0 {
+				add(<-s.Metrics)
+			}
+			return
+		case <-timeout:
+			log.Warnf("listeners didn't stop within shutdown_grace %s, flushing without waiting for them", s.ShutdownGrace)
+			return
+		}
+	}
+}
+
+// dump describes the current contents of the given type of metrics (counters|gauges|timers|sets|all)
+// one per line, sorted by bucket. for timers and sets, we only show the amount of points and members.
+func dump(typ string, c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets) []byte {
+	var lines []string
+	if typ == "counters" || typ == "all" {
+		for key, val := range c.Values {
+			lines = append(lines, fmt.Sprintf("counter %s %f\n", key, val))
+		}
+	}
+	if typ == "gauges" || typ == "all" {
+		for key, val := range g.Values {
+			lines = append(lines, fmt.Sprintf("gauge %s %f\n", key, val))
+		}
+	}
+	if typ == "timers" || typ == "all" {
+		for key, val := range t.Values {
+			lines = append(lines, fmt.Sprintf("timer %s %d points\n", key, val.NumPoints()))
+		}
+	}
+	if typ == "sets" || typ == "all" {
+		for key, val := range se.Values {
+			lines = append(lines, fmt.Sprintf("set %s %d members\n", key, len(val)))
+		}
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, ""))
+}
+
+// snapshot is the current state of all metrics, as served on /snapshot
+type snapshot struct {
+	Counters map[string]float64            `json:"counters"`
+	Gauges   map[string]float64            `json:"gauges"`
+	Timers   map[string]map[string]float64 `json:"timers"` // see out.Timers.Snapshot
+	Sets     map[string]int                `json:"sets"`   // the amount of members
+}
+
+// newSnapshot copies the current state of the metrics, so it can be used after they change
+func newSnapshot(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, f out.Formatter) *snapshot {
+	snap := &snapshot{
+		Counters: make(map[string]float64, len(c.Values)),
+		Gauges:   make(map[string]float64, len(g.Values)),
+		Timers:   t.Snapshot(f),
+		Sets:     make(map[string]int, len(se.Values)),
+	}
+	for key, val := range c.Values {
+		snap.Counters[key] = val
+	}
+	for key, val := range g.Values {
+		snap.Gauges[key] = val
+	}
+	for key, val := range se.Values {
+		snap.Sets[key] = len(val)
+	}
+	return snap
+}
+
+// deleteBucket deletes the bucket from the metrics of the given type (counter|gauge|timer|set), or all of them if typ is empty.
+// it describes which of them had it.
+func deleteBucket(typ, bucket string, c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets) []byte {
+	buf := deleteFrom(typ, bucket, c, g, t, se)
+	if buf == nil {
+		buf = []byte(fmt.Sprintf("not found: %s\n", bucket))
+	}
+	return buf
+}
+
+// deleteFrom is like deleteBucket, but it returns nil if none of the metrics had the bucket.
+func deleteFrom(typ, bucket string, c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets) []byte {
+	var buf []byte
+	del := func(name string, found bool) {
+		if found {
+			buf = append(buf, fmt.Sprintf("deleted %s %s\n", name, bucket)...)
+		}
+	}
+	if typ == "" || typ == "counter" {
+		del("counter", c.Delete(bucket))
+	}
+	if typ == "" || typ == "gauge" {
+		del("gauge", g.Delete(bucket))
+	}
+	if typ == "" || typ == "timer" {
+		del("timer", t.Delete(bucket))
+	}
+	if typ == "" || typ == "set" {
+		del("set", se.Delete(bucket))
+	}
+	return buf
+}
+
+// loadGauges reads the gauges saved by saveGauges.
+// if that fails, we just start without them.
+func loadGauges(path string) map[string]float64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warnf("could not read gauges from %q, starting without them: %s", path, err)
+		return nil
+	}
+	var gauges map[string]float64
+	err = json.Unmarshal(data, &gauges)
+	if err != nil {
+		log.Warnf("could not parse gauges from %q, starting without them: %s", path, err)
+		return nil
+	}
+	log.Infof("restored %d gauges from %q", len(gauges), path)
+	return gauges
+}
+
+// saveGauges writes the last known value of all gauges to path, as json.
+// it writes to a temporary file first, so that we never leave a half written file behind.
+func saveGauges(path string, last map[string]float64) {
+	data, err := json.Marshal(last)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Errorf("could not save gauges to %q: %s", path, err)
+	}
+}
+
 // instrument wraps around a processing function, and makes sure we track the number of metrics and duration of the call,
 // which it flushes as metrics2.0 metrics to the outgoing buffer.
-func (s *StatsDaemon) instrument(st out.Type, buf []byte, now int64, name string) ([]byte, int64) {
+func (s *StatsDaemon) instrument(st out.Type, buf []byte, now int64, interval int, name string) ([]byte, int64) {
 	time_start := s.Clock.Now()
-	buf, num := st.Process(buf, now, s.flushInterval, s.fmt)
+	buf, num := st.Process(buf, now, interval, s.fmt)
 	time_end := s.Clock.Now()
 	duration_ms := float64(time_end.Sub(time_start).Nanoseconds()) / float64(1000000)
+	s.flushDurationsLock.Lock()
+	if s.flushDurations == nil {
+		s.flushDurations = make(map[string]float64)
+	}
+	s.flushDurations[name] = duration_ms / 1000
+	s.flushDurationsLock.Unlock()
+	log.WithFields(log.Fields{"metric_type": name, "count": num, "duration_ms": duration_ms}).Debug("processed metrics")
 	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%sstatsd_type_is_%s.mtype_is_gauge.type_is_calculation.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal, name)), duration_ms, now)
-	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%sdirection_is_out.statsd_type_is_%s.mtype_is_rate.unit_is_Metricps", s.fmt.Prefix_m20ne_rates, s.fmt.PrefixInternal, name)), float64(num)/float64(s.flushInterval), now)
+	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%sdirection_is_out.statsd_type_is_%s.mtype_is_rate.unit_is_Metricps", s.fmt.Prefix_m20ne_rates, s.fmt.PrefixInternal, name)), float64(num)/float64(interval), now)
+	buf = out.WriteInt64(buf, []byte(fmt.Sprintf("%s%sdirection_is_out.statsd_type_is_%s.mtype_is_gauge.unit_is_Metric", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal, name)), num, now)
 	return buf, num
 }
 
-// graphiteWriter is the background workers that connects to graphite and submits all pending data to it
-// TODO: conn.Write() returns no error for a while when the remote endpoint is down, the reconnect happens with a delay
-func (s *StatsDaemon) graphiteWriter() {
-	lock := &sync.Mutex{}
-	connectTicker := s.Clock.Tick(2 * time.Second)
-	var conn net.Conn
-	var err error
-	go func() {
-		for range connectTicker {
-			lock.Lock()
-			if conn == nil {
-				conn, err = net.Dial("tcp", s.graphite_addr)
-				if err == nil {
-					log.Infof("now connected to %s", s.graphite_addr)
-				} else {
-					log.Warnf("dialing %s failed: %s. will retry", s.graphite_addr, err.Error())
-				}
-			}
-			lock.Unlock()
-		}
-	}()
-	for buf := range s.graphiteQueue {
-		lock.Lock()
-		haveConn := (conn != nil)
-		lock.Unlock()
-		for !haveConn {
-			s.Clock.Sleep(time.Second)
-			lock.Lock()
-			haveConn = (conn != nil)
-			lock.Unlock()
-		}
-		if log.IsLevelEnabled(log.DebugLevel) {
-			for _, line := range bytes.Split(buf, []byte("\n")) {
-				if len(line) == 0 {
-					continue
-				}
-				log.Debugf("writing %s", line)
-			}
-		}
-		ok := false
+// flushStats describe the flushes, for the stats admin command
+type flushStats struct {
+	flushes   uint64        // amount of intervals processed
+	metrics   int64         // amount of metrics of the last flush
+	duration  time.Duration // time spent processing the last flush
+	writeTime time.Time     // time of the last write to Output
+	writeErr  error         // error of the last write to Output, nil if it succeeded
+}
+
+// lastWrite records the outcome of a write to Output
+func (s *StatsDaemon) lastWrite(err error) {
+	s.flushStatsLock.Lock()
+	s.flushStats.writeTime = s.Clock.Now()
+	s.flushStats.writeErr = err
+	s.flushStatsLock.Unlock()
+}
+
+// stats describes the daemon and its flushes, given the sizes of the current metrics datastructures
+func (s *StatsDaemon) stats(sizes mapSizes) []byte {
+	s.flushStatsLock.Lock()
+	fs := s.flushStats
+	s.flushStatsLock.Unlock()
+	now := s.Clock.Now()
+	var packets uint64
+	if s.output != nil {
+		packets = atomic.LoadUint64(&s.output.Stats.Packets)
+	}
+	var buf bytes.Buffer
+	line := func(key string, val interface{}) {
+		fmt.Fprintf(&buf, "%-20s %v\n", key, val)
+	}
+	line("uptime", now.Sub(s.startTime).Truncate(time.Second))
+	line("flush_interval", time.Duration(s.flushInterval)*time.Second)
+	line("packets", packets)
+	line("flushes", fs.flushes)
+	switch {
+	case fs.writeTime.IsZero():
+		line("last_write", "none yet")
+	case fs.writeErr != nil:
+		line("last_write", fmt.Sprintf("failed %s ago: %s", now.Sub(fs.writeTime).Truncate(time.Second), fs.writeErr))
+	default:
+		line("last_write", fmt.Sprintf("ok %s ago", now.Sub(fs.writeTime).Truncate(time.Second)))
+	}
+	line("last_flush_metrics", fs.metrics)
+	line("last_flush_duration", fs.duration)
+	line("counters", sizes.counters)
+	line("gauges", sizes.gauges)
+	line("timers", sizes.timers)
+	line("sets", sizes.sets)
+	return buf.Bytes()
+}
+
+// destination is an output along with the queue of data to write to it
+type destination struct {
+	prefix string // metrics starting with prefix go to this destination
+	name   string
+	output backend.Output
+	queue  chan []byte
+}
+
+// graphiteOutput creates an output to the graphite at addr, using GraphiteOptions, GraphiteWriteTimeout and GraphiteRetries.
+// with DryRun, it logs the metrics for addr instead.
+func (s *StatsDaemon) graphiteOutput(addr string) backend.Output {
+	if s.DryRun {
+		return backend.NewLogOutput(addr)
+	}
+	interval := time.Duration(s.flushInterval) * time.Second
+	timeout := s.GraphiteWriteTimeout
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+	}
+	output := backend.NewGraphiteOutputOpts(addr, s.Clock, timeout, s.GraphiteOptions)
+	if s.graphiteOutputs == nil {
+		s.graphiteOutputs = make(map[string]*backend.GraphiteOutput)
+	}
+	s.graphiteOutputs[addr] = output
+	// a retry must start early enough for its write to time out before the next flush
+	if s.GraphiteRetries <= 0 || timeout == interval {
+		return output
+	}
+	return backend.NewRetryOutput(output, s.Clock, s.GraphiteRetries, s.GraphiteRetryBackoff, interval-timeout)
+}
+
+// spool wraps output in a SpoolOutput, if SpoolDir is set. subdir is used for the spoolfiles of this output.
+// with DryRun it doesn't, as replaying what an earlier run spooled would only log (and delete) it.
+func (s *StatsDaemon) spool(output backend.Output, subdir string) backend.Output {
+	if s.SpoolDir == "" || s.DryRun {
+		return output
+	}
+	dir := s.SpoolDir
+	if subdir != "" {
+		dir = filepath.Join(dir, strings.Replace(subdir, string(os.PathSeparator), "_", -1))
+	}
+	spool, err := backend.NewSpoolOutput(output, dir, s.SpoolMaxBytes)
+	if err != nil {
+		log.Fatalf("could not set up spool in %s: %s", dir, err)
+	}
+	return spool
+}
+
+// outputWriter is the background worker that submits all pending data to the destination
+func (s *StatsDaemon) outputWriter(d *destination) {
+	for buf := range d.queue {
+		// the outputs log (with debug logging) what they write, as they write it
+		metrics := backend.Parse(buf)
 		var duration float64
 		var pre time.Time
-		for !ok {
+		for {
 			pre = s.Clock.Now()
-			lock.Lock()
-			_, err = conn.Write(buf)
+			err := d.output.Write(metrics)
 			if err == nil {
-				ok = true
 				duration = float64(s.Clock.Now().Sub(pre).Nanoseconds()) / float64(1000000)
-				log.Debug("wrote metrics payload to graphite!")
-			} else {
-				log.Errorf("failed to write to graphite: %s (took %s). will retry...", err, s.Clock.Now().Sub(pre))
-				conn.Close()
-				conn = nil
-				haveConn = false
+				log.WithFields(log.Fields{"graphite_addr": d.name, "count": len(metrics), "duration_ms": duration}).Debug("wrote metrics payload")
+				if d.name == DefaultBackend {
+					atomic.StoreInt64(&s.lastFlush, s.Clock.Now().Unix())
+					s.lastWrite(nil)
+				}
+				break
 			}
-			lock.Unlock()
-			for !ok && !haveConn {
-				s.Clock.Sleep(2 * time.Second)
-				lock.Lock()
-				haveConn = (conn != nil)
-				lock.Unlock()
+			if d.name == DefaultBackend {
+				s.lastWrite(err)
 			}
+			atomic.AddUint64(&s.writeFailures, 1)
+			log.WithFields(log.Fields{
+				"graphite_addr": d.name,
+				"count":         len(metrics),
+				"duration_ms":   float64(s.Clock.Now().Sub(pre).Nanoseconds()) / float64(1000000),
+			}).WithError(err).Error("failed to write metrics payload. will retry...")
+			s.Clock.Sleep(2 * time.Second)
 		}
-		buf = buf[:0]
-		buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%smtype_is_gauge.type_is_send.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal)), duration, pre.Unix())
-		ok = false
-		for !ok {
-			lock.Lock()
-			_, err = conn.Write(buf)
+		// formatted like the flushed metrics, so it gets the global prefix, suffix and static tags too
+		name := fmt.Sprintf("%s%smtype_is_gauge.type_is_send.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal)
+		line := out.SetTimestamps(out.WriteFloat64(nil, []byte(name), duration, pre.Unix()), pre, s.TimestampPrecision)
+		sendTime := backend.Parse(s.fmt.Namespace(line))
+		for {
+			err := d.output.Write(sendTime)
 			if err == nil {
-				ok = true
-				log.Debug("wrote sendtime to graphite!")
-			} else {
-				log.Errorf("failed to write mtype_is_gauge.type_is_send.unit_is_ms: %s. will retry...", err)
-				conn.Close()
-				conn = nil
-				haveConn = false
+				log.WithField("graphite_addr", d.name).Debug("wrote sendtime")
+				break
 			}
-			lock.Unlock()
-			for !ok && !haveConn {
-				s.Clock.Sleep(2 * time.Second)
-				lock.Lock()
-				haveConn = (conn != nil)
-				lock.Unlock()
+			atomic.AddUint64(&s.writeFailures, 1)
+			log.WithField("graphite_addr", d.name).WithError(err).Error("failed to write mtype_is_gauge.type_is_send.unit_is_ms. will retry...")
+			s.Clock.Sleep(2 * time.Second)
+		}
+	}
+}
+
+// route enqueues the lines of buf for the destinations they should go to.
+// if there's only one destination, we wait for room in its queue. otherwise, data for
+// destinations with a full queue is dropped, so that they don't hold up the others.
+func (s *StatsDaemon) route(buf []byte) {
+	if len(s.destinations) == 1 {
+		s.destinations[0].queue <- s.fmt.Namespace(buf)
+		return
+	}
+	bufs := make([][]byte, len(s.destinations))
+	for len(buf) > 0 {
+		end := bytes.IndexByte(buf, '\n') + 1
+		if end == 0 {
+			end = len(buf)
+		}
+		line := buf[:end]
+		buf = buf[end:]
+		if i := s.backendRoute(line); i >= 0 {
+			bufs[i] = append(bufs[i], line...)
+			continue
+		}
+		// up to the one for Output, whose empty prefix matches anything
+		for i, d := range s.destinations {
+			if bytes.HasPrefix(line, []byte(d.prefix)) {
+				bufs[i] = append(bufs[i], line...)
+				break
 			}
 		}
 	}
-	lock.Lock()
-	if conn != nil {
-		conn.Close()
+	for i, d := range s.destinations {
+		if len(bufs[i]) == 0 {
+			continue
+		}
+		select {
+		case d.queue <- s.fmt.Namespace(bufs[i]):
+		default:
+			log.Errorf("queue for %s is full, dropping %d bytes of metrics", d.name, len(bufs[i]))
+		}
+	}
+}
+
+// process puts the outbound metrics of all types in the buffer, along with statsdaemon's own stats about them:
+// how long processing took, how many buckets were sent, per type and in total, and how many timer points were dropped.
+// interval is the amount of seconds the data covers, which per second rates are based on.
+func (s *StatsDaemon) process(buf []byte, now int64, interval int, c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets) []byte {
+	start := s.Clock.Now()
+	buf, numCounters := s.instrument(c, buf, now, interval, "counter")
+	buf, numGauges := s.instrument(g, buf, now, interval, "gauge")
+	buf, numTimers := s.instrument(t, buf, now, interval, "timer")
+	buf, numSets := s.instrument(se, buf, now, interval, "set")
+	total := numCounters + numGauges + numTimers + numSets
+	s.flushStatsLock.Lock()
+	s.flushStats.flushes++
+	s.flushStats.metrics = total
+	s.flushStats.duration = s.Clock.Now().Sub(start)
+	s.flushStatsLock.Unlock()
+	if s.TimerReservoirSize > 0 {
+		atomic.AddUint64(&s.timerPointsDropped, uint64(t.Dropped()))
+		buf = out.WriteInt64(buf, []byte(fmt.Sprintf("%s%sdirection_is_in.statsd_type_is_timer.mtype_is_count.type_is_dropped.unit_is_Metric", s.fmt.Prefix_m20ne_counters, s.fmt.PrefixInternal)), t.Dropped(), now)
+	}
+	return out.WriteInt64(buf, []byte(fmt.Sprintf("%s%sdirection_is_out.mtype_is_gauge.unit_is_Metric", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal)), total, now)
+}
+
+// elapsed returns how many seconds passed since the previous flush, and records now as the time of the latest one.
+// flushes can happen later than planned (e.g. when the process stalls), so this is what rates should be based on.
+// for the first flush, and if the clock went backwards, it's the flush interval.
+func (s *StatsDaemon) elapsed(now int64) int {
+	prev := atomic.SwapInt64(&s.prevFlush, now)
+	if prev == 0 || now <= prev {
+		return s.flushInterval
 	}
-	lock.Unlock()
+	return int(now - prev)
 }
 
-// GraphiteQuepue invokes the processing function (instrumented) and enqueues data for writing to graphite
-func (s *StatsDaemon) GraphiteQueue(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
+// GraphiteQueue invokes the processing function (instrumented) and enqueues data for writing to graphite,
+// along with the flush lag: how long after it was due (see SubmitFunc) the flush was processed.
+func (s *StatsDaemon) GraphiteQueue(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, deadline time.Time) {
 	buf := make([]byte, 0)
 
-	now := s.Clock.Now().Unix()
-	buf, _ = s.instrument(c, buf, now, "counter")
-	buf, _ = s.instrument(g, buf, now, "gauge")
-	buf, _ = s.instrument(t, buf, now, "timer")
-	s.graphiteQueue <- buf
+	flushTime := s.Clock.Now()
+	now := flushTime.Unix()
+	buf = s.process(buf, now, s.elapsed(now), c, g, t, se)
+	if s.summaries != nil {
+		s.summaries.Update(t, s.fmt)
+	}
+	if s.exposed != nil {
+		s.exposed.Update(c, g)
+	}
+	t.Release()
+	lag := s.Clock.Now().Sub(deadline.Add(-time.Duration(s.flushInterval) * time.Second))
+	atomic.StoreInt64(&s.flushLag, int64(lag))
+	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%smtype_is_gauge.type_is_flush_lag.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal)), float64(lag.Nanoseconds())/float64(1000000), now)
+	buf = out.SetTimestamps(buf, flushTime, s.TimestampPrecision)
+	s.route(buf)
 	s.prometheusQueue <- buf
 	file, _ := os.OpenFile(os.TempDir()+string(os.PathSeparator)+"prometheus_metrics", os.O_CREATE|os.O_WRONLY, 0666)
 	file.Truncate(0)
-	file.Seek(0,0)
+	file.Seek(0, 0)
 	file.WriteString("# HELP metrics autogenerated by statsdaemon\n")
 	file.Close()
 }
 
 func (s *StatsDaemon) prometheusWriter() {
-    for buf := range s.prometheusQueue {
-	if !s.pmb {
-	   continue
-	}
-	file,_ := os.OpenFile(os.TempDir()+string(os.PathSeparator)+"prometheus_metrics", os.O_APPEND|os.O_WRONLY, 0666)
-	defer file.Close()
-        in_timer := false
-        for _, line := range bytes.Split(buf, []byte("\n")) {
-            if len(line) == 0 {
-                continue
-            }
-            data := strings.Split(string(line), " ")
-            if len(data) < 2 {
-                continue
-            }
-            if data[1] == "" {
-                continue
-            }
-            if strings.HasPrefix(data[0], s.fmt.Prefix_counters) || strings.Contains(data[0], "mtype_is_count") {
-                key1 := strings.Replace(data[0], ".", "_", -1)
-                key2 := strings.Replace(key1, "-", "_", -1)		    
-		n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s counter\n%s %s\n", key2, key2, key2, data[1]))
-		log.Debugf("Wrote %d stats to metrics file", n)
-            } else if strings.HasPrefix(data[0], s.fmt.Prefix_gauges) || strings.HasPrefix(data[0], "stats.all.") || strings.Contains(data[0], "mtype_is_gauge"){
-                key1 := strings.Replace(data[0], ".", "_", -1)
-                key2 := strings.Replace(key1, "-", "_", -1)		    
-		n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s gauge\n%s %s\n", key2, key2, key2, data[1]))
-		log.Debugf("Wrote %d stats to metrics file", n)
-            } else if strings.HasPrefix(data[0], s.fmt.Prefix_timers) {
-                if in_timer {
-                    timer_base_pos := strings.LastIndex(data[0], ".")
-                    if !strings.Contains(data[0][timer_base_pos:], "_") {
-                        key1 := strings.Replace(data[0], ".", "_", -1)
-                        key2 := strings.Replace(key1, "-", "_", -1)		    
-			n, _ := io.WriteString(file, fmt.Sprintf("%s %s\n", key2, data[1]))
-			log.Debugf("Wrote %d stats to metrics file", n)
-                    }
-                } else {
-                    in_timer = true
-                    timer_base_pos := strings.LastIndex(data[0], ".")
-                    key1 := strings.Replace(data[0], ".", "_", -1)
-                    key2 := strings.Replace(key1, "-", "_", -1)		    
-		    n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s summary\n%s %s\n", data[0][0:timer_base_pos], data[0][0:timer_base_pos], key2, data[1]))
-		    log.Debugf("Wrote %d stats to metrics file", n)
-                }
-            } else {
-		log.Debugf("LINE %s is not valid\n", line)
-	    }
-        }
-        buf = buf[:0]
-    }
+	for buf := range s.prometheusQueue {
+		if !s.pmb {
+			continue
+		}
+		file, _ := os.OpenFile(os.TempDir()+string(os.PathSeparator)+"prometheus_metrics", os.O_APPEND|os.O_WRONLY, 0666)
+		defer file.Close()
+		in_timer := false
+		for _, line := range bytes.Split(buf, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			data := strings.Split(string(line), " ")
+			if len(data) < 2 {
+				continue
+			}
+			if data[1] == "" {
+				continue
+			}
+			if s.exposed != nil && (strings.HasPrefix(data[0], s.fmt.Prefix_counters) || strings.HasPrefix(data[0], s.fmt.Prefix_gauges)) {
+				continue
+			}
+			if strings.HasPrefix(data[0], s.fmt.Prefix_counters) || strings.Contains(data[0], "mtype_is_count") {
+				key1 := strings.Replace(data[0], ".", "_", -1)
+				key2 := strings.Replace(key1, "-", "_", -1)
+				n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s counter\n%s %s\n", key2, key2, key2, data[1]))
+				log.Debugf("Wrote %d stats to metrics file", n)
+			} else if strings.HasPrefix(data[0], s.fmt.Prefix_gauges) || strings.HasPrefix(data[0], s.fmt.Prefix_sets) || strings.HasPrefix(data[0], "stats.all.") || strings.Contains(data[0], "mtype_is_gauge") {
+				key1 := strings.Replace(data[0], ".", "_", -1)
+				key2 := strings.Replace(key1, "-", "_", -1)
+				n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s gauge\n%s %s\n", key2, key2, key2, data[1]))
+				log.Debugf("Wrote %d stats to metrics file", n)
+			} else if strings.HasPrefix(data[0], s.fmt.Prefix_timers) {
+				if s.summaries != nil {
+					continue
+				}
+				if in_timer {
+					timer_base_pos := strings.LastIndex(data[0], ".")
+					if !strings.Contains(data[0][timer_base_pos:], "_") {
+						key1 := strings.Replace(data[0], ".", "_", -1)
+						key2 := strings.Replace(key1, "-", "_", -1)
+						n, _ := io.WriteString(file, fmt.Sprintf("%s %s\n", key2, data[1]))
+						log.Debugf("Wrote %d stats to metrics file", n)
+					}
+				} else {
+					in_timer = true
+					timer_base_pos := strings.LastIndex(data[0], ".")
+					key1 := strings.Replace(data[0], ".", "_", -1)
+					key2 := strings.Replace(key1, "-", "_", -1)
+					n, _ := io.WriteString(file, fmt.Sprintf("# HELP %s autogenerated by statsdaemon\n# TYPE %s summary\n%s %s\n", data[0][0:timer_base_pos], data[0][0:timer_base_pos], key2, data[1]))
+					log.Debugf("Wrote %d stats to metrics file", n)
+				}
+			} else {
+				log.Debugf("LINE %s is not valid\n", line)
+			}
+		}
+		buf = buf[:0]
+	}
 }
 
 // Amounts is a datastructure to track numbers of packets, in particular:
@@ -385,7 +1129,10 @@ type Amounts struct {
 // upon incoming requests we use the "old" buffer and the new one for the timeperiod it applies to.
 // (this way we have the absolute latest information)
 func (s *StatsDaemon) metricStatsMonitor() {
-	period := 10 * time.Second
+	period := s.SampleRateWindow
+	if period <= 0 {
+		period = 10 * time.Second
+	}
 	tick := s.Clock.Ticker(period)
 	// use two maps so we always have enough data shortly after we start a new period
 	// counts would be too low and/or too inaccurate otherwise
@@ -401,43 +1148,55 @@ func (s *StatsDaemon) metricStatsMonitor() {
 			new_counts := make(map[string]Amounts)
 			cur_counts = &new_counts
 			swap_ts = s.Clock.Now()
+			atomic.StoreInt64(&s.trackerPrevBuckets, int64(len(*prev_counts)))
+			atomic.StoreInt64(&s.trackerCurBuckets, 0)
+			atomic.StoreInt64(&s.trackerSwap, swap_ts.Unix())
+			if s.EnforceSampleRate {
+				s.sampler.SetRates(s.enforcedRates(*prev_counts, period))
+			}
 		case metrics := <-s.metricAmounts:
 			for _, metric := range metrics {
-				el, ok := (*cur_counts)[metric.Bucket]
-				if ok {
-					el.Seen += 1
-					el.Submitted += uint64(1 / metric.Sampling)
-				} else {
-					(*cur_counts)[metric.Bucket] = Amounts{uint64(1 / metric.Sampling), 1}
-				}
+				el := (*cur_counts)[metric.Bucket]
+				el.Seen += 1
+				el.Submitted += uint64(1 / metric.Sampling)
+				(*cur_counts)[metric.Bucket] = el
 			}
+			common.Release(metrics)
+			atomic.StoreInt64(&s.trackerCurBuckets, int64(len(*cur_counts)))
 		case req := <-s.metricStatsRequests:
 			current_ts := s.Clock.Now()
-			interval := current_ts.Sub(swap_ts).Seconds() + 10
+			interval := current_ts.Sub(swap_ts).Seconds() + period.Seconds()
 			var buf []byte
 			switch req.Command[0] {
 			case "sample_rate":
 				bucket := req.Command[1]
-				submitted := uint64(0)
+				submitted, seen := uint64(0), uint64(0)
 				el, ok := (*cur_counts)[bucket]
 				if ok {
 					submitted += el.Submitted
+					seen += el.Seen
 				}
 				el, ok = (*prev_counts)[bucket]
 				if ok {
 					submitted += el.Submitted
+					seen += el.Seen
 				}
 				submitted_per_s := float64(submitted) / interval
 				// submitted (at source) per second * ideal_sample_rate should be ~= max_timers_per_s
 				ideal_sample_rate := float64(1)
-				if uint64(submitted_per_s) > s.max_timers_per_s {
-					ideal_sample_rate = float64(s.max_timers_per_s) / submitted_per_s
+				max := s.maxTimersPerS(bucket)
+				if uint64(submitted_per_s) > max {
+					ideal_sample_rate = float64(max) / submitted_per_s
 				}
-				buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, ideal_sample_rate, submitted_per_s))...)
-				// this needs to be less realtime, so for simplicity (and performance?) we just use the prev 10s bucket.
+				if len(req.Command) == 3 {
+					buf = append(buf, []byte(fmt.Sprintf("%s %f %f %f %d\n", bucket, ideal_sample_rate, submitted_per_s, float64(seen)/interval, max))...)
+				} else {
+					buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, ideal_sample_rate, submitted_per_s))...)
+				}
+				// this needs to be less realtime, so for simplicity (and performance?) we just use the prev bucket.
 			case "metric_stats":
 				for bucket, el := range *prev_counts {
-					buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, float64(el.Submitted)/10, float64(el.Seen)/10))...)
+					buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, float64(el.Submitted)/period.Seconds(), float64(el.Seen)/period.Seconds()))...)
 				}
 			}
 
@@ -446,18 +1205,61 @@ func (s *StatsDaemon) metricStatsMonitor() {
 	}
 }
 
+// maxTimersPerS returns the max timers per second that the sample_rate advice for the bucket aims for,
+// see MaxTimersPerSPrefixes
+func (s *StatsDaemon) maxTimersPerS(bucket string) uint64 {
+	max, longest := s.max_timers_per_s, -1
+	for prefix, val := range s.MaxTimersPerSPrefixes {
+		if len(prefix) > longest && strings.HasPrefix(bucket, prefix) {
+			max, longest = val, len(prefix)
+		}
+	}
+	return max
+}
+
+// enforcedRates returns, for the buckets that were submitted more often than their max timers per second in
+// the period that counts cover, the sample rate to enforce, like the sample_rate advice.
+func (s *StatsDaemon) enforcedRates(counts map[string]Amounts, period time.Duration) map[string]float64 {
+	rates := make(map[string]float64)
+	for bucket, el := range counts {
+		submitted_per_s := float64(el.Submitted) / period.Seconds()
+		max := s.maxTimersPerS(bucket)
+		if uint64(submitted_per_s) > max {
+			rates[bucket] = float64(max) / submitted_per_s
+		}
+	}
+	return rates
+}
+
 func writeHelp(conn net.Conn) {
 	help := `
 commands:
     help                        show this menu
-    sample_rate <metric key>    for given metric, show:
+    auth <token>                authenticate with admin_token, needed for all other commands if it's set.
+    sample_rate <metric key> [-v]
+                                for given metric, show:
                                 <key> <ideal sample rate> <Pckt/s sent (estim)>
-    metric_stats                in the past 10s interval, for every metric show:
+                                with -v, followed by: <Pckt/s received> <max timers/s>
+    metric_stats                in the past sample_rate_window, for every metric show:
                                 <key> <Pckt/s sent (estim)> <Pckt/s received>
     peek_valid                  stream all valid lines seen in real time
                                 until you disconnect or can't keep up.
     peek_invalid                stream all invalid lines seen in real time
                                 until you disconnect or can't keep up.
+    tail_invalid [n]            show the last n (default 10) invalid lines with why they were
+                                rejected, followed by the amount of invalid lines per reason.
+    stats                       show uptime, packets received, flushes and how the last one went,
+                                and how many metrics of each type there are in the current interval.
+    dump <type>                 show the data in the current interval so far, for every metric of the type:
+                                counters, gauges, timers, sets or all. for timers and sets only
+                                the amount of points and members is shown.
+    rewrite <metric key>        show what the metric key is renamed to by rewrite_rules, and by which rule.
+    delete [type] <metric key>  delete all data of the metric, so that it's not sent anymore
+                                (until it gets new data). type is one of counter, gauge, timer
+                                or set. if not specified, it's deleted from all of them.
+    loglevel <level>            change the log level (panic, fatal, error, warning, info, debug or trace)
+                                until the next restart. at debug level, invalid lines are logged too.
+    version                     show the version, go version and git hash statsdaemon was built with.
     wait_flush                  after the next flush, writes 'flush' and closes connection.
                                 this is convenient to restart statsdaemon
                                 with a minimal loss of data like so:
@@ -492,14 +1294,45 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 		}
 		clean_cmd := strings.TrimSpace(string(buf[:n]))
 		command := strings.Split(clean_cmd, " ")
-		log.Debug("[api] received command: '" + clean_cmd + "'")
+		if command[0] == "auth" {
+			log.Debug("[api] received command: 'auth'") // without the token
+		} else {
+			log.Debug("[api] received command: '" + clean_cmd + "'")
+		}
+		ac, _ := conn.(*adminConn)
+		if s.AdminToken != "" && command[0] != "help" && command[0] != "auth" && (ac == nil || !ac.authed) {
+			conn.Write([]byte("authentication required: auth <token>\n"))
+			continue
+		}
 		switch command[0] {
-		case "sample_rate":
+		case "auth":
 			if len(command) != 2 {
 				conn.Write([]byte("invalid request\n"))
 				writeHelp(conn)
 				continue
 			}
+			if s.AdminToken == "" {
+				conn.Write([]byte("no admin_token configured, no need to authenticate\n"))
+				continue
+			}
+			if ac == nil || subtle.ConstantTimeCompare([]byte(command[1]), []byte(s.AdminToken)) != 1 {
+				log.Warnf("[api] failed authentication from %s", conn.RemoteAddr())
+				conn.Write([]byte("authentication failed\n"))
+				continue
+			}
+			ac.authed = true
+			conn.Write([]byte("authenticated\n"))
+			continue
+		case "sample_rate":
+			if (len(command) != 2 && len(command) != 3) || (len(command) == 3 && command[2] != "-v") {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			if s.DisableSampleRateTracking {
+				conn.Write([]byte("sample rate tracking is disabled (sample_rate_tracking = false)\n"))
+				continue
+			}
 			s.metricStatsRequests <- metricsStatsReq{command, &conn}
 			return
 		case "metric_stats":
@@ -508,26 +1341,79 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 				writeHelp(conn)
 				continue
 			}
+			if s.DisableSampleRateTracking {
+				conn.Write([]byte("sample rate tracking is disabled (sample_rate_tracking = false)\n"))
+				continue
+			}
 			s.metricStatsRequests <- metricsStatsReq{command, &conn}
 			return
+		case "stats":
+			if len(command) != 1 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			s.statsRequests <- metricsStatsReq{command, &conn}
+			return
+		case "dump":
+			if len(command) != 2 || !validDumpType(command[1]) {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			s.dumpRequests <- metricsStatsReq{command, &conn}
+			return
+		case "delete":
+			if len(command) < 2 || len(command) > 3 || (len(command) == 3 && !validDeleteType(command[1])) {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			s.deleteRequests <- metricsStatsReq{command, &conn}
+			return
+		case "rewrite":
+			if len(command) != 2 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			renamed, rule := s.Rewriter.Match(command[1])
+			if rule == "" {
+				conn.Write([]byte(fmt.Sprintf("%s is not renamed\n", command[1])))
+			} else {
+				conn.Write([]byte(fmt.Sprintf("%s => %s (rule %s)\n", command[1], renamed, rule)))
+			}
+			continue
 		case "peek_invalid":
 			consumer := make(chan interface{}, 100)
 			s.Invalid_lines.Register(consumer)
-			conn.(*net.TCPConn).SetNoDelay(false)
+			setNoDelay(conn, false)
 			for line := range consumer {
 				conn.Write(line.([]byte))
 				conn.Write([]byte("\n"))
 			}
-			conn.(*net.TCPConn).SetNoDelay(true)
+			setNoDelay(conn, true)
+		case "tail_invalid":
+			n := 10
+			if len(command) == 2 {
+				n, err = strconv.Atoi(command[1])
+			}
+			if len(command) > 2 || err != nil || n < 0 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			s.writeInvalid(conn, n)
+			continue
 		case "peek_valid":
 			consumer := make(chan interface{}, 100)
 			s.valid_lines.Register(consumer)
-			conn.(*net.TCPConn).SetNoDelay(false)
+			setNoDelay(conn, false)
 			for line := range consumer {
 				conn.Write(line.([]byte))
 				conn.Write([]byte("\n"))
 			}
-			conn.(*net.TCPConn).SetNoDelay(true)
+			setNoDelay(conn, true)
 		case "wait_flush":
 			consumer := make(chan interface{}, 10)
 			s.events.Register(consumer)
@@ -536,6 +1422,24 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 			conn.Write([]byte("\n"))
 			conn.Close()
 			break
+		case "loglevel":
+			if len(command) != 2 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			lvl, err := log.ParseLevel(command[1])
+			if err != nil {
+				conn.Write([]byte(fmt.Sprintf("invalid log level %q. panic|fatal|error|warning|info|debug|trace\n", command[1])))
+				continue
+			}
+			prev := s.SetLogLevel(lvl)
+			log.Infof("[api] log level changed from %s to %s", prev, lvl)
+			conn.Write([]byte(fmt.Sprintf("log level changed from %s to %s\n", prev, lvl)))
+			continue
+		case "version":
+			conn.Write([]byte(BuildInfo() + "\n"))
+			continue
 		case "help":
 			writeHelp(conn)
 			continue
@@ -545,37 +1449,247 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 		}
 	}
 }
+
+// SetLogLevel changes the log level and returns the previous one. at debug level (or above), the invalid lines
+// are logged as well.
+func (s *StatsDaemon) SetLogLevel(lvl log.Level) log.Level {
+	s.debugLock.Lock()
+	defer s.debugLock.Unlock()
+	prev := log.GetLevel()
+	log.SetLevel(lvl)
+	if lvl >= log.DebugLevel && s.debugInvalid == nil {
+		consumer := make(chan interface{}, 100)
+		s.Invalid_lines.Register(consumer)
+		s.debugInvalid = consumer
+		go func() {
+			for line := range consumer {
+				log.Debugf("invalid line '%s'", line)
+			}
+			// unregistered, or dropped by the topic because we couldn't keep up
+			s.debugLock.Lock()
+			if s.debugInvalid == consumer {
+				s.debugInvalid = nil
+			}
+			s.debugLock.Unlock()
+		}()
+	} else if lvl < log.DebugLevel && s.debugInvalid != nil {
+		s.Invalid_lines.Unregister(s.debugInvalid)
+		s.debugInvalid = nil
+	}
+	return prev
+}
+
+// adminConn is a connection to the admin interface, that remembers whether it authenticated (see AdminToken).
+// it's passed along with the requests that a Monitor handles, so that handleApiRequest can resume with it.
+type adminConn struct {
+	net.Conn
+	authed bool
+}
+
+// setNoDelay sets TCP_NODELAY on the tcp connection underlying conn, if any
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if ac, ok := conn.(*adminConn); ok {
+		conn = ac.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(noDelay)
+	}
+}
+
+// writeInvalid writes the last n invalid lines, and the amount of invalid lines per reason
+func (s *StatsDaemon) writeInvalid(conn net.Conn, n int) {
+	var buf bytes.Buffer
+	for _, il := range s.invalid.Last(n) {
+		fmt.Fprintf(&buf, "%s %s\n", il.Reason, il.Line)
+	}
+	buf.WriteString("reasons:\n")
+	for i, reason := range out.InvalidReasons {
+		if n := atomic.LoadUint64(&s.output.Stats.Rejected[i]); n > 0 {
+			fmt.Fprintf(&buf, "%s %d\n", reason, n)
+		}
+	}
+	conn.Write(buf.Bytes())
+}
+
+func validDumpType(typ string) bool {
+	switch typ {
+	case "counters", "gauges", "timers", "sets", "all":
+		return true
+	}
+	return false
+}
+
+func validDeleteType(typ string) bool {
+	switch typ {
+	case "counter", "gauge", "timer", "set":
+		return true
+	}
+	return false
+}
+
 func (s *StatsDaemon) adminListener() {
 	l, err := net.Listen("tcp", s.admin_addr)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+		log.Fatalf("ERROR: Listen admin tcp - %s", err)
 	}
 	defer l.Close()
 	log.Info("Listening on " + s.admin_addr)
+	// accepting can fail temporarily, e.g. when we run out of file descriptors. that's no reason to stop the daemon.
+	var backoff common.Backoff
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+			wait := backoff.Next()
+			log.Errorf("ERROR: accepting admin connection - %s. retrying in %s", err, wait)
+			s.Clock.Sleep(wait)
+			continue
 		}
-		go s.handleApiRequest(conn, nil)
+		backoff.Reset()
+		go s.handleApiRequest(&adminConn{Conn: conn}, nil)
 	}
 }
 
-func (s *StatsDaemon) prometheusListener() {
-    http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-	s.pmb = true
-	file, _ := os.OpenFile(os.TempDir()+string(os.PathSeparator)+"prometheus_metrics", os.O_RDONLY, 0666)
-	b, _ := ioutil.ReadAll(file)
-	file.Close()
-        w.Write([]byte(b))
-    })
-    if err := http.ListenAndServe(s.prometheus_addr, nil); err != nil {
-        fmt.Println("Error accepting: ", err.Error())
-        os.Exit(1)
-    }
+// writeInternalMetrics writes statsdaemon's own metrics in the prometheus text format
+func (s *StatsDaemon) writeInternalMetrics(w io.Writer) {
+	metric := func(name, typ, help string, val float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, val)
+	}
+	fmt.Fprintf(w, "# HELP statsdaemon_build_info the build of statsdaemon, always 1\n# TYPE statsdaemon_build_info gauge\n")
+	fmt.Fprintf(w, "statsdaemon_build_info{version=%q,go=%q,githash=%q} 1\n", Version, runtime.Version(), GitHash)
+	metric("statsdaemon_metrics_queue_length", "gauge", "batches of metrics waiting to be processed", float64(s.queueLength()))
+	if s.output != nil {
+		metric("statsdaemon_packets_total", "counter", "udp packets received", float64(atomic.LoadUint64(&s.output.Stats.Packets)))
+		metric("statsdaemon_udp_read_errors_total", "counter", "failed udp reads", float64(atomic.LoadUint64(&s.output.Stats.ReadErrors)))
+		metric("statsdaemon_invalid_lines_total", "counter", "lines that could not be parsed", float64(atomic.LoadUint64(&s.output.Stats.InvalidLines)))
+		metric("statsdaemon_metrics_dropped_total", "counter", "metrics dropped because aggregation couldn't keep up, see overflow_policy", float64(atomic.LoadUint64(&s.output.Stats.Dropped)))
+		if udp.KernelDropsSupported {
+			metric("statsdaemon_udp_kernel_drops", "gauge", "udp packets the kernel dropped because the receive buffer was full, since the socket(s) were opened. see udp_recv_buffer", float64(atomic.LoadUint64(&s.output.Stats.KernelDrops)))
+		}
+		fmt.Fprint(w, "# HELP statsdaemon_invalid_lines_by_reason_total lines that could not be parsed, per reason\n# TYPE statsdaemon_invalid_lines_by_reason_total counter\n")
+		for i, reason := range out.InvalidReasons {
+			fmt.Fprintf(w, "statsdaemon_invalid_lines_by_reason_total{reason=%q} %d\n", reason, atomic.LoadUint64(&s.output.Stats.Rejected[i]))
+		}
+	}
+	if s.Forwarder != nil {
+		metric("statsdaemon_forwarded_lines_total", "counter", "lines forwarded to forward_addr", float64(atomic.LoadUint64(&s.Forwarder.Forwarded)))
+		metric("statsdaemon_forward_dropped_lines_total", "counter", "lines to forward that were dropped because the forwarder couldn't keep up", float64(atomic.LoadUint64(&s.Forwarder.Dropped)))
+		metric("statsdaemon_forward_write_errors_total", "counter", "packets that could not be forwarded", float64(atomic.LoadUint64(&s.Forwarder.WriteErrors)))
+	}
+	if len(s.MaxBuckets) > 0 {
+		fmt.Fprint(w, "# HELP statsdaemon_buckets_rejected_total metrics of new buckets dropped because max_buckets was reached, per type\n# TYPE statsdaemon_buckets_rejected_total counter\n")
+		for _, typ := range []string{"counter", "gauge", "timer", "set"} {
+			fmt.Fprintf(w, "statsdaemon_buckets_rejected_total{type=%q} %d\n", typ, atomic.LoadUint64(&s.limitStats[typ].rejected))
+		}
+		fmt.Fprint(w, "# HELP statsdaemon_buckets_evicted_total buckets deleted to make room for new ones because max_buckets was reached, per type\n# TYPE statsdaemon_buckets_evicted_total counter\n")
+		for _, typ := range []string{"counter", "gauge", "timer", "set"} {
+			fmt.Fprintf(w, "statsdaemon_buckets_evicted_total{type=%q} %d\n", typ, atomic.LoadUint64(&s.limitStats[typ].evicted))
+		}
+	}
+	metric("statsdaemon_timer_points_dropped_total", "counter", "timer points left out of the samples, see timer_reservoir_size", float64(atomic.LoadUint64(&s.timerPointsDropped)))
+	if s.EnforceSampleRate {
+		metric("statsdaemon_timer_points_sampled_out_total", "counter", "timer points dropped to enforce the sample rate, see enforce_sample_rate", float64(atomic.LoadUint64(&s.sampler.Dropped)))
+	}
+	metric("statsdaemon_output_write_failures_total", "counter", "failed writes to the output backend(s)", float64(atomic.LoadUint64(&s.writeFailures)))
+	if !s.DisableSampleRateTracking {
+		fmt.Fprint(w, "# HELP statsdaemon_sample_rate_tracker_buckets buckets tracked for the sample_rate and metric_stats admin commands, per period\n# TYPE statsdaemon_sample_rate_tracker_buckets gauge\n")
+		fmt.Fprintf(w, "statsdaemon_sample_rate_tracker_buckets{period=\"current\"} %d\n", atomic.LoadInt64(&s.trackerCurBuckets))
+		fmt.Fprintf(w, "statsdaemon_sample_rate_tracker_buckets{period=\"previous\"} %d\n", atomic.LoadInt64(&s.trackerPrevBuckets))
+		metric("statsdaemon_sample_rate_tracker_swap_timestamp_seconds", "gauge", "unix time the current period of the sample rate tracker started, 0 until the first one ended", float64(atomic.LoadInt64(&s.trackerSwap)))
+	}
+	if len(s.graphiteOutputs) > 0 {
+		addrs := make([]string, 0, len(s.graphiteOutputs))
+		for addr := range s.graphiteOutputs {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		perAddr := func(name, help string, val func(st *backend.GraphiteStats) *uint64) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+			for _, addr := range addrs {
+				fmt.Fprintf(w, "%s{addr=%q} %d\n", name, addr, atomic.LoadUint64(val(&s.graphiteOutputs[addr].Stats)))
+			}
+		}
+		perAddr("statsdaemon_graphite_metrics_total", "metrics written to graphite, including those of failed writes",
+			func(st *backend.GraphiteStats) *uint64 { return &st.Metrics })
+		perAddr("statsdaemon_graphite_bytes_expected_total", "bytes written to graphite, including those of failed writes",
+			func(st *backend.GraphiteStats) *uint64 { return &st.BytesExpected })
+		perAddr("statsdaemon_graphite_bytes_written_total", "bytes graphite's connection accepted",
+			func(st *backend.GraphiteStats) *uint64 { return &st.BytesWritten })
+	}
+
+	s.flushDurationsLock.Lock()
+	defer s.flushDurationsLock.Unlock()
+	if len(s.flushDurations) == 0 {
+		return
+	}
+	types := make([]string, 0, len(s.flushDurations))
+	for typ := range s.flushDurations {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	metric("statsdaemon_flush_lag_seconds", "gauge", "how long after it was due the last flush was processed", time.Duration(atomic.LoadInt64(&s.flushLag)).Seconds())
+	fmt.Fprint(w, "# HELP statsdaemon_flush_duration_seconds time spent computing the metrics of the last flush, per type\n# TYPE statsdaemon_flush_duration_seconds gauge\n")
+	for _, typ := range types {
+		fmt.Fprintf(w, "statsdaemon_flush_duration_seconds{type=%q} %v\n", typ, s.flushDurations[typ])
+	}
 }
 
+// health is the status reported by /health and /ready
+type health struct {
+	Healthy              bool  `json:"healthy"`
+	UDPListening         bool  `json:"udp_listening"`
+	LastFlush            int64 `json:"last_flush"`
+	MetricsQueue         int   `json:"metrics_queue"`
+	MetricsQueueCapacity int   `json:"metrics_queue_capacity"`
+}
 
+// healthHandler reports healthy (200) if the udp listener is bound and the last successful flush
+// was no more than HealthMaxIntervals flush intervals ago. otherwise 503.
+func (s *StatsDaemon) healthHandler(w http.ResponseWriter, r *http.Request) {
+	h := health{
+		UDPListening:         atomic.LoadInt32(&s.udpListening) == 1,
+		LastFlush:            atomic.LoadInt64(&s.lastFlush),
+		MetricsQueue:         s.queueLength(),
+		MetricsQueueCapacity: s.queueCapacity(),
+	}
+	maxAge := int64(s.HealthMaxIntervals * s.flushInterval)
+	h.Healthy = h.UDPListening && s.Clock.Now().Unix()-h.LastFlush <= maxAge
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// snapshotHandler serves the current state of all metrics as json, see snapshot. it doesn't reset anything.
+func (s *StatsDaemon) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan *snapshot, 1)
+	s.snapshotRequests <- reply
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(<-reply)
+}
+
+func (s *StatsDaemon) prometheusListener() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/ready", s.healthHandler)
+	mux.HandleFunc("/snapshot", s.snapshotHandler)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.pmb = true
+		file, _ := os.OpenFile(os.TempDir()+string(os.PathSeparator)+"prometheus_metrics", os.O_RDONLY, 0666)
+		b, _ := ioutil.ReadAll(file)
+		file.Close()
+		w.Write([]byte(b))
+		if s.summaries != nil {
+			s.summaries.Write(w)
+		}
+		if s.exposed != nil {
+			s.exposed.Write(w)
+		}
+		s.writeInternalMetrics(w)
+	})
+	// ListenAndServe retries failed accepts itself, so this is a failure to listen
+	if err := http.ListenAndServe(s.prometheus_addr, mux); err != nil {
+		log.Fatalf("ERROR: Listen prometheus tcp - %s", err)
+	}
+}
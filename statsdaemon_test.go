@@ -1,7 +1,21 @@
 package statsdaemon
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -9,9 +23,11 @@ import (
 
 	"github.com/benbjohnson/clock"
 	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/backend"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
 	"github.com/raintank/statsdaemon/udp"
+	log "github.com/sirupsen/logrus"
 )
 
 var output = out.NullOutput()
@@ -56,7 +72,7 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "gaugor", packet.Bucket)
 	assert.Equal(t, float64(333), packet.Value)
 	assert.Equal(t, "g", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	d = []byte("gorets:2|c|@0.1")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -65,7 +81,7 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(2), packet.Value)
 	assert.Equal(t, "c", packet.Modifier)
-	assert.Equal(t, float32(0.1), packet.Sampling)
+	assert.Equal(t, float64(0.1), packet.Sampling)
 
 	d = []byte("gorets:4|c")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -74,16 +90,15 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(4), packet.Value)
 	assert.Equal(t, "c", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	d = []byte("gorets:-4|c")
-	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
-	assert.Equal(t, len(packets), 1)
-	packet = packets[0]
+	packet, err := udp.ParseLine(d)
+	assert.Equal(t, nil, err)
 	assert.Equal(t, "gorets", packet.Bucket)
 	assert.Equal(t, float64(-4), packet.Value)
 	assert.Equal(t, "c", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	d = []byte("glork:320|ms")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -92,7 +107,7 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "glork", packet.Bucket)
 	assert.Equal(t, float64(320), packet.Value)
 	assert.Equal(t, "ms", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	d = []byte("a.key.with-0.dash:4|c")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -101,7 +116,7 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
 	assert.Equal(t, float64(4), packet.Value)
 	assert.Equal(t, "c", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	d = []byte("a.key.with-0.dash:4|c\ngauge:3|g")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -110,13 +125,13 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "a.key.with-0.dash", packet.Bucket)
 	assert.Equal(t, float64(4), packet.Value)
 	assert.Equal(t, "c", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	packet = packets[1]
 	assert.Equal(t, "gauge", packet.Bucket)
 	assert.Equal(t, float64(3), packet.Value)
 	assert.Equal(t, "g", packet.Modifier)
-	assert.Equal(t, float32(1), packet.Sampling)
+	assert.Equal(t, float64(1), packet.Sampling)
 
 	errors_key := "internal.mtype_is_count.type_is_invalid_line.unit_is_Err"
 	d = []byte("a.key.with-0.dash:4\ngauge3|g")
@@ -131,6 +146,64 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, packets[0].Bucket, errors_key)
 }
 
+func TestFoldTags(t *testing.T) {
+	m := &common.Metric{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1, Tags: map[string]string{"region": "eu.west", "env": "prod"}}
+	f := out.Formatter{Tag_format: out.TagsDotted}
+	assert.Equal(t, "foo.env_is_prod.region_is_eu_west", f.FoldTags(m).Bucket)
+	assert.Equal(t, "foo", m.Bucket)
+
+	f = out.Formatter{Tag_format: out.TagsNone}
+	assert.Equal(t, m, f.FoldTags(m))
+
+	f = out.Formatter{Tag_format: out.TagsGraphite}
+	m.Tags["url"] = "a;b=c"
+	assert.Equal(t, "foo;env:prod;region:eu_west;url:a_b=c", f.FoldTags(m).Bucket)
+}
+
+func TestGraphiteTags(t *testing.T) {
+	f := formatM1Legacy
+	f.Tag_format = out.TagsGraphite
+	stats, _ := out.NewTimerStats("upper_pct,count")
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("90")
+	ti := out.NewTimers(*pct, 0, 0, 0, false)
+	c := out.NewCounters(true, false, 0, false)
+	for _, m := range udp.ParseMessage([]byte("foo:5|ms|#region:eu,env:prod\nbar:1|c|#env:prod\nbaz:1|c"), "", output, udp.ParseLine2) {
+		m = f.FoldTags(m)
+		if m.Modifier == "ms" {
+			ti.Add(m)
+		} else {
+			c.Add(m)
+		}
+	}
+	buf, _ := ti.Process(nil, 10, 10, f)
+	assert.Equal(t, "stats.timers.foo.upper_90;env=prod;region=eu 5 10\nstats.timers.foo.count;env=prod;region=eu 1 10\n", string(f.Namespace(buf)))
+	f.Global_prefix = "dc1."
+	f.Global_suffix = ".eu"
+	buf, _ = c.Process(nil, 10, 10, f)
+	lines := strings.Split(string(f.Namespace(buf)), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"", "dc1.stats.bar.eu;env=prod 0.1 10", "dc1.stats.baz.eu 0.1 10"}, lines)
+}
+
+func TestStaticTags(t *testing.T) {
+	tags, err := out.ParseTags("env=prod, cluster=eu.1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{"env": "prod", "cluster": "eu.1"}, tags)
+	_, err = out.ParseTags("env")
+	assert.NotEqual(t, nil, err)
+
+	m := &common.Metric{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1, Tags: map[string]string{"env": "dev", "region": "eu"}}
+	buf := []byte("stats.foo 1 10\nstats.foo;region:eu.count 1 10\n")
+	f := out.Formatter{Tag_format: out.TagsDotted, Static_tags: tags, Global_suffix: ".x"}
+	assert.Equal(t, "foo.region_is_eu", f.FoldTags(m).Bucket)
+	assert.Equal(t, "stats.foo.x.cluster_is_eu_1.env_is_prod 1 10\n", string(f.Namespace(buf[:15])))
+
+	f = out.Formatter{Tag_format: out.TagsGraphite, Static_tags: tags}
+	assert.Equal(t, "foo;region:eu", f.FoldTags(m).Bucket)
+	assert.Equal(t, "stats.foo;cluster=eu_1;env=prod 1 10\nstats.foo.count;region=eu;cluster=eu_1;env=prod 1 10\n", string(f.Namespace(buf)))
+}
+
 func processTimer(ti *out.Timers, input string, f out.Formatter) (string, int64) {
 	packets := udp.ParseMessage([]byte(input), "", output, udp.ParseLine)
 	for _, p := range packets {
@@ -151,7 +224,7 @@ func processCounter(cnt *out.Counters, input string, f out.Formatter) (string, i
 }
 
 func TestTimerM1(t *testing.T) {
-	got, num := processTimer(out.NewTimers(out.Percentiles{}), "response_time:0|ms\nresponse_time:30|ms\nresponse_time:30|ms", formatM1Legacy)
+	got, num := processTimer(out.NewTimers(out.Percentiles{}, 0, 0, 0, false), "response_time:0|ms\nresponse_time:30|ms\nresponse_time:30|ms", formatM1Legacy)
 	assert.Equal(t, num, int64(1))
 	exp := "stats.timers.response_time.mean 20 "
 	if !strings.Contains(got, exp) {
@@ -173,7 +246,7 @@ func TestTimerM1(t *testing.T) {
 
 func TestTimerM20(t *testing.T) {
 	pct, _ := out.NewPercentiles("75")
-	got, num := processTimer(out.NewTimers(*pct), "direction=out.unit=ms.mtype=gauge:0|ms\ndirection=out.unit=ms.mtype=gauge:30|ms\ndirection=out.unit=ms.mtype=gauge:30|ms", formatM20)
+	got, num := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "direction=out.unit=ms.mtype=gauge:0|ms\ndirection=out.unit=ms.mtype=gauge:30|ms\ndirection=out.unit=ms.mtype=gauge:30|ms", formatM20)
 	assert.Equal(t, num, int64(1))
 	exps := []string{
 
@@ -197,8 +270,472 @@ func TestTimerM20(t *testing.T) {
 
 }
 
+func TestTimerHistograms(t *testing.T) {
+	_, err := out.NewHistograms("api.*=10,x")
+	assert.NotEqual(t, nil, err)
+	_, err = out.NewHistograms("=10")
+	assert.NotEqual(t, nil, err)
+
+	histograms, err := out.NewHistograms("db.*=1,0.5; 10,50")
+	assert.Equal(t, nil, err)
+	f := formatM1Legacy
+	f.Timer_histograms = histograms
+	stats, _ := out.NewTimerStats("count")
+	f.Timer_stats = stats
+
+	got, _ := processTimer(out.NewTimers(out.Percentiles{}, 0, 0, 0, false), "api.get:5|ms\napi.get:10|ms\napi.get:30|ms\napi.get:100|ms", f)
+	assert.Equal(t, "stats.timers.api.get.le_10 2 ;stats.timers.api.get.le_50 3 ;stats.timers.api.get.le_inf 4 ;stats.timers.api.get.count 4 ", stripTimestamps(got))
+
+	got, _ = processTimer(out.NewTimers(out.Percentiles{}, 0, 0, 0, false), "db.query:0.2|ms\ndb.query:0.7|ms", f)
+	assert.Equal(t, "stats.timers.db.query.le_0_5 1 ;stats.timers.db.query.le_1 2 ;stats.timers.db.query.le_inf 2 ;stats.timers.db.query.count 2 ", stripTimestamps(got))
+}
+
+// stripTimestamps removes the timestamps from the lines in buf, and joins them with semicolons
+func stripTimestamps(buf string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(buf), "\n") {
+		lines = append(lines, line[:strings.LastIndex(line, " ")+1])
+	}
+	return strings.Join(lines, ";")
+}
+
+func TestTimerReservoir(t *testing.T) {
+	ti := out.NewTimers(out.Percentiles{}, 0, 10, 0, false)
+	for i := 1; i <= 1000; i++ {
+		ti.Add(&common.Metric{Bucket: "t", Value: float64(i), Modifier: "ms", Sampling: 1})
+	}
+	assert.Equal(t, 10, len(ti.Values["t"].Points))
+	assert.Equal(t, int64(990), ti.Dropped())
+
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("count,sum,mean,upper,lower")
+	f.Timer_stats = stats
+	buf, _ := ti.Process(nil, 1, 10, f)
+	assert.Equal(t, "stats.timers.t.mean 500.5 ;stats.timers.t.sum 500500 ;stats.timers.t.upper 1000 ;stats.timers.t.lower 1 ;stats.timers.t.count 1000 ", stripTimestamps(string(buf)))
+
+	// the counts are those of what was submitted, not of the points that were kept
+	ti = out.NewTimers(out.Percentiles{}, 0, 10, 0, false)
+	for i := 1; i <= 1000; i++ {
+		ti.Add(&common.Metric{Bucket: "t", Value: float64(i), Modifier: "ms", Sampling: 0.1})
+	}
+	assert.Equal(t, 10, len(ti.Values["t"].Points))
+	f.Timer_stats, _ = out.NewTimerStats("count,count_ps")
+	buf, _ = ti.Process(nil, 1, 10, f)
+	assert.Equal(t, "stats.timers.t.count 10000 ;stats.timers.t.count_ps 1000 ", stripTimestamps(string(buf)))
+}
+
+func TestTimersRelease(t *testing.T) {
+	ti := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	for i := 1; i <= 3; i++ {
+		ti.Add(&common.Metric{Bucket: "t", Value: float64(i), Modifier: "ms", Sampling: 1})
+	}
+	ti.Release()
+	assert.Equal(t, 0, len(ti.Values))
+
+	// a reused slice starts out empty
+	ti = out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	ti.Add(&common.Metric{Bucket: "u", Value: 5, Modifier: "ms", Sampling: 1})
+	assert.Equal(t, out.Float64Slice{5}, ti.Values["u"].Points)
+}
+
+func TestNewPercentiles(t *testing.T) {
+	pct, err := out.NewPercentiles("90, 75,-10 ,99.9")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "[90 75 -10 99_9]", pct.String())
+
+	for _, bad := range []string{"0", "100", "101", "-100", "9o", "NaN", "90,,x"} {
+		_, err := out.NewPercentiles(bad)
+		if err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+	_, err = out.NewPercentiles("90,abc")
+	assert.Equal(t, `invalid percentile "abc": not a number`, err.Error())
+
+	var pctls out.Percentiles
+	assert.Equal(t, nil, pctls.Set("90"))
+	assert.Equal(t, nil, pctls.Set("-5"))
+	assert.Equal(t, "[90 -5]", pctls.String())
+	assert.NotEqual(t, nil, pctls.Set("100"))
+}
+
+func TestPercentileLinear(t *testing.T) {
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("upper_pct,sum_pct,count_pct")
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("75,-25")
+	input := "t:10|ms\nt:20|ms\nt:30|ms\nt:40|ms"
+
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), input, f)
+	assert.Equal(t, "stats.timers.t.upper_75 30 ;stats.timers.t.sum_75 60 ;stats.timers.t.count_75 3 ;"+
+		"stats.timers.t.lower_25 40 ;stats.timers.t.sum_25 40 ;stats.timers.t.count_25 1 ", stripTimestamps(got))
+
+	f.Percentile_method = out.PercentileLinear
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 0, false), input, f)
+	// both use rank 0.75 * (4-1) = 2.25, between 30 and 40
+	assert.Equal(t, "stats.timers.t.upper_75 32.5 ;stats.timers.t.sum_75 60 ;stats.timers.t.count_75 3 ;"+
+		"stats.timers.t.lower_25 32.5 ;stats.timers.t.sum_25 40 ;stats.timers.t.count_25 1 ", stripTimestamps(got))
+}
+
+func TestTimerStats(t *testing.T) {
+	_, err := out.NewTimerStats("mean,foo")
+	assert.NotEqual(t, nil, err)
+
+	stats, err := out.NewTimerStats("mean, upper_pct,count")
+	assert.Equal(t, nil, err)
+	f := formatM1Legacy
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("75")
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "response_time:0|ms\nresponse_time:30|ms\nresponse_time:30|ms", f)
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	assert.Equal(t, 3, len(lines))
+	for i, exp := range []string{"stats.timers.response_time.upper_75 30 ", "stats.timers.response_time.mean 20 ", "stats.timers.response_time.count 3 "} {
+		if !strings.HasPrefix(lines[i], exp) {
+			t.Fatalf("output %q does not start with %q", lines[i], exp)
+		}
+	}
+}
+
+func TestTimerMedianStdPct(t *testing.T) {
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("count_pct,median_pct,std_pct")
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("75,20,-50")
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:10|ms\nt:20|ms\nt:30|ms\nt:40|ms\nt:1000|ms", f)
+	// the lowest 4 points for the 75th percentile, the lowest one for the 20th. none for lower percentiles
+	assert.Equal(t, "stats.timers.t.count_75 4 ;stats.timers.t.median_75 25 ;stats.timers.t.std_75 11.180339887498949 ;"+
+		"stats.timers.t.count_20 1 ;stats.timers.t.median_20 10 ;stats.timers.t.std_20 0 ;"+
+		"stats.timers.t.count_50 2 ", stripTimestamps(got))
+
+	// with a single point, they're those of all points
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:10|ms", f)
+	assert.Equal(t, "stats.timers.t.count_75 1 ;stats.timers.t.median_75 10 ;stats.timers.t.std_75 0 ;"+
+		"stats.timers.t.count_20 1 ;stats.timers.t.median_20 10 ;stats.timers.t.std_20 0 ;"+
+		"stats.timers.t.count_50 1 ", stripTimestamps(got))
+}
+
+func TestSummaries(t *testing.T) {
+	f := formatM1Legacy
+	f.Timer_scale = 0.001
+	pct, _ := out.NewPercentiles("75,-50")
+	sums := out.NewSummaries()
+	add := func(input string) string {
+		ti := out.NewTimers(*pct, 0, 0, 0, false)
+		for _, m := range udp.ParseMessage([]byte(input), "", output, udp.ParseLine) {
+			ti.Add(m)
+		}
+		sums.Update(ti, f)
+		var buf bytes.Buffer
+		sums.Write(&buf)
+		return buf.String()
+	}
+	assert.Equal(t, "# TYPE api_get summary\napi_get{quantile=\"0.75\"} 0.03\napi_get{quantile=\"0.5\"} 0.03\napi_get_sum 0.1\napi_get_count 4\n",
+		add("api.get:10|ms\napi.get:20|ms\napi.get:30|ms\napi.get:40|ms"))
+	// _sum and _count are cumulative, and the quantiles disappear when there are no new points
+	assert.Equal(t, "# TYPE _5xx summary\n_5xx{quantile=\"0.75\"} 0.005\n_5xx{quantile=\"0.5\"} 0.005\n_5xx_sum 0.005\n_5xx_count 1\n"+
+		"# TYPE api_get summary\napi_get_sum 0.1\napi_get_count 4\n", add("5xx:5|ms"))
+	got := add("api.get:50|ms|@0.5")
+	assert.T(t, strings.Contains(got, "api_get{quantile=\"0.75\"} 0.05\napi_get{quantile=\"0.5\"} 0.05\napi_get_sum 0.15000000000000002\napi_get_count 5\n"), got)
+
+	assert.Equal(t, "foo_bar:baz_1_x", out.PrometheusName("foo.bar:baz=1-x"))
+}
+
+func TestExposed(t *testing.T) {
+	exposed := out.NewExposed()
+	add := func(c *out.Counters, input string) string {
+		g := out.NewGauges(false, 0, false)
+		for _, m := range udp.ParseMessage([]byte(input), "", output, udp.ParseLine) {
+			if m.Modifier == "g" {
+				g.Add(m)
+			} else {
+				c.Add(m)
+			}
+		}
+		exposed.Update(c, g)
+		var buf bytes.Buffer
+		exposed.Write(&buf)
+		return buf.String()
+	}
+	assert.Equal(t, "# TYPE api_hits_total counter\napi_hits_total 12\n# TYPE requests_total counter\nrequests_total 1\n# TYPE api_users gauge\napi_users 5\n",
+		add(out.NewCounters(true, false, 0, false), "api.hits:2|c\napi.hits:5|c|@0.5\nrequests_total:1|c\napi.users:5|g"))
+	// counters add up across intervals, gauges keep their last value
+	assert.Equal(t, "# TYPE api_hits_total counter\napi_hits_total 13\n# TYPE requests_total counter\nrequests_total 1\n# TYPE api_users gauge\napi_users 7\n",
+		add(out.NewCounters(true, false, 0, false), "api.hits:1|c\napi.users:7|g"))
+
+	// cumulative counters are flushed with their totals already
+	exposed = out.NewExposed()
+	c := out.NewCounters(true, false, 0, true)
+	c.Add(&common.Metric{Bucket: "hits", Value: 3, Sampling: 1})
+	next := c.Next()
+	exposed.Update(c, out.NewGauges(false, 0, false))
+	next.Add(&common.Metric{Bucket: "hits", Value: 4, Sampling: 1})
+	next.Next()
+	exposed.Update(next, out.NewGauges(false, 0, false))
+	var buf bytes.Buffer
+	exposed.Write(&buf)
+	assert.Equal(t, "# TYPE hits_total counter\nhits_total 7\n", buf.String())
+}
+
+func TestPercentileSuffix(t *testing.T) {
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("upper_pct,count_pct")
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("99.9,-50")
+	for format, want := range map[string]string{
+		"":                             "stats.timers.t.upper_99_9 2 ;stats.timers.t.count_99_9 2 ;stats.timers.t.lower_50 2 ;stats.timers.t.count_50 1 ",
+		out.PercentileSuffixUnderscore: "stats.timers.t.upper_99_9 2 ;stats.timers.t.count_99_9 2 ;stats.timers.t.lower_50 2 ;stats.timers.t.count_50 1 ",
+		out.PercentileSuffixPPrefix:    "stats.timers.t.upper_p99_9 2 ;stats.timers.t.count_p99_9 2 ;stats.timers.t.lower_p50 2 ;stats.timers.t.count_p50 1 ",
+		out.PercentileSuffixRaw:        "stats.timers.t.upper_99.9 2 ;stats.timers.t.count_99.9 2 ;stats.timers.t.lower_50 2 ;stats.timers.t.count_50 1 ",
+	} {
+		f.Percentile_suffix = format
+		got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:1|ms\nt:2|ms", f)
+		assert.Equal(t, want, stripTimestamps(got), format)
+	}
+}
+
+func TestStatSeparator(t *testing.T) {
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("upper_pct,count")
+	f.Timer_stats = stats
+	pct, _ := out.NewPercentiles("90")
+	for sep, want := range map[string]string{
+		"":                    "stats.timers.t.upper_90 2 ;stats.timers.t.count 2 ",
+		";":                   "stats.timers.t;upper_90 2 ;stats.timers.t;count 2 ",
+		out.StatSeparatorNone: "stats.timers.tupper_90 2 ;stats.timers.tcount 2 ",
+	} {
+		f.Stat_separator = sep
+		got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:1|ms\nt:2|ms", f)
+		assert.Equal(t, want, stripTimestamps(got), sep)
+	}
+
+	// legacy counters have no stat, without legacy_namespace they do
+	f.Stat_separator = ";"
+	got, _ := processCounter(out.NewCounters(true, true, 0, false), "c:3|c", f)
+	assert.Equal(t, "stats_counts.c 3 ;stats.c 0.3 ", stripTimestamps(got))
+	f.Legacy_namespace = false
+	f.Prefix_counters, f.Prefix_rates = "stats.counters.", "stats.counters."
+	got, _ = processCounter(out.NewCounters(true, true, 0, false), "c:3|c\nc.unit_is_req.mtype_is_count:3|c", f)
+	for _, exp := range []string{"stats.counters.c;count 3 ", "stats.counters.c;rate 0.3 ", "c.unit_is_req.mtype_is_count 3 "} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in output:\n%s", exp, got)
+		}
+	}
+
+	// with graphite tags, the stat comes before them
+	f.Stat_separator = "_"
+	f.Tag_format = out.TagsGraphite
+	ti := out.NewTimers(*pct, 0, 0, 0, false)
+	ti.Add(f.FoldTags(&common.Metric{Bucket: "t", Value: 1, Modifier: "ms", Sampling: 1, Tags: map[string]string{"env": "prod"}}))
+	buf, _ := ti.Process(nil, 1, 10, f)
+	assert.Equal(t, "stats.timers.t_upper_90;env=prod 1 ;stats.timers.t_count;env=prod 1 ", stripTimestamps(string(f.Namespace(buf))))
+}
+
+func TestValuePrecision(t *testing.T) {
+	defer func() { out.ValuePrecision = -1 }()
+	for _, c := range []struct {
+		precision int
+		val       float64
+		want      string
+	}{
+		{-1, 1, "1"},
+		{-1, 12.3456789, "12.3456789"},
+		{-1, 1e-9, "0.000000001"},
+		{3, 1, "1"},
+		{3, 1000000, "1000000"},
+		{3, 12.3456789, "12.346"},
+		{3, -12.3456789, "-12.346"},
+		{3, 0.1, "0.1"},
+		{3, 0.0000123, "0.0000123"},
+		{3, -0.00012345, "-0.000123"},
+		{3, 0, "0"},
+		{3, 1e21, "1000000000000000000000"},
+		{0, 2.6, "3"},
+		{0, 0.3, "0.3"},
+		{0, 0.0000123, "0.00001"},
+	} {
+		out.ValuePrecision = c.precision
+		got := string(out.WriteFloat64(nil, []byte("a"), c.val, 10))
+		assert.Equal(t, "a "+c.want+" 10\n", got, c.precision, c.val)
+	}
+
+	out.ValuePrecision = 2
+	stats, _ := out.NewTimerStats("mean,count")
+	f := formatM1Legacy
+	f.Timer_stats = stats
+	got, _ := processTimer(out.NewTimers(out.Percentiles{}, 0, 0, 0, false), "t:1|ms\nt:2|ms\nt:2|ms", f)
+	assert.Equal(t, "stats.timers.t.mean 1.67 ;stats.timers.t.count 3 ", stripTimestamps(got))
+}
+
+func TestSetTimestamps(t *testing.T) {
+	buf := []byte("stats.a 1 1500000000\nstats.b 2.5 1500000000\n")
+	at := time.Unix(1500000000, 250400000)
+	assert.Equal(t, string(buf), string(out.SetTimestamps(buf, at, time.Second)))
+	assert.Equal(t, string(buf), string(out.SetTimestamps(buf, at, 0)))
+	assert.Equal(t, "stats.a 1 1500000000.250\nstats.b 2.5 1500000000.250\n", string(out.SetTimestamps(buf, at, time.Millisecond)))
+	assert.Equal(t, "stats.a 1 1500000000.250400000\nstats.b 2.5 1500000000.250400000\n", string(out.SetTimestamps(buf, at, time.Nanosecond)))
+	assert.Equal(t, int64(250000000), out.SubSecond(at, time.Millisecond))
+	assert.Equal(t, int64(0), out.SubSecond(at, time.Second))
+}
+
+func TestTimerDigest(t *testing.T) {
+	pct, _ := out.NewPercentiles("50,90,99,99.9,-10")
+	// with few points, all centroids hold a single point, so the estimates are exact
+	exact := out.NewTimers(*pct, 0, 0, 0, false)
+	approx := out.NewTimers(*pct, 0, 0, out.DigestCompression, false)
+	for i := 1; i <= 10; i++ {
+		m := &common.Metric{Bucket: "t", Value: float64(i), Sampling: 1}
+		exact.Add(m)
+		approx.Add(m)
+	}
+	e, a := exact.Snapshot(out.Formatter{})["t"], approx.Snapshot(out.Formatter{})["t"]
+	for _, stat := range []string{"count", "points", "lower", "upper", "mean", "upper_90", "upper_99", "lower_10"} {
+		assert.Equal(t, e[stat], a[stat], stat)
+	}
+	f := formatM1Legacy
+	f.Timer_stats, _ = out.NewTimerStats("upper_pct,sum_pct,count_pct,std,count")
+	f.Timer_histograms, _ = out.NewHistograms("3.5,7")
+	buf, _ := approx.Process(nil, 10, 10, f)
+	lines := strings.Split(stripTimestamps(string(buf)), ";")
+	for _, exp := range []string{"stats.timers.t.upper_90 9 ", "stats.timers.t.sum_90 45 ", "stats.timers.t.count_90 9 ",
+		"stats.timers.t.le_3_5 3 ", "stats.timers.t.le_7 7 ", "stats.timers.t.le_inf 10 ", "stats.timers.t.std 2.8722813232690143 "} {
+		found := false
+		for _, line := range lines {
+			found = found || line == exp
+		}
+		if !found {
+			t.Errorf("expected %q in %v", exp, lines)
+		}
+	}
+
+	// with many points, the percentiles should be within a small fraction of their rank, on uniform and skewed
+	// distributions. the points go to two timers, which are merged, like with shards.
+	rnd := rand.New(rand.NewSource(1))
+	for name, gen := range map[string]func() float64{
+		"uniform":     func() float64 { return rnd.Float64() * 1000 },
+		"exponential": func() float64 { return rnd.ExpFloat64() * 100 },
+	} {
+		exact := out.NewTimers(*pct, 0, 0, 0, false)
+		approx := out.NewTimers(*pct, 0, 0, out.DigestCompression, false)
+		other := out.NewTimers(*pct, 0, 0, out.DigestCompression, false)
+		var points []float64
+		for i := 0; i < 100000; i++ {
+			m := &common.Metric{Bucket: "t", Value: gen(), Sampling: 1}
+			points = append(points, m.Value)
+			exact.Add(m)
+			if i%2 == 0 {
+				approx.Add(m)
+			} else {
+				other.Add(m)
+			}
+		}
+		approx.Merge(other)
+		sort.Float64s(points)
+		// rank returns the fraction of the points below v
+		rank := func(v float64) float64 {
+			return float64(sort.SearchFloat64s(points, v)) / float64(len(points))
+		}
+		e, a := exact.Snapshot(out.Formatter{})["t"], approx.Snapshot(out.Formatter{})["t"]
+		assert.Equal(t, e["count"], a["count"], name)
+		assert.Equal(t, e["upper"], a["upper"], name)
+		for stat, maxErr := range map[string]float64{"upper_50": 0.005, "upper_90": 0.005, "upper_99": 0.002, "upper_99_9": 0.001, "lower_10": 0.005} {
+			if diff := math.Abs(rank(a[stat]) - rank(e[stat])); diff > maxErr {
+				t.Errorf("%s: %s is %f (rank %f), exact %f (rank %f)", name, stat, a[stat], rank(a[stat]), e[stat], rank(e[stat]))
+			}
+		}
+	}
+}
+
+func TestTimerPercentiles(t *testing.T) {
+	_, err := out.NewPercentileSets("db.*")
+	assert.NotEqual(t, nil, err)
+	_, err = out.NewPercentileSets("=90")
+	assert.NotEqual(t, nil, err)
+	_, err = out.NewPercentileSets("db.*=100")
+	assert.NotEqual(t, nil, err)
+
+	f := formatM1Legacy
+	f.Timer_stats, _ = out.NewTimerStats("upper_pct")
+	f.Timer_percentiles, err = out.NewPercentileSets("db.*=99,99.9; http.*=50; debug.*=")
+	assert.Equal(t, nil, err)
+	pct, _ := out.NewPercentiles("90")
+	ti := out.NewTimers(*pct, 0, 0, 0, false)
+	for _, bucket := range []string{"db.query", "http.get", "debug.x", "other"} {
+		for i := 1; i <= 10; i++ {
+			ti.Add(&common.Metric{Bucket: bucket, Value: float64(i), Sampling: 1})
+		}
+	}
+	buf, _ := ti.Process(nil, 10, 10, f)
+	lines := strings.Split(stripTimestamps(string(buf)), ";")
+	sort.Strings(lines)
+	assert.Equal(t, []string{"stats.timers.db.query.upper_99 10 ", "stats.timers.db.query.upper_99_9 10 ",
+		"stats.timers.http.get.upper_50 5 ", "stats.timers.other.upper_90 9 "}, lines)
+	assert.Equal(t, float64(5), ti.Snapshot(f)["http.get"]["upper_50"])
+	_, ok := ti.Snapshot(f)["http.get"]["upper_90"]
+	assert.Equal(t, false, ok)
+}
+
+func TestTimerScale(t *testing.T) {
+	f := formatM1Legacy
+	stats, _ := out.NewTimerStats("upper_pct,mean_pct,count_pct,mean,median,std,sum,upper,lower,count")
+	f.Timer_stats = stats
+	f.Timer_histograms, _ = out.NewHistograms("15")
+	f.Timer_scale = 0.5
+	pct, _ := out.NewPercentiles("75")
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:10|ms\nt:20|ms\nt:30|ms\nt:40|ms", f)
+	// the histogram bounds apply to the scaled points (5, 10, 15 and 20), and counts are not scaled
+	assert.Equal(t, "stats.timers.t.upper_75 15 ;stats.timers.t.mean_75 10 ;stats.timers.t.count_75 3 ;"+
+		"stats.timers.t.le_15 3 ;stats.timers.t.le_inf 4 ;"+
+		"stats.timers.t.mean 12.5 ;stats.timers.t.median 12.5 ;stats.timers.t.std 5.5901699437494745 ;"+
+		"stats.timers.t.sum 50 ;stats.timers.t.upper 20 ;stats.timers.t.lower 5 ;stats.timers.t.count 4 ", stripTimestamps(got))
+}
+
+func TestTimerWeightedPercentiles(t *testing.T) {
+	f := formatM1Legacy
+	f.Timer_stats, _ = out.NewTimerStats("upper_pct,count_pct")
+	pct, _ := out.NewPercentiles("50,90,-20")
+	var input []string
+	for i := 1; i <= 10; i++ {
+		input = append(input, fmt.Sprintf("t:%d|ms", i))
+	}
+	// stands for 10 measurements, as many as all others together
+	input = append(input, "t:100|ms|@0.1")
+	process := func(weighted bool, input []string) []string {
+		got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, weighted), strings.Join(input, "\n"), f)
+		lines := strings.Split(stripTimestamps(got), ";")
+		sort.Strings(lines)
+		return lines
+	}
+	assert.Equal(t, []string{"stats.timers.t.count_20 2 ", "stats.timers.t.count_50 6 ", "stats.timers.t.count_90 10 ",
+		"stats.timers.t.lower_20 10 ", "stats.timers.t.upper_50 6 ", "stats.timers.t.upper_90 10 "}, process(false, input))
+	assert.Equal(t, []string{"stats.timers.t.count_20 1 ", "stats.timers.t.count_50 10 ", "stats.timers.t.count_90 11 ",
+		"stats.timers.t.lower_20 100 ", "stats.timers.t.upper_50 10 ", "stats.timers.t.upper_90 100 "}, process(true, input))
+
+	// with the same sample rate everywhere, it's like without weights
+	for i := range input {
+		input[i] = strings.TrimSuffix(input[i], "|@0.1") + "|@0.5"
+	}
+	assert.Equal(t, process(false, input), process(true, input))
+}
+
+func TestTimerStddevSample(t *testing.T) {
+	f := formatM1Legacy
+	f.Timer_stats, _ = out.NewTimerStats("std")
+	input := "t:2|ms\nt:4|ms\nt:4|ms\nt:4|ms\nt:5|ms\nt:5|ms\nt:7|ms\nt:9|ms"
+	pct, _ := out.NewPercentiles("")
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), input, f)
+	assert.Equal(t, "stats.timers.t.std 2 ", stripTimestamps(got))
+
+	f.Stddev_sample = true
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 0, false), input, f)
+	assert.Equal(t, "stats.timers.t.std 2.138089935299395 ", stripTimestamps(got)) // sqrt(32/7)
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 10, false), input, f)
+	assert.Equal(t, "stats.timers.t.std 2.138089935299395 ", stripTimestamps(got))
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 0, false), "t:5|ms", f)
+	assert.Equal(t, "stats.timers.t.std 0 ", stripTimestamps(got))
+}
+
 func TestTimerM20NE(t *testing.T) {
-	got, num := processTimer(out.NewTimers(out.Percentiles{}), "direction_is_out.unit_is_ms.mtype_is_gauge:0|ms\ndirection_is_out.unit_is_ms.mtype_is_gauge:30|ms\ndirection_is_out.unit_is_ms.mtype_is_gauge:30|ms", formatM20NE)
+	got, num := processTimer(out.NewTimers(out.Percentiles{}, 0, 0, 0, false), "direction_is_out.unit_is_ms.mtype_is_gauge:0|ms\ndirection_is_out.unit_is_ms.mtype_is_gauge:30|ms\ndirection_is_out.unit_is_ms.mtype_is_gauge:30|ms", formatM20NE)
 	assert.Equal(t, num, int64(1))
 	exp := "timers-2NE.direction_is_out.unit_is_ms.mtype_is_gauge.stat_is_mean 20 "
 	if !strings.Contains(got, exp) {
@@ -219,7 +756,7 @@ func TestTimerM20NE(t *testing.T) {
 }
 
 func TestCountersM1Recommended(t *testing.T) {
-	cnt := out.NewCounters(true, true)
+	cnt := out.NewCounters(true, true, 0, false)
 	dataForGraphite, num := processCounter(cnt, "logins:1|c\nlogins:2|c\nlogins:3|c", formatM1Recommended)
 
 	assert.Equal(t, num, int64(1))
@@ -227,7 +764,7 @@ func TestCountersM1Recommended(t *testing.T) {
 }
 
 func TestCountersM1Legacy(t *testing.T) {
-	cnt := out.NewCounters(true, true)
+	cnt := out.NewCounters(true, true, 0, false)
 	dataForGraphite, num := processCounter(cnt, "logins:1|c\nlogins:2|c\nlogins:3|c", formatM1Legacy)
 
 	assert.Equal(t, num, int64(1))
@@ -235,19 +772,795 @@ func TestCountersM1Legacy(t *testing.T) {
 }
 
 func TestCountersM1LegacyFlushCountsFalse(t *testing.T) {
-	cnt := out.NewCounters(true, false)
+	cnt := out.NewCounters(true, false, 0, false)
 	dataForGraphite, num := processCounter(cnt, "logins:1|c\nlogins:2|c\nlogins:3|c", formatM1Legacy)
 
 	assert.Equal(t, num, int64(1))
 	assert.Equal(t, "stats.logins 0.6 1\n", dataForGraphite)
 }
 
+func TestCountersM1LegacyFlushRatesFalse(t *testing.T) {
+	cnt := out.NewCounters(false, true, 0, false)
+	dataForGraphite, num := processCounter(cnt, "logins:1|c\nlogins:2|c\nlogins:3|c", formatM1Legacy)
+
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "stats_counts.logins 6 1\n", dataForGraphite)
+}
+
+func TestCountersNegative(t *testing.T) {
+	allowNegative := out.NullOutput()
+	allowNegative.CounterAllowNegative = true
+	cnt := out.NewCounters(false, true, 0, false)
+	for _, m := range udp.ParseMessage([]byte("foo:3|c\nfoo:-5|c"), "", allowNegative, udp.ParseLine) {
+		cnt.Add(m)
+	}
+	buf, _ := cnt.Process(nil, 1, 10, formatM1Legacy)
+	assert.Equal(t, "stats_counts.foo -2 1\n", string(buf))
+
+	// by default, the negative value is an invalid line
+	cnt = out.NewCounters(false, true, 0, false)
+	for _, m := range udp.ParseMessage([]byte("foo:3|c\nfoo:-5|c"), "internal.", out.NullOutput(), udp.ParseLine) {
+		cnt.Add(m)
+	}
+	assert.Equal(t, map[string]float64{"foo": 3, "internal.mtype_is_count.type_is_invalid_line.unit_is_Err": 1}, cnt.Values)
+}
+
+func TestCountersRatesAndCounts(t *testing.T) {
+	f := formatM1Legacy
+	f.Prefix_rates = "stats.rates."
+	cnt := out.NewCounters(true, true, 0, false)
+	dataForGraphite, _ := processCounter(cnt, "foo:10|c", f)
+	assert.Equal(t, "stats_counts.foo 10 1\nstats.rates.foo 1 1\n", dataForGraphite)
+
+	cnt = out.NewCounters(false, false, 0, false)
+	dataForGraphite, _ = processCounter(cnt, "foo:10|c", f)
+	assert.Equal(t, "", dataForGraphite)
+}
+
+func TestCounterSampleRateRounding(t *testing.T) {
+	f := formatM1Legacy
+	f.Prefix_rates = "stats.rates."
+	// 3 * 1/0.333 is 9.009..., which is 9 counts. the rate isn't rounded
+	got, _ := processCounter(out.NewCounters(true, true, 0, false), "foo:1|c|@0.333\nfoo:1|c|@0.333\nfoo:1|c|@0.333", f)
+	assert.Equal(t, "stats_counts.foo 9 1\nstats.rates.foo 0.9009009009009009 1\n", got)
+
+	// floating point increments aren't rounded
+	got, _ = processCounter(out.NewCounters(false, true, 0, false), "foo:0.25|c\nfoo:1|c|@0.5\nbar:1.5|c|@0.5", f)
+	assert.Equal(t, true, strings.Contains(got, "stats_counts.foo 2.25 1\n"), got)
+	assert.Equal(t, true, strings.Contains(got, "stats_counts.bar 3 1\n"), got)
+
+	// and neither are cumulative counters
+	cnt := out.NewCounters(false, true, 0, true)
+	got, _ = processCounter(cnt, "foo:1|c|@0.3", f)
+	assert.Equal(t, "stats_counts.foo 3.3333333333333335 1\n", got)
+}
+
+func TestFlushRatesFalse(t *testing.T) {
+	f := formatM1Legacy
+	f.Prefix_rates = "stats.rates."
+	daemon := New("test", f, false, true, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	a := daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("foo:10|c\nbar:1|c|@0.5\nt:5|ms"), "", output, udp.ParseLine))
+	buf := string(daemon.process(nil, 10, 10, a.c, a.g, a.t, a.se))
+	assert.Equal(t, true, strings.Contains(buf, "stats_counts.foo 10 10\n"))
+	assert.Equal(t, true, strings.Contains(buf, "stats_counts.bar 2 10\n"))
+	if strings.Contains(buf, "stats.rates.") {
+		t.Errorf("expected no rates with flush_rates false, got:\n%s", buf)
+	}
+}
+
+func processGauge(g *out.Gauges, input string) string {
+	packets := udp.ParseMessage([]byte(input), "", output, udp.ParseLine2)
+	for _, p := range packets {
+		g.Add(p)
+	}
+	buf, _ := g.Process(nil, 1, 10, out.Formatter{Prefix_gauges: "stats.gauges."})
+	return string(buf)
+}
+
+func TestGaugeDeltas(t *testing.T) {
+	g := out.NewGauges(true, 0, false)
+	assert.Equal(t, "stats.gauges.foo 2 1\n", processGauge(g, "foo:+5|g\nfoo:-3|g"))
+	// deltas apply to the last value of the previous interval
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 12 1\n", processGauge(g, "foo:+10|g"))
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 7 1\n", processGauge(g, "foo:10|g\nfoo:-3|g"))
+}
+
+func TestGaugeTimestamps(t *testing.T) {
+	g := out.NewGauges(false, 2, false)
+	for _, p := range udp.ParseMessage([]byte("foo:1|g|T50\nbar:2|g|T50\nbar:3|g\nbaz:4|g|T500"), "", output, udp.ParseLine2) {
+		g.Add(p)
+	}
+	buf, _ := g.Process(nil, 100, 10, out.Formatter{Prefix_gauges: "stats.gauges."})
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	sort.Strings(lines)
+	// bar's last value has no timestamp, and baz's is in the future
+	assert.Equal(t, []string{"stats.gauges.bar 3 100", "stats.gauges.baz 4 100", "stats.gauges.foo 1 50"}, lines)
+
+	// idle gauges are sent at flush time
+	g = g.Next()
+	buf, _ = g.Process(nil, 110, 10, out.Formatter{Prefix_gauges: "stats.gauges."})
+	assert.Equal(t, true, strings.Contains(string(buf), "stats.gauges.foo 1 110\n"))
+}
+
+func TestGaugeDeltasDisabled(t *testing.T) {
+	g := out.NewGauges(false, 0, false)
+	assert.Equal(t, "stats.gauges.foo -3 1\n", processGauge(g, "foo:+5|g\nfoo:-3|g"))
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 10 1\n", processGauge(g, "foo:+10|g"))
+}
+
+func TestIdleGauges(t *testing.T) {
+	g := out.NewGauges(false, 2, false)
+	assert.Equal(t, "stats.gauges.foo 5 1\n", processGauge(g, "foo:5|g"))
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 5 1\n", processGauge(g, ""))
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 5 1\n", processGauge(g, ""))
+	g = g.Next()
+	assert.Equal(t, "", processGauge(g, ""))
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.foo 1 1\n", processGauge(g, "foo:1|g"))
+
+	g = out.NewGauges(false, 0, false)
+	assert.Equal(t, "stats.gauges.foo 5 1\n", processGauge(g, "foo:5|g"))
+	g = g.Next()
+	assert.Equal(t, "", processGauge(g, ""))
+}
+
+func TestIdleGaugeDeltas(t *testing.T) {
+	g := out.NewGauges(true, 0, false)
+	assert.Equal(t, "stats.gauges.foo 5 1\n", processGauge(g, "foo:+5|g"))
+	g = g.Next()
+	assert.Equal(t, "", processGauge(g, ""))
+	// deleted for being idle, but deltas still apply to the last value, and it's still persisted
+	g = g.Next()
+	assert.Equal(t, map[string]float64{"foo": 5}, g.Last())
+	assert.Equal(t, "stats.gauges.foo 8 1\n", processGauge(g, "foo:+3|g"))
+}
+
+// flushGauge is like processGauge, but moves on to the next interval before processing, like a flush does.
+// it returns the gauges of the next interval, along with the output.
+func flushGauge(g *out.Gauges, input string) (*out.Gauges, string) {
+	for _, p := range udp.ParseMessage([]byte(input), "", output, udp.ParseLine2) {
+		g.Add(p)
+	}
+	next := g.Next()
+	buf, _ := g.Process(nil, 1, 10, out.Formatter{Prefix_gauges: "stats.gauges."})
+	return next, string(buf)
+}
+
+func TestGaugesSkipUnchanged(t *testing.T) {
+	g := out.NewGauges(false, 2, true)
+	var got string
+	g, got = flushGauge(g, "foo:5|g\nbar:1|g")
+	lines := strings.Split(got, "\n")
+	sort.Strings(lines)
+	assert.Equal(t, "\nstats.gauges.bar 1 1\nstats.gauges.foo 5 1", strings.Join(lines, "\n"))
+	g, got = flushGauge(g, "foo:5|g\nbar:2|g")
+	assert.Equal(t, "stats.gauges.bar 2 1\n", got)
+	// idle gauges keep their value, so they're not sent either
+	g, got = flushGauge(g, "")
+	assert.Equal(t, "", got)
+	g, got = flushGauge(g, "foo:6|g")
+	assert.Equal(t, "stats.gauges.foo 6 1\n", got)
+	// once a gauge is deleted for being idle, its next value is like a first one
+	g, _ = flushGauge(g, "")
+	g, _ = flushGauge(g, "")
+	g, got = flushGauge(g, "bar:2|g")
+	assert.Equal(t, "stats.gauges.bar 2 1\n", got)
+
+	// the default sends them every interval
+	g = out.NewGauges(false, 0, false)
+	g, _ = flushGauge(g, "foo:5|g")
+	g, got = flushGauge(g, "foo:5|g")
+	assert.Equal(t, "stats.gauges.foo 5 1\n", got)
+}
+
+func TestIdleCountersAndTimers(t *testing.T) {
+	c := out.NewCounters(true, false, -1, false)
+	got, _ := processCounter(c, "logins:5|c", formatM1Legacy)
+	assert.Equal(t, "stats.logins 0.5 1\n", got)
+	for i := 0; i < 3; i++ {
+		c = c.Next()
+		got, _ = processCounter(c, "", formatM1Legacy)
+		assert.Equal(t, "stats.logins 0 1\n", got)
+	}
+
+	ti := out.NewTimers(out.Percentiles{}, 1, 0, 0, false)
+	processTimer(ti, "time:5|ms", formatM1Legacy)
+	ti = ti.Next()
+	got, num := processTimer(ti, "", formatM1Legacy)
+	assert.Equal(t, int64(1), num)
+	assert.T(t, strings.HasPrefix(got, "stats.timers.time.count 0 "))
+	ti = ti.Next()
+	_, num = processTimer(ti, "", formatM1Legacy)
+	assert.Equal(t, int64(0), num)
+}
+
+func TestCumulativeCounters(t *testing.T) {
+	c := out.NewCounters(true, true, 0, true)
+	flush := func(input string) string {
+		for _, m := range udp.ParseMessage([]byte(input), "", output, udp.ParseLine) {
+			c.Add(m)
+		}
+		prev := c
+		c = c.Next()
+		buf, _ := prev.Process(nil, 1, 10, formatM1Legacy)
+		lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	assert.Equal(t, "stats.logins 5 1\nstats_counts.logins 5 1", flush("logins:5|c"))
+	// the totals survive the flushes, also when idle, and rates are not divided by the interval
+	assert.Equal(t, "stats.errors 1 1\nstats.logins 8 1\nstats_counts.errors 1 1\nstats_counts.logins 8 1", flush("logins:3|c\nerrors:1|c"))
+	assert.Equal(t, "stats.errors 1 1\nstats.logins 10 1\nstats_counts.errors 1 1\nstats_counts.logins 10 1", flush("logins:1|c|@0.5"))
+	assert.Equal(t, "stats.errors 1 1\nstats.logins 10 1\nstats_counts.errors 1 1\nstats_counts.logins 10 1", flush(""))
+
+	// deleting a counter resets its total
+	assert.T(t, c.Delete("logins"))
+	assert.Equal(t, "stats.errors 1 1\nstats.logins 2 1\nstats_counts.errors 1 1\nstats_counts.logins 2 1", flush("logins:2|c"))
+
+	// idle counters are deleted, and start from 0 again, after keepIdle intervals without data
+	c = out.NewCounters(false, true, 1, true)
+	assert.Equal(t, "stats_counts.logins 5 1", flush("logins:5|c"))
+	assert.Equal(t, "stats_counts.logins 5 1", flush(""))
+	assert.Equal(t, "", flush(""))
+	assert.Equal(t, "stats_counts.logins 1 1", flush("logins:1|c"))
+}
+
+func TestGaugesPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsdaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gauges.json")
+
+	assert.Equal(t, 0, len(loadGauges(path)))
+
+	g := out.NewGauges(true, 0, false)
+	processGauge(g, "foo:5|g\nbar:-1.5|g")
+	saveGauges(path, g.Last())
+
+	g = out.NewGauges(true, 0, false)
+	g.Restore(loadGauges(path))
+	processGauge(g, "foo:+2|g")
+	assert.Equal(t, map[string]float64{"foo": 7, "bar": -1.5}, g.Values)
+
+	ioutil.WriteFile(path, []byte("{corrupt"), 0644)
+	assert.Equal(t, 0, len(loadGauges(path)))
+}
+
+func TestHealth(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.HealthMaxIntervals = 3
+	check := func() int {
+		w := httptest.NewRecorder()
+		daemon.healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+		return w.Code
+	}
+
+	// not listening yet
+	assert.Equal(t, http.StatusServiceUnavailable, check())
+	daemon.udpListening = 1
+	assert.Equal(t, http.StatusOK, check())
+	mock.Add(30 * time.Second)
+	assert.Equal(t, http.StatusOK, check())
+	mock.Add(time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, check())
+	daemon.lastFlush = mock.Now().Unix()
+	assert.Equal(t, http.StatusOK, check())
+}
+
+func TestDump(t *testing.T) {
+	c := out.NewCounters(true, false, 0, false)
+	g := out.NewGauges(false, 0, false)
+	ti := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	se := out.NewSets(0)
+	for _, m := range udp.ParseMessage([]byte("a:2|c\na:3|c\nb:5|g\nc:1|ms\nc:2|ms\nd:x|s"), "", output, udp.ParseLine2) {
+		switch m.Modifier {
+		case "c":
+			c.Add(m)
+		case "g":
+			g.Add(m)
+		case "ms":
+			ti.Add(m)
+		case "s":
+			se.Add(m)
+		}
+	}
+	assert.Equal(t, "counter a 5.000000\n", string(dump("counters", c, g, ti, se)))
+	assert.Equal(t, "timer c 2 points\n", string(dump("timers", c, g, ti, se)))
+	assert.Equal(t, "counter a 5.000000\ngauge b 5.000000\nset d 1 members\ntimer c 2 points\n", string(dump("all", c, g, ti, se)))
+}
+
+func TestSnapshot(t *testing.T) {
+	pct, _ := out.NewPercentiles("50,-50")
+	// unbuffered, so that metricsMonitor has aggregated the metrics once they're sent
+	daemon := New("test", formatM1Legacy, true, false, *pct, 10, 0, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	go daemon.RunBare()
+	daemon.Metrics <- udp.ParseMessage([]byte("a:2|c\na:3|c\nb:5|g\nc:3|ms\nc:1|ms|@0.5\nc:2|ms\nd:x|s\nd:y|s"), "", output, udp.ParseLine2)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		daemon.snapshotHandler(w, httptest.NewRequest("GET", "/snapshot", nil))
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		return w.Body.String()
+	}
+	body := get()
+	var snap snapshot
+	assert.Equal(t, nil, json.Unmarshal([]byte(body), &snap))
+	assert.Equal(t, float64(5), snap.Counters["a"])
+	assert.Equal(t, float64(3), snap.Counters["internal.direction_is_in.statsd_type_is_timer.mtype_is_count.unit_is_Metric"])
+	assert.Equal(t, map[string]float64{"b": 5}, snap.Gauges)
+	assert.Equal(t, map[string]map[string]float64{
+		"c": {"count": 4, "points": 3, "lower": 1, "upper": 3, "mean": 2, "median": 2, "upper_50": 2, "lower_50": 3},
+	}, snap.Timers)
+	assert.Equal(t, map[string]int{"d": 2}, snap.Sets)
+	// nothing is reset
+	assert.Equal(t, body, get())
+}
+
+func TestMaxTimersPerS(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	assert.Equal(t, uint64(1000), daemon.maxTimersPerS("db.query.time"))
+	daemon.MaxTimersPerSPrefixes = map[string]uint64{"db.": 100, "db.query.": 10, "http.": 5000}
+	assert.Equal(t, uint64(10), daemon.maxTimersPerS("db.query.time"))
+	assert.Equal(t, uint64(100), daemon.maxTimersPerS("db.insert.time"))
+	assert.Equal(t, uint64(5000), daemon.maxTimersPerS("http.request.time"))
+	assert.Equal(t, uint64(1000), daemon.maxTimersPerS("dbx.time"))
+}
+
+func TestSampleRate(t *testing.T) {
+	// unbuffered, so that the amounts are tracked once they're sent
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 0, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.SampleRateWindow = 5 * time.Second
+	daemon.MaxTimersPerSPrefixes = map[string]uint64{"db.": 10}
+	go daemon.RunBare()
+	// let metricStatsMonitor set up its ticker
+	time.Sleep(10 * time.Millisecond)
+	var metrics []*common.Metric
+	for i := 0; i < 150; i++ {
+		metrics = append(metrics, &common.Metric{Bucket: "db.query", Value: 1, Modifier: "ms", Sampling: 0.5})
+	}
+	daemon.metricAmounts <- metrics
+	mock.Add(5 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+
+	request := func(command ...string) string {
+		client, server := net.Pipe()
+		defer client.Close()
+		daemon.metricStatsRequests <- metricsStatsReq{command, &server}
+		buf := make([]byte, 1000)
+		n, _ := client.Read(buf)
+		return string(buf[:n])
+	}
+	// 300 submitted in the 5s window, which makes 60/s, of which we want 10/s
+	assert.Equal(t, "db.query 0.166667 60.000000\n", request("sample_rate", "db.query"))
+	assert.Equal(t, "db.query 0.166667 60.000000 30.000000 10\n", request("sample_rate", "db.query", "-v"))
+	assert.Equal(t, "db.query 60.000000 30.000000\n", request("metric_stats"))
+
+	daemon.metricAmounts <- []*common.Metric{{Bucket: "a", Sampling: 1}, {Bucket: "b", Sampling: 1}}
+	// the request is handled after the amounts, so they're counted by then
+	request("metric_stats")
+	var buf bytes.Buffer
+	daemon.writeInternalMetrics(&buf)
+	for _, exp := range []string{
+		"statsdaemon_sample_rate_tracker_buckets{period=\"current\"} 2\nstatsdaemon_sample_rate_tracker_buckets{period=\"previous\"} 1\n",
+		fmt.Sprintf("statsdaemon_sample_rate_tracker_swap_timestamp_seconds %d\n", mock.Now().Unix()),
+	} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected %q in output:\n%s", exp, buf.String())
+		}
+	}
+}
+
+// recordingOutput is a backend.Output that keeps all metrics written to it
+type recordingOutput struct {
+	sync.Mutex
+	metrics map[string]float64
+}
+
+func (r *recordingOutput) Write(metrics []backend.Metric) error {
+	r.Lock()
+	for _, m := range metrics {
+		r.metrics[m.Name] = m.Value
+	}
+	r.Unlock()
+	return nil
+}
+
+func TestDropWhenFull(t *testing.T) {
+	metrics := udp.ParseMessage([]byte("a:1|c\nb:1|c"), "", output, udp.ParseLine2)
+	o := &out.Output{Metrics: make(chan []*common.Metric, 1), MetricAmounts: make(chan []*common.Metric, 1), DropWhenFull: true}
+	for i := 0; i < 3; i++ {
+		o.Send(metrics)
+		o.Track(metrics)
+	}
+	assert.Equal(t, 1, len(o.Metrics))
+	assert.Equal(t, uint64(4), o.Stats.Dropped)
+
+	// with shards, only the metrics of the full ones are dropped
+	o = &out.Output{Shards: []chan []*common.Metric{make(chan []*common.Metric, 1), make(chan []*common.Metric, 1)}, DropWhenFull: true}
+	a, b := out.Shard("a", 2), out.Shard("b", 2)
+	if a == b {
+		t.Fatal("expected a and b in different shards")
+	}
+	o.Send(metrics[:1])
+	o.Send(metrics)
+	assert.Equal(t, uint64(1), o.Stats.Dropped)
+	assert.Equal(t, 1, len(o.Shards[a]))
+	assert.Equal(t, 1, len(o.Shards[b]))
+}
+
+func TestReplay(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	rec := &recordingOutput{metrics: make(map[string]float64)}
+	daemon.Output = rec
+	in := strings.NewReader("a:10|c\na:20|c\nb:5|g\nbad line\nc:3|ms")
+	assert.Equal(t, nil, daemon.Replay(in, 0, ""))
+	// once it returns, everything is written
+	assert.Equal(t, float64(3), rec.metrics["stats.a"])
+	assert.Equal(t, float64(5), rec.metrics["stats.gauges.b"])
+	assert.Equal(t, float64(3), rec.metrics["stats.timers.c.upper"])
+	assert.Equal(t, uint64(1), daemon.output.Stats.InvalidLines)
+}
+
+func TestDryRun(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.DryRun = true
+	daemon.SpoolDir = t.TempDir()
+	daemon.GraphiteRoutes = map[string]string{"stats.timers.": "127.0.0.1:2004"}
+	daemon.setDestinations("127.0.0.1:2003")
+	assert.Equal(t, 2, len(daemon.destinations))
+	for _, d := range daemon.destinations {
+		_, ok := d.output.(*backend.LogOutput)
+		assert.Equal(t, true, ok, d.name)
+	}
+	assert.Equal(t, 0, len(daemon.graphiteOutputs))
+}
+
+func TestDeleteBucket(t *testing.T) {
+	c := out.NewCounters(true, false, 0, false)
+	g := out.NewGauges(false, -1, false)
+	ti := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	se := out.NewSets(0)
+	for _, m := range udp.ParseMessage([]byte("foo:2|c\nfoo:5|g\nbar:1|g"), "", output, udp.ParseLine2) {
+		if m.Modifier == "c" {
+			c.Add(m)
+		} else {
+			g.Add(m)
+		}
+	}
+	assert.Equal(t, "deleted gauge foo\n", string(deleteBucket("gauge", "foo", c, g, ti, se)))
+	assert.Equal(t, "deleted counter foo\n", string(deleteBucket("", "foo", c, g, ti, se)))
+	assert.Equal(t, "not found: foo\n", string(deleteBucket("", "foo", c, g, ti, se)))
+
+	// idle gauges are kept forever, but not once deleted
+	g = g.Next()
+	assert.Equal(t, "stats.gauges.bar 1 1\n", processGauge(g, ""))
+	assert.Equal(t, "deleted gauge bar\n", string(deleteBucket("", "bar", c, g, ti, se)))
+	assert.Equal(t, "", processGauge(g, ""))
+	g = g.Next()
+	assert.Equal(t, "", processGauge(g, ""))
+}
+
+func TestRoute(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	timers := &destination{"stats.timers.", "timers", nil, make(chan []byte, 1)}
+	timersFoo := &destination{"stats.timers.foo.", "timers foo", nil, make(chan []byte, 1)}
+	def := &destination{"", "default", nil, make(chan []byte, 1)}
+	daemon.destinations = []*destination{timersFoo, timers, def}
+
+	daemon.route([]byte("stats.timers.a.count 1 10\nstats.gauges.b 2 10\nstats.timers.foo.count 3 10\nstats.timers.c.count 4 10\n"))
+	assert.Equal(t, "stats.timers.foo.count 3 10\n", string(<-timersFoo.queue))
+	assert.Equal(t, "stats.timers.a.count 1 10\nstats.timers.c.count 4 10\n", string(<-timers.queue))
+	assert.Equal(t, "stats.gauges.b 2 10\n", string(<-def.queue))
+
+	// a full queue doesn't block the other destinations
+	timers.queue <- []byte{}
+	daemon.route([]byte("stats.timers.a.count 1 20\nstats.gauges.b 2 20\n"))
+	assert.Equal(t, "stats.gauges.b 2 20\n", string(<-def.queue))
+}
+
+func TestBackendRoutes(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.DryRun = true
+	daemon.GraphiteRoutes = map[string]string{"stats.counters.": "127.0.0.1:2004"}
+	daemon.Backends = map[string]Backend{
+		"longterm": {Type: "graphite", Addr: "127.0.0.1:2005"},
+		"events":   {Type: "influxdb", Addr: "http://127.0.0.1:8086", DB: "statsd"},
+		"unused":   {Type: "graphite", Addr: "127.0.0.1:2006"},
+	}
+	daemon.BackendRoutes = []BackendRoute{
+		{"stats.timers.a.*", DefaultBackend},
+		{"stats.timers.*", "longterm"},
+		{"/^stats\\.gauges\\.deploy\\./", "events"},
+		{"stats.gauges.deploy.*", "longterm"},
+	}
+	daemon.setDestinations("127.0.0.1:2003")
+	// the graphite route, the default, and the backends that are used
+	assert.Equal(t, 4, len(daemon.destinations))
+	for _, d := range daemon.destinations {
+		d.queue = make(chan []byte, 1)
+	}
+	counters, def, longterm, events := daemon.destinations[0], daemon.destinations[1], daemon.destinations[2], daemon.destinations[3]
+	assert.Equal(t, DefaultBackend, def.name)
+	assert.Equal(t, "longterm", longterm.name)
+	assert.Equal(t, "events", events.name)
+
+	daemon.route([]byte("stats.timers.a.count 1 10\nstats.timers.b.count 2 10\nstats.gauges.deploy.web 3 10\nstats.gauges.c 4 10\nstats.counters.x 5 10\n"))
+	assert.Equal(t, "stats.timers.a.count 1 10\nstats.gauges.c 4 10\n", string(<-def.queue))
+	assert.Equal(t, "stats.timers.b.count 2 10\n", string(<-longterm.queue))
+	assert.Equal(t, "stats.gauges.deploy.web 3 10\n", string(<-events.queue))
+	assert.Equal(t, "stats.counters.x 5 10\n", string(<-counters.queue))
+
+	assert.NotEqual(t, nil, CheckBackendRoutes([]BackendRoute{{"stats.*", "nope"}}, daemon.Backends))
+	assert.NotEqual(t, nil, CheckBackendRoutes([]BackendRoute{{"/(/", "longterm"}}, daemon.Backends))
+	assert.NotEqual(t, nil, CheckBackendRoutes(nil, map[string]Backend{"x": {Type: "kafka", Addr: "k:9092"}}))
+	assert.NotEqual(t, nil, CheckBackendRoutes(nil, map[string]Backend{DefaultBackend: {Type: "graphite", Addr: "g:2003"}}))
+}
+
+func TestGlobalPrefixSuffix(t *testing.T) {
+	f := formatM1Legacy
+	f.Global_prefix = "dc1."
+	f.Global_suffix = ".eu"
+	daemon := New("test", f, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	timers := &destination{"stats.timers.", "timers", nil, make(chan []byte, 1)}
+	def := &destination{"", "default", nil, make(chan []byte, 1)}
+	daemon.destinations = []*destination{timers, def}
+
+	// routes match the names without the global prefix
+	daemon.route([]byte("stats.timers.a.count 1 10\nstats.gauges.b 2 10\n"))
+	assert.Equal(t, "dc1.stats.timers.a.count.eu 1 10\n", string(<-timers.queue))
+	assert.Equal(t, "dc1.stats.gauges.b.eu 2 10\n", string(<-def.queue))
+
+	// composes with the metrics 2.0 prefixes
+	f.Legacy_namespace = false
+	f.Prefix_m20ne_gauges = "env_is_prod."
+	g := out.NewGauges(false, 0, false)
+	g.Add(&common.Metric{Bucket: "foo.unit_is_B", Value: 5, Modifier: "g", Sampling: 1})
+	buf, _ := g.Process(nil, 10, 10, f)
+	assert.Equal(t, "dc1.env_is_prod.foo.unit_is_B.eu 5 10\n", string(f.Namespace(buf)))
+
+	// without a global prefix or suffix, nothing changes
+	buf = []byte("stats.gauges.b 2 10\nincomplete")
+	assert.Equal(t, string(buf), string(formatM1Legacy.Namespace(buf)))
+}
+
+// shardedFlush runs a daemon with the given amount of shards, feeds it the metrics, and returns what it flushes.
+func shardedFlush(shards int, metrics []*common.Metric) string {
+	pct, _ := out.NewPercentiles("90")
+	daemon := New("test", formatM1Legacy, true, true, *pct, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.NumShards = shards
+	flushes := make(chan string)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, ti *out.Timers, se *out.Sets, deadline time.Time) {
+		var buf []byte
+		buf, _ = c.Process(buf, 0, 10, formatM1Legacy)
+		buf, _ = g.Process(buf, 0, 10, formatM1Legacy)
+		buf, _ = ti.Process(buf, 0, 10, formatM1Legacy)
+		buf, _ = se.Process(buf, 0, 10, formatM1Legacy)
+		lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+		sort.Strings(lines)
+		flushes <- strings.Join(lines, "\n")
+	}
+	go daemon.RunBare()
+	daemon.Metrics <- metrics
+	for len(daemon.Metrics) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	mock.Add(10 * time.Second)
+	return <-flushes
+}
+
+func TestFlushOffset(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.FlushOffset = 3 * time.Second
+	flushes := make(chan time.Time, 10)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, ti *out.Timers, se *out.Sets, deadline time.Time) {
+		flushes <- mock.Now()
+	}
+	go daemon.RunBare()
+	// let metricsMonitor set up its ticker
+	time.Sleep(10 * time.Millisecond)
+	for i := 1; i <= 13; i++ {
+		mock.Add(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(3), (<-flushes).Unix())
+	assert.Equal(t, int64(13), (<-flushes).Unix())
+	assert.Equal(t, 0, len(flushes))
+}
+
+func TestRollupInterval(t *testing.T) {
+	pct, _ := out.NewPercentiles("90")
+	daemon := New("test", formatM1Legacy, false, true, *pct, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.RollupInterval = 30 * time.Second
+	daemon.KeepIdleCounters = -1
+	f := formatM1Legacy
+	f.Timer_stats, _ = out.NewTimerStats("upper_pct,count")
+	flushes := make(chan string, 10)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, ti *out.Timers, se *out.Sets, deadline time.Time) {
+		var buf []byte
+		buf, _ = c.Process(buf, mock.Now().Unix(), 30, f)
+		buf, _ = g.Process(buf, mock.Now().Unix(), 30, f)
+		buf, _ = ti.Process(buf, mock.Now().Unix(), 30, f)
+		buf, _ = se.Process(buf, mock.Now().Unix(), 30, f)
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			if !strings.Contains(line, "statsd_type_is") {
+				lines = append(lines, line)
+			}
+		}
+		sort.Strings(lines)
+		flushes <- strings.Join(lines, "\n")
+	}
+	go daemon.RunBare()
+	// let metricsMonitor set up its ticker
+	time.Sleep(10 * time.Millisecond)
+	interval := func(input string) {
+		daemon.Metrics <- udp.ParseMessage([]byte(input), "", output, udp.ParseLine2)
+		for len(daemon.Metrics) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(time.Millisecond)
+		mock.Add(10 * time.Second)
+		time.Sleep(time.Millisecond)
+	}
+
+	interval("hits:1|c\ntemp:20|g\nlatency:10|ms\nusers:a|s")
+	interval("hits:2|c\ntemp:21|g\nlatency:20|ms\nusers:b|s")
+	assert.Equal(t, 0, len(flushes))
+	interval("hits:3|c\nusers:a|s")
+	assert.Equal(t, "stats.gauges.temp 21 30\n"+
+		"stats.timers.latency.count 2 30\n"+
+		"stats.timers.latency.upper_90 20 30\n"+
+		"stats_counts.hits 6 30\n"+
+		"users.count 2 30", <-flushes)
+
+	// idle counters are sent once, even though they were idle in every interval
+	interval("")
+	interval("")
+	interval("")
+	assert.Equal(t, "stats_counts.hits 0 60", <-flushes)
+	assert.Equal(t, 0, len(flushes))
+}
+
+func TestShards(t *testing.T) {
+	var metrics []*common.Metric
+	for i := 0; i < 20; i++ {
+		metrics = append(metrics, udp.ParseMessage([]byte(fmt.Sprintf("c%d:%d|c\ng%d:%d|g\nt%d:%d|ms\nt%d:1|ms\ns%d:%d|s", i, i, i, i, i, i, i, i, i)), "", output, udp.ParseLine2)...)
+	}
+	single := shardedFlush(1, metrics)
+	assert.Equal(t, true, strings.Contains(single, "internal.direction_is_in.statsd_type_is_timer.mtype_is_count.unit_is_Metric 40 0"))
+	assert.Equal(t, single, shardedFlush(4, metrics))
+}
+
+func TestCounterSamplingExtrapolation(t *testing.T) {
+	for _, rate := range []string{"0.1", "0.001"} {
+		c := out.NewCounters(false, true, 0, false)
+		for i := 0; i < 1000; i++ {
+			for _, m := range udp.ParseMessage([]byte("hits:1|c|@"+rate), "", output, udp.ParseLine2) {
+				c.Add(m)
+			}
+		}
+		want := 1000 / mustParseFloat(rate)
+		if math.Abs(c.Values["hits"]-want) > want*1e-9 {
+			t.Errorf("1000 samples at @%s: expected ~%f, got %f", rate, want, c.Values["hits"])
+		}
+	}
+}
+
+func mustParseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestNumStats(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	c := out.NewCounters(true, false, 0, false)
+	g := out.NewGauges(false, 0, false)
+	ti := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	for _, m := range udp.ParseMessage([]byte("a:1|c\nb:1|c\nc:1|g"), "", output, udp.ParseLine2) {
+		if m.Modifier == "c" {
+			c.Add(m)
+		} else {
+			g.Add(m)
+		}
+	}
+	got := string(daemon.process(nil, 10, 10, c, g, ti, out.NewSets(0)))
+	for _, exp := range []string{
+		"internal.direction_is_out.statsd_type_is_counter.mtype_is_gauge.unit_is_Metric 2 10\n",
+		"internal.direction_is_out.statsd_type_is_gauge.mtype_is_gauge.unit_is_Metric 1 10\n",
+		"internal.direction_is_out.statsd_type_is_timer.mtype_is_gauge.unit_is_Metric 0 10\n",
+		"internal.direction_is_out.mtype_is_gauge.unit_is_Metric 3 10\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in output:\n%s", exp, got)
+		}
+	}
+}
+
+func TestInternalMetrics(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	daemon.output = out.NullOutput()
+	daemon.output.Stats.InvalidLines = 3
+	daemon.output.Stats.Rejected[1] = 3
+	daemon.writeFailures = 2
+	daemon.graphiteOutputs = map[string]*backend.GraphiteOutput{"127.0.0.1:2003": {Stats: backend.GraphiteStats{Metrics: 2, BytesExpected: 20, BytesWritten: 15}}}
+	daemon.instrument(out.NewGauges(false, 0, false), nil, 0, 10, "gauge")
+
+	var buf bytes.Buffer
+	daemon.writeInternalMetrics(&buf)
+	got := buf.String()
+	for _, exp := range []string{
+		"# TYPE statsdaemon_invalid_lines_total counter\nstatsdaemon_invalid_lines_total 3\n",
+		"statsdaemon_invalid_lines_by_reason_total{reason=\"no_colon\"} 0\nstatsdaemon_invalid_lines_by_reason_total{reason=\"double_colon\"} 3\n",
+		"statsdaemon_output_write_failures_total 2\n",
+		"statsdaemon_graphite_metrics_total{addr=\"127.0.0.1:2003\"} 2\n",
+		"statsdaemon_graphite_bytes_expected_total{addr=\"127.0.0.1:2003\"} 20\n",
+		"statsdaemon_graphite_bytes_written_total{addr=\"127.0.0.1:2003\"} 15\n",
+		"statsdaemon_metrics_queue_length 0\n",
+		"statsdaemon_flush_duration_seconds{type=\"gauge\"} 0\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in output:\n%s", exp, got)
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	d := []byte("users:alice|s\nusers:bob|s\nusers:alice|s\nusers:1|s\nusers:1.0|s")
+	packets := udp.ParseMessage(d, "", output, udp.ParseLine2)
+
+	se := out.NewSets(0)
+	for _, p := range packets {
+		se.Add(p)
+	}
+	buf, num := se.Process(nil, 1, 10, out.Formatter{Prefix_sets: "stats.sets."})
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "stats.sets.users.count 4 1\n", string(buf))
+}
+
+func TestSetsMaxMembers(t *testing.T) {
+	d := []byte("users:alice|s\nusers:bob|s\nusers:carol|s\nusers:alice|s")
+	packets := udp.ParseMessage(d, "", output, udp.ParseLine2)
+
+	se := out.NewSets(2)
+	for _, p := range packets {
+		se.Add(p)
+	}
+	buf, num := se.Process(nil, 1, 10, out.Formatter{Prefix_sets: "stats.sets."})
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "stats.sets.users.count 2 1\n", string(buf))
+}
+
 func TestUpperPercentile(t *testing.T) {
 	d := []byte("time:0|ms\ntime:1|ms\ntime:2|ms\ntime:3|ms")
 	packets := udp.ParseMessage(d, "", output, udp.ParseLine)
 
 	pct, _ := out.NewPercentiles("75")
-	ti := out.NewTimers(*pct)
+	ti := out.NewTimers(*pct, 0, 0, 0, false)
 
 	for _, p := range packets {
 		ti.Add(p)
@@ -268,7 +1581,7 @@ func TestMetrics20Count(t *testing.T) {
 	d := []byte("foo=bar.mtype=count.unit=B:5|c\nfoo=bar.mtype=count.unit=B:10|c")
 	packets := udp.ParseMessage(d, "", output, udp.ParseLine)
 
-	c := out.NewCounters(true, false)
+	c := out.NewCounters(true, false, 0, false)
 	for _, p := range packets {
 		c.Add(p)
 	}
@@ -286,7 +1599,7 @@ func TestLowerPercentile(t *testing.T) {
 	packets := udp.ParseMessage(d, "", output, udp.ParseLine)
 
 	pct, _ := out.NewPercentiles("-75")
-	ti := out.NewTimers(*pct)
+	ti := out.NewTimers(*pct, 0, 0, 0, false)
 
 	for _, p := range packets {
 		ti.Add(p)
@@ -309,12 +1622,71 @@ func TestLowerPercentile(t *testing.T) {
 	if !strings.Contains(got, exp) {
 		t.Fatalf("output %q does not contain %q", got, exp)
 	}
+	// the lower 75th percentile covers the 3 highest points
+	for _, exp := range []string{"time.sum_75 6 ", "time.mean_75 2 ", "time.count_75 3 ", "time.count_ps_75 0.3 "} {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
+}
+
+// few points must not make the rank of any percentile fall outside of them
+func TestPercentileFewPoints(t *testing.T) {
+	spec := "1,10,50,90,95,99,99.9,-1,-5,-10,-50,-90,-95,-99,-99.9"
+	pcts, _ := out.NewPercentiles(spec)
+	for _, method := range []string{out.PercentileNearestRank, out.PercentileLinear} {
+		f := formatM1Legacy
+		f.Percentile_method = method
+		f.Timer_stats, _ = out.NewTimerStats("upper_pct,count_pct")
+		for n := 1; n <= 3; n++ {
+			var lines []string
+			for i := 1; i <= n; i++ {
+				lines = append(lines, fmt.Sprintf("t:%d|ms", i*10))
+			}
+			got, _ := processTimer(out.NewTimers(*pcts, 0, 0, 0, false), strings.Join(lines, "\n"), f)
+			stats := make(map[string]float64)
+			for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+				fields := strings.Fields(line)
+				val, err := strconv.ParseFloat(fields[1], 64)
+				assert.Equal(t, nil, err, line)
+				stats[strings.TrimPrefix(fields[0], "stats.timers.t.")] = val
+			}
+			for _, pct := range *pcts {
+				suffix := strings.Replace(strings.TrimPrefix(pct.String(), "-"), ".", "_", -1)
+				name := "upper_" + suffix
+				if strings.HasPrefix(pct.String(), "-") {
+					name = "lower_" + suffix
+				}
+				threshold, count := stats[name], stats["count_"+suffix]
+				desc := fmt.Sprintf("%s %s with %d points: %s=%v count=%v", method, pct.String(), n, name, threshold, count)
+				assert.T(t, threshold >= 10 && threshold <= float64(n*10), desc)
+				assert.T(t, count >= 1 && count <= float64(n), desc)
+			}
+		}
+	}
+}
+
+func TestPercentileCounts(t *testing.T) {
+	pct, _ := out.NewPercentiles("75")
+	got, _ := processTimer(out.NewTimers(*pct, 0, 0, 0, false), "time:0|ms\ntime:1|ms\ntime:2|ms\ntime:3|ms", formatM1Legacy)
+	for _, exp := range []string{"stats.timers.time.count_75 3 ", "stats.timers.time.count_ps_75 0.3 "} {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
+
+	got, _ = processTimer(out.NewTimers(*pct, 0, 0, 0, false), "unit=ms.mtype=gauge:12|ms", formatM20)
+	for _, exp := range []string{"timers-2.unit=ms.mtype=gauge.stat=count_75 1 ", "timers-2.unit=ms.mtype=gauge.stat=count_ps_75 0.1 "} {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
 }
 
 func BenchmarkDifferentCountersAddAndProcessM1Recommended(b *testing.B) {
 	metrics := getDifferentCounters(b.N)
 	b.ResetTimer()
-	c := out.NewCounters(true, false)
+	c := out.NewCounters(true, false, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
@@ -324,7 +1696,7 @@ func BenchmarkDifferentCountersAddAndProcessM1Recommended(b *testing.B) {
 func BenchmarkDifferentCountersAddAndProcessM1Legacy(b *testing.B) {
 	metrics := getDifferentCounters(b.N)
 	b.ResetTimer()
-	c := out.NewCounters(true, true)
+	c := out.NewCounters(true, true, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
@@ -334,7 +1706,7 @@ func BenchmarkDifferentCountersAddAndProcessM1Legacy(b *testing.B) {
 func BenchmarkSameCountersAddAndProcessM1Recommended(b *testing.B) {
 	metrics := getSameCounters(b.N)
 	b.ResetTimer()
-	c := out.NewCounters(true, false)
+	c := out.NewCounters(true, false, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
@@ -344,7 +1716,7 @@ func BenchmarkSameCountersAddAndProcessM1Recommended(b *testing.B) {
 func BenchmarkSameCountersAddAndProcessM1Legacy(b *testing.B) {
 	metrics := getSameCounters(b.N)
 	b.ResetTimer()
-	c := out.NewCounters(true, true)
+	c := out.NewCounters(true, true, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
@@ -354,7 +1726,7 @@ func BenchmarkSameCountersAddAndProcessM1Legacy(b *testing.B) {
 func BenchmarkDifferentGaugesAddAndProcess(b *testing.B) {
 	metrics := getDifferentGauges(b.N)
 	b.ResetTimer()
-	g := out.NewGauges()
+	g := out.NewGauges(false, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		g.Add(&metrics[i])
 	}
@@ -364,7 +1736,7 @@ func BenchmarkDifferentGaugesAddAndProcess(b *testing.B) {
 func BenchmarkSameGaugesAddAndProcess(b *testing.B) {
 	metrics := getSameGauges(b.N)
 	b.ResetTimer()
-	g := out.NewGauges()
+	g := out.NewGauges(false, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		g.Add(&metrics[i])
 	}
@@ -375,7 +1747,7 @@ func BenchmarkDifferentTimersAddAndProcess(b *testing.B) {
 	metrics := getDifferentTimers(b.N)
 	b.ResetTimer()
 	pct, _ := out.NewPercentiles("99")
-	t := out.NewTimers(*pct)
+	t := out.NewTimers(*pct, 0, 0, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		t.Add(&metrics[i])
 	}
@@ -386,19 +1758,43 @@ func BenchmarkSameTimersAddAndProcess(b *testing.B) {
 	metrics := getSameTimers(b.N)
 	b.ResetTimer()
 	pct, _ := out.NewPercentiles("99")
-	t := out.NewTimers(*pct)
+	t := out.NewTimers(*pct, 0, 0, 0, false)
 	for i := 0; i < len(metrics); i++ {
 		t.Add(&metrics[i])
 	}
 	t.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
 }
 
+// BenchmarkTimersIntervals measures aggregating and flushing 100 timers with 100 points each, over many intervals
+func BenchmarkTimersIntervals(b *testing.B) {
+	metrics := make([]common.Metric, 10000)
+	for i := range metrics {
+		metrics[i] = common.Metric{Bucket: "timer" + strconv.Itoa(i%100), Value: float64(i), Modifier: "ms", Sampling: 1}
+	}
+	stats, _ := out.NewTimerStats("count")
+	f := formatM1Legacy
+	f.Timer_stats = stats
+	t := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	buf := make([]byte, 0, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range metrics {
+			t.Add(&metrics[i])
+		}
+		prev := t
+		t = t.Next()
+		buf, _ = prev.Process(buf[:0], 1, 10, f)
+		prev.Release()
+	}
+}
+
 func BenchmarkIncomingMetrics(b *testing.B) {
 	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
 	daemon.Clock = clock.NewMock()
 	total := float64(0)
 	totalLock := sync.Mutex{}
-	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, deadline time.Time) {
 		totalLock.Lock()
 		total += c.Values["internal.direction_is_in.statsd_type_is_counter.mtype_is_count.unit_is_Metric"]
 		totalLock.Unlock()
@@ -411,7 +1807,7 @@ func BenchmarkIncomingMetrics(b *testing.B) {
 			Bucket:   "test-counter",
 			Value:    float64(1),
 			Modifier: "c",
-			Sampling: float32(1),
+			Sampling: float64(1),
 		}
 	}
 	// each operation consists of 100x write (1k * 10 metrics + move clock by 1second)
@@ -439,7 +1835,7 @@ func BenchmarkIncomingMetrics(b *testing.B) {
 func BenchmarkIncomingMetricAmounts(b *testing.B) {
 	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil)
 	daemon.Clock = clock.NewMock()
-	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, deadline time.Time) {
 	}
 	go daemon.RunBare()
 	b.ResetTimer()
@@ -449,7 +1845,7 @@ func BenchmarkIncomingMetricAmounts(b *testing.B) {
 			Bucket:   "test-counter",
 			Value:    float64(1),
 			Modifier: "c",
-			Sampling: float32(1),
+			Sampling: float64(1),
 		}
 	}
 	// each operation consists of 100x write (1k * 10 metrics + move clock by 1second)
@@ -465,3 +1861,466 @@ func BenchmarkIncomingMetricAmounts(b *testing.B) {
 	}
 
 }
+
+func TestInvalidLines(t *testing.T) {
+	il := out.NewInvalidLines(3)
+	assert.Equal(t, 0, len(il.Last(10)))
+	for i := 0; i < 5; i++ {
+		reason := "bad_value"
+		if i%2 == 1 {
+			reason = "no_colon"
+		}
+		il.Add([]byte(fmt.Sprintf("line%d", i)), reason)
+	}
+	last := il.Last(10)
+	assert.Equal(t, 3, len(last))
+	assert.Equal(t, "line2", string(last[0].Line))
+	assert.Equal(t, "line4", string(last[2].Line))
+	assert.Equal(t, "bad_value", last[2].Reason)
+	last = il.Last(1)
+	assert.Equal(t, 1, len(last))
+	assert.Equal(t, "line4", string(last[0].Line))
+
+	var none *out.InvalidLines
+	none.Add([]byte("foo"), "no_colon")
+	assert.Equal(t, 0, len(none.Last(10)))
+}
+
+func TestStatsCommand(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.startTime = mock.Now()
+	daemon.output = out.NullOutput()
+	daemon.output.Stats.Packets = 42
+	mock.Add(time.Hour + 1500*time.Millisecond)
+
+	stats := string(daemon.stats(mapSizes{counters: 4}))
+	for _, exp := range []string{
+		"uptime               1h0m1s\n",
+		"flush_interval       10s\n",
+		"packets              42\n",
+		"flushes              0\n",
+		"last_write           none yet\n",
+		"counters             4\n",
+	} {
+		if !strings.Contains(stats, exp) {
+			t.Errorf("expected %q in stats:\n%s", exp, stats)
+		}
+	}
+
+	c := out.NewCounters(true, false, 0, false)
+	c.Add(&common.Metric{Bucket: "foo", Value: 1, Sampling: 1})
+	daemon.process(nil, 10, 10, c, out.NewGauges(false, 0, false), out.NewTimers(nil, 0, 0, 0, false), out.NewSets(0))
+	daemon.lastWrite(fmt.Errorf("connection refused"))
+	mock.Add(5 * time.Second)
+	stats = string(daemon.stats(mapSizes{}))
+	for _, exp := range []string{
+		"flushes              1\n",
+		"last_write           failed 5s ago: connection refused\n",
+		"last_flush_metrics   1\n",
+	} {
+		if !strings.Contains(stats, exp) {
+			t.Errorf("expected %q in stats:\n%s", exp, stats)
+		}
+	}
+
+	daemon.lastWrite(nil)
+	assert.Equal(t, true, strings.Contains(string(daemon.stats(mapSizes{})), "last_write           ok 0s ago\n"))
+}
+
+func TestAdminToken(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.AdminToken = "secret"
+	client, server := net.Pipe()
+	defer client.Close()
+	go daemon.handleApiRequest(&adminConn{Conn: server}, nil)
+	r := bufio.NewReader(client)
+	for _, c := range []struct{ cmd, resp string }{
+		{"rewrite foo", "authentication required: auth <token>\n"},
+		{"auth wrong", "authentication failed\n"},
+		{"rewrite foo", "authentication required: auth <token>\n"},
+		{"auth secret", "authenticated\n"},
+		{"rewrite foo", "foo is not renamed\n"},
+	} {
+		client.Write([]byte(c.cmd + "\n"))
+		resp, err := r.ReadString('\n')
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.resp, resp, c.cmd)
+	}
+}
+
+func TestStrictTypes(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.StrictTypes = true
+	output := daemon.newOutput(nil)
+	a := daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("foo:1|c\nfoo:5|g\nfoo:2|c\nbar:5|g\nbar:3|ms\nbaz:x|s\nbaz:1|c"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, float64(3), a.c.Values["foo"])
+	assert.Equal(t, map[string]float64{"bar": 5}, a.g.Values)
+	assert.Equal(t, 0, len(a.t.Values))
+	assert.Equal(t, 1, len(a.se.Values))
+	_, ok := a.c.Values["baz"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, float64(3), a.c.Values["internal.mtype_is_count.type_is_invalid_line.unit_is_Err"])
+	rejected := udp.Rejections(output.Stats.Rejected)
+	assert.Equal(t, uint64(3), rejected.Count("type_conflict"))
+	assert.Equal(t, uint64(3), output.Stats.InvalidLines)
+
+	// every interval starts over
+	a.next()
+	a.add(udp.ParseMessage([]byte("foo:5|g"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, map[string]float64{"foo": 5}, a.g.Values)
+
+	// by default, all types are accepted
+	daemon.StrictTypes = false
+	a = daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("foo:1|c\nfoo:5|g"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, float64(1), a.c.Values["foo"])
+	assert.Equal(t, float64(5), a.g.Values["foo"])
+}
+
+func TestTreatAsGauge(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	daemon.TreatAsGauge, _ = common.NewFilter("exporter.*", "")
+	output := daemon.newOutput(nil)
+	a := daemon.newAggregator(nil)
+	metrics := udp.ParseMessage([]byte("exporter.temp:20|c\nexporter.temp:22|c|@0.5\nother:20|c\nother:22|c"), "internal.", output, udp.ParseLine2)
+	a.add(metrics)
+	assert.Equal(t, float64(22), a.g.Values["exporter.temp"])
+	_, ok := a.c.Values["exporter.temp"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, float64(42), a.c.Values["other"])
+	// the metrics themselves are left alone, for the other consumers
+	assert.Equal(t, "c", metrics[0].Modifier)
+
+	// and it's flushed like any other gauge
+	got := string(daemon.process(nil, 10, 10, a.c, a.g, a.t, a.se))
+	assert.T(t, strings.Contains(got, "stats.gauges.exporter.temp 22 10\n"), got)
+	assert.T(t, !strings.Contains(got, "stats.exporter.temp "), got)
+}
+
+func TestMaxBuckets(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	daemon.Clock = clock.NewMock()
+	daemon.MaxBuckets = map[string]int{"counter": 2, "timer": 1}
+	output := daemon.newOutput(nil)
+	a := daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("a:1|c\nb:1|c\nc:1|c\na:1|c\nt1:1|ms\nt2:1|ms\ng1:1|g\ng2:1|g\nbad"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, float64(2), a.c.Values["a"])
+	assert.Equal(t, float64(1), a.c.Values["b"])
+	_, ok := a.c.Values["c"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 1, len(a.t.Values))
+	assert.Equal(t, 2, len(a.g.Values))
+	// our own metrics don't count
+	assert.Equal(t, float64(1), a.c.Values["internal.mtype_is_count.type_is_invalid_line.unit_is_Err"])
+	assert.Equal(t, uint64(1), daemon.limitStats["counter"].rejected)
+	assert.Equal(t, uint64(1), daemon.limitStats["timer"].rejected)
+
+	// buckets make room once they're deleted for being idle
+	a.next()
+	a.add(udp.ParseMessage([]byte("a:1|c\nc:1|c\nd:1|c"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, float64(1), a.c.Values["c"])
+	_, ok = a.c.Values["d"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, uint64(2), daemon.limitStats["counter"].rejected)
+
+	// they don't while they're still sent
+	daemon.KeepIdleCounters = 1
+	a = daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("a:1|c\nb:1|c"), "internal.", output, udp.ParseLine2))
+	a.next()
+	a.add(udp.ParseMessage([]byte("c:1|c"), "internal.", output, udp.ParseLine2))
+	_, ok = a.c.Values["c"]
+	assert.Equal(t, false, ok)
+	a.next()
+	a.add(udp.ParseMessage([]byte("c:1|c"), "internal.", output, udp.ParseLine2))
+	_, ok = a.c.Values["c"]
+	assert.Equal(t, true, ok)
+
+	// evicting deletes the least recently used bucket, and its idle state
+	daemon.MaxBucketsEvict = true
+	a = daemon.newAggregator(nil)
+	a.add(udp.ParseMessage([]byte("a:1|c\nb:1|c\na:1|c\nc:1|c"), "internal.", output, udp.ParseLine2))
+	assert.Equal(t, float64(2), a.c.Values["a"])
+	assert.Equal(t, float64(1), a.c.Values["c"])
+	_, ok = a.c.Values["b"]
+	assert.Equal(t, false, ok)
+	assert.Equal(t, uint64(1), daemon.limitStats["counter"].evicted)
+	next := a.next()
+	buf := string(daemon.process(nil, 10, 10, next.c, next.g, next.t, next.se))
+	assert.Equal(t, false, strings.Contains(buf, "stats.b "), buf)
+	buf = string(daemon.process(nil, 20, 10, a.c, a.g, a.t, a.se))
+	assert.Equal(t, true, strings.Contains(buf, "stats.a 0 20\n"), buf)
+	assert.Equal(t, false, strings.Contains(buf, "stats.b "), buf)
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	go daemon.handleApiRequest(&adminConn{Conn: server}, nil)
+	r := bufio.NewReader(client)
+	for _, c := range []struct{ cmd, resp string }{
+		{"loglevel verbose", "invalid log level \"verbose\". panic|fatal|error|warning|info|debug|trace\n"},
+		{"loglevel debug", "log level changed from info to debug\n"},
+		{"loglevel warning", "log level changed from debug to warning\n"},
+	} {
+		client.Write([]byte(c.cmd + "\n"))
+		resp, err := r.ReadString('\n')
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.resp, resp, c.cmd)
+	}
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+
+	// the invalid lines are logged at debug level only
+	assert.Equal(t, log.WarnLevel, daemon.SetLogLevel(log.DebugLevel))
+	daemon.debugLock.Lock()
+	assert.NotEqual(t, nil, daemon.debugInvalid)
+	daemon.debugLock.Unlock()
+	daemon.SetLogLevel(log.InfoLevel)
+	daemon.debugLock.Lock()
+	assert.Equal(t, true, daemon.debugInvalid == nil)
+	daemon.debugLock.Unlock()
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(hash string) { GitHash = hash }(GitHash)
+	GitHash = "abc123"
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	go daemon.handleApiRequest(&adminConn{Conn: server}, nil)
+	client.Write([]byte("version\n"))
+	resp, err := bufio.NewReader(client).ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "statsdaemon v"+Version+" (built w/"+runtime.Version()+", git hash abc123)\n", resp)
+
+	var buf bytes.Buffer
+	daemon.writeInternalMetrics(&buf)
+	exp := fmt.Sprintf("statsdaemon_build_info{version=%q,go=%q,githash=\"abc123\"} 1\n", Version, runtime.Version())
+	assert.T(t, strings.Contains(buf.String(), exp), buf.String())
+}
+
+func TestRatesUseElapsed(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	def := &destination{"", "default", nil, make(chan []byte, 2)}
+	daemon.destinations = []*destination{def}
+	daemon.prometheusQueue = make(chan []byte, 2)
+	flush := func() string {
+		c := out.NewCounters(true, false, 0, false)
+		c.Add(&common.Metric{Bucket: "foo", Value: 30, Sampling: 1})
+		ti := out.NewTimers(nil, 0, 0, 0, false)
+		ti.Add(&common.Metric{Bucket: "bar", Value: 1, Sampling: 1, Modifier: "ms"})
+		daemon.GraphiteQueue(c, out.NewGauges(false, 0, false), ti, out.NewSets(0), mock.Now())
+		return string(<-def.queue)
+	}
+
+	// the first flush uses the flush interval
+	mock.Add(10 * time.Second)
+	got := flush()
+	assert.Equal(t, true, strings.Contains(got, "stats.foo 3 10\n"))
+
+	// the next one came 15s later, e.g. because of a stall
+	mock.Add(15 * time.Second)
+	got = flush()
+	for _, exp := range []string{
+		"stats.foo 2 25\n",
+		"stats.timers.bar.count_ps 0.06666666666666667 25\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in output:\n%s", exp, got)
+		}
+	}
+}
+
+func TestSamplingPerType(t *testing.T) {
+	f := out.Formatter{Prefix_rates: "stats.", Prefix_counters: "stats_counts.", Prefix_timers: "stats.timers.", Prefix_gauges: "stats.gauges.", Prefix_sets: "stats.sets.", Legacy_namespace: true}
+	c := out.NewCounters(false, true, 0, false)
+	g := out.NewGauges(false, 0, false)
+	ti := out.NewTimers(out.Percentiles{}, 0, 0, 0, false)
+	se := out.NewSets(0)
+	for _, m := range udp.ParseMessage([]byte("hits:1|c|@0.1\nload:3|g|@0.5\nreq:1|ms|@0.3\nreq:2|ms|@0.3\nreq:3|ms|@0.3\nusers:joe|s|@0.5"), "", output, udp.ParseLine2) {
+		switch m.Modifier {
+		case "c":
+			c.Add(m)
+		case "g":
+			g.Add(m)
+		case "ms":
+			ti.Add(m)
+		case "s":
+			se.Add(m)
+		}
+	}
+	var buf []byte
+	buf, _ = c.Process(buf, 1, 10, f)
+	buf, _ = g.Process(buf, 1, 10, f)
+	buf, _ = ti.Process(buf, 1, 10, f)
+	buf, _ = se.Process(buf, 1, 10, f)
+	got := string(buf)
+	for _, exp := range []string{
+		// counters are extrapolated
+		"stats_counts.hits 10 1\n",
+		// gauges and sets ignore the sample rate
+		"stats.gauges.load 3 1\n",
+		"stats.sets.users.count 1 1\n",
+		// timer points count as 1/rate in count and count_ps, the other stats are based on the points as received
+		"stats.timers.req.count 10 1\n",
+		"stats.timers.req.count_ps 1 1\n",
+		"stats.timers.req.mean 2 1\n",
+		"stats.timers.req.upper 3 1\n",
+		"stats.timers.req.sum 6 1\n",
+	} {
+		if !strings.Contains(got, exp) {
+			t.Errorf("expected %q in output:\n%s", exp, got)
+		}
+	}
+}
+
+// flakyOutput is a backend.Output that fails the first fails writes
+type flakyOutput struct {
+	fails int
+}
+
+func (f *flakyOutput) Write(metrics []backend.Metric) error {
+	if f.fails > 0 {
+		f.fails--
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func TestOutputWriterLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	d := &destination{"", "127.0.0.1:2003", &flakyOutput{fails: 1}, make(chan []byte, 1)}
+	d.queue <- []byte("stats.a 1 10\nstats.b 2 10\n")
+	close(d.queue)
+	done := make(chan struct{})
+	go func() {
+		daemon.outputWriter(d)
+		close(done)
+	}()
+	// let the retry after the failure happen
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-time.After(time.Millisecond):
+			mock.Add(2 * time.Second)
+		}
+	}
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, "failed to write metrics payload") {
+			assert.Equal(t, nil, json.Unmarshal([]byte(line), &entry))
+		}
+	}
+	if entry == nil {
+		t.Fatalf("expected a failed write to be logged:\n%s", buf.String())
+	}
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "127.0.0.1:2003", entry["graphite_addr"])
+	assert.Equal(t, float64(2), entry["count"])
+	assert.Equal(t, "connection refused", entry["error"])
+	_, ok := entry["duration_ms"].(float64)
+	assert.Equal(t, true, ok)
+}
+
+func TestEnforceSampleRate(t *testing.T) {
+	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 0, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	daemon.SampleRateWindow = 5 * time.Second
+	daemon.MaxTimersPerSPrefixes = map[string]uint64{"db.": 10}
+	daemon.EnforceSampleRate = true
+	output := daemon.newOutput(daemon.metricAmounts)
+	assert.Equal(t, daemon.sampler, output.Sampler)
+	go daemon.RunBare()
+	// let metricStatsMonitor set up its ticker
+	time.Sleep(10 * time.Millisecond)
+	var metrics []*common.Metric
+	for i := 0; i < 150; i++ {
+		metrics = append(metrics, &common.Metric{Bucket: "db.query", Value: 1, Modifier: "ms", Sampling: 0.5})
+	}
+	metrics = append(metrics, &common.Metric{Bucket: "db.insert", Value: 1, Modifier: "ms", Sampling: 1})
+	daemon.metricAmounts <- metrics
+	// nothing is enforced until the first window ended
+	assert.Equal(t, len(metrics), len(daemon.sampler.Sample(metrics)))
+	mock.Add(5 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+
+	// 300 submitted in the 5s window, which makes 60/s, of which we want 10/s
+	var hot []*common.Metric
+	for i := 0; i < 6000; i++ {
+		hot = append(hot, &common.Metric{Bucket: "db.query", Value: 1, Modifier: "ms", Sampling: 0.5})
+	}
+	cold := &common.Metric{Bucket: "db.insert", Value: 1, Modifier: "ms", Sampling: 1}
+	counter := &common.Metric{Bucket: "db.query", Value: 1, Modifier: "c", Sampling: 1}
+	kept := daemon.sampler.Sample(append(hot, cold, counter))
+	if len(kept) < 800 || len(kept) > 1200 {
+		t.Fatalf("expected about 1000 points of db.query kept, got %d", len(kept)-2)
+	}
+	assert.Equal(t, uint64(6000+2-len(kept)), daemon.sampler.Dropped)
+	for _, m := range kept[:len(kept)-2] {
+		assert.Equal(t, 0.5/6, m.Sampling)
+	}
+	assert.Equal(t, cold, kept[len(kept)-2])
+	assert.Equal(t, counter, kept[len(kept)-1])
+	// the metrics themselves are left alone, as they're tracked too
+	assert.Equal(t, 0.5, hot[0].Sampling)
+
+	var buf bytes.Buffer
+	daemon.writeInternalMetrics(&buf)
+	exp := fmt.Sprintf("statsdaemon_timer_points_sampled_out_total %d\n", daemon.sampler.Dropped)
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected %q in output:\n%s", exp, buf.String())
+	}
+}
+
+func TestFlushLag(t *testing.T) {
+	daemon := New("test", formatM1Legacy, true, false, out.Percentiles{}, 10, 1000, 1000, nil)
+	mock := clock.NewMock()
+	daemon.Clock = mock
+	// the monitor passes when the flush was due
+	deadlines := make(chan time.Time, 1)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, se *out.Sets, deadline time.Time) {
+		deadlines <- deadline
+	}
+	go daemon.RunBare()
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(10 * time.Second)
+	assert.Equal(t, time.Unix(20, 0), (<-deadlines).In(time.Local))
+
+	def := &destination{"", "default", nil, make(chan []byte, 1)}
+	daemon.destinations = []*destination{def}
+	daemon.prometheusQueue = make(chan []byte, 1)
+	// the flush that was due now gets processed 1.5s late
+	due := mock.Now()
+	mock.Add(1500 * time.Millisecond)
+	daemon.GraphiteQueue(out.NewCounters(true, false, 0, false), out.NewGauges(false, 0, false), out.NewTimers(nil, 0, 0, 0, false), out.NewSets(0), due.Add(10*time.Second))
+	got := string(<-def.queue)
+	exp := "internal.mtype_is_gauge.type_is_flush_lag.unit_is_ms 1500 11\n"
+	if !strings.Contains(got, exp) {
+		t.Errorf("expected %q in output:\n%s", exp, got)
+	}
+	var buf bytes.Buffer
+	daemon.writeInternalMetrics(&buf)
+	if !strings.Contains(buf.String(), "statsdaemon_flush_lag_seconds 1.5\n") {
+		t.Errorf("expected the flush lag in:\n%s", buf.String())
+	}
+}
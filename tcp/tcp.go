@@ -0,0 +1,136 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxLineSize is the longest line we accept over tcp. longer lines are dropped.
+	MaxLineSize = 65535
+)
+
+func StatsListener(listen_addr, prefix_internal string, output *out.Output) {
+	Listener(listen_addr, prefix_internal, output, udp.ParseLine2)
+}
+
+// Listener accepts tcp connections carrying newline-delimited metrics. like the udp listener,
+// it parses them and feeds both the Metrics channel as well as the metricAmounts channel
+func Listener(listen_addr, prefix_internal string, output *out.Output, parse udp.ParseLineFunc) {
+	listener, err := net.Listen("tcp", listen_addr)
+	if err != nil {
+		log.Fatalf("ERROR: Listen tcp - %s", err)
+	}
+	defer listener.Close()
+	defer output.Reading(listener)()
+	log.Infof("listening on %s (tcp)", listener.Addr())
+	output.Listen("tcp", listen_addr)
+
+	var backoff common.Backoff
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if output.Stopping() {
+				return
+			}
+			wait := backoff.Next()
+			log.Errorf("ERROR: accepting tcp connection - %s. retrying in %s", err, wait)
+			time.Sleep(wait)
+			continue
+		}
+		backoff.Reset()
+		done := output.Reading(conn)
+		go func() {
+			defer done()
+			handleConn(conn, prefix_internal, output, parse)
+		}()
+	}
+}
+
+// handleConn reads metrics from the connection until it is closed, by the client or because the output stops it.
+// we don't parse line by line, rather we parse everything up to the last newline we have,
+// and keep the partial line (which may have been split across tcp segments) around for the next read.
+// with out.EncodingGzip, the connection is decompressed as we read. if that fails, it's counted as an invalid line
+// and the connection is closed, as there's no way to find where the next valid data starts.
+func handleConn(conn net.Conn, prefix_internal string, output *out.Output, parse udp.ParseLineFunc) {
+	defer conn.Close()
+	var r io.Reader = conn
+	gzipped := output.StreamEncoding == out.EncodingGzip
+	if gzipped {
+		zr, err := gzip.NewReader(conn)
+		if err != nil {
+			rejectStream(conn, err, prefix_internal, output)
+			return
+		}
+		r = zr
+	}
+	buf := make([]byte, MaxLineSize)
+	n := 0
+	// we are discarding an overly long line, up to the next newline
+	skip := false
+	for {
+		read, err := r.Read(buf[n:])
+		n += read
+		if skip {
+			if j := bytes.IndexByte(buf[:n], '\n'); j >= 0 {
+				n = copy(buf, buf[j+1:n])
+				skip = false
+			} else {
+				n = 0
+			}
+		}
+		if !skip {
+			if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+				metrics := udp.ParseMessage(buf[:i], prefix_internal, output, parse)
+				output.Send(metrics)
+				output.Track(metrics)
+				n = copy(buf, buf[i+1:n])
+			} else if n == len(buf) {
+				log.Warnf("dropping line from %s longer than %d bytes", conn.RemoteAddr(), MaxLineSize)
+				n = 0
+				skip = true
+			}
+		}
+		if err != nil {
+			if gzipped && err != io.EOF {
+				rejectStream(conn, err, prefix_internal, output)
+				return
+			}
+			if err != io.EOF && !output.Stopping() {
+				log.Errorf("ERROR: reading from tcp connection %s - %s", conn.RemoteAddr(), err)
+			}
+			// the last line may not be terminated by a newline
+			if n > 0 && !skip {
+				metrics := udp.ParseMessage(buf[:n], prefix_internal, output, parse)
+				output.Send(metrics)
+				output.Track(metrics)
+			}
+			return
+		}
+	}
+}
+
+// rejectStream handles a gzip encoded connection failing to read. unless that's due to the connection itself
+// (closing before sending anything, failing, or being stopped), the data couldn't be decompressed,
+// which is counted as an invalid line
+func rejectStream(conn net.Conn, err error, prefix_internal string, output *out.Output) {
+	if err == io.EOF || output.Stopping() {
+		return
+	}
+	if _, ok := err.(net.Error); ok {
+		log.Errorf("ERROR: reading from tcp connection %s - %s", conn.RemoteAddr(), err)
+		return
+	}
+	log.Warnf("could not decompress tcp connection %s, closing it: %s", conn.RemoteAddr(), err)
+	metrics := []*common.Metric{udp.RejectPayload("bad_compression", prefix_internal, output)}
+	output.Send(metrics)
+	output.Track(metrics)
+}
@@ -0,0 +1,86 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
+	"github.com/tv42/topic"
+)
+
+func TestHandleConnPartialReads(t *testing.T) {
+	output := &out.Output{
+		Metrics:       make(chan []*common.Metric, 10),
+		MetricAmounts: make(chan []*common.Metric, 10),
+		Valid_lines:   topic.New(),
+		Invalid_lines: topic.New(),
+	}
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConn(server, "", output, udp.ParseLine2)
+		close(done)
+	}()
+
+	// a metric split across writes, several metrics in one write, and a final line without newline
+	for _, chunk := range []string{"foo:1|c\nba", "r:2|c\n", "baz:3|g\nqux:4", "|ms"} {
+		client.Write([]byte(chunk))
+	}
+	client.Close()
+	<-done
+	close(output.Metrics)
+
+	var buckets []string
+	var values []float64
+	for metrics := range output.Metrics {
+		for _, m := range metrics {
+			buckets = append(buckets, m.Bucket)
+			values = append(values, m.Value)
+		}
+	}
+	assert.Equal(t, []string{"foo", "bar", "baz", "qux"}, buckets)
+	assert.Equal(t, []float64{1, 2, 3, 4}, values)
+}
+
+func TestHandleConnGzip(t *testing.T) {
+	output := &out.Output{
+		Metrics:        make(chan []*common.Metric, 10),
+		Valid_lines:    topic.New(),
+		Invalid_lines:  topic.New(),
+		StreamEncoding: out.EncodingGzip,
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("foo:1|c\nbar:2|c\n"))
+	zw.Flush()
+	zw.Write([]byte("baz:3|g"))
+	zw.Close()
+	// a complete stream, then one that is cut off halfway: what was decompressed is kept, the rest is invalid
+	for _, data := range [][]byte{buf.Bytes(), buf.Bytes()[:buf.Len()-4]} {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConn(server, "internal.", output, udp.ParseLine2)
+			close(done)
+		}()
+		client.Write(data)
+		client.Close()
+		<-done
+	}
+	close(output.Metrics)
+
+	var buckets []string
+	for metrics := range output.Metrics {
+		for _, m := range metrics {
+			buckets = append(buckets, m.Bucket)
+		}
+	}
+	assert.Equal(t, []string{"foo", "bar", "baz", "foo", "bar", "internal.mtype_is_count.type_is_invalid_line.unit_is_Err"}, buckets)
+	rejected := udp.Rejections(output.Stats.Rejected)
+	assert.Equal(t, uint64(1), rejected.Count("bad_compression"))
+}
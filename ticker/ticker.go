@@ -24,7 +24,13 @@ func main() {
 // minute. Note that in my testing this is about .0001 to 0.0002 seconds off due
 // to scheduling etc.
 func GetAlignedTicker(c clock.Clock, period time.Duration) *clock.Ticker {
-	unix := c.Now().UnixNano()
-	diff := time.Duration(period - (time.Duration(unix) % period))
+	return GetAlignedTickerOffset(c, period, 0)
+}
+
+// GetAlignedTickerOffset is like GetAlignedTicker, but it ticks offset after
+// every whole period. e.g. with a period of 10s and an offset of 3s, at :03, :13, etc.
+func GetAlignedTickerOffset(c clock.Clock, period, offset time.Duration) *clock.Ticker {
+	unix := time.Duration(c.Now().UnixNano()) - offset
+	diff := period - ((unix%period)+period)%period
 	return c.Ticker(diff)
 }
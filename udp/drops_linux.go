@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// KernelDropsSupported is whether the listeners can tell how many packets the kernel dropped, see watchKernelDrops
+const KernelDropsSupported = true
+
+// kernelDrops returns the packets the kernel dropped for the udp sockets bound to port, because their receive
+// buffer was full (or, rarely, for lack of memory), summed over ipv4 and ipv6.
+func kernelDrops(port int) (uint64, error) {
+	var total uint64
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// e.g. ipv6 is disabled
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		drops, err := parseKernelDrops(f, port)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", path, err)
+		}
+		total += drops
+	}
+	return total, nil
+}
+
+// parseKernelDrops sums the drops column of the sockets bound to port, in the format of /proc/net/udp(6):
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+//	 0: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 81218 2 0000000000000000 3
+//
+// with SO_REUSEPORT, there's a line per socket.
+func parseKernelDrops(r io.Reader, port int) (uint64, error) {
+	var total uint64
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			return 0, fmt.Errorf("unexpected line %q", scanner.Text())
+		}
+		i := strings.LastIndexByte(fields[1], ':')
+		if i < 0 {
+			return 0, fmt.Errorf("unexpected local_address %q", fields[1])
+		}
+		p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected local_address %q", fields[1])
+		}
+		if int(p) != port {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected drops %q", fields[len(fields)-1])
+		}
+		total += drops
+	}
+	return total, scanner.Err()
+}
+
+// readBuffer returns the receive buffer size (SO_RCVBUF) of the socket. linux reports twice what was set,
+// to account for its bookkeeping overhead.
+func readBuffer(c syscall.RawConn) (int, error) {
+	var size int
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		size, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return size / 2, err
+}
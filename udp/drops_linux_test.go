@@ -0,0 +1,44 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseKernelDrops(t *testing.T) {
+	proc := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  415: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 81218 2 0000000000000000 3
+  415: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 81219 2 0000000000000000 4
+  908: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 17488 2 0000000000000000 12
+ 1031: 00000000000000000000000001000000:1FBD 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 81220 2 0000000000000000 5
+`
+	for port, exp := range map[int]uint64{8125: 12, 53: 12, 8126: 0} {
+		drops, err := parseKernelDrops(strings.NewReader(proc), port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drops != exp {
+			t.Errorf("expected %d drops for port %d, got %d", exp, port, drops)
+		}
+	}
+
+	if _, err := parseKernelDrops(strings.NewReader("header\n  415: 00000000:1FBD\n"), 8125); err == nil {
+		t.Error("expected an error for a truncated line")
+	}
+}
+
+func TestKernelDrops(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	drops, err := kernelDrops(conn.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drops != 0 {
+		t.Errorf("expected no drops for a new socket, got %d", drops)
+	}
+}
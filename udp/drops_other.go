@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"syscall"
+)
+
+const KernelDropsSupported = false
+
+func kernelDrops(port int) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
+
+func readBuffer(c syscall.RawConn) (int, error) {
+	return 0, errors.New("not supported on this platform")
+}
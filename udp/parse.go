@@ -1,9 +1,11 @@
 package udp
 
 import (
+	"bytes"
 	"errors"
 	"github.com/raintank/statsdaemon/common"
 	"strconv"
+	"sync"
 )
 
 type lexer struct {
@@ -11,10 +13,14 @@ type lexer struct {
 	len   int
 	start int
 	pos   int
-	m     common.Metric
+	value []byte
+	m     *common.Metric
 	err   error
 }
 
+// lexerPool holds lexers to reuse, as they escape to the heap because of the state functions
+var lexerPool = sync.Pool{New: func() interface{} { return &lexer{} }}
+
 // assumes we don't have \x00 bytes in input
 const eof = 0
 
@@ -32,7 +38,7 @@ func (l *lexer) run() {
 		state = state(l)
 	}
 	if l.err == nil && l.m.Sampling == 0 {
-		l.m.Sampling = float32(1)
+		l.m.Sampling = float64(1)
 	}
 
 }
@@ -43,6 +49,9 @@ var (
 	errMissingValueSep = errors.New("missing value separator")
 	errInvalidModifier = errors.New("invalid modifier")
 	errInvalidSampling = errors.New("invalid sampling")
+	errEmptySetMember  = errors.New("set member zero len")
+	errInvalidTags     = errors.New("invalid tags")
+	errInvalidTime     = errors.New("invalid timestamp")
 )
 
 type stateFn func(*lexer) stateFn
@@ -85,14 +94,9 @@ func lexValueSep(l *lexer) stateFn {
 	}
 }
 
-// lex the value
+// lex the value. we can only interpret it once we know the modifier
 func lexValue(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
-	if err != nil {
-		l.err = err
-		return nil
-	}
-	l.m.Value = v
+	l.value = l.input[l.start : l.pos-1]
 	l.start = l.pos
 	return lexModifier
 }
@@ -102,10 +106,22 @@ func lexModifier(l *lexer) stateFn {
 	b := l.next()
 	switch b {
 	case 'g':
+		if len(l.value) > 0 && (l.value[0] == '+' || l.value[0] == '-') {
+			l.m.GaugeDelta = true
+		}
 		fallthrough
 	case 'c':
 		l.m.Modifier = string(b)
 		l.start = l.pos
+	case 's':
+		// set members are arbitrary strings, they are not parsed as a number
+		if len(l.value) == 0 {
+			l.err = errEmptySetMember
+			return nil
+		}
+		l.m.Modifier = "s"
+		l.m.Member = string(l.value)
+		l.start = l.pos
 		return lexModifierSep
 	case 'm':
 		if b := l.next(); b != 's' {
@@ -114,15 +130,24 @@ func lexModifier(l *lexer) stateFn {
 		}
 		l.start = l.pos
 		l.m.Modifier = "ms"
-		return lexModifierSep
 	default:
 		l.err = errInvalidModifier
 		return nil
-
 	}
+	if len(l.value) > MaxValueLen {
+		l.err = errValueTooLong
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(l.value), 64)
+	if err != nil {
+		l.err = err
+		return nil
+	}
+	l.m.Value = v
+	return lexModifierSep
 }
 
-// lex the possible separator between modifier and samplerate
+// lex the possible separator between modifier (or the previous segment) and the next segment
 func lexModifierSep(l *lexer) stateFn {
 	b := l.next()
 	switch b {
@@ -130,30 +155,86 @@ func lexModifierSep(l *lexer) stateFn {
 		return nil
 	case '|':
 		l.start = l.pos
-		return lexSampleRate
+		return lexSegment
 	}
 	l.err = errInvalidModifier
 	return nil
 }
 
+// lex the type of the segment: @<sample rate>, #<tags> or T<unix timestamp>. segments can come in any order
+func lexSegment(l *lexer) stateFn {
+	b := l.next()
+	l.start = l.pos
+	switch b {
+	case '@':
+		return lexSampleRate
+	case '#':
+		return lexTags
+	case 'T':
+		return lexTimestamp
+	}
+	l.err = errInvalidSampling
+	return nil
+}
+
+// segmentEnd returns the end of the current segment, and which state follows it
+func (l *lexer) segmentEnd() (int, stateFn) {
+	for {
+		switch b := l.next(); b {
+		case eof:
+			return l.pos, nil
+		case '|':
+			return l.pos - 1, lexSegment
+		}
+	}
+}
+
 // lex the sample rate
 func lexSampleRate(l *lexer) stateFn {
-	b := l.next()
-	if b == '#' {
+	end, next := l.segmentEnd()
+	v, err := strconv.ParseFloat(string(l.input[l.start:end]), 64)
+	if err != nil {
+		l.err = samplingError{err}
 		return nil
 	}
-	if b != '@' {
+	// this also rejects NaN
+	if !(v > 0 && v <= 1) {
 		l.err = errInvalidSampling
+		return nil
 	}
+	l.m.Sampling = v
 	l.start = l.pos
+	return next
+}
 
-	v, err := strconv.ParseFloat(string(l.input[l.start:]), 32)
-	if err != nil {
-		l.err = err
+// lex the dogstatsd style tags, like #key1:val1,key2:val2
+func lexTags(l *lexer) stateFn {
+	end, next := l.segmentEnd()
+	tags := make(map[string]string)
+	for _, tag := range bytes.Split(l.input[l.start:end], []byte(",")) {
+		i := bytes.IndexByte(tag, ':')
+		if i <= 0 {
+			l.err = errInvalidTags
+			return nil
+		}
+		tags[string(tag[:i])] = string(tag[i+1:])
+	}
+	l.m.Tags = tags
+	l.start = l.pos
+	return next
+}
+
+// lex the timestamp the client provided, in seconds since the epoch, like T1700000000
+func lexTimestamp(l *lexer) stateFn {
+	end, next := l.segmentEnd()
+	v, err := strconv.ParseInt(string(l.input[l.start:end]), 10, 64)
+	if err != nil || v <= 0 {
+		l.err = errInvalidTime
 		return nil
 	}
-	l.m.Sampling = float32(v)
-	return nil
+	l.m.Timestamp = v
+	l.start = l.pos
+	return next
 }
 
 // ParseLine with lexer impl
@@ -162,10 +243,14 @@ func ParseLine2(line []byte) (*common.Metric, error) {
 	if llen == 0 {
 		return nil, nil
 	}
-	l := &lexer{input: line, len: llen}
+	l := lexerPool.Get().(*lexer)
+	*l = lexer{input: line, len: llen, m: common.NewMetric()}
 	l.run()
-	if l.err != nil {
-		return nil, l.err
+	m, err := l.m, l.err
+	*l = lexer{}
+	lexerPool.Put(l)
+	if err != nil {
+		return nil, err
 	}
-	return &l.m, nil
+	return m, nil
 }
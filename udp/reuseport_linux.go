@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on the socket, so that several sockets can bind the same address,
+// with the kernel distributing incoming packets over them.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
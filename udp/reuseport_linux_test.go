@@ -0,0 +1,21 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePort}
+	first, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := lc.ListenPacket(context.Background(), "udp", first.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("binding a second socket to %s failed: %s", first.LocalAddr(), err)
+	}
+	second.Close()
+}
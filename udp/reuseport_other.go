@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import "syscall"
+
+const reusePortSupported = false
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -2,56 +2,98 @@ package udp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"os"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-const (
-	MaxUdpPacketSize = 65535
-)
+// MaxUdpPacketSize is the size of the read buffer of the udp and unix datagram listeners.
+// larger packets are truncated, and their last line is dropped. it must be set before the listeners start.
+var MaxUdpPacketSize = 65535
+
+// MaxDecompressedSize is the most a gzip encoded packet may decompress to, see out.Output.DatagramEncoding.
+// larger ones are invalid (reason bad_compression), so that a small packet can't make us allocate lots of memory.
+const MaxDecompressedSize = 1 << 20
+
+// ReadErrorLogInterval is how often, at most, a listener logs that reading a packet failed.
+// the others are only counted, in out.Stats.ReadErrors.
+const ReadErrorLogInterval = 10 * time.Second
+
+// RecvBuffer is the size of the kernel receive buffer (SO_RCVBUF) of the udp listeners, in bytes. packets that
+// arrive while it's full are dropped by the kernel, see out.Stats.KernelDrops. linux caps it at
+// net.core.rmem_max. 0 keeps the default of the OS. it must be set before the listeners start.
+var RecvBuffer = 0
+
+// KernelDropsInterval is how often the udp listeners update out.Stats.KernelDrops, see KernelDropsSupported
+var KernelDropsInterval = 10 * time.Second
 
 // ParseLine turns a line into a *Metric (or not) and returns an error if the line was invalid.
 // note that *Metric can be nil when the line was valid (if the line was empty)
 // input format: key:value|modifier[|@samplerate]
+// for sets (modifier s), value is taken verbatim as the set member.
 func ParseLine(line []byte) (metric *common.Metric, err error) {
 	if len(line) == 0 {
 		return nil, nil
 	}
 	parts := bytes.SplitN(bytes.TrimSpace(line), []byte(":"), 2)
 	if len(parts) != 2 {
-		return nil, errors.New("bad amount of colons")
+		return nil, errNoColon
 	}
 	if bytes.Contains(parts[1], []byte(":")) {
-		return nil, errors.New("bad amount of colons")
+		return nil, errDoubleColon
 	}
 	bucket := parts[0]
 	if len(bucket) == 0 {
-		return nil, errors.New("key zero len")
+		return nil, errEmptyKey
 	}
 	parts = bytes.SplitN(parts[1], []byte("|"), 3)
 	if len(parts) < 2 {
-		return nil, errors.New("bad amount of pipes")
+		return nil, errPipes
 	}
 	modifier := string(parts[1])
-	if modifier != "g" && modifier != "c" && modifier != "ms" {
-		return nil, errors.New("unsupported metric type")
+	if modifier != "g" && modifier != "c" && modifier != "ms" && modifier != "s" {
+		return nil, errUnsupportedType
 	}
 	sampleRate := float64(1)
 	if len(parts) == 3 {
 		if parts[2][0] != byte('@') {
-			return nil, errors.New("invalid sampling")
+			return nil, errInvalidSampling
 		}
 		var err error
-		sampleRate, err = strconv.ParseFloat(string(parts[2])[1:], 32)
+		sampleRate, err = strconv.ParseFloat(string(parts[2])[1:], 64)
 		if err != nil {
-			return nil, err
+			return nil, samplingError{err}
+		}
+		// this also rejects NaN
+		if !(sampleRate > 0 && sampleRate <= 1) {
+			return nil, errInvalidSampling
 		}
 	}
+	if modifier == "s" {
+		if len(parts[0]) == 0 {
+			return nil, errEmptySetMember
+		}
+		metric = &common.Metric{
+			Bucket:   string(bucket),
+			Modifier: modifier,
+			Sampling: sampleRate,
+			Member:   string(parts[0]),
+		}
+		return metric, nil
+	}
+	if len(parts[0]) > MaxValueLen {
+		return nil, errValueTooLong
+	}
 	value, err := strconv.ParseFloat(string(parts[0]), 64)
 	if err != nil {
 		return nil, err
@@ -60,7 +102,10 @@ func ParseLine(line []byte) (metric *common.Metric, err error) {
 		Bucket:   string(bucket),
 		Value:    value,
 		Modifier: modifier,
-		Sampling: float32(sampleRate),
+		Sampling: sampleRate,
+	}
+	if modifier == "g" && (parts[0][0] == '+' || parts[0][0] == '-') {
+		metric.GaugeDelta = true
 	}
 	return metric, nil
 }
@@ -68,34 +113,264 @@ func ParseLine(line []byte) (metric *common.Metric, err error) {
 // ParseMessage turns byte data into a slice of metric pointers
 // note that it creates "invalid line" metrics itself, upon invalid lines,
 // which will get passed on and aggregated along with the other metrics
-func ParseMessage(data []byte, prefix_internal string, output *out.Output, parse parseLineFunc) (metrics []*common.Metric) {
+// the valid lines of buckets that the output's Forwarder matches are passed on to it as they are, instead.
+func ParseMessage(data []byte, prefix_internal string, output *out.Output, parse ParseLineFunc) []*common.Metric {
+	metrics, rejected := ParseMessageTally(data, prefix_internal, output, parse)
+	rejected.Report(output)
+	return metrics
+}
+
+// ParseMessageTally is like ParseMessage, but rather than adding the invalid lines per reason to the stats
+// of the output, it returns them, so they can be reported along with those of the caller, see Rejections.Report
+func ParseMessageTally(data []byte, prefix_internal string, output *out.Output, parse ParseLineFunc) (metrics []*common.Metric, rejected Rejections) {
+	return parseMessageTally(nil, data, prefix_internal, output, parse)
+}
+
+// parseMessageTally is like ParseMessageTally, but appends the metrics to metrics, e.g. the slice of a common.Batch
+func parseMessageTally(metrics []*common.Metric, data []byte, prefix_internal string, output *out.Output, parse ParseLineFunc) ([]*common.Metric, Rejections) {
+	var rejected Rejections
+	var tapped []*common.Metric
+	tap := output.ValidPackets.Active()
+	// the lines to forward verbatim, rather than aggregating them here
+	var forwarded []byte
+	var numForwarded int
 	for _, line := range bytes.Split(data, []byte("\n")) {
 		metric, err := parse(line)
-		if err != nil {
-			// data will be repurposed by the udpListener
-			report_line := make([]byte, len(line), len(line))
-			copy(report_line, line)
-			output.Invalid_lines.Broadcast <- report_line
-			metric = &common.Metric{
-				Bucket:   fmt.Sprintf("%smtype_is_count.type_is_invalid_line.unit_is_Err", prefix_internal),
-				Value:    float64(1),
-				Modifier: "c",
-				Sampling: float32(1),
+		if err != nil && output.DefaultModifier != "" {
+			if fixed := withDefaultModifier(line, output.DefaultModifier); fixed != nil {
+				metric, err = parse(fixed)
 			}
+		}
+		if err == nil && metric != nil && output.Forwarder.Match(metric.Bucket) {
+			forwarded = append(append(forwarded, line...), '\n')
+			numForwarded++
+			continue
+		}
+		if err == nil && metric != nil && metric.Modifier == "c" && metric.Value < 0 && !output.CounterAllowNegative {
+			err = errNegativeCounter
+		}
+		if err == nil && metric != nil && output.Sanitizer != nil {
+			metric.Bucket = output.Sanitizer.Sanitize(metric.Bucket)
+			if metric.Bucket == "" {
+				err = errEmptyKey
+			}
+		}
+		if err == nil && metric != nil && output.MaxBucketLen > 0 && len(metric.Bucket) > output.MaxBucketLen {
+			err = errBucketTooLong
+		}
+		if err != nil {
+			reason := Reason(err)
+			rejected.Add(reason)
+			metric = invalidLine(line, reason, prefix_internal, output)
 		} else {
 			// data will be repurposed by the udpListener
 			report_line := make([]byte, len(line), len(line))
 			copy(report_line, line)
 			output.Valid_lines.Broadcast <- report_line
+			if metric != nil && !output.Filter.Accept(metric.Bucket) {
+				metric = &common.Metric{
+					Bucket:   fmt.Sprintf("%smtype_is_count.type_is_blocked.unit_is_Metric", prefix_internal),
+					Value:    float64(1),
+					Modifier: "c",
+					Sampling: float64(1),
+				}
+			} else if metric != nil {
+				metric.Bucket = output.Rewriter.Rewrite(metric.Bucket)
+				if tap {
+					tapped = append(tapped, metric)
+				}
+			}
 		}
 		if metric != nil {
 			metrics = append(metrics, metric)
 		}
 	}
-	return metrics
+	output.ValidPackets.Send(tapped)
+	output.Forwarder.Forward(forwarded, numForwarded)
+	return metrics, rejected
 }
 
-type parseLineFunc func(line []byte) (metric *common.Metric, err error)
+// withDefaultModifier returns the line with the given modifier, if it has none: if there's no pipe after the value,
+// or only whitespace between the first pipe and the next one (or the end). otherwise it returns nil.
+func withDefaultModifier(line []byte, modifier string) []byte {
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
+		return nil
+	}
+	pipe := bytes.IndexByte(line[colon:], '|')
+	if pipe < 0 {
+		line = bytes.TrimRight(line, " \t\r")
+		return append(append(append(make([]byte, 0, len(line)+1+len(modifier)), line...), '|'), modifier...)
+	}
+	pipe += colon
+	end := bytes.IndexByte(line[pipe+1:], '|')
+	if end < 0 {
+		end = len(line)
+	} else {
+		end += pipe + 1
+	}
+	if len(bytes.TrimSpace(line[pipe+1:end])) > 0 {
+		return nil
+	}
+	fixed := make([]byte, 0, len(line)+len(modifier))
+	fixed = append(fixed, line[:pipe+1]...)
+	fixed = append(fixed, modifier...)
+	return append(fixed, line[end:]...)
+}
+
+// Rejections tallies invalid lines per reason, indexed like out.InvalidReasons
+type Rejections [len(out.InvalidReasons)]uint64
+
+// Add counts an invalid line with the given reason, see Reason
+func (r *Rejections) Add(reason string) {
+	for i, known := range out.InvalidReasons {
+		if known == reason {
+			r[i]++
+			return
+		}
+	}
+	r[len(r)-1]++ // other
+}
+
+// Count returns the amount of invalid lines with the given reason
+func (r *Rejections) Count(reason string) uint64 {
+	for i, known := range out.InvalidReasons {
+		if known == reason {
+			return r[i]
+		}
+	}
+	return 0
+}
+
+// Report adds the tally to the stats of the output
+func (r *Rejections) Report(output *out.Output) {
+	for i, n := range r {
+		if n > 0 {
+			atomic.AddUint64(&output.Stats.Rejected[i], n)
+		}
+	}
+}
+
+var (
+	errNoColon         = errors.New("bad amount of colons")
+	errDoubleColon     = errors.New("bad amount of colons")
+	errPipes           = errors.New("bad amount of pipes")
+	errUnsupportedType = errors.New("unsupported metric type")
+	errNegativeCounter = errors.New("negative counter")
+	errBucketTooLong   = errors.New("bucket too long")
+	errValueTooLong    = errors.New("value too long")
+)
+
+// MaxValueLen is the longest value that is parsed as a number. longer ones are rejected without trying,
+// no number needs more. set members are not limited.
+const MaxValueLen = 64
+
+// samplingError is a sample rate that is not a number. it keeps the message of the underlying error
+type samplingError struct {
+	error
+}
+
+// Reason categorizes the error of a line that failed to parse, so invalid lines can be counted by reason.
+// it returns one of out.InvalidReasons.
+func Reason(err error) string {
+	switch err {
+	case errNoColon, errMissingKeySep:
+		return "no_colon"
+	case errDoubleColon:
+		return "double_colon"
+	case errEmptyKey:
+		return "empty_key"
+	case errPipes, errMissingValueSep:
+		return "no_pipe"
+	case errUnsupportedType, errInvalidModifier:
+		return "bad_modifier"
+	case errInvalidSampling:
+		return "bad_sample_rate"
+	case errEmptySetMember:
+		return "empty_set_member"
+	case errInvalidTags:
+		return "bad_tags"
+	case errInvalidTime:
+		return "bad_timestamp"
+	case errNegativeCounter:
+		return "negative_counter"
+	case errBucketTooLong:
+		return "bucket_too_long"
+	case errValueTooLong:
+		return "value_too_long"
+	}
+	switch err.(type) {
+	case samplingError:
+		return "bad_sample_rate"
+	case *strconv.NumError:
+		return "bad_value"
+	}
+	return "other"
+}
+
+// invalidLine reports the line as invalid, and returns the metric to count it
+func invalidLine(line []byte, reason, prefix_internal string, output *out.Output) *common.Metric {
+	atomic.AddUint64(&output.Stats.InvalidLines, 1)
+	// data will be repurposed by the udpListener
+	report_line := make([]byte, len(line), len(line))
+	copy(report_line, line)
+	output.Invalid_lines.Broadcast <- report_line
+	output.Invalid.Add(report_line, reason)
+	return &common.Metric{
+		Bucket:   fmt.Sprintf("%smtype_is_count.type_is_invalid_line.unit_is_Err", prefix_internal),
+		Value:    float64(1),
+		Modifier: "c",
+		Sampling: float64(1),
+	}
+}
+
+// RejectPayload counts data that could not be read at all (e.g. because it could not be decompressed)
+// as a single, empty, invalid line with the given reason, see out.InvalidReasons, and returns the metric to count it
+func RejectPayload(reason, prefix_internal string, output *out.Output) *common.Metric {
+	return RejectLine(nil, reason, prefix_internal, output)
+}
+
+// RejectLine counts a line that parsed, but was rejected later on, as an invalid line with the given reason,
+// see out.InvalidReasons, and returns the metric to count it
+func RejectLine(line []byte, reason, prefix_internal string, output *out.Output) *common.Metric {
+	var rejected Rejections
+	rejected.Add(reason)
+	rejected.Report(output)
+	return invalidLine(line, reason, prefix_internal, output)
+}
+
+var errDecompressedTooLarge = fmt.Errorf("decompresses to more than %d bytes", MaxDecompressedSize)
+
+// gzipDecoder decompresses gzip encoded packets, reusing its buffers
+type gzipDecoder struct {
+	zr  *gzip.Reader
+	buf bytes.Buffer
+}
+
+// decode returns the decompressed data, which is valid until the next call
+func (d *gzipDecoder) decode(data []byte) ([]byte, error) {
+	var err error
+	if d.zr == nil {
+		d.zr, err = gzip.NewReader(bytes.NewReader(data))
+	} else {
+		err = d.zr.Reset(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.buf.Reset()
+	n, err := d.buf.ReadFrom(io.LimitReader(d.zr, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxDecompressedSize {
+		return nil, errDecompressedTooLarge
+	}
+	return d.buf.Bytes(), nil
+}
+
+// ParseLineFunc parses a single line into a metric, see ParseLine
+type ParseLineFunc func(line []byte) (metric *common.Metric, err error)
 
 func StatsListener(listen_addr, prefix_internal string, output *out.Output) {
 	Listener(listen_addr, prefix_internal, output, ParseLine2)
@@ -103,7 +378,7 @@ func StatsListener(listen_addr, prefix_internal string, output *out.Output) {
 
 // Listener receives packets from the udp buffer, parses them and feeds both the Metrics channel
 // as well as the metricAmounts channel
-func Listener(listen_addr, prefix_internal string, output *out.Output, parse parseLineFunc) {
+func Listener(listen_addr, prefix_internal string, output *out.Output, parse ParseLineFunc) {
 	address, err := net.ResolveUDPAddr("udp", listen_addr)
 	if err != nil {
 		log.Fatalf("ERROR: Cannot resolve '%s' - %s", listen_addr, err)
@@ -114,17 +389,178 @@ func Listener(listen_addr, prefix_internal string, output *out.Output, parse par
 		log.Fatalf("ERROR: ListenUDP - %s", err)
 	}
 	defer listener.Close()
+	defer output.Reading(listener)()
+	setRecvBuffer(listener)
 	log.Infof("listening on %s", address)
+	output.Listen("udp", listen_addr)
+	go watchKernelDrops(listener.LocalAddr().(*net.UDPAddr).Port, output)
+	readPackets(listener, MaxUdpPacketSize, prefix_internal, output, parse)
+}
 
-	message := make([]byte, MaxUdpPacketSize)
+func StatsListeners(listen_addr string, readers int, prefix_internal string, output *out.Output) {
+	Listeners(listen_addr, readers, prefix_internal, output, ParseLine2)
+}
+
+// Listeners is like Listener, but uses the given amount of sockets bound to the same address with SO_REUSEPORT,
+// each with their own reader, to spread the load over multiple cores.
+// this requires linux (3.9 or later). on other platforms we fall back to a single Listener.
+func Listeners(listen_addr string, readers int, prefix_internal string, output *out.Output, parse ParseLineFunc) {
+	if readers <= 1 || !reusePortSupported {
+		if readers > 1 {
+			log.Warnf("SO_REUSEPORT is not supported on this platform, using 1 udp reader instead of %d", readers)
+		}
+		Listener(listen_addr, prefix_internal, output, parse)
+		return
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	conns := make([]net.PacketConn, readers)
+	for i := range conns {
+		conn, err := lc.ListenPacket(context.Background(), "udp", listen_addr)
+		if err != nil {
+			log.Fatalf("ERROR: ListenUDP - %s", err)
+		}
+		defer conn.Close()
+		setRecvBuffer(conn.(*net.UDPConn))
+		conns[i] = conn
+	}
+	log.Infof("listening on %s with %d readers", conns[0].LocalAddr(), readers)
+	output.Listen("udp", listen_addr)
+	go watchKernelDrops(conns[0].LocalAddr().(*net.UDPAddr).Port, output)
+	for _, conn := range conns[1:] {
+		go func(conn net.PacketConn) {
+			defer output.Reading(conn)()
+			readPackets(conn, MaxUdpPacketSize, prefix_internal, output, parse)
+		}(conn)
+	}
+	defer output.Reading(conns[0])()
+	readPackets(conns[0], MaxUdpPacketSize, prefix_internal, output, parse)
+}
+
+// setRecvBuffer sets the receive buffer of conn to RecvBuffer, if it's set.
+// we warn when the kernel gave us less than that, which linux does silently.
+func setRecvBuffer(conn *net.UDPConn) {
+	if RecvBuffer <= 0 {
+		return
+	}
+	if err := conn.SetReadBuffer(RecvBuffer); err != nil {
+		log.Errorf("ERROR: setting the udp receive buffer to %d bytes - %s", RecvBuffer, err)
+		return
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	if size, err := readBuffer(raw); err == nil && size < RecvBuffer {
+		log.Warnf("udp receive buffer is %d bytes rather than %d. raise net.core.rmem_max to allow more", size, RecvBuffer)
+	}
+}
+
+// watchKernelDrops keeps out.Stats.KernelDrops up to date with the packets the kernel dropped for the udp sockets
+// bound to port, every KernelDropsInterval, until the output stops the listeners (see out.Output.Done).
+// it gives up, logging why, if they can't be read.
+func watchKernelDrops(port int, output *out.Output) {
+	if !KernelDropsSupported {
+		return
+	}
+	ticker := time.NewTicker(KernelDropsInterval)
+	defer ticker.Stop()
 	for {
-		n, remaddr, err := listener.ReadFromUDP(message)
+		drops, err := kernelDrops(port)
 		if err != nil {
-			log.Errorf("ERROR: reading UDP packet from %+v - %s", remaddr, err)
+			log.Warnf("can't read the packets the kernel dropped for udp port %d, not updating them - %s", port, err)
+			return
+		}
+		atomic.StoreUint64(&output.Stats.KernelDrops, drops)
+		select {
+		case <-ticker.C:
+		case <-output.Done:
+			return
+		}
+	}
+}
+
+func UnixStatsListener(socket_path, prefix_internal string, output *out.Output) {
+	UnixListener(socket_path, prefix_internal, output, ParseLine2)
+}
+
+// UnixListener is like Listener, but reads datagrams from a unix socket.
+// a stale socket file (e.g. left behind after a crash) is removed first.
+// the caller is responsible for removing the socket file on shutdown.
+func UnixListener(socket_path, prefix_internal string, output *out.Output, parse ParseLineFunc) {
+	if fi, err := os.Lstat(socket_path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		log.Infof("removing stale socket %s", socket_path)
+		os.Remove(socket_path)
+	}
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket_path, Net: "unixgram"})
+	if err != nil {
+		log.Fatalf("ERROR: ListenUnixgram - %s", err)
+	}
+	defer listener.Close()
+	defer output.Reading(listener)()
+	log.Infof("listening on %s", socket_path)
+	output.Listen("unixgram", socket_path)
+	readPackets(listener, MaxUdpPacketSize, prefix_internal, output, parse)
+}
+
+// readPackets reads packets from the connection until the output stops it (see out.Output.Done),
+// parses them and feeds both the Metrics channel as well as the metricAmounts channel
+// packets larger than size get truncated, in which case their last line is (most likely) incomplete,
+// so we drop it as invalid rather than parsing part of it.
+// with out.EncodingGzip, packets are decompressed first. those that can't be are a single invalid line,
+// as are truncated ones.
+func readPackets(conn net.PacketConn, size int, prefix_internal string, output *out.Output, parse ParseLineFunc) {
+	// one extra byte so we can tell whether a packet was truncated
+	message := make([]byte, size+1)
+	var gz *gzipDecoder
+	if output.DatagramEncoding == out.EncodingGzip {
+		gz = &gzipDecoder{}
+	}
+	// a broken socket can fail every read, so we don't log every single error
+	throttle := common.Throttle{Interval: ReadErrorLogInterval}
+	for {
+		n, remaddr, err := conn.ReadFrom(message)
+		if err != nil {
+			if output.Stopping() {
+				return
+			}
+			atomic.AddUint64(&output.Stats.ReadErrors, 1)
+			if ok, suppressed := throttle.Allow(time.Now()); ok {
+				log.Errorf("ERROR: reading packet from %+v - %s (%d more read errors not logged since the previous one)", remaddr, err, suppressed)
+			}
 			continue
 		}
-		metrics := ParseMessage(message[:n], prefix_internal, output, parse)
-		output.Metrics <- metrics
-		output.MetricAmounts <- metrics
+		atomic.AddUint64(&output.Stats.Packets, 1)
+		// the consumers release the batch once they've aggregated (or tracked) the metrics, see common.Batch
+		batch := common.NewBatch()
+		metrics := batch.Metrics
+		var rejected Rejections
+		if gz != nil {
+			var data []byte
+			if n > size {
+				log.Warnf("gzip packet from %+v is larger than %d bytes, dropping it", remaddr, size)
+				metrics = append(metrics, RejectPayload("truncated", prefix_internal, output))
+			} else if data, err = gz.decode(message[:n]); err != nil {
+				log.Debugf("could not decompress packet from %+v: %s", remaddr, err)
+				metrics = append(metrics, RejectPayload("bad_compression", prefix_internal, output))
+			} else {
+				metrics, rejected = parseMessageTally(metrics, data, prefix_internal, output, parse)
+			}
+		} else if n > size {
+			log.Warnf("packet from %+v is larger than %d bytes, dropping its last line", remaddr, size)
+			data := message[:size]
+			end := bytes.LastIndexByte(data, '\n') + 1
+			if end > 0 {
+				metrics, rejected = parseMessageTally(metrics, data[:end], prefix_internal, output, parse)
+			}
+			rejected.Add("truncated")
+			metrics = append(metrics, invalidLine(data[end:], "truncated", prefix_internal, output))
+		} else {
+			metrics, rejected = parseMessageTally(metrics, message[:n], prefix_internal, output, parse)
+		}
+		batch.Own(metrics)
+		rejected.Report(output)
+		output.Send(metrics)
+		output.Track(metrics)
+		batch.Release()
 	}
 }
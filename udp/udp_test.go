@@ -1,10 +1,18 @@
 package udp
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
+	"fmt"
 	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/tv42/topic"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
@@ -24,7 +32,7 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 				Bucket:   "search.solr.clips.results",
 				Value:    78186,
 				Modifier: "g",
-				Sampling: float32(1),
+				Sampling: float64(1),
 			},
 			nil,
 		},
@@ -36,7 +44,7 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 					Bucket:   "cliapp1.queue.consumer.VideoFile_PruneSourceFilesV6.processing.10_90_128_162.removed",
 					Value:    1,
 					Modifier: "c",
-					Sampling: float32(1),
+					Sampling: float64(1),
 				},
 				nil,
 			},
@@ -47,7 +55,7 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 					Bucket:   "lvimdfs3.object-replicator.partition.update.timing",
 					Value:    3.69596481323,
 					Modifier: "ms",
-					Sampling: float32(0.05),
+					Sampling: float64(0.05),
 				},
 				nil,
 			},
@@ -59,7 +67,7 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 				Bucket:   "foo%bar=yes",
 				Value:    12,
 				Modifier: "ms",
-				Sampling: float32(0.05),
+				Sampling: float64(0.05),
 			},
 			nil,
 		},
@@ -70,10 +78,51 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 				Bucket:   "foo bar",
 				Value:    12,
 				Modifier: "ms",
-				Sampling: float32(0.05),
+				Sampling: float64(0.05),
 			},
 			nil,
 		},
+		Case{
+			"gauge-delta-positive",
+			"queue.size:+5|g",
+			&common.Metric{
+				Bucket:     "queue.size",
+				Value:      5,
+				Modifier:   "g",
+				Sampling:   float64(1),
+				GaugeDelta: true,
+			},
+			nil,
+		},
+		Case{
+			"gauge-delta-negative",
+			"queue.size:-3|g",
+			&common.Metric{
+				Bucket:     "queue.size",
+				Value:      -3,
+				Modifier:   "g",
+				Sampling:   float64(1),
+				GaugeDelta: true,
+			},
+			nil,
+		},
+		Case{
+			"set-simple",
+			"unique.users:user123|s",
+			&common.Metric{
+				Bucket:   "unique.users",
+				Modifier: "s",
+				Sampling: float64(1),
+				Member:   "user123",
+			},
+			nil,
+		},
+		Case{
+			"empty-set-member",
+			"unique.users:|s",
+			nil,
+			[]error{errors.New("set member zero len")},
+		},
 		Case{
 			"empty-key",
 			":12|ms|@0.05",
@@ -104,6 +153,24 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 			nil,
 			[]error{errors.New("strconv.ParseFloat: parsing \"f\": invalid syntax")},
 		},
+		Case{
+			"zero-samplerate",
+			"key:12|c|@0",
+			nil,
+			[]error{errors.New("invalid sampling")},
+		},
+		Case{
+			"samplerate-above-1",
+			"key:12|c|@1.5",
+			nil,
+			[]error{errors.New("invalid sampling")},
+		},
+		Case{
+			"nan-samplerate",
+			"key:12|c|@NaN",
+			nil,
+			[]error{errors.New("invalid sampling")},
+		},
 		Case{
 			"missing-modifier",
 			"foo_bar:12|@0.05",
@@ -143,10 +210,43 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 	}
 }
 
+func TestParseLine2Segments(t *testing.T) {
+	type Case struct {
+		In        string
+		OutMetric *common.Metric
+		OutErr    error
+	}
+	tags := map[string]string{"env": "prod", "region": "eu"}
+	tests := []Case{
+		{"foo:1|c|#env:prod,region:eu", &common.Metric{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1, Tags: tags}, nil},
+		{"foo:1|c|@0.5|#env:prod,region:eu", &common.Metric{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 0.5, Tags: tags}, nil},
+		{"foo:1|c|#env:prod,region:eu|@0.5", &common.Metric{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 0.5, Tags: tags}, nil},
+		{"foo:1|c|#env:prod,region", nil, errors.New("invalid tags")},
+		{"foo:1|c|#", nil, errors.New("invalid tags")},
+		{"foo:1|c|@0.5|", nil, errors.New("invalid sampling")},
+		{"foo:1|g|T1700000000", &common.Metric{Bucket: "foo", Value: 1, Modifier: "g", Sampling: 1, Timestamp: 1700000000}, nil},
+		{"foo:1|g|#env:prod,region:eu|T1700000000|@0.5", &common.Metric{Bucket: "foo", Value: 1, Modifier: "g", Sampling: 0.5, Tags: tags, Timestamp: 1700000000}, nil},
+		{"foo:1|g|T", nil, errors.New("invalid timestamp")},
+		{"foo:1|g|T1700000000.5", nil, errors.New("invalid timestamp")},
+		{"foo:1|g|T-1", nil, errors.New("invalid timestamp")},
+		{"foo:1|g|T0", nil, errors.New("invalid timestamp")},
+		{"foo:1|c|x", nil, errors.New("invalid sampling")},
+	}
+	for _, c := range tests {
+		metric, err := ParseLine2([]byte(c.In))
+		if !reflect.DeepEqual(c.OutErr, err) {
+			t.Errorf("case %s failed\nexpected err: %v\nreceived err: %v\n", c.In, c.OutErr, err)
+		}
+		if !reflect.DeepEqual(c.OutMetric, metric) {
+			t.Errorf("case %s failed\nexpected metric: %v\nreceived metric: %v\n", c.In, c.OutMetric, metric)
+		}
+	}
+}
+
 func runBench(b *testing.B, f func([]byte) (*common.Metric, error)) {
 	var err error
 	line1 := []byte("cat:12.0231|ms")
-	line2 := []byte("meow:45.0231|g|@54.12")
+	line2 := []byte("meow:45.0231|g|@0.5412")
 	for i := 0; i < b.N; i++ {
 		_, err = f(line1)
 		if err != nil {
@@ -174,3 +274,540 @@ func BenchmarkParseLine(b *testing.B) {
 func BenchmarkParseLine2(b *testing.B) {
 	runBench(b, ParseLine2)
 }
+
+func TestParseMessageFilter(t *testing.T) {
+	output := out.NullOutput()
+	filter, err := common.NewFilter("", "tmp.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Filter = filter
+	metrics := ParseMessage([]byte("foo:1|c\ntmp.foo:1|c"), "internal.", output, ParseLine2)
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Bucket != "foo" {
+		t.Errorf("expected bucket foo to be accepted, got %q", metrics[0].Bucket)
+	}
+	if metrics[1].Bucket != "internal.mtype_is_count.type_is_blocked.unit_is_Metric" {
+		t.Errorf("expected tmp.foo to be counted as blocked, got %q", metrics[1].Bucket)
+	}
+}
+
+func TestParseMessageForward(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	forwarder, err := out.NewForwarder(upstream.LocalAddr().String(), "legacy.*,/^old\\./")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- forwarder.Run(done)
+	}()
+
+	output := out.NullOutput()
+	output.Forwarder = forwarder
+	metrics := ParseMessage([]byte("foo:1|c\nlegacy.foo:1|c|@0.5\nold.bar:3|ms|#env:prod\nbad\nlegacy.bad"), "internal.", output, ParseLine2)
+	metrics = append(metrics, ParseMessage([]byte("bar:2|g\nlegacy.baz:1|s"), "internal.", output, ParseLine2)...)
+	var buckets []string
+	for _, m := range metrics {
+		buckets = append(buckets, m.Bucket)
+	}
+	exp := []string{"foo", "internal.mtype_is_count.type_is_invalid_line.unit_is_Err", "internal.mtype_is_count.type_is_invalid_line.unit_is_Err", "bar"}
+	if !reflect.DeepEqual(buckets, exp) {
+		t.Fatalf("expected to aggregate %v, got %v", exp, buckets)
+	}
+	close(done)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2000)
+	n, err := upstream.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "legacy.foo:1|c|@0.5\nold.bar:3|ms|#env:prod\nlegacy.baz:1|s" {
+		t.Errorf("unexpected packet forwarded: %q", got)
+	}
+	if forwarder.Forwarded != 3 {
+		t.Errorf("expected 3 lines forwarded, got %d", forwarder.Forwarded)
+	}
+}
+
+func TestForwarderPackets(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	forwarder, err := out.NewForwarder(upstream.LocalAddr().String(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- forwarder.Run(done)
+	}()
+	// 100 lines of 21 bytes (with their newline) don't fit a single packet, 68 of them do.
+	// a line longer than a packet is sent by itself.
+	var data bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&data, "bucket.%03d:1234567|c\n", i)
+	}
+	long := "long." + strings.Repeat("a", out.ForwardPacketSize) + ":1|c"
+	output := out.NullOutput()
+	output.Forwarder = forwarder
+	ParseMessage(append(data.Bytes(), long...), "internal.", output, ParseLine2)
+	close(done)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2*out.ForwardPacketSize)
+	var sizes []int
+	for i := 0; i < 3; i++ {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, n)
+	}
+	exp := []int{68*21 - 1, 32*21 - 1, len(long)}
+	if !reflect.DeepEqual(sizes, exp) {
+		t.Errorf("expected packets of %v bytes, got %v", exp, sizes)
+	}
+}
+
+func TestParseMessageValidPackets(t *testing.T) {
+	output := out.NullOutput()
+	output.Filter, _ = common.NewFilter("", "tmp.*")
+	output.ValidPackets = out.NewTap()
+	all, none, full := make(chan []common.Metric, 10), make(chan []common.Metric, 10), make(chan []common.Metric)
+	output.ValidPackets.Register(all, 1)
+	output.ValidPackets.Register(none, 0)
+	output.ValidPackets.Register(full, 1)
+
+	ParseMessage([]byte("foo:1|c\ntmp.foo:1|c\nbad\nbar:2|ms"), "internal.", output, ParseLine2)
+	if len(all) != 1 {
+		t.Fatalf("expected 1 batch, got %d", len(all))
+	}
+	got := <-all
+	if len(got) != 2 || got[0].Bucket != "foo" || got[1].Bucket != "bar" || got[1].Value != 2 {
+		t.Errorf("expected only foo and bar, got %+v", got)
+	}
+	if len(none) != 0 {
+		t.Errorf("expected nothing with sample rate 0, got %d batches", len(none))
+	}
+	// nobody reads full, which must not block parsing
+	if output.ValidPackets.Dropped != 2 {
+		t.Errorf("expected 2 dropped metrics, got %d", output.ValidPackets.Dropped)
+	}
+
+	output.ValidPackets.Unregister(all)
+	output.ValidPackets.Unregister(none)
+	output.ValidPackets.Unregister(full)
+	if output.ValidPackets.Active() {
+		t.Error("expected the tap to be inactive without consumers")
+	}
+}
+
+func TestParseMessageInvalidReasons(t *testing.T) {
+	lines := map[string]string{
+		"foo":          "no_colon",
+		"foo:1|c:2":    "bad_modifier",
+		":1|c":         "empty_key",
+		"foo:1":        "no_pipe",
+		"foo:1|x":      "bad_modifier",
+		"foo:abc|c":    "bad_value",
+		"foo:1|c|@2":   "bad_sample_rate",
+		"foo:1|c|@abc": "bad_sample_rate",
+		"foo:|s":       "empty_set_member",
+		"foo:1|c|#env": "bad_tags",
+		"foo:1|g|Tabc": "bad_timestamp",
+		"foo:-1|c":     "negative_counter",
+		"foo:1" + strings.Repeat("0", MaxValueLen) + "|c": "value_too_long",
+		strings.Repeat("a", 11) + ":1|c":                  "bucket_too_long",
+	}
+	for line, reason := range lines {
+		output := out.NullOutput()
+		output.Invalid = out.NewInvalidLines(10)
+		output.MaxBucketLen = 10
+		metrics, rejected := ParseMessageTally([]byte(line+"\nok:1|c"), "internal.", output, ParseLine2)
+		if len(metrics) != 2 || metrics[1].Bucket != "ok" {
+			t.Errorf("line %q: expected an invalid line metric and ok, got %v", line, metrics)
+		}
+		if rejected.Count(reason) != 1 {
+			t.Errorf("line %q: expected reason %s, got %v", line, reason, rejected)
+		}
+		if last := output.Invalid.Last(10); len(last) != 1 || last[0].Reason != reason || string(last[0].Line) != line {
+			t.Errorf("line %q: expected it to be kept with reason %s, got %v", line, reason, last)
+		}
+		// the tally is only added to the stats when reported
+		if output.Stats.Rejected != [len(out.InvalidReasons)]uint64{} {
+			t.Errorf("line %q: expected no stats before reporting, got %v", line, output.Stats.Rejected)
+		}
+		rejected.Report(output)
+		if output.Stats.Rejected != rejected {
+			t.Errorf("line %q: expected stats %v, got %v", line, rejected, output.Stats.Rejected)
+		}
+	}
+
+	// the other parser has its own errors, but the same reasons
+	for line, reason := range map[string]string{"foo": "no_colon", "foo:1:2|c": "double_colon", "foo:1|c|@abc": "bad_sample_rate", "foo:1" + strings.Repeat("0", MaxValueLen) + "|c": "value_too_long"} {
+		_, err := ParseLine([]byte(line))
+		if Reason(err) != reason {
+			t.Errorf("line %q: expected reason %s, got %s", line, reason, Reason(err))
+		}
+	}
+}
+
+func TestParseMessageMaxLen(t *testing.T) {
+	output := out.NullOutput()
+	output.MaxBucketLen = 5
+	output.Sanitizer = common.NewSanitizer(" ")
+	value := "1." + strings.Repeat("0", MaxValueLen-2)
+	metrics := ParseMessage([]byte("abcde:"+value+"|c\nabcdef:1|c\n.ab  c.:1|c\nset:"+value+value+"|s"), "internal.", output, ParseLine2)
+	if len(metrics) != 4 {
+		t.Fatalf("expected 4 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Bucket != "abcde" || metrics[0].Value != 1 {
+		t.Errorf("expected a bucket and value of the maximum length to be accepted, got %v", metrics[0])
+	}
+	if metrics[1].Bucket != "internal.mtype_is_count.type_is_invalid_line.unit_is_Err" {
+		t.Errorf("expected a bucket that is too long to be invalid, got %q", metrics[1].Bucket)
+	}
+	// the length is that after sanitizing
+	if metrics[2].Bucket != "ab__c" {
+		t.Errorf("expected sanitized bucket ab__c, got %q", metrics[2].Bucket)
+	}
+	if metrics[3].Member != value+value {
+		t.Errorf("expected set members not to be limited, got %v", metrics[3])
+	}
+	if output.Stats.InvalidLines != 1 {
+		t.Errorf("expected 1 invalid line, got %d", output.Stats.InvalidLines)
+	}
+}
+
+func TestParseMessageRewrite(t *testing.T) {
+	output := out.NullOutput()
+	output.Filter, _ = common.NewFilter("", "tmp.*")
+	output.Rewriter, _ = common.NewRewriter("*.req.*.latency=>$1.req.latency, tmp.*=>foo")
+	metrics := ParseMessage([]byte("api.req.abc.latency:1|ms\napi.req.def.latency:2|ms|#env:prod\ntmp.x:1|c"), "internal.", output, ParseLine2)
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Bucket != "api.req.latency" || metrics[1].Bucket != "api.req.latency" || metrics[1].Tags["env"] != "prod" {
+		t.Errorf("expected api.req.latency twice, the 2nd one with its tags, got %v and %v", metrics[0], metrics[1])
+	}
+	// blocked metrics are not renamed
+	if metrics[2].Bucket != "internal.mtype_is_count.type_is_blocked.unit_is_Metric" {
+		t.Errorf("expected tmp.x to be counted as blocked, got %q", metrics[2].Bucket)
+	}
+}
+
+func TestParseMessageSanitize(t *testing.T) {
+	output := out.NullOutput()
+	metrics := ParseMessage([]byte("my metric..foo.:1|c"), "internal.", output, ParseLine2)
+	if len(metrics) != 1 || metrics[0].Bucket != "my metric..foo." {
+		t.Fatalf("expected the bucket to be left as is without a sanitizer, got %v", metrics)
+	}
+
+	output.Sanitizer = common.NewSanitizer(" /")
+	output.Filter, _ = common.NewFilter("", "tmp.*")
+	metrics = ParseMessage([]byte("my metric..foo.:1|c\napp/web01/hits:1|c\n..:1|c\n.tmp.x:1|c"), "internal.", output, ParseLine2)
+	if len(metrics) != 4 {
+		t.Fatalf("expected 4 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Bucket != "my_metric.foo" || metrics[1].Bucket != "app_web01_hits" {
+		t.Errorf("expected sanitized buckets, got %q and %q", metrics[0].Bucket, metrics[1].Bucket)
+	}
+	if metrics[2].Bucket != "internal.mtype_is_count.type_is_invalid_line.unit_is_Err" {
+		t.Errorf("expected bucket that ends up empty to be invalid, got %q", metrics[2].Bucket)
+	}
+	// buckets are filtered after they're sanitized
+	if metrics[3].Bucket != "internal.mtype_is_count.type_is_blocked.unit_is_Metric" {
+		t.Errorf("expected .tmp.x to be counted as blocked, got %q", metrics[3].Bucket)
+	}
+}
+
+func TestParseMessageNegativeCounters(t *testing.T) {
+	output := out.NullOutput()
+	metrics := ParseMessage([]byte("foo:-5|c\nfoo:5|c\nbar:-5|g"), "internal.", output, ParseLine2)
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Bucket != "internal.mtype_is_count.type_is_invalid_line.unit_is_Err" {
+		t.Errorf("expected negative counter to be invalid, got %q", metrics[0].Bucket)
+	}
+	if metrics[1].Bucket != "foo" || metrics[2].Bucket != "bar" {
+		t.Errorf("expected positive counter and negative gauge to be accepted, got %q and %q", metrics[1].Bucket, metrics[2].Bucket)
+	}
+	if output.Stats.InvalidLines != 1 {
+		t.Errorf("expected 1 invalid line, got %d", output.Stats.InvalidLines)
+	}
+
+	output.CounterAllowNegative = true
+	metrics = ParseMessage([]byte("foo:-5|c"), "internal.", output, ParseLine2)
+	if len(metrics) != 1 || metrics[0].Bucket != "foo" || metrics[0].Value != -5 {
+		t.Fatalf("expected negative counter foo to be accepted, got %v", metrics)
+	}
+}
+
+func TestParseMessageDefaultModifier(t *testing.T) {
+	msg := []byte("foo:1\nfoo:2|\nfoo:3| |@0.5\nfoo:4 \nbar:5|g\nbaz|c\nfoo:x\nfoo:6|@0.5")
+	// strict: only the line with a modifier is accepted
+	output := out.NullOutput()
+	metrics := ParseMessage(msg, "internal.", output, ParseLine2)
+	if len(metrics) != 8 || metrics[4].Bucket != "bar" || output.Stats.InvalidLines != 7 {
+		t.Fatalf("expected only bar to be accepted, got %d invalid lines", output.Stats.InvalidLines)
+	}
+
+	for _, parse := range []ParseLineFunc{ParseLine, ParseLine2} {
+		output := out.NullOutput()
+		output.DefaultModifier = "c"
+		metrics := ParseMessage(msg, "internal.", output, parse)
+		var got []string
+		for _, m := range metrics {
+			got = append(got, fmt.Sprintf("%s %s %v %v", m.Bucket, m.Modifier, m.Value, m.Sampling))
+		}
+		invalid := "internal.mtype_is_count.type_is_invalid_line.unit_is_Err c 1 1"
+		exp := []string{"foo c 1 1", "foo c 2 1", "foo c 3 0.5", "foo c 4 1", "bar g 5 1", invalid, invalid, invalid}
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("expected %v, got %v", exp, got)
+		}
+	}
+}
+
+func benchParseMessage(b *testing.B, filter *common.Filter) {
+	output := out.NullOutput()
+	output.Filter = filter
+	msg := []byte("app.requests.count:1|c\napp.response_time:12.0231|ms\nreq_deadbeef.time:4|ms\nweb12.load:45.0231|g")
+	for i := 0; i < b.N; i++ {
+		ParseMessage(msg, "internal.", output, ParseLine2)
+	}
+}
+
+func BenchmarkParseMessage(b *testing.B) {
+	benchParseMessage(b, nil)
+}
+
+func BenchmarkParseMessageFilter(b *testing.B) {
+	filter, err := common.NewFilter("app.*,/^web[0-9]+\\./", "/req_[0-9a-f]{8}/,app.*.debug")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchParseMessage(b, filter)
+}
+
+func BenchmarkParseMessageFilterGlobs(b *testing.B) {
+	filter, err := common.NewFilter("app.*,web*", "req_*,app.*.debug")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchParseMessage(b, filter)
+}
+
+// readPacket sends data as one datagram to a listener with the given buffer size, and returns what it parsed
+func readPacket(t *testing.T, size int, data []byte) []*common.Metric {
+	return readEncodedPacket(t, size, data, out.EncodingPlain)
+}
+
+// testOutput returns an output that passes the metrics on to metrics, and doesn't track them (no MetricAmounts).
+// unlike out.NullOutput, nothing else receives from its channels.
+func testOutput(metrics chan []*common.Metric) *out.Output {
+	return &out.Output{
+		Metrics:       metrics,
+		Valid_lines:   topic.New(),
+		Invalid_lines: topic.New(),
+	}
+}
+
+func readEncodedPacket(t *testing.T, size int, data []byte, encoding string) []*common.Metric {
+	output := testOutput(make(chan []*common.Metric, 1))
+	output.DatagramEncoding = encoding
+	return readOutputPacket(t, output, size, data)
+}
+
+// readOutputPacket is readPacket with the given output, which must be a testOutput
+func readOutputPacket(t *testing.T, output *out.Output, size int, data []byte) []*common.Metric {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := output.Metrics
+	go readPackets(conn, size, "internal.", output, ParseLine2)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-metrics:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for packet")
+	}
+	return nil
+}
+
+func TestReadLargePacket(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 8000; i++ {
+		fmt.Fprintf(&buf, "some.fairly.long.metric.name.%d:%d|c\n", i, i)
+	}
+	data := buf.Bytes()
+	lines := bytes.Count(data, []byte("\n"))
+
+	metrics := readPacket(t, 65535, data)
+	if len(metrics) != lines {
+		t.Fatalf("expected %d metrics, got %d", lines, len(metrics))
+	}
+	if metrics[lines-1].Bucket != fmt.Sprintf("some.fairly.long.metric.name.%d", lines-1) {
+		t.Fatalf("unexpected last metric %v", metrics[lines-1])
+	}
+
+	// if the packet doesn't fit, the last (truncated) line must be counted as invalid, not parsed partially
+	cut := bytes.LastIndexByte(data[:4100], '\n') + 1
+	size := cut + 10
+	metrics = readPacket(t, size, data)
+	complete := bytes.Count(data[:cut], []byte("\n"))
+	if len(metrics) != complete+1 {
+		t.Fatalf("expected %d metrics and 1 invalid line, got %d metrics", complete, len(metrics))
+	}
+	if metrics[complete].Bucket != "internal.mtype_is_count.type_is_invalid_line.unit_is_Err" {
+		t.Fatalf("expected truncated line to be invalid, got %v", metrics[complete])
+	}
+}
+
+func TestReadGzipPacket(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("foo:1|c\nbar:2|g\nbaz:3|ms"))
+	zw.Close()
+	metrics := readEncodedPacket(t, 1500, buf.Bytes(), out.EncodingGzip)
+	if len(metrics) != 3 || metrics[0].Bucket != "foo" || metrics[1].Bucket != "bar" || metrics[2].Value != 3 {
+		t.Fatalf("unexpected metrics %v", metrics)
+	}
+
+	// a plain packet, and a gzip one that was cut off, can't be decompressed
+	output := testOutput(make(chan []*common.Metric, 1))
+	output.DatagramEncoding = out.EncodingGzip
+	for _, data := range [][]byte{[]byte("foo:1|c"), buf.Bytes()[:buf.Len()-4]} {
+		metrics = readOutputPacket(t, output, 1500, data)
+		if len(metrics) != 1 || metrics[0].Bucket != "internal.mtype_is_count.type_is_invalid_line.unit_is_Err" {
+			t.Fatalf("expected %q to be an invalid line, got %v", data, metrics)
+		}
+	}
+	rejected := Rejections(output.Stats.Rejected)
+	if n := rejected.Count("bad_compression"); n != 2 || output.Stats.InvalidLines != 2 {
+		t.Fatalf("expected 2 invalid lines for bad_compression, got %d (%d invalid lines)", n, output.Stats.InvalidLines)
+	}
+}
+
+func TestReadPacketsStop(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	output := testOutput(make(chan []*common.Metric, 1))
+	output.Done = done
+	returned := make(chan struct{})
+	go func() {
+		defer output.Reading(conn)()
+		readPackets(conn, 1500, "internal.", output, ParseLine2)
+		close(returned)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("a:1|c")); err != nil {
+		t.Fatal(err)
+	}
+	// what was read before stopping is still passed on
+	m := <-output.Metrics
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for readPackets to return")
+	}
+	output.Wait()
+	if len(m) != 1 || m[0].Bucket != "a" {
+		t.Fatalf("unexpected metrics %v", m)
+	}
+	if output.Stats.ReadErrors != 0 {
+		t.Fatalf("closing the socket should not count as read error, got %d", output.Stats.ReadErrors)
+	}
+}
+
+// repeatConn is a net.PacketConn that returns the same packet n times, and then closes done and blocks
+type repeatConn struct {
+	net.PacketConn
+	packet []byte
+	n      int
+	done   chan struct{}
+}
+
+func (c *repeatConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.n == 0 {
+		close(c.done)
+		select {}
+	}
+	c.n--
+	return copy(b, c.packet), nil, nil
+}
+
+// BenchmarkReadPackets50 measures the whole udp hot path for packets of 50 metrics: parsing, and handing them over
+// to the consumers, which takes a channel send per packet for each of them, not per metric.
+func BenchmarkReadPackets50(b *testing.B) {
+	benchReadPackets50(b, true)
+}
+
+// BenchmarkReadPackets50Untracked is like BenchmarkReadPackets50, without sample rate tracking (MetricAmounts)
+func BenchmarkReadPackets50Untracked(b *testing.B) {
+	benchReadPackets50(b, false)
+}
+
+func benchReadPackets50(b *testing.B, track bool) {
+	var buf bytes.Buffer
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&buf, "app.server%d.requests:1|c\n", i)
+	}
+	// like out.NullOutput, releasing the metrics so that their memory is reused
+	drain := func(ch chan []*common.Metric) {
+		for {
+			common.Release(<-ch)
+		}
+	}
+	metrics := make(chan []*common.Metric)
+	go drain(metrics)
+	output := testOutput(metrics)
+	if track {
+		amounts := make(chan []*common.Metric)
+		go drain(amounts)
+		output.MetricAmounts = amounts
+	}
+	conn := &repeatConn{packet: buf.Bytes(), n: b.N, done: make(chan struct{})}
+	b.ReportAllocs()
+	b.ResetTimer()
+	go readPackets(conn, MaxUdpPacketSize, "internal.", output, ParseLine2)
+	<-conn.done
+}